@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/creachadair/jrpc2/code"
 )
@@ -35,6 +36,23 @@ type Handler interface {
 	// return a value of type *jrpc2.Error to control the response code sent
 	// back to the caller; otherwise the server will wrap the resulting value.
 	//
+	// If the error aggregates several errors, as reported by a method with
+	// signature Unwrap() []error (such as an error from errors.Join), the
+	// server reports a single error whose message combines the messages of
+	// the aggregated errors, and whose code is the most severe code among
+	// them (see code.ErrCoder), in the order:
+	//
+	//    1. code.InternalError and code.SystemError
+	//    2. other codes reserved by the JSON-RPC spec, -32768 to -32000
+	//    3. codes defined by the application
+	//
+	// Among codes of equal severity, the first in the aggregate wins. If none
+	// of the aggregated errors has a code, the code is code.InternalError.
+	//
+	// If the request is a notification (see Request.IsNotification), the
+	// client does not expect a reply: The server discards any value or error
+	// the handler returns, and sends nothing back to the client.
+	//
 	// The context passed to the handler by a *jrpc2.Server includes two special
 	// values that the handler may extract.
 	//
@@ -60,8 +78,34 @@ type Request struct {
 	params json.RawMessage // method parameters
 }
 
+// NewRequest returns a notification request for method with the given
+// encoded parameters, which may be empty. It is intended for testing
+// handlers directly, without a client and server:
+//
+//	req := jrpc2.NewRequest("Add", json.RawMessage(`[1, 2]`))
+//	result, err := h.Handle(ctx, req)
+//
+// NewRequest does not check that params are valid JSON.
+func NewRequest(method string, params json.RawMessage) *Request {
+	return NewRequestWithID("", method, params)
+}
+
+// NewRequestWithID returns a request for method with the given ID and
+// encoded parameters, as for NewRequest. The id is the JSON encoding of the
+// request ID, for example 1 or "a"; if it is empty the request is a
+// notification.
+func NewRequestWithID(id, method string, params json.RawMessage) *Request {
+	return &Request{
+		id:     fixID(json.RawMessage(id)),
+		method: method,
+		params: append(json.RawMessage(nil), params...),
+	}
+}
+
 // IsNotification reports whether the request is a notification, and thus does
-// not require a value response.
+// not require a value response. A handler may use this to skip work whose only
+// purpose is to construct a reply, since the server discards the result of a
+// handler for a notification.
 func (r *Request) IsNotification() bool { return r.id == nil }
 
 // ID returns the request identifier for r, or "" if r is a notification.
@@ -113,20 +157,39 @@ func (r *Request) ParamString() string { return string(r.params) }
 // A Response is a response message from a server to a client.
 type Response struct {
 	id     string
+	method string
 	err    *Error
 	result json.RawMessage
+	meta   json.RawMessage // response metadata, if the server sent any
 
 	// Waiters synchronize on reading from ch. The first successful reader from
 	// ch completes the request and is responsible for updating rsp and then
 	// closing ch. The client owns writing to ch, and is responsible to ensure
 	// that at most one write is ever performed.
 	ch     chan *jmessage
+	pctx   context.Context // the context governing the request (client only)
 	cancel func()
+
+	// Whether pctx had already ended when the client delivered the reply, in
+	// which case a cancellation lost the race. Protected by the client lock.
+	late bool
+
+	internal bool // the request was sent by the client on its own behalf
+
+	// The client records when the request was sent, and how long it took to
+	// complete. The elapsed time is set before the reply is written to ch.
+	sent    time.Time
+	elapsed time.Duration
 }
 
 // ID returns the request identifier for r.
 func (r *Response) ID() string { return r.id }
 
+// Method returns the name of the method whose call produced r, as recorded
+// by the client when the request was sent. This is useful for attributing the
+// responses from a batch. It returns "" if r was not issued by a client.
+func (r *Response) Method() string { return r.method }
+
 // SetID sets the ID of r to s, for use in proxies.
 func (r *Response) SetID(s string) { r.id = s }
 
@@ -160,6 +223,35 @@ func (r *Response) UnmarshalResult(v interface{}) error {
 	return json.Unmarshal(r.result, v)
 }
 
+// UnmarshalResultNumber behaves like UnmarshalResult, but decodes numbers
+// into an interface{} value as json.Number rather than float64. Use this to
+// decode results into generic values such as map[string]interface{} without
+// losing the precision of large integers.
+func (r *Response) UnmarshalResultNumber(v interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	dec := json.NewDecoder(bytes.NewReader(r.result))
+	dec.UseNumber()
+	if _, ok := v.(strictFielder); ok {
+		dec.DisallowUnknownFields()
+	}
+	return dec.Decode(v)
+}
+
+// ProcessTime reports how long the server spent processing the request for r,
+// and whether the server reported it. A jrpc2 server reports this only if its
+// IncludeTiming option is set.
+func (r *Response) ProcessTime() (time.Duration, bool) {
+	var meta struct {
+		N *int64 `json:"processNanos"`
+	}
+	if len(r.meta) == 0 || json.Unmarshal(r.meta, &meta) != nil || meta.N == nil {
+		return 0, false
+	}
+	return time.Duration(*meta.N), true
+}
+
 // ResultString returns the encoded result message of r as a string.
 // If r has no result, for example if r is an error response, it returns "".
 func (r *Response) ResultString() string { return string(r.result) }
@@ -173,10 +265,45 @@ func (r *Response) MarshalJSON() ([]byte, error) {
 	}).toJSON()
 }
 
+// WaitContext blocks until r is complete or ctx ends, and reports nil if r is
+// complete or otherwise the error from ctx. A response returned by the client
+// from Call or Batch is already complete, and a response not issued by a
+// client is always complete.
+//
+// The end of ctx stops the wait, but does not cancel the request: That is
+// governed by the context that was passed when the request was issued. It is
+// safe to call WaitContext multiple times and from concurrent goroutines, and
+// once it reports nil the contents of r will not change.
+func (r *Response) WaitContext(ctx context.Context) error {
+	if r.ch == nil {
+		return nil
+	}
+	select {
+	case raw, ok := <-r.ch:
+		r.settle(raw, ok)
+		return nil
+	case <-ctx.Done():
+		// If the response arrived concurrently, prefer it.
+		select {
+		case raw, ok := <-r.ch:
+			r.settle(raw, ok)
+			return nil
+		default:
+			return ctx.Err()
+		}
+	}
+}
+
 // wait blocks until r is complete. It is safe to call this multiple times and
 // from concurrent goroutines.
 func (r *Response) wait() {
 	raw, ok := <-r.ch
+	r.settle(raw, ok)
+}
+
+// settle completes r from a value received from r.ch, if ok is true.
+// Otherwise, r was already completed by another waiter.
+func (r *Response) settle(raw *jmessage, ok bool) {
 	if ok {
 		// N.B. We intentionally DO NOT have the sender close the channel, to
 		// prevent a data race between callers of Wait. The channel is closed
@@ -187,6 +314,7 @@ func (r *Response) wait() {
 		// waiters all get the same response, and do not race on accessing it.
 		r.err = raw.E
 		r.result = raw.R
+		r.meta = raw.meta
 		close(r.ch)
 		r.cancel() // release the context observer
 
@@ -237,9 +365,13 @@ func isServiceName(s string) bool {
 	return true
 }
 
-// filterError filters an *Error value to distinguish context errors from other
-// error types. If err is not a context error, it is returned unchanged.
+// filterError filters an *Error value to distinguish context errors and
+// acknowledgement timeouts from other error types. If err is not one of these,
+// it is returned unchanged.
 func filterError(e *Error) error {
+	if e == errAckTimeout {
+		return ErrAckTimeout
+	}
 	switch e.Code {
 	case code.Cancelled:
 		return context.Canceled
@@ -33,6 +33,8 @@ func BenchmarkRoundTrip(b *testing.B) {
 		{"C04+B", nil, &jrpc2.ServerOptions{Concurrency: 4}},
 		{"C12-B", nil, &jrpc2.ServerOptions{DisableBuiltin: true, Concurrency: 12}},
 		{"C12+B", nil, &jrpc2.ServerOptions{Concurrency: 12}},
+		{"C04-B-W", nil, &jrpc2.ServerOptions{DisableBuiltin: true, Concurrency: 4, UseWorkerPool: true}},
+		{"C12-B-W", nil, &jrpc2.ServerOptions{DisableBuiltin: true, Concurrency: 12, UseWorkerPool: true}},
 	}
 	for _, test := range tests {
 		b.Run(test.desc, func(b *testing.B) {
@@ -122,6 +124,43 @@ func BenchmarkLoad(b *testing.B) {
 	}
 }
 
+func BenchmarkDispatchMode(b *testing.B) {
+	// Compare the cost of concurrent calls when each request is dispatched on
+	// its own goroutine versus via a fixed pool of workers.
+	voidService := handler.Map{
+		"void": handler.Func(func(context.Context, *jrpc2.Request) (interface{}, error) {
+			return nil, nil
+		}),
+	}
+	for _, usePool := range []bool{false, true} {
+		name := "Goroutine"
+		if usePool {
+			name = "WorkerPool"
+		}
+		b.Run(name, func(b *testing.B) {
+			loc := server.NewLocal(voidService, &server.LocalOptions{
+				Server: &jrpc2.ServerOptions{Concurrency: 8, UseWorkerPool: usePool},
+			})
+			defer loc.Close()
+			ctx := context.Background()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			var wg sync.WaitGroup
+			for i := 0; i < b.N; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if _, err := loc.Client.Call(ctx, "void", nil); err != nil {
+						b.Errorf("Call void failed: %v", err)
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
+
 func BenchmarkParseRequests(b *testing.B) {
 	reqs := []struct {
 		desc, input string
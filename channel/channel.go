@@ -38,6 +38,7 @@ import (
 	"errors"
 	"io"
 	"net"
+	"sync"
 )
 
 // A Channel represents the ability to transmit and receive data records.  A
@@ -62,6 +63,21 @@ type Channel interface {
 	Close() error
 }
 
+// A StreamSender is an optional interface that a Channel may implement to
+// send a record whose content is read from an io.Reader, without holding the
+// complete record in memory. A jrpc2.Server uses this to stream large results
+// (see jrpc2.StreamResult).
+//
+// SendStream must transmit the contents of r, up to EOF, as one complete
+// record, and report the number of bytes written. If it reports an error, the
+// record may have been partly written. The reader passed by a jrpc2.Server
+// also implements io.WriterTo, so an implementation that uses io.Copy lets a
+// result produced by an io.WriterTo (see jrpc2.WriterStream) write directly
+// to the output.
+type StreamSender interface {
+	SendStream(r io.Reader) (int64, error)
+}
+
 // ErrClosed is a sentinel error that can be returned to indicate an operation
 // failed because the channel was closed.
 var ErrClosed = errors.New("channel is closed")
@@ -80,27 +96,38 @@ type Framing func(io.Reader, io.WriteCloser) Channel
 type direct struct {
 	send chan<- []byte
 	recv <-chan []byte
+
+	done  chan struct{}   // closed when this end is closed
+	peer  <-chan struct{} // closed when the other end is closed
+	close *sync.Once
 }
 
-func (d direct) Send(msg []byte) (err error) {
-	defer func() {
-		if p := recover(); p != nil {
-			err = errors.New("send on closed channel")
-		}
-	}()
-	d.send <- msg
-	return nil
+func (d direct) Send(msg []byte) error {
+	select {
+	case <-d.done:
+		return ErrClosed
+	default:
+	}
+	select {
+	case d.send <- msg:
+		return nil
+	case <-d.done:
+		return ErrClosed
+	}
 }
 
 func (d direct) Recv() ([]byte, error) {
-	msg, ok := <-d.recv
-	if ok {
+	select {
+	case msg := <-d.recv:
 		return msg, nil
+	case <-d.peer:
+		return nil, io.EOF
 	}
-	return nil, io.EOF
 }
 
-func (d direct) Close() error { close(d.send); return nil }
+// Close closes d. It is safe to call Close concurrently with Send, and doing
+// so unblocks a Send that is waiting for the other end to receive.
+func (d direct) Close() error { d.close.Do(func() { close(d.done) }); return nil }
 
 // Direct returns a pair of synchronous connected channels that pass message
 // buffers directly in memory without framing or encoding. Sends to client will
@@ -112,7 +139,9 @@ func (d direct) Close() error { close(d.send); return nil }
 func Direct() (client, server Channel) {
 	c2s := make(chan []byte)
 	s2c := make(chan []byte)
-	client = direct{send: c2s, recv: s2c}
-	server = direct{send: s2c, recv: c2s}
+	cdone := make(chan struct{})
+	sdone := make(chan struct{})
+	client = direct{send: c2s, recv: s2c, done: cdone, peer: sdone, close: new(sync.Once)}
+	server = direct{send: s2c, recv: c2s, done: sdone, peer: cdone, close: new(sync.Once)}
 	return
 }
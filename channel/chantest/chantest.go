@@ -0,0 +1,146 @@
+// Copyright (C) 2026 Michael J. Fromberger. All Rights Reserved.
+
+// Package chantest provides a programmable implementation of the
+// channel.Channel interface, for use in testing code that sends and receives
+// messages on a channel.
+//
+// The test controls what Recv returns, by enqueuing records and errors in the
+// order they should be received, and inspects what was passed to Send:
+//
+//	ch := chantest.New()
+//	ch.Enqueue([]byte(`{"jsonrpc":"2.0","id":1,"result":true}`))
+//	ch.Enqueue([]byte(`garbage`))
+//	ch.EnqueueEOF()
+//	cli := jrpc2.NewClient(ch, nil)
+//	// ...
+//	sent := ch.Sent()
+package chantest
+
+import (
+	"io"
+	"sync"
+
+	"github.com/creachadair/jrpc2/channel"
+)
+
+// Channel is an implementation of channel.Channel whose Recv returns records
+// and errors enqueued by the test, and whose Send records the messages sent.
+// A zero Channel is not ready for use; call New to construct one. The methods
+// of a Channel are safe for concurrent use by multiple goroutines.
+type Channel struct {
+	mu      sync.Mutex
+	cond    *sync.Cond // signaled when recv, sent, or closed changes
+	recv    []result   // pending results for Recv, in order
+	sent    [][]byte   // copies of the records passed to Send
+	sendErr error      // if not nil, Send reports this error
+	closed  bool
+}
+
+type result struct {
+	data []byte
+	err  error
+}
+
+// New returns a new empty Channel.
+func New() *Channel {
+	c := new(Channel)
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Enqueue adds data to the records to be returned by Recv, in order.
+// The channel retains a copy of data.
+func (c *Channel) Enqueue(data []byte) { c.push(result{data: append([]byte(nil), data...)}) }
+
+// EnqueueError arranges for Recv to report err, once the records enqueued
+// before it have been received. Recv reports the error once, and resumes
+// returning records enqueued after it.
+func (c *Channel) EnqueueError(err error) { c.push(result{err: err}) }
+
+// EnqueueEOF arranges for Recv to report io.EOF, once the records enqueued
+// before it have been received. It is shorthand for EnqueueError(io.EOF).
+func (c *Channel) EnqueueEOF() { c.EnqueueError(io.EOF) }
+
+func (c *Channel) push(r result) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.recv = append(c.recv, r)
+	c.cond.Broadcast()
+}
+
+// SetSendError arranges for subsequent calls to Send to fail with err, or to
+// succeed again if err == nil. A failed send is not recorded.
+func (c *Channel) SetSendError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sendErr = err
+}
+
+// Sent returns copies of the records successfully sent on c, in order.
+func (c *Channel) Sent() [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.copySent()
+}
+
+// WaitSent blocks until at least n records have been sent on c, or until c
+// is closed, and then returns copies of the records sent, in order.
+func (c *Channel) WaitSent(n int) [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.sent) < n && !c.closed {
+		c.cond.Wait()
+	}
+	return c.copySent()
+}
+
+func (c *Channel) copySent() [][]byte {
+	out := make([][]byte, len(c.sent))
+	for i, msg := range c.sent {
+		out[i] = append([]byte(nil), msg...)
+	}
+	return out
+}
+
+// Send implements part of the channel.Channel interface. It records a copy of
+// msg, unless c is closed or an error was set by SetSendError.
+func (c *Channel) Send(msg []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return channel.ErrClosed
+	} else if c.sendErr != nil {
+		return c.sendErr
+	}
+	c.sent = append(c.sent, append([]byte(nil), msg...))
+	c.cond.Broadcast()
+	return nil
+}
+
+// Recv implements part of the channel.Channel interface. It blocks until a
+// record or error is enqueued, and returns it. Once c is closed, Recv reports
+// channel.ErrClosed, for which channel.IsErrClosing is true.
+func (c *Channel) Recv() ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.recv) == 0 && !c.closed {
+		c.cond.Wait()
+	}
+	if c.closed {
+		return nil, channel.ErrClosed
+	}
+	next := c.recv[0]
+	c.recv = c.recv[1:]
+	return next.data, next.err
+}
+
+// Close implements part of the channel.Channel interface. Closing c unblocks
+// any pending calls to Recv and WaitSent. Close is safe to call more than
+// once.
+func (c *Channel) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	c.cond.Broadcast()
+	return nil
+}
@@ -0,0 +1,129 @@
+// Copyright (C) 2026 Michael J. Fromberger. All Rights Reserved.
+
+package chantest_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/creachadair/jrpc2"
+	"github.com/creachadair/jrpc2/channel"
+	"github.com/creachadair/jrpc2/channel/chantest"
+	"github.com/creachadair/jrpc2/code"
+)
+
+func TestChannel(t *testing.T) {
+	ch := chantest.New()
+	ch.Enqueue([]byte("first"))
+	ch.EnqueueError(errors.New("bad"))
+	ch.Enqueue([]byte("second"))
+	ch.EnqueueEOF()
+
+	for _, want := range []string{"first", "error:bad", "second", "error:EOF"} {
+		msg, err := ch.Recv()
+		got := string(msg)
+		if err != nil {
+			got = "error:" + err.Error()
+		}
+		if got != want {
+			t.Errorf("Recv: got %q, want %q", got, want)
+		}
+	}
+
+	buf := []byte("alpha")
+	if err := ch.Send(buf); err != nil {
+		t.Errorf("Send(alpha): unexpected error: %v", err)
+	}
+	buf[0] = 'A' // the channel should have kept a copy
+
+	ch.SetSendError(errors.New("send failed"))
+	if err := ch.Send([]byte("beta")); err == nil {
+		t.Error("Send(beta): got nil, want error")
+	}
+	ch.SetSendError(nil)
+	if err := ch.Send([]byte("gamma")); err != nil {
+		t.Errorf("Send(gamma): unexpected error: %v", err)
+	}
+	if got := ch.Sent(); len(got) != 2 || string(got[0]) != "alpha" || string(got[1]) != "gamma" {
+		t.Errorf("Sent: got %q, want [alpha gamma]", got)
+	}
+
+	// Closing the channel unblocks a pending Recv.
+	errc := make(chan error, 1)
+	go func() { _, err := ch.Recv(); errc <- err }()
+	ch.Close()
+	if err := <-errc; !channel.IsErrClosing(err) {
+		t.Errorf("Recv after Close: got %v, want closing error", err)
+	}
+	if err := ch.Send([]byte("delta")); !channel.IsErrClosing(err) {
+		t.Errorf("Send after Close: got %v, want closing error", err)
+	}
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Reply", func(t *testing.T) {
+		ch := chantest.New()
+		cli := jrpc2.NewClient(ch, nil)
+		defer cli.Close()
+
+		type result struct {
+			rsp *jrpc2.Response
+			err error
+		}
+		done := make(chan result, 1)
+		go func() {
+			rsp, err := cli.Call(ctx, "Test", []int{1, 2})
+			done <- result{rsp, err}
+		}()
+
+		sent := ch.WaitSent(1)
+		const wantReq = `{"jsonrpc":"2.0","id":1,"method":"Test","params":[1,2]}`
+		if got := string(sent[0]); got != wantReq {
+			t.Errorf("Sent request: got %#q, want %#q", got, wantReq)
+		}
+		ch.Enqueue([]byte(`{"jsonrpc":"2.0","id":1,"result":"ok"}`))
+
+		r := <-done
+		if r.err != nil {
+			t.Fatalf("Call failed: %v", r.err)
+		}
+		if got := r.rsp.ResultString(); got != `"ok"` {
+			t.Errorf("Call result: got %#q, want %#q", got, `"ok"`)
+		}
+	})
+
+	t.Run("Garbage", func(t *testing.T) {
+		ch := chantest.New()
+		ch.Enqueue([]byte(`this is not JSON`))
+		cli := jrpc2.NewClient(ch, nil)
+		defer cli.Close()
+
+		// The call fails once the client stops on the undecodable reply.
+		if rsp, err := cli.Call(ctx, "Test", nil); err == nil {
+			t.Errorf("Call: got %+v, want error", rsp)
+		}
+		if err := cli.LastError(); code.FromError(err) != code.ParseError {
+			t.Errorf("LastError: got %v, want code %v", err, code.ParseError)
+		}
+	})
+
+	t.Run("EOF", func(t *testing.T) {
+		ch := chantest.New()
+		ch.EnqueueEOF()
+		cli := jrpc2.NewClient(ch, nil)
+
+		if rsp, err := cli.Call(ctx, "Test", nil); err == nil {
+			t.Errorf("Call: got %+v, want error", rsp)
+		}
+		if err := cli.LastError(); err != io.EOF {
+			t.Errorf("LastError: got %v, want %v", err, io.EOF)
+		}
+		if err := cli.Close(); err != nil {
+			t.Errorf("Close: unexpected error: %v", err)
+		}
+	})
+}
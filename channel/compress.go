@@ -0,0 +1,123 @@
+// Copyright (C) 2026 Michael J. Fromberger. All Rights Reserved.
+
+package channel
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Flag bytes prefixed to each record sent by a Compress channel.
+const (
+	flagRaw  = 0 // the payload is not compressed
+	flagGzip = 1 // the payload is compressed with gzip
+)
+
+// Compress returns a Channel that wraps ch, compressing with gzip each record
+// whose length is at least threshold bytes. Smaller records are sent as-is,
+// avoiding the overhead of compression for short messages. If threshold <= 0,
+// every record is compressed.
+//
+// Each record sent on ch is prefixed with a one-byte flag indicating whether
+// the remainder is compressed, and Recv uses the flag to decide whether to
+// inflate the record. Both ends of a connection must therefore use Compress,
+// though they need not agree on the threshold.
+//
+// Because the records sent on ch contain arbitrary binary data, ch must use a
+// framing that does not interpret record contents, such as Header or LSP.
+// Framings that depend on the syntax of the record, such as Line or RawJSON,
+// will not work.
+//
+// Recv refuses to inflate a record to more than DefaultInflateLimit bytes (see
+// CompressLimit).
+func Compress(ch Channel, threshold int) Channel {
+	return CompressLimit(ch, threshold, DefaultInflateLimit)
+}
+
+// DefaultInflateLimit is the maximum size in bytes to which the Recv method of
+// a Compress channel will inflate a compressed record.
+const DefaultInflateLimit = 64 << 20
+
+// ErrInflateLimit is reported by the Recv method of a compressing channel for
+// a compressed record whose inflated size exceeds its limit.
+var ErrInflateLimit = errors.New("compressed record exceeds the size limit")
+
+// CompressLimit is as Compress, but the Recv method of the channel reports an
+// error wrapping ErrInflateLimit for a compressed record that inflates to more
+// than limit bytes, instead of inflating it. This protects the receiver from a
+// small record that expands to an enormous payload. If limit <= 0, records are
+// inflated without limit.
+func CompressLimit(ch Channel, threshold, limit int) Channel {
+	return compressor{ch: ch, threshold: threshold, limit: limit}
+}
+
+type compressor struct {
+	ch        Channel
+	threshold int
+	limit     int // if positive, the maximum inflated record size
+}
+
+// Send implements part of the Channel interface.
+func (c compressor) Send(msg []byte) error {
+	if len(msg) >= c.threshold {
+		var buf bytes.Buffer
+		buf.WriteByte(flagGzip)
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(msg); err != nil {
+			return err
+		} else if err := zw.Close(); err != nil {
+			return err
+		}
+
+		// If compression did not help, fall through and send it raw.
+		if buf.Len() <= len(msg) {
+			return c.ch.Send(buf.Bytes())
+		}
+	}
+	out := make([]byte, len(msg)+1)
+	out[0] = flagRaw
+	copy(out[1:], msg)
+	return c.ch.Send(out)
+}
+
+// Recv implements part of the Channel interface. It reports an error if the
+// record lacks a valid flag byte, its compressed payload is invalid, or the
+// payload inflates to more than the limit of the channel.
+func (c compressor) Recv() ([]byte, error) {
+	msg, err := c.ch.Recv()
+	if err != nil {
+		return msg, err
+	} else if len(msg) == 0 {
+		return nil, errors.New("compressed record is missing its flag")
+	}
+	switch msg[0] {
+	case flagRaw:
+		return msg[1:], nil
+	case flagGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(msg[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid compressed record: %w", err)
+		}
+		defer zr.Close()
+		var r io.Reader = zr
+		if c.limit > 0 {
+			// Read one byte past the limit, to detect an oversized record.
+			r = io.LimitReader(zr, int64(c.limit)+1)
+		}
+		out, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid compressed record: %w", err)
+		} else if c.limit > 0 && len(out) > c.limit {
+			return nil, fmt.Errorf("inflating record: %w (%d bytes)", ErrInflateLimit, c.limit)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unknown compression flag %d", msg[0])
+	}
+}
+
+// Close implements part of the Channel interface.
+func (c compressor) Close() error { return c.ch.Close() }
@@ -0,0 +1,97 @@
+// Copyright (C) 2026 Michael J. Fromberger. All Rights Reserved.
+
+package channel_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/creachadair/jrpc2/channel"
+)
+
+// capture is a channel that records the last record sent and replays it.
+type capture struct{ last []byte }
+
+func (c *capture) Send(msg []byte) error { c.last = append([]byte(nil), msg...); return nil }
+func (c *capture) Recv() ([]byte, error) { return c.last, nil }
+func (*capture) Close() error            { return nil }
+
+func TestCompress(t *testing.T) {
+	const threshold = 64
+	long := `{"data":"` + strings.Repeat("abcdefgh", 64) + `"}`
+	tests := []struct {
+		msg  string
+		flag byte
+	}{
+		{"", 0},
+		{`{"short":true}`, 0},
+		{long, 1},
+
+		// Long enough to compress, but compression does not make it shorter.
+		{"\x01\x02\x03" + strings.Repeat("\x00", threshold), 0},
+	}
+	for _, test := range tests {
+		var cap capture
+		ch := channel.Compress(&cap, threshold)
+		if err := ch.Send([]byte(test.msg)); err != nil {
+			t.Errorf("Send %q failed: %v", test.msg, err)
+			continue
+		}
+		if len(cap.last) == 0 || cap.last[0] != test.flag {
+			t.Errorf("Send %q: record %q, want flag %d", test.msg, cap.last, test.flag)
+		}
+		got, err := ch.Recv()
+		if err != nil {
+			t.Errorf("Recv %q failed: %v", test.msg, err)
+		} else if string(got) != test.msg {
+			t.Errorf("Recv: got %q, want %q", got, test.msg)
+		}
+	}
+	if long := []byte(long); len(long) <= threshold {
+		t.Fatalf("Test message is too short (%d bytes)", len(long))
+	}
+}
+
+func TestCompress_pipe(t *testing.T) {
+	lhs, rhs := newPipe(channel.Header("application/octet-stream"))
+	defer lhs.Close()
+	defer rhs.Close()
+	client := channel.Compress(lhs, 0)
+	server := channel.Compress(rhs, 16)
+
+	testSendRecv(t, client, server, strings.Repeat("hello, world ", 20))
+	testSendRecv(t, server, client, "tiny")
+}
+
+func TestCompressLimit(t *testing.T) {
+	msg := strings.Repeat("x", 1000)
+	var cap capture
+	if err := channel.Compress(&cap, 0).Send([]byte(msg)); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	record := cap.last
+
+	for _, limit := range []int{0, 1000, 5000} {
+		got, err := channel.CompressLimit(&capture{last: record}, 0, limit).Recv()
+		if err != nil {
+			t.Errorf("Recv with limit %d: unexpected error: %v", limit, err)
+		} else if string(got) != msg {
+			t.Errorf("Recv with limit %d: got %d bytes, want %d", limit, len(got), len(msg))
+		}
+	}
+	got, err := channel.CompressLimit(&capture{last: record}, 0, 999).Recv()
+	if !errors.Is(err, channel.ErrInflateLimit) {
+		t.Errorf("Recv with limit 999: got %d bytes, %v; want %v", len(got), err, channel.ErrInflateLimit)
+	}
+}
+
+func TestCompress_invalid(t *testing.T) {
+	tests := []string{"", "\x02abc", "\x01not gzip"}
+	for _, test := range tests {
+		cap := &capture{last: []byte(test)}
+		if got, err := channel.Compress(cap, 0).Recv(); err == nil {
+			t.Errorf("Recv %q: got %q, want error", test, got)
+		}
+	}
+}
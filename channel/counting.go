@@ -0,0 +1,61 @@
+// Copyright (C) 2026 Michael J. Fromberger. All Rights Reserved.
+
+package channel
+
+import "sync/atomic"
+
+// Counting returns a Channel that wraps ch, and a *Counters that records the
+// number of records and bytes successfully sent and received through it.
+// The counts are of the records passed to and returned by the wrapper, and
+// do not include any framing added by ch.
+func Counting(ch Channel) (Channel, *Counters) {
+	c := new(Counters)
+	return counting{ch: ch, c: c}, c
+}
+
+// Counters records traffic on a channel returned by Counting. Its methods are
+// safe for concurrent use by multiple goroutines.
+type Counters struct {
+	bytesSent, bytesRecv int64
+	msgsSent, msgsRecv   int64
+}
+
+// BytesSent reports the total number of bytes sent.
+func (c *Counters) BytesSent() int64 { return atomic.LoadInt64(&c.bytesSent) }
+
+// BytesReceived reports the total number of bytes received.
+func (c *Counters) BytesReceived() int64 { return atomic.LoadInt64(&c.bytesRecv) }
+
+// MessagesSent reports the number of records sent.
+func (c *Counters) MessagesSent() int64 { return atomic.LoadInt64(&c.msgsSent) }
+
+// MessagesReceived reports the number of records received.
+func (c *Counters) MessagesReceived() int64 { return atomic.LoadInt64(&c.msgsRecv) }
+
+type counting struct {
+	ch Channel
+	c  *Counters
+}
+
+// Send implements part of the Channel interface.
+func (c counting) Send(msg []byte) error {
+	if err := c.ch.Send(msg); err != nil {
+		return err
+	}
+	atomic.AddInt64(&c.c.msgsSent, 1)
+	atomic.AddInt64(&c.c.bytesSent, int64(len(msg)))
+	return nil
+}
+
+// Recv implements part of the Channel interface.
+func (c counting) Recv() ([]byte, error) {
+	msg, err := c.ch.Recv()
+	if err == nil {
+		atomic.AddInt64(&c.c.msgsRecv, 1)
+		atomic.AddInt64(&c.c.bytesRecv, int64(len(msg)))
+	}
+	return msg, err
+}
+
+// Close implements part of the Channel interface.
+func (c counting) Close() error { return c.ch.Close() }
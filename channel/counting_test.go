@@ -0,0 +1,51 @@
+// Copyright (C) 2026 Michael J. Fromberger. All Rights Reserved.
+
+package channel_test
+
+import (
+	"testing"
+
+	"github.com/creachadair/jrpc2/channel"
+)
+
+func TestCounting(t *testing.T) {
+	ch, c := channel.Counting(new(capture))
+	for _, msg := range []string{"alpha", "", "bravo charlie"} {
+		if err := ch.Send([]byte(msg)); err != nil {
+			t.Fatalf("Send %q: unexpected error: %v", msg, err)
+		}
+	}
+	if _, err := ch.Recv(); err != nil {
+		t.Fatalf("Recv: unexpected error: %v", err)
+	}
+	if err := ch.Close(); err != nil {
+		t.Errorf("Close: unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		got, want int64
+	}{
+		{"MessagesSent", c.MessagesSent(), 3},
+		{"BytesSent", c.BytesSent(), 18},
+		{"MessagesReceived", c.MessagesReceived(), 1},
+		{"BytesReceived", c.BytesReceived(), 13},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, test.got, test.want)
+		}
+	}
+
+	// Failed operations are not counted.
+	lhs, rhs := channel.Direct()
+	defer rhs.Close()
+	dch, c := channel.Counting(lhs)
+	dch.Close()
+	if err := dch.Send([]byte("x")); err == nil {
+		t.Error("Send on closed channel: got nil, want error")
+	}
+	if n := c.MessagesSent(); n != 0 {
+		t.Errorf("MessagesSent after failure: got %d, want 0", n)
+	}
+}
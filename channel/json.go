@@ -38,6 +38,9 @@ func (c jsonc) Send(msg []byte) error {
 	return err
 }
 
+// SendStream implements the channel.StreamSender interface.
+func (c jsonc) SendStream(r io.Reader) (int64, error) { return io.Copy(c.wc, r) }
+
 // Recv implements part of the Channel interface. It reports an error if the
 // message is not a structurally valid JSON value. It is safe for the caller to
 // treat any record returned as a json.RawMessage.
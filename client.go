@@ -6,36 +6,74 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"sort"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/creachadair/jrpc2/channel"
 	"github.com/creachadair/jrpc2/code"
+	"github.com/creachadair/jrpc2/metrics"
 )
 
 // A Client is a JSON-RPC 2.0 client. The client sends requests and receives
 // responses on a channel.Channel provided by the caller.
 type Client struct {
 	done *sync.WaitGroup // done when the reader is finished at shutdown time
+	recv sync.WaitGroup  // done when received responses have been delivered
+
+	// Closed when the most recently received message has been delivered.
+	// This is accessed only by the reader goroutine.
+	lastRecv chan struct{}
 
 	log   func(string, ...interface{}) // write debug logs here
 	snote func(*jmessage)
 	scall func(context.Context, *jmessage) []byte
 	chook func(*Client, *Response)
+	cdone func(string, time.Duration, error)
+	osend func(string, bool, string)
+	emeta func(context.Context, string) (json.RawMessage, error)
+	retry RetryPolicy
+	vname func(string) bool
+
+	version string // the protocol version marker
+
+	partial bool       // whether batch specs may fail individually
+	always  bool       // whether to call chook for cancellations that are too late
+	metrics *metrics.M // if not nil, record client metrics here
+
+	// If not nil, the client is in manual accept mode, and Accept reads
+	// from this channel.
+	manual receiver
 
 	cbctx    context.Context // terminates when the client is closed
 	cbcancel func()          // cancels cbctx
 
+	// Holds a token while a message is being sent, to serialize writes to
+	// the channel without holding c.mu.
+	sendq chan struct{}
+
 	mu      sync.Mutex           // protects the fields below
 	ch      channel.Channel      // channel to the server
 	err     error                // error from a previous operation
 	pending map[string]*Response // requests pending completion, by ID
 	nextID  int64                // next unused request ID
+	freeIDs []int64              // completed request IDs available for reuse
+	isFree  map[int64]bool       // the elements of freeIDs, if reusing IDs
+	caps    *Capabilities        // server capabilities, if known
+	maxPend int                  // if positive, the limit on len(pending)
+	room    chan struct{}        // if set, closed when a pending request ends
+
+	unsub   string                   // method to call to end a subscription
+	pendSub map[string]*Subscription // subscribe requests pending, by request ID
+	subs    map[string]*Subscription // active subscriptions, by subscription ID
 }
 
 // NewClient returns a new client that communicates with the server via ch.
 func NewClient(ch channel.Channel, opts *ClientOptions) *Client {
+	ch = tapFrames(ch, opts.onFrame())
 	cbctx, cbcancel := context.WithCancel(context.Background())
 	c := &Client{
 		done:  new(sync.WaitGroup),
@@ -43,14 +81,32 @@ func NewClient(ch channel.Channel, opts *ClientOptions) *Client {
 		snote: opts.handleNotification(),
 		scall: opts.handleCallback(),
 		chook: opts.handleCancel(),
+		cdone: opts.onCallDone(),
+		osend: opts.onSend(),
+		emeta: opts.encodeMeta(),
+		retry: opts.retryPolicy(),
+		vname: opts.validMethod(),
+
+		version: opts.version(),
+
+		partial: opts.partialBatch(),
+		always:  opts.alwaysCancel(),
+		metrics: opts.metrics(),
 
 		cbctx:    cbctx,
 		cbcancel: cbcancel,
+		sendq:    make(chan struct{}, 1),
 
 		// Lock-protected fields
 		ch:      ch,
 		pending: make(map[string]*Response),
 		nextID:  1,
+		isFree:  opts.freeIDSet(),
+		maxPend: opts.maxPending(),
+
+		unsub:   opts.unsubscribeMethod(),
+		pendSub: make(map[string]*Subscription),
+		subs:    make(map[string]*Subscription),
 
 		// Note that we start the ID counter at 1 here to avoid issues with a
 		// server implementation that treats 0 as equivalent to null.
@@ -60,15 +116,109 @@ func NewClient(ch channel.Channel, opts *ClientOptions) *Client {
 	// back to pending requests by their ID. Outbound requests do not queue;
 	// they are sent synchronously in the Send method.
 
-	c.done.Add(1)
-	go func() {
-		defer c.done.Done()
-		for c.accept(ch) == nil {
-		}
-	}()
+	if opts.manualAccept() {
+		c.manual = ch
+	} else {
+		onClose := opts.onClose()
+		c.done.Add(1)
+		go func() {
+			for c.accept(ch) == nil {
+			}
+			err := c.LastError()
+			c.done.Done()
+
+			// Call the hook after signaling completion, so that the hook may
+			// safely call c.Close.
+			if onClose != nil {
+				if err == errClientStopped {
+					err = nil
+				}
+				onClose(err)
+			}
+		}()
+	}
+
+	// If requested, periodically check that the server is still responsive.
+	// A manual-accept client may not read the replies in time, so it does not
+	// send pings.
+	if d := opts.keepAlive(); d > 0 && c.manual == nil {
+		c.done.Add(1)
+		go func() {
+			defer c.done.Done()
+			c.keepAlive(d)
+		}()
+	}
 	return c
 }
 
+// Accept receives the next message from the server, and delivers it to the
+// pending request or subscription it belongs to, or to the notification or
+// callback handler. It blocks until a message is received, and returns after
+// the message has been delivered. If the client has stopped, or if receiving
+// the message fails, Accept reports the error that stopped the client.
+//
+// Accept may be used only if the client was created with the ManualAccept
+// option set, and must not be called concurrently with itself.
+func (c *Client) Accept() error {
+	if c.manual == nil {
+		return errAutoAccept
+	}
+	if err := c.LastError(); err != nil {
+		return err
+	}
+	err := c.accept(c.manual)
+	c.recv.Wait()
+	return err
+}
+
+// ping calls the rpc.ping method on the server and waits for its reply. Unlike
+// Call, the ping bypasses the retry policy, the MaxPending limit, the method
+// and metadata hooks, and the OnSend, OnCallDone, and OnCancel hooks, since it
+// is sent by the client on its own behalf.
+func (c *Client) ping(ctx context.Context) error {
+	c.mu.Lock()
+	id := c.newID()
+	c.mu.Unlock()
+	rsps, _, err := c.sendTrace(ctx, jmessages{{V: c.version, ID: id, M: "rpc.ping", internal: true}})
+	if err != nil {
+		return err
+	}
+	rsps[0].wait()
+	if err := rsps[0].Error(); err != nil {
+		return filterError(err)
+	}
+	return nil
+}
+
+// keepAlive pings the server every d until the client stops, stopping the
+// client if the server does not reply within d.
+func (c *Client) keepAlive(d time.Duration) {
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.cbctx.Done():
+			return
+		case <-t.C:
+		}
+
+		ctx, cancel := context.WithTimeout(c.cbctx, d)
+		err := c.ping(ctx)
+		cancel()
+		var jerr *Error
+		if err == nil || errors.As(err, &jerr) {
+			continue // the server replied, so the link is still alive
+		} else if c.cbctx.Err() != nil {
+			return // the client was closed while the ping was in flight
+		}
+		c.log("Keepalive ping failed: %v", err)
+		c.mu.Lock()
+		c.stop(fmt.Errorf("keepalive ping failed: %w", err))
+		c.mu.Unlock()
+		return
+	}
+}
+
 // accept receives the next batch of responses from the server.  This may
 // either be a list or a single object, the decoder for jmessages knows how to
 // handle both. The caller must not hold c.mu.
@@ -76,12 +226,29 @@ func (c *Client) accept(ch receiver) error {
 	var in jmessages
 	bits, err := ch.Recv()
 	if err == nil {
-		err = in.parseJSON(bits)
+		if perr := in.parseJSON(bits, c.version); perr != nil {
+			// Distinguish a peer that sent us garbage from a failure of the
+			// channel itself, by classifying the error as a parse error.
+			// If the parser reported an *Error, keep its message but not its
+			// code, rather than nesting one error inside the other.
+			msg := perr.Error()
+			var jerr *Error
+			if errors.As(perr, &jerr) {
+				msg = jerr.Message
+			}
+			err = fmt.Errorf("decoding %d-byte message: %w", len(bits),
+				&Error{Code: code.ParseError, Message: msg})
+		}
 	}
 	if err != nil {
 		if !isUninteresting(err) {
 			c.log("Decoding error: %v", err)
 		}
+
+		// Let any responses already received reach their callers before the
+		// pending requests are failed, so a server that replies and then
+		// closes the channel does not lose the replies.
+		c.recv.Wait()
 		c.mu.Lock()
 		c.stop(err)
 		c.mu.Unlock()
@@ -89,9 +256,20 @@ func (c *Client) accept(ch receiver) error {
 	}
 
 	c.log("Received %d responses", len(in))
+
+	// Deliver each message after its predecessors, so that the handling of
+	// responses and notifications respects their order of arrival.
+	prev, next := c.lastRecv, make(chan struct{})
+	c.lastRecv = next
 	c.done.Add(1)
+	c.recv.Add(1)
 	go func() {
 		defer c.done.Done()
+		defer c.recv.Done()
+		defer close(next)
+		if prev != nil {
+			<-prev
+		}
 		c.mu.Lock()
 		defer c.mu.Unlock()
 		for _, rsp := range in {
@@ -106,7 +284,9 @@ func (c *Client) accept(ch receiver) error {
 // Precondition: msg is a request or notification, not a response or error.
 func (c *Client) handleRequest(msg *jmessage) {
 	if msg.isNotification() {
-		if c.snote == nil {
+		if sub := c.matchSubscription(msg); sub != nil {
+			sub.push(&Request{method: msg.M, params: msg.P})
+		} else if c.snote == nil {
 			c.log("Discarding notification: %v", msg)
 		} else {
 			c.snote(msg)
@@ -125,10 +305,11 @@ func (c *Client) handleRequest(msg *jmessage) {
 			bits := c.scall(ctx, msg)
 
 			c.mu.Lock()
-			defer c.mu.Unlock()
-			if c.err != nil {
-				c.log("Discarding callback response: %v", c.err)
-			} else if err := c.ch.Send(bits); err != nil {
+			ch, err := c.ch, c.err
+			c.mu.Unlock()
+			if err != nil {
+				c.log("Discarding callback response: %v", err)
+			} else if err := c.transmit(c.cbctx, ch, bits); err != nil {
 				c.log("Sending reply for callback %v failed: %v", msg, err)
 			}
 		}()
@@ -155,6 +336,16 @@ func (c *Client) deliver(rsp *jmessage) {
 	// Remove the pending request from the set and deliver its response.
 	// Determining whether it's an error is the caller's responsibility.
 	delete(c.pending, id)
+	c.releaseID(id)
+	c.signalRoom()
+	p.elapsed = time.Since(p.sent)
+	p.late = p.pctx != nil && p.pctx.Err() != nil
+	if sub := c.pendSub[id]; sub != nil {
+		delete(c.pendSub, id)
+		if rsp.err == nil && rsp.E == nil {
+			c.startSubscription(sub, rsp.R)
+		}
+	}
 	if rsp.err != nil {
 		p.ch <- &jmessage{ID: rsp.ID, E: rsp.err}
 		c.log("Invalid response for ID %q", id)
@@ -167,29 +358,86 @@ func (c *Client) deliver(rsp *jmessage) {
 // req constructs a fresh request for the specified method and parameters.
 // This does not transmit the request to the server; use c.send to do so.
 func (c *Client) req(ctx context.Context, method string, params interface{}) (*jmessage, error) {
+	return c.reqWithID(ctx, nil, method, params)
+}
+
+// reqWithID behaves as req, but uses the given request ID. If id == nil, the
+// client assigns a fresh ID.
+func (c *Client) reqWithID(ctx context.Context, id json.RawMessage, method string, params interface{}) (*jmessage, error) {
+	if err := c.checkMethod(method); err != nil {
+		return nil, err
+	}
 	bits, err := c.marshalParams(ctx, method, params)
 	if err != nil {
 		return nil, err
 	}
-
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	id := json.RawMessage(strconv.FormatInt(c.nextID, 10))
-	c.nextID++
+	meta, err := c.marshalMeta(ctx, method)
+	if err != nil {
+		return nil, err
+	}
+	if id == nil {
+		c.mu.Lock()
+		id = c.newID()
+		c.mu.Unlock()
+	}
 	return &jmessage{
-		ID: id,
-		M:  method,
-		P:  bits,
+		V:    c.version,
+		ID:   id,
+		M:    method,
+		P:    bits,
+		meta: meta,
 	}, nil
 }
 
+// newID returns an unused request ID, either reused from the free list or
+// fresh from the sequence. The caller must hold c.mu.
+func (c *Client) newID() json.RawMessage {
+	for {
+		var n int64
+		if k := len(c.freeIDs); k > 0 {
+			n = c.freeIDs[k-1]
+			c.freeIDs = c.freeIDs[:k-1]
+			delete(c.isFree, n)
+		} else {
+			n = c.nextID
+			c.nextID++
+		}
+
+		// Skip IDs claimed by the caller via CallID.
+		if id := strconv.FormatInt(n, 10); c.pending[id] == nil {
+			return json.RawMessage(id)
+		}
+	}
+}
+
+// releaseID makes id available for reuse, if the client reuses IDs and id
+// is one the client could have issued. The caller must hold c.mu.
+func (c *Client) releaseID(id string) {
+	if c.isFree == nil {
+		return
+	}
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || n < 1 || n >= c.nextID || c.isFree[n] {
+		return
+	}
+	c.freeIDs = append(c.freeIDs, n)
+	c.isFree[n] = true
+}
+
 // note constructs a notification request for the specified method and parameters.
 func (c *Client) note(ctx context.Context, method string, params interface{}) (*jmessage, error) {
+	if err := c.checkMethod(method); err != nil {
+		return nil, err
+	}
 	bits, err := c.marshalParams(ctx, method, params)
 	if err != nil {
 		return nil, err
 	}
-	return &jmessage{M: method, P: bits}, nil
+	meta, err := c.marshalMeta(ctx, method)
+	if err != nil {
+		return nil, err
+	}
+	return &jmessage{V: c.version, M: method, P: bits, meta: meta}, nil
 }
 
 // send transmits the specified requests to the server and returns a slice of
@@ -201,8 +449,15 @@ func (c *Client) note(ctx context.Context, method string, params interface{}) (*
 //
 // This method blocks until the entire batch of requests has been transmitted.
 func (c *Client) send(ctx context.Context, reqs jmessages) ([]*Response, error) {
+	rsps, _, err := c.sendTrace(ctx, reqs)
+	return rsps, err
+}
+
+// sendTrace behaves as send, but also reports the encoded message passed to
+// the channel, if it got that far; otherwise the message is nil.
+func (c *Client) sendTrace(ctx context.Context, reqs jmessages) ([]*Response, []byte, error) {
 	if len(reqs) == 0 {
-		return nil, errors.New("empty request batch")
+		return nil, nil, errors.New("empty request batch")
 	}
 
 	// Marshal and prepare responses outside the lock. This may wind up being
@@ -210,44 +465,173 @@ func (c *Client) send(ctx context.Context, reqs jmessages) ([]*Response, error)
 	// on a closing path.
 	b, err := reqs.toJSON()
 	if err != nil {
-		return nil, Errorf(code.InternalError, "marshaling request failed: %v", err)
+		return nil, nil, Errorf(code.InternalError, "marshaling request failed: %v", err)
 	}
 
 	var pends []*Response
 	var pctxs []context.Context
 	for _, req := range reqs {
 		if id := string(req.ID); id != "" {
-			pctx, p := newPending(ctx, id)
+			pctx, p := newPending(ctx, id, req.M, req.ack)
+			p.internal = req.internal
 			pends = append(pends, p)
 			pctxs = append(pctxs, pctx)
 		}
 	}
 
+	// If there is a send hook, call it once the messages were sent. Messages
+	// the client sends on its own behalf are never batched with others, so
+	// the first message determines whether the hooks and limits apply.
+	internal := reqs[0].internal
+	var didSend bool
+	if c.osend != nil && !internal {
+		defer func() {
+			if !didSend {
+				return
+			}
+			for _, req := range reqs {
+				c.osend(req.M, len(req.ID) == 0, string(req.ID))
+			}
+		}()
+	}
+
 	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.err != nil {
-		return nil, c.err
+	if internal {
+		err = c.err // the client's own messages do not wait for room
+	} else {
+		err = c.waitForRoom(ctx, len(pends))
+	}
+	if err != nil {
+		c.mu.Unlock()
+		for _, p := range pends {
+			p.cancel()
+		}
+		return nil, nil, err
+	}
+
+	// Reject request IDs that would be ambiguous, either because a request
+	// with the same ID is already pending, or because it is repeated here.
+	seen := make(map[string]bool, len(pends))
+	for _, p := range pends {
+		if c.pending[p.id] != nil || seen[p.id] {
+			c.mu.Unlock()
+			for _, p := range pends {
+				p.cancel()
+			}
+			return nil, nil, errDuplicateID.WithData(p.id)
+		}
+		seen[p.id] = true
+	}
+
+	// Record the requests for which we are awaiting replies before sending
+	// them, since the replies may arrive before the send returns. If sending
+	// fails, they are removed again, so that an error in sending does not leave
+	// us with zombies that will never be fulfilled.
+	sent := time.Now()
+	for _, p := range pends {
+		p.sent = sent
+		c.pending[p.id] = p
 	}
+	ch := c.ch
+	c.mu.Unlock()
+
 	c.log("Outgoing batch: %s", string(b))
-	if err := c.ch.Send(b); err != nil {
-		return nil, err
+	if err := c.transmit(ctx, ch, b); err != nil {
+		c.mu.Lock()
+		for _, p := range pends {
+			if c.pending[p.id] == p {
+				delete(c.pending, p.id)
+			}
+			p.cancel()
+		}
+		c.signalRoom()
+		c.mu.Unlock()
+		return nil, b, err
 	}
+	didSend = true
 
-	// Now that we have sent them, record the requests for which we are awaiting
-	// replies. We do this after transmission so that an error in sending does
-	// not leave us with zombies that will never be fulfilled.
 	for i, p := range pends {
-		c.pending[p.id] = p
-		go c.waitComplete(pctxs[i], p.id, p)
+		go c.waitComplete(ctx, pctxs[i], p.id, p)
+	}
+	return pends, b, nil
+}
+
+// waitForRoom blocks until the client has room for n more pending requests,
+// or ctx ends, and reports an error if the client stopped or ctx ended first.
+// If the client has no MaxPending limit, or no requests are pending, there is
+// always room, so that a batch larger than the limit can still be sent. The
+// caller must hold c.mu, which is released while waiting.
+func (c *Client) waitForRoom(ctx context.Context, n int) error {
+	for {
+		if c.err != nil {
+			return c.err
+		} else if c.maxPend <= 0 || len(c.pending) == 0 || len(c.pending)+n <= c.maxPend {
+			return nil
+		}
+		if c.room == nil {
+			c.room = make(chan struct{})
+		}
+		room := c.room
+		c.mu.Unlock()
+		select {
+		case <-room:
+			c.mu.Lock()
+		case <-ctx.Done():
+			c.mu.Lock()
+			return ctx.Err()
+		}
+	}
+}
+
+// signalRoom wakes any callers waiting for room to send requests. The caller
+// must hold c.mu.
+func (c *Client) signalRoom() {
+	if c.room != nil {
+		close(c.room)
+		c.room = nil
+	}
+}
+
+// transmit sends b on ch, or gives up and reports an error if ctx ends before
+// the send completes. Writes to the channel are serialized, so that messages
+// are not interleaved. If ctx ends while b is being sent, the send continues
+// in the background, and later messages wait until it is finished.
+// The caller must not hold c.mu.
+func (c *Client) transmit(ctx context.Context, ch sender, b []byte) error {
+	select {
+	case c.sendq <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if ctx.Done() == nil {
+		defer func() { <-c.sendq }()
+		return ch.Send(b) // the send cannot be abandoned, so don't bother
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		defer func() { <-c.sendq }()
+		errc <- ch.Send(b)
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		select {
+		case err := <-errc:
+			return err // the send finished anyway; prefer its outcome
+		default:
+			return ctx.Err()
+		}
 	}
-	return pends, nil
 }
 
 // waitComplete waits for completion of the context governing p. When the
 // context ends, check whether the request is still in the pending set for the
 // client: If so, a reply has not yet been delivered.  Otherwise, the
-// cancellation is a no-op ("too late").
-func (c *Client) waitComplete(pctx context.Context, id string, p *Response) {
+// cancellation is a no-op ("too late"). The parent context of the call is
+// ctx, which distinguishes an acknowledgement timeout from the end of ctx.
+func (c *Client) waitComplete(ctx, pctx context.Context, id string, p *Response) {
 	<-pctx.Done()
 	cleanup := func() {}
 	c.mu.Lock()
@@ -256,17 +640,33 @@ func (c *Client) waitComplete(pctx context.Context, id string, p *Response) {
 		cleanup() // N.B. outside the lock
 	}()
 
-	if _, ok := c.pending[id]; !ok {
+	if c.pending[id] != p {
+		// Completing the response also ends pctx, so this was a cancellation
+		// only if pctx had already ended when the response was delivered.
+		if c.err == nil && p.late && !p.internal {
+			c.log("Context ended too late for id %q", id)
+			c.metrics.Count("rpc.cancel.tooLate", 1)
+			if c.always && c.chook != nil {
+				cleanup = func() {
+					c.log("Calling OnCancel for id %q", id)
+					c.chook(c, p)
+				}
+			}
+		}
 		return
 	}
 
 	err := pctx.Err()
 	c.log("Context ended for id %q, err=%v", id, err)
 	delete(c.pending, id)
+	c.signalRoom()
+	p.elapsed = time.Since(p.sent)
 
 	var jerr *Error
 	if c.err != nil && !isUninteresting(c.err) {
 		jerr = &Error{Code: code.InternalError, Message: c.err.Error()}
+	} else if err == context.DeadlineExceeded && ctx.Err() == nil {
+		jerr = errAckTimeout
 	} else if err != nil {
 		jerr = &Error{Code: code.FromError(err), Message: err.Error()}
 	}
@@ -277,7 +677,7 @@ func (c *Client) waitComplete(pctx context.Context, id string, p *Response) {
 	}
 
 	// If there is a cancellation hook, give it a chance to run.
-	if c.chook != nil {
+	if c.chook != nil && !p.internal {
 		cleanup = func() {
 			p.wait() // ensure the response has settled
 			c.log("Calling OnCancel for id %q", id)
@@ -297,8 +697,79 @@ func (c *Client) waitComplete(pctx context.Context, id string, p *Response) {
 //	   log.Fatalf("Call failed: %v", err)
 //	}
 //	handleValidResponse(rsp)
+//
+// If the client has a retry policy (see ClientOptions), a request that could
+// not be sent is retried as the policy permits.
 func (c *Client) Call(ctx context.Context, method string, params interface{}) (*Response, error) {
-	req, err := c.req(ctx, method, params)
+	return c.call(ctx, 0, method, params, nil)
+}
+
+// CallTrace behaves as Call, but also returns the exact request message that
+// the client sent to the server on its channel. This is useful for debugging,
+// or to reproduce a failing request outside the client. The message is
+// reported even if the call fails, provided the client attempted to send it;
+// if the call was retried, it is the message from the final attempt.
+func (c *Client) CallTrace(ctx context.Context, method string, params interface{}) (*Response, []byte, error) {
+	var msg []byte
+	rsp, err := c.call(ctx, 0, method, params, &msg)
+	return rsp, msg, err
+}
+
+// CallAck behaves as Call, but fails the call with ErrAckTimeout if its
+// response does not arrive within the acknowledgement timeout ack, even if
+// ctx has not ended. This is meant for channels that may lose messages. If the
+// client has a retry policy, a call that reports ErrAckTimeout is retried as
+// the policy permits, as for a request that could not be sent.
+//
+// A response that arrives after the call has failed is discarded. If ack <= 0,
+// CallAck is equivalent to Call.
+func (c *Client) CallAck(ctx context.Context, ack time.Duration, method string, params interface{}) (*Response, error) {
+	return c.call(ctx, ack, method, params, nil)
+}
+
+// call implements Call and its variants. If trace != nil, it is populated
+// with the last request message passed to the channel.
+func (c *Client) call(ctx context.Context, ack time.Duration, method string, params interface{}, trace *[]byte) (*Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := c.req(ctx, method, params)
+		if err != nil {
+			return nil, err
+		}
+		req.ack = ack
+		rsps, msg, err := c.sendTrace(ctx, jmessages{req})
+		if trace != nil && msg != nil {
+			*trace = msg
+		}
+		if err == nil {
+			var rsp *Response
+			rsp, err = c.waitCall(method, rsps[0])
+			if err != ErrAckTimeout {
+				return rsp, err
+			}
+		}
+		if !c.retry.retry(attempt, err) || c.LastError() != nil {
+			return nil, err
+		}
+		c.log("Retrying call to %q after error: %v", method, err)
+		if err := c.retry.wait(ctx, attempt+1); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// CallID behaves as Call, but sends the request with the given ID rather than
+// one assigned by the client. This allows the caller to reuse the same ID when
+// it retries a request, for example so that the server can detect duplicates.
+// The ID must be a JSON string or number.
+//
+// CallID reports an error without sending anything if a request with the
+// same ID is already pending on the client.
+func (c *Client) CallID(ctx context.Context, id json.RawMessage, method string, params interface{}) (*Response, error) {
+	key := json.RawMessage(compactJSON(id))
+	if len(key) == 0 || isNull(key) || !isValidID(key) {
+		return nil, &Error{Code: code.InvalidRequest, Message: "invalid request ID"}
+	}
+	req, err := c.reqWithID(ctx, key, method, params)
 	if err != nil {
 		return nil, err
 	}
@@ -306,11 +777,17 @@ func (c *Client) Call(ctx context.Context, method string, params interface{}) (*
 	if err != nil {
 		return nil, err
 	}
-	rsp[0].wait()
-	if err := rsp[0].Error(); err != nil {
+	return c.waitCall(method, rsp[0])
+}
+
+// waitCall blocks until rsp settles and reports the result of the call.
+func (c *Client) waitCall(method string, rsp *Response) (*Response, error) {
+	rsp.wait()
+	c.callDone(method, rsp)
+	if err := rsp.Error(); err != nil {
 		return nil, filterError(err)
 	}
-	return rsp[0], nil
+	return rsp, nil
 }
 
 // CallResult invokes Call with the given method and params. If it succeeds,
@@ -329,39 +806,245 @@ func (c *Client) CallResult(ctx context.Context, method string, params, result i
 // original specs, omitting notifications.
 //
 // Any error reported by Batch represents an error in encoding or sending the
-// batch to the server. Errors reported by the server in response to requests
-// must be recovered from the responses.
+// batch to the server. If a spec cannot be encoded, the error identifies the
+// offending spec by its index and method name, and wraps the underlying error.
+// Errors reported by the server in response to requests must be recovered
+// from the responses.
+//
+// If the client has the PartialBatch option set, a call spec that cannot be
+// encoded does not fail the batch: Instead, its response reports the error
+// with code InvalidParams (or the code of the error, if it has one), without
+// having been sent, and the rest of the batch is sent as usual.
 func (c *Client) Batch(ctx context.Context, specs []Spec) ([]*Response, error) {
-	reqs := make(jmessages, len(specs))
+	rsps, err := c.sendSpecs(ctx, specs)
+	if err != nil {
+		return nil, err
+	}
+	next := 0
+	for _, spec := range specs {
+		if spec.Notify {
+			continue
+		}
+		rsps[next].wait()
+		c.callDone(spec.Method, rsps[next])
+		next++
+	}
+	return rsps, nil
+}
+
+// BatchStream initiates a batch of concurrent requests as for Batch, but does
+// not wait for the responses. Instead, it returns a channel that delivers each
+// response as it arrives, in order of completion rather than the order of the
+// specs, and is closed once all the responses have been delivered. Use the ID
+// and Method of each response to correlate it with its request. If all the
+// specs are notifications, the channel is closed without delivering anything.
+//
+// An error reported by BatchStream is as for Batch, and if it occurs no
+// responses are delivered. The channel is buffered to hold all the responses,
+// so the caller may stop receiving from it early without blocking the client.
+func (c *Client) BatchStream(ctx context.Context, specs []Spec) (<-chan *Response, error) {
+	rsps, err := c.sendSpecs(ctx, specs)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan *Response, len(rsps))
+	var wg sync.WaitGroup
+	for _, rsp := range rsps {
+		rsp := rsp
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rsp.wait()
+			c.callDone(rsp.method, rsp)
+			out <- rsp
+		}()
+	}
+	go func() { wg.Wait(); close(out) }()
+	return out, nil
+}
+
+// sendSpecs constructs and sends the requests for a batch from specs, and
+// returns the pending responses for the calls, in order. If a spec cannot be
+// encoded, the error identifies it by index and method; but in PartialBatch
+// mode, a call that cannot be encoded gets a failed response instead.
+func (c *Client) sendSpecs(ctx context.Context, specs []Spec) ([]*Response, error) {
+	var reqs jmessages
+	var out []*Response // calls only; nil for those sent
 	for i, spec := range specs {
 		var req *jmessage
 		var err error
 		if spec.Notify {
 			req, err = c.note(ctx, spec.Method, spec.Params)
-		} else {
-			req, err = c.req(ctx, spec.Method, spec.Params)
+		} else if req, err = c.req(ctx, spec.Method, spec.Params); err == nil {
+			req.ack = spec.AckTimeout
 		}
-		if err != nil {
-			return nil, err
+		if err != nil && c.partial && !spec.Notify {
+			out = append(out, failedResponse(spec.Method, err, i))
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("spec %d (%q): %w", i, spec.Method, err)
+		}
+		reqs = append(reqs, req)
+		if !spec.Notify {
+			out = append(out, nil)
 		}
-		reqs[i] = req
 	}
-	rsps, err := c.send(ctx, reqs)
+	if len(reqs) == 0 {
+		return out, nil // every call failed, so there is nothing to send
+	}
+	rsps, err := c.sendBatch(ctx, reqs)
 	if err != nil {
 		return nil, err
 	}
-	for _, rsp := range rsps {
-		rsp.wait()
+	next := 0
+	for i, rsp := range out {
+		if rsp == nil {
+			out[i] = rsps[next]
+			next++
+		}
+	}
+	return out, nil
+}
+
+// failedResponse returns a completed response for a call to method that could
+// not be sent because constructing spec i of its batch failed with err.
+func failedResponse(method string, err error, i int) *Response {
+	jerr, ok := err.(*Error)
+	if !ok {
+		jerr = &Error{Code: code.InvalidParams, Message: fmt.Sprintf("spec %d (%q): %v", i, method, err)}
+	}
+	ch := make(chan *jmessage)
+	close(ch) // the response is already complete
+	return &Response{method: method, err: jerr, ch: ch, cancel: func() {}}
+}
+
+// BatchTimeout behaves as Batch, but bounds the time spent waiting for the
+// whole batch to d. If some responses have not arrived when d elapses, the
+// unfinished requests are abandoned and BatchTimeout returns the responses
+// received so far along with the unfinished ones, whose Error reports
+// code.DeadlineExceeded. If d <= 0, BatchTimeout is equivalent to Batch.
+//
+// An error reported by BatchTimeout is as for Batch, and may include the
+// expiration of the deadline before the batch was completely sent.
+func (c *Client) BatchTimeout(ctx context.Context, specs []Spec, d time.Duration) ([]*Response, error) {
+	if d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	return c.Batch(ctx, specs)
+}
+
+// sendBatch sends reqs as for c.send, but if the capabilities of the server
+// are known and reqs has more elements than the server accepts in a batch, it
+// sends them as a sequence of smaller batches.
+func (c *Client) sendBatch(ctx context.Context, reqs jmessages) ([]*Response, error) {
+	c.mu.Lock()
+	max := 0
+	if c.caps != nil {
+		max = c.caps.MaxBatchSize
+	}
+	c.mu.Unlock()
+	if max <= 0 || len(reqs) <= max {
+		return c.send(ctx, reqs)
+	}
+
+	var rsps []*Response
+	for len(reqs) != 0 {
+		n := max
+		if n > len(reqs) {
+			n = len(reqs)
+		}
+		next, err := c.send(ctx, reqs[:n])
+		if err != nil {
+			for _, rsp := range rsps {
+				rsp.cancel() // abandon the batches already sent
+			}
+			return nil, err
+		}
+		rsps = append(rsps, next...)
+		reqs = reqs[n:]
 	}
 	return rsps, nil
 }
 
+// callDone invokes the completion hook, if one is set, for a response that
+// has settled. The caller must not hold c.mu.
+func (c *Client) callDone(method string, rsp *Response) {
+	if c.cdone == nil {
+		return
+	}
+	var err error
+	if e := rsp.Error(); e != nil {
+		err = e
+	}
+	c.cdone(method, rsp.elapsed, err)
+}
+
 // A Spec combines a method name and parameter value as part of a Batch.  If
 // the Notify field is true, the request is sent as a notification.
 type Spec struct {
 	Method string
 	Params interface{}
 	Notify bool
+
+	// If positive, the response to this request fails with an error having
+	// code DeadlineExceeded if it does not arrive within this interval, even
+	// if the context of the batch has not ended (see Client.CallAck). This has
+	// no effect for a notification.
+	AckTimeout time.Duration
+}
+
+// A BatchBuilder accumulates the requests of a batch for a client. Use the
+// NewBatch method of a client to create one, and the Add and Notify methods to
+// add requests to it:
+//
+//	rsps, err := cli.NewBatch().
+//	   Add("Math.Add", []int{1, 2}).
+//	   Notify("Log.Record", msg).
+//	   Add("Math.Mul", []int{3, 4}).
+//	   Do(ctx)
+//
+// A BatchBuilder is not safe for concurrent use by multiple goroutines.
+type BatchBuilder struct {
+	c     *Client
+	specs []Spec
+}
+
+// NewBatch returns a new empty batch builder that sends its requests via c.
+func (c *Client) NewBatch() *BatchBuilder { return &BatchBuilder{c: c} }
+
+// Add adds a call to method with the given parameters to b, and returns b.
+func (b *BatchBuilder) Add(method string, params interface{}) *BatchBuilder {
+	b.specs = append(b.specs, Spec{Method: method, Params: params})
+	return b
+}
+
+// Notify adds a notification to method with the given parameters to b, and
+// returns b.
+func (b *BatchBuilder) Notify(method string, params interface{}) *BatchBuilder {
+	b.specs = append(b.specs, Spec{Method: method, Params: params, Notify: true})
+	return b
+}
+
+// Do sends the accumulated requests as a batch, and blocks until all the
+// responses return. Unlike Batch, the result has one entry for each request
+// added to b, in the order they were added, with a nil entry for each
+// notification. Errors are reported as for Batch.
+func (b *BatchBuilder) Do(ctx context.Context) ([]*Response, error) {
+	rsps, err := b.c.Batch(ctx, b.specs)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*Response, len(b.specs))
+	next := 0
+	for i, spec := range b.specs {
+		if !spec.Notify {
+			out[i] = rsps[next]
+			next++
+		}
+	}
+	return out, nil
 }
 
 // Notify transmits a notification to the specified method and parameters.  It
@@ -375,7 +1058,122 @@ func (c *Client) Notify(ctx context.Context, method string, params interface{})
 	return err
 }
 
+// NotifyReliable behaves as Notify, but if the channel reports an error in
+// sending the notification, it retries according to the retry policy of the
+// client (see ClientOptions.Retry), until the notification is sent, the policy
+// gives up, or ctx ends. If the client has no retry policy, it behaves as
+// Notify.
+//
+// A notification has no reply, so the only evidence that it was delivered is
+// that the channel accepted it. Once the channel accepts the notification,
+// NotifyReliable reports success and does not send it again. It retries only
+// after the channel reported an error for the send. Note, however, that a
+// channel may report an error after it has written part or all of the
+// message, so the server may receive the notification more than once: The
+// guarantee is "at least once", and the handler should tolerate duplicates.
+//
+// Some failures are reported without retrying: Errors that occur before the
+// notification reaches the channel, such as a failure to encode params or a
+// client that has stopped, and the end of ctx. If ctx ends while the channel
+// is sending the notification, the send continues in the background, so the
+// outcome is unknown; NotifyReliable reports the error from ctx, and it is up
+// to the caller whether to send the notification again.
+func (c *Client) NotifyReliable(ctx context.Context, method string, params interface{}) error {
+	req, err := c.note(ctx, method, params)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		_, msg, err := c.sendTrace(ctx, jmessages{req})
+		if err == nil {
+			return nil
+		} else if msg == nil || ctx.Err() != nil || !c.retry.retry(attempt, err) || c.LastError() != nil {
+			// The failure was not in the channel, or was ambiguous, or the
+			// policy does not allow another attempt.
+			return err
+		}
+		c.log("Retrying notification to %q after error: %v", method, err)
+		if err := c.retry.wait(ctx, attempt+1); err != nil {
+			return err
+		}
+	}
+}
+
+// PendingInfo describes a request awaiting a response from the server, as
+// reported by Client.PendingIDs.
+type PendingInfo struct {
+	ID     string    // the request ID
+	Method string    // the method name of the request
+	Sent   time.Time // when the request was sent
+}
+
+// PendingIDs reports the requests issued by c that are still awaiting a
+// response from the server, in the order they were sent. This is meant for
+// diagnosing calls that the server has not answered.
+func (c *Client) PendingIDs() []PendingInfo {
+	c.mu.Lock()
+	out := make([]PendingInfo, 0, len(c.pending))
+	for id, p := range c.pending {
+		out = append(out, PendingInfo{ID: id, Method: p.method, Sent: p.sent})
+	}
+	c.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Sent.Equal(out[j].Sent) {
+			return out[i].ID < out[j].ID
+		}
+		return out[i].Sent.Before(out[j].Sent)
+	})
+	return out
+}
+
+// CancelAll fails all the requests pending on c, without stopping the client
+// or closing its channel, so that the client remains usable for new calls.
+// Each pending call reports err, or context.Canceled if err == nil. If err
+// is not a *jrpc2.Error, the error delivered has the code reported by
+// code.FromError, or code.Cancelled if err has no code.
+//
+// If an OnCancel hook is set, it is called for each request that was failed,
+// for example to notify the server that its result is no longer wanted.  A
+// reply that arrives later for a cancelled request is discarded.
+func (c *Client) CancelAll(err error) {
+	if err == nil {
+		err = context.Canceled
+	}
+	jerr, ok := err.(*Error)
+	if !ok {
+		ec := code.FromError(err)
+		if ec == code.NoError {
+			ec = code.Cancelled
+		}
+		jerr = &Error{Code: ec, Message: err.Error()}
+	}
+
+	c.mu.Lock()
+	var failed []*Response
+	for id, p := range c.pending {
+		delete(c.pending, id)
+		delete(c.pendSub, id)
+		p.elapsed = time.Since(p.sent)
+		p.ch <- &jmessage{ID: json.RawMessage(id), E: jerr}
+		failed = append(failed, p)
+	}
+	c.signalRoom()
+	c.mu.Unlock()
+	c.log("Cancelled %d pending requests: %v", len(failed), err)
+
+	for _, p := range failed {
+		p.wait() // ensure the response has settled, and release its context
+		if c.chook != nil {
+			c.chook(c, p)
+		}
+	}
+}
+
 // Close shuts down the client, terminating any pending in-flight requests.
+// Close does not wait for messages that are still being sent: It closes the
+// channel, which interrupts a send blocked on a peer that has stopped reading,
+// and the call or notification that was sending it reports an error.
 func (c *Client) Close() error {
 	c.mu.Lock()
 	c.stop(errClientStopped)
@@ -389,6 +1187,17 @@ func (c *Client) Close() error {
 	return c.err
 }
 
+// LastError reports the error that caused the client to stop, or nil if the
+// client is still running. If the client stopped because the server sent a
+// message that could not be decoded, the error has code code.ParseError;
+// otherwise it reports the failure from the channel, such as io.EOF when the
+// server closed the connection.
+func (c *Client) LastError() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
 func isUninteresting(err error) bool {
 	return err == io.EOF || channel.IsErrClosing(err) || err == errClientStopped
 }
@@ -410,18 +1219,47 @@ func (c *Client) stop(err error) {
 		p.cancel()
 	}
 
+	// Terminate any active subscriptions.
+	for key, sub := range c.subs {
+		sub.shutdown()
+		delete(c.subs, key)
+	}
+
 	c.err = err
 	c.ch = nil
 }
 
+// checkMethod reports an error if method is empty, or is rejected by the
+// ValidMethod option of the client.
+func (c *Client) checkMethod(method string) error {
+	if method == "" {
+		return errEmptyMethod
+	} else if c.vname != nil && !c.vname(method) {
+		return errInvalidMethod.WithData(method)
+	}
+	return nil
+}
+
 // marshalParams validates and marshals params to JSON for a request.  The
 // value of params must be either nil or encodable as a JSON object or array.
+// If params implements ParamsMarshaler, its encoding is used instead of the
+// one produced by json.Marshal.
 func (c *Client) marshalParams(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
 	if params == nil {
 		return nil, nil // no parameters, that is OK
 	}
-	pbits, err := json.Marshal(params)
-	if err != nil {
+	var pbits []byte
+	var err error
+	if pm, ok := params.(ParamsMarshaler); ok {
+		pbits, err = pm.MarshalParams()
+		if err != nil {
+			return nil, err
+		} else if len(pbits) == 0 {
+			return nil, nil
+		} else if !json.Valid(pbits) {
+			return nil, &Error{Code: code.InvalidRequest, Message: "invalid parameters: not valid JSON"}
+		}
+	} else if pbits, err = json.Marshal(params); err != nil {
 		return nil, err
 	}
 	if fb := firstByte(pbits); fb != '[' && fb != '{' && !isNull(pbits) {
@@ -432,13 +1270,37 @@ func (c *Client) marshalParams(ctx context.Context, method string, params interf
 	return pbits, nil
 }
 
-func newPending(ctx context.Context, id string) (context.Context, *Response) {
+// marshalMeta returns the request metadata for a call of method, or nil if
+// the client has no metadata encoder.
+func (c *Client) marshalMeta(ctx context.Context, method string) (json.RawMessage, error) {
+	if c.emeta == nil {
+		return nil, nil
+	}
+	meta, err := c.emeta(ctx, method)
+	if err != nil {
+		return nil, err
+	} else if len(meta) == 0 || isNull(meta) {
+		return nil, nil
+	} else if firstByte(meta) != '{' {
+		return nil, &Error{Code: code.InvalidRequest, Message: "invalid request metadata: object required"}
+	} else if !json.Valid(meta) {
+		return nil, &Error{Code: code.InvalidRequest, Message: "invalid request metadata: not valid JSON"}
+	}
+	return meta, nil
+}
+
+func newPending(ctx context.Context, id, method string, ack time.Duration) (context.Context, *Response) {
 	// Buffer the channel so the response reader does not need to rendezvous
 	// with the recipient.
 	pctx, cancel := context.WithCancel(ctx)
+	if ack > 0 {
+		pctx, cancel = context.WithTimeout(ctx, ack)
+	}
 	return pctx, &Response{
 		ch:     make(chan *jmessage, 1),
 		id:     id,
+		method: method,
+		pctx:   pctx,
 		cancel: cancel,
 	}
 }
@@ -69,10 +69,11 @@ const (
 	InvalidParams  Code = -32602 // [std] Invalid method parameters
 	InternalError  Code = -32603 // [std] Internal JSON-RPC error
 
-	NoError          Code = -32099 // Denotes a nil error (used by FromError)
-	SystemError      Code = -32098 // Errors from the operating environment
-	Cancelled        Code = -32097 // Request cancelled (context.Canceled)
-	DeadlineExceeded Code = -32096 // Request deadline exceeded (context.DeadlineExceeded)
+	NoError           Code = -32099 // Denotes a nil error (used by FromError)
+	SystemError       Code = -32098 // Errors from the operating environment
+	Cancelled         Code = -32097 // Request cancelled (context.Canceled)
+	DeadlineExceeded  Code = -32096 // Request deadline exceeded (context.DeadlineExceeded)
+	ServerUnavailable Code = -32095 // Server is shutting down (the request may be retried)
 )
 
 var stdError = map[Code]string{
@@ -82,10 +83,11 @@ var stdError = map[Code]string{
 	InvalidParams:  "invalid parameters",
 	InternalError:  "internal error",
 
-	NoError:          "no error (success)",
-	SystemError:      "system error",
-	Cancelled:        "request cancelled",
-	DeadlineExceeded: "deadline exceeded",
+	NoError:           "no error (success)",
+	SystemError:       "system error",
+	Cancelled:         "request cancelled",
+	DeadlineExceeded:  "deadline exceeded",
+	ServerUnavailable: "server unavailable",
 }
 
 // Register adds a new Code value with the specified message string.  This
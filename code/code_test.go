@@ -105,7 +105,7 @@ func TestErr(t *testing.T) {
 		// Codes reserved by the JSON-RPC 2.0 spec.
 		-32700, -32600, -32601, -32602, -32603,
 		// Codes reserved by this implementation.
-		-32098, -32097, -32096,
+		-32098, -32097, -32096, -32095,
 	} {
 		c := code.Code(v)
 		tests = append(tests, test{
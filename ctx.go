@@ -4,6 +4,8 @@ package jrpc2
 
 import (
 	"context"
+	"fmt"
+	"time"
 )
 
 // InboundRequest returns the inbound request associated with the given
@@ -23,6 +25,54 @@ func InboundRequest(ctx context.Context) *Request {
 
 type inboundRequestKey struct{}
 
+// InboundBatch returns all the requests of the batch containing the inbound
+// request associated with the given context, in order of arrival. It returns
+// nil if ctx does not have an inbound request, or if the request was not sent
+// as part of a batch. The context passed to the handler by *jrpc2.Server will
+// include this value for each request in a batch.
+//
+// The requests in the batch are handled concurrently, so a handler that uses
+// this to coordinate with the other elements of its batch must synchronize
+// with them explicitly. The caller must not modify the slice or its contents.
+func InboundBatch(ctx context.Context) []*Request {
+	if v := ctx.Value(inboundBatchKey{}); v != nil {
+		return v.([]*Request)
+	}
+	return nil
+}
+
+type inboundBatchKey struct{}
+
+// WithPrincipal returns a copy of ctx that carries the given principal, the
+// authenticated identity of a client. It is intended for use by the function
+// set as ServerOptions.Authenticate, so that the principal is available to the
+// handlers of all the requests the server receives.
+func WithPrincipal(ctx context.Context, principal interface{}) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// Principal returns the principal attached to ctx by WithPrincipal, or nil if
+// ctx does not carry a principal.
+func Principal(ctx context.Context) interface{} { return ctx.Value(principalKey{}) }
+
+type principalKey struct{}
+
+// TimeRemaining reports how long remains until the deadline of ctx, and
+// whether ctx has a deadline. If the deadline has passed, the duration is
+// negative. A handler may use this to size its own sub-operations.
+//
+// The deadline of a handler context reflects any timeout set by the server,
+// such as ServerOptions.HandlerTimeout, as well as any deadline carried by
+// the client, for example in request metadata decoded by
+// ServerOptions.DecodeMeta.
+func TimeRemaining(ctx context.Context) (time.Duration, bool) {
+	dl, ok := ctx.Deadline()
+	if !ok {
+		return 0, false
+	}
+	return time.Until(dl), true
+}
+
 // ServerFromContext returns the server associated with the given context.
 // This will be populated on the context passed to request handlers.
 // This function is for use by handlers, and will panic for a non-handler context.
@@ -35,6 +85,56 @@ func ServerFromContext(ctx context.Context) *Server { return ctx.Value(serverKey
 
 type serverKey struct{}
 
+// LocalAssigner returns the assigner of the server associated with the given
+// context, or nil if ctx is not a handler context. A handler may use it to
+// look up a sibling method and invoke it directly, without a round trip:
+//
+//	if h := jrpc2.LocalAssigner(ctx).Assign(ctx, "Sibling"); h != nil {
+//	   result, err := h.Handle(ctx, req)
+//	   // ...
+//	}
+//
+// A direct invocation bypasses the server: It runs in the goroutine of the
+// calling handler, and does not count against the Concurrency limit of the
+// server, so it cannot deadlock waiting for a free slot. It is not recorded
+// in the server logs or metrics, its result is not encoded or transformed,
+// and the built-in rpc.* methods are not available. The context passed to
+// the sibling is whatever the caller passes, so InboundRequest reports the
+// request of the calling handler unless the caller arranges otherwise.
+func LocalAssigner(ctx context.Context) Assigner {
+	if s, ok := ctx.Value(serverKey{}).(*Server); ok {
+		return s.mux
+	}
+	return nil
+}
+
+// Logf writes a formatted message to the Logger of the server associated with
+// ctx, prefixed with the method name and ID of the inbound request, if ctx has
+// one. If ctx is not a handler context, or the server has no Logger, the
+// message is discarded. This allows a handler to write log messages that can
+// be correlated with its request without plumbing a logger through.
+//
+// For example, in a handler for a call to "Sum" with ID 5,
+//
+//	jrpc2.Logf(ctx, "adding %d values", len(vals))
+//
+// logs "[Sum id=5] adding 3 values". For a notification, the ID is omitted.
+func Logf(ctx context.Context, msg string, args ...interface{}) {
+	s, ok := ctx.Value(serverKey{}).(*Server)
+	if !ok {
+		return
+	}
+	text := fmt.Sprintf(msg, args...)
+	if req := InboundRequest(ctx); req == nil {
+		// no request, no prefix
+	} else if req.IsNotification() {
+		text = fmt.Sprintf("[%s] %s", req.method, text)
+	} else {
+		text = fmt.Sprintf("[%s id=%s] %s", req.method, req.ID(), text)
+	}
+	s.log("%s", text)
+}
+
 // ClientFromContext returns the client associated with the given context.
 // This will be populated on the context passed to callback handlers.
 //
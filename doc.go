@@ -239,5 +239,7 @@ a client response that will never arrive.
 package jrpc2
 
 // Version is the version string for the JSON-RPC protocol understood by this
-// implementation, defined at http://www.jsonrpc.org/specification.
+// implementation, defined at http://www.jsonrpc.org/specification.  Clients
+// and servers use this version by default (see ClientOptions.Version and
+// ServerOptions.Version).
 const Version = "2.0"
@@ -6,6 +6,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/creachadair/jrpc2/code"
 )
@@ -43,9 +45,17 @@ var errServerStopped = errors.New("the server has been stopped")
 // explicit call to its Close method.
 var errClientStopped = errors.New("the client has been stopped")
 
+// errAutoAccept is reported by Client.Accept when the client runs its own
+// reader goroutine.
+var errAutoAccept = errors.New("client does not use manual accept")
+
 // errEmptyMethod is the error reported for an empty request method name.
 var errEmptyMethod = &Error{Code: code.InvalidRequest, Message: "empty method name"}
 
+// errInvalidMethod is the error reported by a client for a method name that
+// its ValidMethod option rejects.
+var errInvalidMethod = &Error{Code: code.InvalidRequest, Message: "invalid method name"}
+
 // errNoSuchMethod is the error reported for an unknown method name.
 var errNoSuchMethod = &Error{Code: code.MethodNotFound, Message: code.MethodNotFound.String()}
 
@@ -58,12 +68,36 @@ var errInvalidRequest = &Error{Code: code.ParseError, Message: "invalid request
 // errEmptyBatch is the error reported for an empty request batch.
 var errEmptyBatch = &Error{Code: code.InvalidRequest, Message: "empty request batch"}
 
+// errBatchDisabled is the error reported for a batch sent to a server that
+// does not accept batches.
+var errBatchDisabled = &Error{Code: code.InvalidRequest, Message: "batch requests are not supported"}
+
+// errBatchTooLarge is the error reported for a batch having more elements than
+// the server permits.
+var errBatchTooLarge = &Error{Code: code.InvalidRequest, Message: "request batch is too large"}
+
+// errRequestTooLarge is the error reported for a request message longer than
+// the server permits.
+var errRequestTooLarge = &Error{Code: code.InvalidRequest, Message: "request message is too large"}
+
+// errServerUnavailable is the error reported for a request received while the
+// server is shutting down.
+var errServerUnavailable = &Error{Code: code.ServerUnavailable, Message: "server is shutting down"}
+
 // errInvalidParams is the error reported for invalid request parameters.
 var errInvalidParams = &Error{Code: code.InvalidParams, Message: code.InvalidParams.String()}
 
 // errTaskNotExecuted is the internal sentinel error for an unassigned task.
 var errTaskNotExecuted = new(Error)
 
+// ErrAckTimeout is reported by a call whose response did not arrive within its
+// acknowledgement timeout (see Spec.AckTimeout). Unlike the error for a call
+// whose context ended, this error may be retried by a client RetryPolicy.
+var ErrAckTimeout = errors.New("no response within the acknowledgement timeout")
+
+// errAckTimeout is the response error for a request that reports ErrAckTimeout.
+var errAckTimeout = &Error{Code: code.DeadlineExceeded, Message: ErrAckTimeout.Error()}
+
 // ErrConnClosed is returned by a server's push-to-client methods if they are
 // called after the client connection is closed.
 var ErrConnClosed = errors.New("client connection is closed")
@@ -73,3 +107,76 @@ var ErrConnClosed = errors.New("client connection is closed")
 func Errorf(code code.Code, msg string, args ...interface{}) *Error {
 	return &Error{Code: code, Message: fmt.Sprintf(msg, args...)}
 }
+
+// truncateData returns a replacement for error data longer than max bytes.
+// If data is a JSON string, the result is a prefix of the string marked as
+// truncated, and fits within max if possible. Otherwise, the result is an
+// object that records the original size of data.
+func truncateData(data json.RawMessage, max int) json.RawMessage {
+	const mark = "...(truncated)"
+	var s string
+	if firstByte(data) == '"' && json.Unmarshal(data, &s) == nil {
+		n := max - len(mark) - 2 // allow for the quotes
+		if n > len(s) {
+			n = len(s)
+		}
+		for n > 0 {
+			// Back up to the start of a UTF-8 sequence.
+			for n > 0 && n < len(s) && !utf8.RuneStart(s[n]) {
+				n--
+			}
+			out, err := json.Marshal(s[:n] + mark)
+			if err != nil {
+				break
+			} else if len(out) <= max {
+				return out
+			}
+			// Escapes made the result longer than the prefix. Each input byte
+			// encodes as at most 6 bytes, so this does not remove too much.
+			n -= (len(out) - max + 5) / 6
+		}
+	}
+	return json.RawMessage(fmt.Sprintf(`{"truncated":true,"size":%d}`, len(data)))
+}
+
+// fromJoinedError converts an error that aggregates other errors into a
+// single *Error, as described for the Handler interface. It reports false if
+// err does not aggregate errors.
+func fromJoinedError(err error) (*Error, bool) {
+	j, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return nil, false
+	}
+	best, bestRank := code.InternalError, -1
+	var msgs []string
+	for _, e := range j.Unwrap() {
+		if e == nil {
+			continue
+		}
+		if je, ok := e.(*Error); ok {
+			msgs = append(msgs, je.Message) // the code is reported separately
+		} else {
+			msgs = append(msgs, e.Error())
+		}
+		var c code.ErrCoder
+		if !errors.As(e, &c) {
+			continue
+		}
+		if r := codeSeverity(c.ErrCode()); r > bestRank {
+			best, bestRank = c.ErrCode(), r
+		}
+	}
+	return &Error{Code: best, Message: strings.Join(msgs, "; ")}, true
+}
+
+// codeSeverity ranks the severity of c for fromJoinedError: higher values
+// are more severe.
+func codeSeverity(c code.Code) int {
+	switch {
+	case c == code.InternalError || c == code.SystemError:
+		return 2
+	case c >= -32768 && c <= -32000:
+		return 1
+	}
+	return 0
+}
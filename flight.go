@@ -0,0 +1,96 @@
+// Copyright (C) 2026 Michael J. Fromberger. All Rights Reserved.
+
+package jrpc2
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// A flightGroup coalesces concurrent calls that share a key, so that a single
+// execution serves all of them (see ServerOptions.SingleFlight).
+type flightGroup struct {
+	mu sync.Mutex
+	m  map[string]*flight // :: key ⇒ the execution in progress for key
+}
+
+// A flight is a single execution shared by one or more callers.
+type flight struct {
+	done   chan struct{}      // closed when the execution is complete
+	cancel context.CancelFunc // cancels the context of the execution
+	nwait  int                // callers still waiting; guarded by flightGroup.mu
+
+	// The results of the execution, valid once done is closed.
+	val json.RawMessage
+	ext map[string]json.RawMessage
+	err error
+}
+
+type flightFunc func(context.Context) (json.RawMessage, map[string]json.RawMessage, error)
+
+// do calls run, or joins an execution of run already in progress for key, and
+// reports its results. The first caller for key starts the execution, with a
+// context that carries the values of ctx. That context does not end when ctx
+// does, but only once every caller waiting for the result has given up.  Each
+// caller stops waiting when its own ctx ends, and reports ctx.Err(). The last
+// caller to give up cancels the execution and waits for run to return, so that
+// the execution does not outlive every request that depends on it.
+func (g *flightGroup) do(ctx context.Context, key string, run flightFunc) (json.RawMessage, map[string]json.RawMessage, error) {
+	g.mu.Lock()
+	f := g.m[key]
+	if f == nil {
+		fctx, cancel := context.WithCancel(detached{ctx})
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		g.m[key] = f
+		go func() {
+			defer close(f.done)
+			f.val, f.ext, f.err = run(fctx)
+			cancel()
+			g.release(key, f)
+		}()
+	}
+	f.nwait++
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.val, f.ext, f.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		f.nwait--
+		if f.nwait == 0 {
+			// Nobody is waiting for the result any more, so abandon it and let
+			// a later caller start afresh.
+			f.cancel()
+			g.releaseLocked(key, f)
+			g.mu.Unlock()
+			<-f.done
+			return nil, nil, ctx.Err()
+		}
+		g.mu.Unlock()
+		return nil, nil, ctx.Err()
+	}
+}
+
+func (g *flightGroup) release(key string, f *flight) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.releaseLocked(key, f)
+}
+
+func (g *flightGroup) releaseLocked(key string, f *flight) {
+	if g.m[key] == f {
+		delete(g.m, key)
+	}
+}
+
+// detached is a context that carries the values of its parent, but not its
+// deadline or cancellation.
+type detached struct{ parent context.Context }
+
+func (detached) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detached) Done() <-chan struct{}               { return nil }
+func (detached) Err() error                          { return nil }
+func (d detached) Value(key interface{}) interface{} { return d.parent.Value(key) }
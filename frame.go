@@ -0,0 +1,58 @@
+// Copyright (C) 2026 Michael J. Fromberger. All Rights Reserved.
+
+package jrpc2
+
+import "github.com/creachadair/jrpc2/channel"
+
+// A Direction identifies whether a frame observed by an OnFrame hook was sent
+// or received by the client or server that reports it.
+type Direction int
+
+const (
+	Outbound Direction = iota // the frame was sent to the peer
+	Inbound                   // the frame was received from the peer
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Outbound:
+		return "outbound"
+	case Inbound:
+		return "inbound"
+	}
+	return "unknown"
+}
+
+// tapFrames wraps ch so that each message sent or successfully received
+// through it is reported to f, with a copy of its contents. Outbound messages
+// are reported before they are sent, so that a reply cannot be reported ahead
+// of the message that provoked it.
+func tapFrames(ch channel.Channel, f func(Direction, []byte)) channel.Channel {
+	if f == nil {
+		return ch
+	}
+	return frameTap{ch: ch, f: f}
+}
+
+type frameTap struct {
+	ch channel.Channel
+	f  func(Direction, []byte)
+}
+
+// Send implements part of channel.Channel.
+func (t frameTap) Send(msg []byte) error {
+	t.f(Outbound, append([]byte(nil), msg...))
+	return t.ch.Send(msg)
+}
+
+// Recv implements part of channel.Channel.
+func (t frameTap) Recv() ([]byte, error) {
+	msg, err := t.ch.Recv()
+	if err == nil {
+		t.f(Inbound, append([]byte(nil), msg...))
+	}
+	return msg, err
+}
+
+// Close implements part of channel.Channel.
+func (t frameTap) Close() error { return t.ch.Close() }
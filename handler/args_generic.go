@@ -0,0 +1,66 @@
+// Copyright (C) 2026 Michael J. Fromberger. All Rights Reserved.
+
+package handler
+
+import "encoding/json"
+
+// Args2 is a typed wrapper that decodes an array of exactly two positional
+// parameters into its fields, as for Args{&v.A, &v.B}. It marshals as a JSON
+// array of its field values.
+//
+// Usage example:
+//
+//	var args handler.Args2[string, int]
+//	if err := req.UnmarshalParams(&args); err != nil {
+//	   return nil, err
+//	}
+//	// do useful work with args.A and args.B
+type Args2[A, B any] struct {
+	A A
+	B B
+}
+
+// UnmarshalJSON supports JSON unmarshaling for a.
+func (a *Args2[A, B]) UnmarshalJSON(data []byte) error {
+	return Args{&a.A, &a.B}.UnmarshalJSON(data)
+}
+
+// MarshalJSON supports JSON marshaling for a.
+func (a Args2[A, B]) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{a.A, a.B})
+}
+
+// Args3 is a typed wrapper for three positional parameters (see Args2).
+type Args3[A, B, C any] struct {
+	A A
+	B B
+	C C
+}
+
+// UnmarshalJSON supports JSON unmarshaling for a.
+func (a *Args3[A, B, C]) UnmarshalJSON(data []byte) error {
+	return Args{&a.A, &a.B, &a.C}.UnmarshalJSON(data)
+}
+
+// MarshalJSON supports JSON marshaling for a.
+func (a Args3[A, B, C]) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{a.A, a.B, a.C})
+}
+
+// Args4 is a typed wrapper for four positional parameters (see Args2).
+type Args4[A, B, C, D any] struct {
+	A A
+	B B
+	C C
+	D D
+}
+
+// UnmarshalJSON supports JSON unmarshaling for a.
+func (a *Args4[A, B, C, D]) UnmarshalJSON(data []byte) error {
+	return Args{&a.A, &a.B, &a.C, &a.D}.UnmarshalJSON(data)
+}
+
+// MarshalJSON supports JSON marshaling for a.
+func (a Args4[A, B, C, D]) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{a.A, a.B, a.C, a.D})
+}
@@ -0,0 +1,65 @@
+// Copyright (C) 2026 Michael J. Fromberger. All Rights Reserved.
+
+package handler_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/creachadair/jrpc2/handler"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestArgsN(t *testing.T) {
+	t.Run("Args2", func(t *testing.T) {
+		var got handler.Args2[string, int]
+		if err := json.Unmarshal([]byte(`["foo", 25]`), &got); err != nil {
+			t.Fatalf("Unmarshal failed: %v", err)
+		}
+		if diff := cmp.Diff(handler.Args2[string, int]{A: "foo", B: 25}, got); diff != "" {
+			t.Errorf("Unmarshal result: (-want, +got)\n%s", diff)
+		}
+		if bits, err := json.Marshal(got); err != nil {
+			t.Errorf("Marshal failed: %v", err)
+		} else if s := string(bits); s != `["foo",25]` {
+			t.Errorf("Marshal: got %#q, want %#q", s, `["foo",25]`)
+		}
+	})
+	t.Run("Args3", func(t *testing.T) {
+		var got handler.Args3[bool, []int, string]
+		if err := json.Unmarshal([]byte(`[true, [1, 2], "x"]`), &got); err != nil {
+			t.Fatalf("Unmarshal failed: %v", err)
+		}
+		want := handler.Args3[bool, []int, string]{A: true, B: []int{1, 2}, C: "x"}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Unmarshal result: (-want, +got)\n%s", diff)
+		}
+	})
+	t.Run("Args4", func(t *testing.T) {
+		var got handler.Args4[int, int, int, float64]
+		if err := json.Unmarshal([]byte(`[1, 2, 3, 4.5]`), &got); err != nil {
+			t.Fatalf("Unmarshal failed: %v", err)
+		}
+		if diff := cmp.Diff(handler.Args4[int, int, int, float64]{1, 2, 3, 4.5}, got); diff != "" {
+			t.Errorf("Unmarshal result: (-want, +got)\n%s", diff)
+		}
+		if bits, err := json.Marshal(got); err != nil {
+			t.Errorf("Marshal failed: %v", err)
+		} else if s := string(bits); s != `[1,2,3,4.5]` {
+			t.Errorf("Marshal: got %#q, want %#q", s, `[1,2,3,4.5]`)
+		}
+	})
+	t.Run("Errors", func(t *testing.T) {
+		var a2 handler.Args2[string, int]
+		for _, input := range []string{
+			`["too few"]`,
+			`["too", 1, "many"]`,
+			`[1, "wrong types"]`,
+			`{"not": "an array"}`,
+		} {
+			if err := json.Unmarshal([]byte(input), &a2); err == nil {
+				t.Errorf("Unmarshal %#q: got %+v, want error", input, a2)
+			}
+		}
+	})
+}
@@ -9,9 +9,13 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/creachadair/jrpc2"
 	"github.com/creachadair/jrpc2/code"
@@ -42,6 +46,163 @@ func (m Map) Names() []string {
 	return names
 }
 
+// A Mutable is an implementation of the jrpc2.Assigner interface whose set
+// of methods may be changed while a server is using it. A zero Mutable has no
+// methods and is ready for use. It is safe for concurrent use by multiple
+// goroutines, but must not be copied after first use.
+//
+// Changes to the method set do not affect requests that have already been
+// assigned a handler.
+type Mutable struct {
+	mu sync.RWMutex
+	m  Map
+}
+
+// Register adds h to m as the handler for the method name, replacing any
+// handler previously registered for that name. If h == nil, Register is
+// equivalent to Unregister.
+func (m *Mutable) Register(name string, h jrpc2.Handler) {
+	if h == nil {
+		m.Unregister(name)
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.m == nil {
+		m.m = make(Map)
+	}
+	m.m[name] = h
+}
+
+// Unregister removes the handler for the method name from m, if any.
+func (m *Mutable) Unregister(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.m, name)
+}
+
+// Assign implements part of the jrpc2.Assigner interface.
+func (m *Mutable) Assign(ctx context.Context, method string) jrpc2.Handler {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.m.Assign(ctx, method)
+}
+
+// Names implements the optional jrpc2.Namer extension interface.
+func (m *Mutable) Names() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.m.Names()
+}
+
+// Fallback returns an assigner that looks up methods in primary, and assigns
+// any method that primary does not handle to fallback. The fallback handler
+// can recover the original method name from its request, which makes it
+// suitable for a catch-all that forwards unknown methods elsewhere:
+//
+//	mux := handler.Fallback(handler.Map{...}, handler.Func(
+//	   func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+//	      return forward(ctx, req.Method(), req)
+//	   }))
+//
+// If primary implements jrpc2.Namer, so does the result, reporting the names
+// of primary.
+func Fallback(primary jrpc2.Assigner, fallback jrpc2.Handler) jrpc2.Assigner {
+	return fallbackAssigner{primary: primary, fallback: fallback}
+}
+
+type fallbackAssigner struct {
+	primary  jrpc2.Assigner
+	fallback jrpc2.Handler
+}
+
+// Assign implements part of the jrpc2.Assigner interface.
+func (f fallbackAssigner) Assign(ctx context.Context, method string) jrpc2.Handler {
+	if h := f.primary.Assign(ctx, method); h != nil {
+		return h
+	}
+	return f.fallback
+}
+
+// Names implements the optional jrpc2.Namer extension interface.
+func (f fallbackAssigner) Names() []string {
+	if n, ok := f.primary.(jrpc2.Namer); ok {
+		return n.Names()
+	}
+	return nil
+}
+
+// NotifyOnly returns a handler that delegates notifications to h, and rejects
+// any call (that is, a request having an ID) with code.InvalidRequest. This is
+// useful for event-sink methods, where a call indicates a bug in the client.
+func NotifyOnly(h jrpc2.Handler) jrpc2.Handler {
+	return Func(func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+		if !req.IsNotification() {
+			return nil, jrpc2.Errorf(code.InvalidRequest, "method %q accepts only notifications", req.Method())
+		}
+		return h.Handle(ctx, req)
+	})
+}
+
+// CallOnly returns a handler that delegates calls to h, and does not run h for
+// a notification, since the client of a method that must return a result
+// will not get one. This is the converse of NotifyOnly. Because the server
+// cannot reply to a notification, the notification is dropped; if onNotify is
+// not nil, it is called with the request first, for example to log it.
+func CallOnly(h jrpc2.Handler, onNotify func(*jrpc2.Request)) jrpc2.Handler {
+	return Func(func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+		if req.IsNotification() {
+			if onNotify != nil {
+				onNotify(req)
+			}
+			return nil, nil
+		}
+		return h.Handle(ctx, req)
+	})
+}
+
+// WithDefaultParams returns a handler that delegates to h, but substitutes
+// params for the parameters of any request that has none, so that h decodes
+// the default value as if the client had sent it. Requests that include
+// parameters, even an empty array or object, are passed through unmodified.
+// The request reported by jrpc2.InboundRequest is not affected.
+//
+// WithDefaultParams will panic if params is not a JSON array or object.
+func WithDefaultParams(h jrpc2.Handler, params json.RawMessage) jrpc2.Handler {
+	if fb := firstByte(params); (fb != '[' && fb != '{') || !json.Valid(params) {
+		panic("handler: default parameters must be a JSON array or object")
+	}
+	def := append(json.RawMessage(nil), params...)
+	return Func(func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+		if !req.HasParams() {
+			req = (&jrpc2.ParsedRequest{
+				ID:     req.ID(),
+				Method: req.Method(),
+				Params: def,
+			}).ToRequest()
+		}
+		return h.Handle(ctx, req)
+	})
+}
+
+// Cacheable returns a handler that delegates to h, and marks its results as
+// cacheable by the server for up to ttl (see jrpc2.ServerOptions.Cache). It
+// will panic if ttl <= 0. A server without a cache ignores the marker.
+func Cacheable(h jrpc2.Handler, ttl time.Duration) jrpc2.Handler {
+	if ttl <= 0 {
+		panic("handler: cache TTL must be positive")
+	}
+	return cacheable{Handler: h, ttl: ttl}
+}
+
+type cacheable struct {
+	jrpc2.Handler
+	ttl time.Duration
+}
+
+// CacheTTL reports the lifetime of the cached results of c.
+func (c cacheable) CacheTTL() time.Duration { return c.ttl }
+
 // A ServiceMap combines multiple assigners into one, permitting a server to
 // export multiple services under different names.
 type ServiceMap map[string]jrpc2.Assigner
@@ -78,6 +239,43 @@ func (m ServiceMap) Names() []string {
 	return all
 }
 
+// Validate reports an error if the names in m are ambiguous. Since Assign
+// splits the method name at the first ".", a service name must be non-empty
+// and must not itself contain a ".". Validate also reports an error if any
+// composed name is exported more than once, and recursively validates any
+// service that is itself a ServiceMap.
+//
+// Validate is intended to be called once, during program initialization,
+// before m is passed to jrpc2.NewServer. Alternatively, a server whose options
+// set ValidateAssigner calls it when the server is constructed.
+func (m ServiceMap) Validate() error {
+	seen := make(map[string]bool)
+	for svc, assigner := range m {
+		if svc == "" {
+			return errors.New("empty service name")
+		} else if strings.Contains(svc, ".") {
+			return fmt.Errorf("service name %q contains %q", svc, ".")
+		}
+		if sub, ok := assigner.(ServiceMap); ok {
+			if err := sub.Validate(); err != nil {
+				return fmt.Errorf("service %q: %w", svc, err)
+			}
+		}
+		namer, ok := assigner.(jrpc2.Namer)
+		if !ok {
+			continue
+		}
+		for _, name := range namer.Names() {
+			full := svc + "." + name
+			if seen[full] {
+				return fmt.Errorf("duplicate method name %q", full)
+			}
+			seen[full] = true
+		}
+	}
+	return nil
+}
+
 // New adapts a function to a jrpc2.Handler. The concrete value of fn must be
 // function accepted by Check. The resulting Func will handle JSON encoding and
 // decoding, call fn, and report appropriate errors.
@@ -100,6 +298,8 @@ var (
 	reqType = reflect.TypeOf((*jrpc2.Request)(nil))          // type *jrpc2.Request
 
 	strictType = reflect.TypeOf((*interface{ DisallowUnknownFields() })(nil)).Elem()
+	unmarType  = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	writeType  = reflect.TypeOf((*io.WriterTo)(nil)).Elem()
 
 	errNoParameters = &jrpc2.Error{Code: code.InvalidParams, Message: "no parameters accepted"}
 )
@@ -158,6 +358,10 @@ func (fi *FuncInfo) Wrap() Func {
 	// arguments are wrapped with the appropriate decoder stubs.
 	wrapArg := fi.argWrapper()
 
+	// If the argument type admits only one kind of JSON value, check the kind
+	// of the parameters before decoding, to give a clearer error.
+	checkKind := fi.kindChecker()
+
 	// Construct a function to unpack the parameters from the request message,
 	// based on the signature of the user's callback.
 	var newInput func(ctx reflect.Value, req *jrpc2.Request) ([]reflect.Value, error)
@@ -179,9 +383,24 @@ func (fi *FuncInfo) Wrap() Func {
 			return []reflect.Value{ctx, reflect.ValueOf(req)}, nil
 		}
 
+	} else if arg.Kind() == reflect.Interface {
+		// Case 3: The function wants a generic value (Check ensures the
+		// interface is empty). Decode into an interface{} directly, and pass
+		// the value as an interface so that a nil value is still valid.
+		newInput = func(ctx reflect.Value, req *jrpc2.Request) ([]reflect.Value, error) {
+			var in interface{}
+			if err := req.UnmarshalParams(&in); err != nil {
+				return nil, jrpc2.Errorf(code.InvalidParams, "invalid parameters: %v", err)
+			}
+			return []reflect.Value{ctx, reflect.ValueOf(&in).Elem()}, nil
+		}
+
 	} else if arg.Kind() == reflect.Ptr {
-		// Case 3a: The function wants a pointer to its argument value.
+		// Case 4a: The function wants a pointer to its argument value.
 		newInput = func(ctx reflect.Value, req *jrpc2.Request) ([]reflect.Value, error) {
+			if err := checkKind(req); err != nil {
+				return nil, err
+			}
 			in := reflect.New(arg.Elem())
 			if err := req.UnmarshalParams(wrapArg(in)); err != nil {
 				return nil, jrpc2.Errorf(code.InvalidParams, "invalid parameters: %v", err)
@@ -189,8 +408,11 @@ func (fi *FuncInfo) Wrap() Func {
 			return []reflect.Value{ctx, in}, nil
 		}
 	} else {
-		// Case 3b: The function wants a bare argument value.
+		// Case 4b: The function wants a bare argument value.
 		newInput = func(ctx reflect.Value, req *jrpc2.Request) ([]reflect.Value, error) {
+			if err := checkKind(req); err != nil {
+				return nil, err
+			}
 			in := reflect.New(arg) // we still need a pointer to unmarshal
 			if err := req.UnmarshalParams(wrapArg(in)); err != nil {
 				return nil, jrpc2.Errorf(code.InvalidParams, "invalid parameters: %v", err)
@@ -227,6 +449,18 @@ func (fi *FuncInfo) Wrap() Func {
 		}
 	}
 
+	// If the function returns an io.WriterTo, stream its output.
+	if fi.Result == writeType {
+		decode := decodeOut
+		decodeOut = func(vals []reflect.Value) (interface{}, error) {
+			v, err := decode(vals)
+			if w, ok := v.(io.WriterTo); ok && err == nil {
+				return jrpc2.WriterStream(w), nil
+			}
+			return v, err
+		}
+	}
+
 	call := reflect.ValueOf(fi.fn).Call
 	return Func(func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
 		args, ierr := newInput(reflect.ValueOf(ctx), req)
@@ -284,6 +518,15 @@ func (fi *FuncInfo) Wrap() Func {
 // the wrapper will report an error when decoding the request.  The recommended
 // solution is to define a struct type for your parameters.
 //
+// If X is the empty interface type, interface{}, the wrapper decodes the
+// parameters as json.Unmarshal does for an interface{} value, and the function
+// can type-switch on the result: An object is decoded as a
+// map[string]interface{}, and an array as a []interface{}, whose elements are
+// in turn decoded as float64 for numbers, string for strings, bool for
+// Booleans, and nil for null. If the request has no parameters, the value is
+// nil. Interface types having methods are not accepted for X, since there is
+// no concrete type to decode into.
+//
 // For a single arbitrary type, another approach is to use a 1-element array:
 //
 //	func(ctx context.Context, sp [1]string) error {
@@ -292,6 +535,12 @@ func (fi *FuncInfo) Wrap() Func {
 //	}
 //
 // For more complex positional signatures, see also handler.Positional.
+//
+// If the type of Y is exactly io.WriterTo, the wrapper passes a non-nil
+// result to jrpc2.WriterStream, so that the server can stream the output of
+// its WriteTo method to the client instead of encoding the value. A result of
+// any other type, including one whose concrete type implements io.WriterTo,
+// is encoded as JSON in the usual way.
 func Check(fn interface{}) (*FuncInfo, error) {
 	if fn == nil {
 		return nil, errors.New("nil function")
@@ -311,6 +560,9 @@ func Check(fn interface{}) (*FuncInfo, error) {
 		return nil, errors.New("variadic functions are not supported")
 	} else if np == 2 {
 		info.Argument = info.Type.In(1)
+		if a := info.Argument; a.Kind() == reflect.Interface && a.NumMethod() != 0 {
+			return nil, fmt.Errorf("argument type %v is not the empty interface", a)
+		}
 	}
 
 	// Check for struct field names on the argument type.
@@ -385,6 +637,50 @@ func (s *strictStub) UnmarshalJSON(data []byte) error {
 	return dec.Decode(s.v)
 }
 
+// kindChecker returns a function that checks whether the parameters of a
+// request have the kind of JSON value required by the argument type of fi,
+// and reports an InvalidParams error if not. Argument types that accept more
+// than one kind, including those with custom decoders, are not checked.
+func (fi *FuncInfo) kindChecker() func(*jrpc2.Request) error {
+	noCheck := func(*jrpc2.Request) error { return nil }
+	arg := fi.Argument
+	if arg == nil || arg == reqType {
+		return noCheck
+	} else if arg.Kind() == reflect.Ptr {
+		arg = arg.Elem()
+	}
+	if reflect.PtrTo(arg).Implements(unmarType) {
+		return noCheck
+	}
+
+	var want byte
+	var wantKind string
+	switch arg.Kind() {
+	case reflect.Struct, reflect.Map:
+		if len(fi.posNames) != 0 {
+			return noCheck // arrays are translated into objects
+		}
+		want, wantKind = '{', "object"
+	case reflect.Slice, reflect.Array:
+		want, wantKind = '[', "array"
+	default:
+		return noCheck
+	}
+	return func(req *jrpc2.Request) error {
+		if !req.HasParams() {
+			return nil
+		}
+		if fb := firstByte([]byte(req.ParamString())); fb != want {
+			got := "array"
+			if fb == '{' {
+				got = "object"
+			}
+			return jrpc2.Errorf(code.InvalidParams, "invalid parameters: expected %s, got %s", wantKind, got)
+		}
+		return nil
+	}
+}
+
 func (fi *FuncInfo) argWrapper() func(reflect.Value) interface{} {
 	strict := fi.strictFields && fi.Argument != nil && !fi.Argument.Implements(strictType)
 	names := fi.posNames // capture so the wrapper does not pin fi
@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/creachadair/jrpc2"
@@ -51,6 +52,7 @@ func TestCheck(t *testing.T) {
 		{v: func(context.Context) bool { return true }},
 		{v: func(context.Context, int) bool { return true }},
 		{v: func(_ context.Context, s [1]string) string { return s[0] }},
+		{v: func(context.Context, interface{}) (string, error) { return "", nil }},
 
 		// Things that aren't supposed to work.
 		{v: func() error { return nil }, bad: true},                           // wrong # of params
@@ -60,6 +62,7 @@ func TestCheck(t *testing.T) {
 		{v: func(string) error { return nil }, bad: true},                     // missing context
 		{v: func(a, b string) error { return nil }, bad: true},                // P1 is not context
 		{v: func(context.Context) (int, bool) { return 1, true }, bad: true},  // R2 is not error
+		{v: func(context.Context, fmt.Stringer) int { return 0 }, bad: true},  // non-empty interface
 
 		//lint:ignore ST1008 verify permuted error position does not match
 		{v: func(context.Context) (error, float64) { return nil, 0 }, bad: true}, // ...
@@ -103,6 +106,14 @@ func TestFuncInfo_wrapDecode(t *testing.T) {
 		// Npn-positional slice argument.
 		{handler.New(func(_ context.Context, ss []string) int { return len(ss) }),
 			`["a", "b", "c"]`, 3},
+
+		// An empty interface argument gets the generic decoded value.
+		{handler.New(func(_ context.Context, v interface{}) interface{} { return v }),
+			`{"a":[1,"two",true,null]}`, map[string]interface{}{
+				"a": []interface{}{1.0, "two", true, nil},
+			}},
+		{handler.New(func(_ context.Context, v interface{}) bool { return v == nil }),
+			`null`, true},
 	}
 	ctx := context.Background()
 	for _, test := range tests {
@@ -117,6 +128,37 @@ func TestFuncInfo_wrapDecode(t *testing.T) {
 	}
 }
 
+// Verify that parameters of the wrong kind are reported clearly.
+func TestFuncInfo_wrapKindMismatch(t *testing.T) {
+	// N.B. Struct arguments are not covered here, because they also accept
+	// arrays, which are decoded positionally into their fields.
+	tests := []struct {
+		fn   handler.Func
+		p    string
+		want string
+	}{
+		{handler.New(func(_ context.Context, m map[string]int) int { return len(m) }),
+			`[1]`, "expected object, got array"},
+		{handler.New(func(_ context.Context, m *map[string]int) int { return len(*m) }),
+			`[1]`, "expected object, got array"},
+		{handler.New(func(_ context.Context, ss []string) int { return len(ss) }),
+			`{"a":"b"}`, "expected array, got object"},
+		{handler.New(func(_ context.Context, v [2]int) int { return v[0] }),
+			`{"a":1}`, "expected array, got object"},
+	}
+	ctx := context.Background()
+	for _, test := range tests {
+		req := testutil.MustParseRequest(t,
+			fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"method":"x","params":%s}`, test.p))
+		got, err := test.fn(ctx, req)
+		if code.FromError(err) != code.InvalidParams {
+			t.Errorf("Call with %s: got %v, %v; want code %v", test.p, got, err, code.InvalidParams)
+		} else if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("Call with %s: got error %v, want %q", test.p, err, test.want)
+		}
+	}
+}
+
 // Verify that the Positional function correctly handles its cases.
 func TestPositional(t *testing.T) {
 	tests := []struct {
@@ -328,6 +370,45 @@ func TestPositional_decode(t *testing.T) {
 	}
 }
 
+func TestPositionalFields(t *testing.T) {
+	type person struct {
+		Name  string `json:"name"`
+		Age   int    `json:"age"`
+		Email string `json:"email,omitempty"`
+	}
+	tests := []struct {
+		params string
+		names  []string
+		want   person
+		bad    bool
+	}{
+		{`{"name":"Alice","age":30}`, []string{"name", "age"}, person{Name: "Alice", Age: 30}, false},
+		{`["Bob",25]`, []string{"name", "age"}, person{Name: "Bob", Age: 25}, false},
+		{`[25,"Bob"]`, []string{"age", "name"}, person{Name: "Bob", Age: 25}, false},
+		{`["Carol",40,"c@x.org"]`, nil, person{Name: "Carol", Age: 40, Email: "c@x.org"}, false},
+
+		{`["Bob"]`, []string{"name", "age"}, person{}, true},        // too few
+		{`["Bob",25,"x"]`, []string{"name", "age"}, person{}, true}, // too many
+		{`[25,"Bob"]`, []string{"name", "age"}, person{}, true},     // wrong types
+	}
+	for _, test := range tests {
+		req := testutil.MustParseRequest(t, fmt.Sprintf(
+			`{"jsonrpc":"2.0","id":1,"method":"X","params":%s}`, test.params))
+		var got person
+		err := req.UnmarshalParams(handler.PositionalFields(&got, test.names...))
+		if test.bad {
+			if err == nil {
+				t.Errorf("UnmarshalParams(%s): got %+v, want error", test.params, got)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("UnmarshalParams(%s): unexpected error: %v", test.params, err)
+		} else if got != test.want {
+			t.Errorf("UnmarshalParams(%s): got %+v, want %+v", test.params, got, test.want)
+		}
+	}
+}
+
 // Verify that a ServiceMap assigns names correctly.
 func TestServiceMap(t *testing.T) {
 	tests := []struct {
@@ -363,6 +444,200 @@ func TestServiceMap(t *testing.T) {
 	}
 }
 
+// Verify that a Fallback assigner defers to its fallback for unknown methods.
+func TestFallback(t *testing.T) {
+	ctx := context.Background()
+	primary := handler.Map{
+		"Known": handler.New(func(context.Context) (string, error) { return "primary", nil }),
+	}
+	mux := handler.Fallback(primary, handler.Func(
+		func(_ context.Context, req *jrpc2.Request) (interface{}, error) {
+			return "fallback:" + req.Method(), nil
+		}))
+
+	tests := []struct {
+		method, want string
+	}{
+		{"Known", "primary"},
+		{"Unknown", "fallback:Unknown"},
+		{"Other.Thing", "fallback:Other.Thing"},
+	}
+	for _, test := range tests {
+		req := testutil.MustParseRequest(t, fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"method":%q}`, test.method))
+		h := mux.Assign(ctx, test.method)
+		if h == nil {
+			t.Errorf("Assign(%q): got nil, want handler", test.method)
+			continue
+		}
+		got, err := h.Handle(ctx, req)
+		if err != nil {
+			t.Errorf("Handle(%q): unexpected error: %v", test.method, err)
+		} else if got != test.want {
+			t.Errorf("Handle(%q): got %v, want %q", test.method, got, test.want)
+		}
+	}
+
+	if diff := cmp.Diff([]string{"Known"}, mux.(jrpc2.Namer).Names()); diff != "" {
+		t.Errorf("Wrong method names: (-want, +got)\n%s", diff)
+	}
+}
+
+func TestNotifyOnly(t *testing.T) {
+	ctx := context.Background()
+	var ran bool
+	h := handler.NotifyOnly(handler.New(func(context.Context) error { ran = true; return nil }))
+
+	note := testutil.MustParseRequest(t, `{"jsonrpc":"2.0","method":"Event"}`)
+	if _, err := h.Handle(ctx, note); err != nil {
+		t.Errorf("Handle(notification): unexpected error: %v", err)
+	} else if !ran {
+		t.Error("Handle(notification) did not run the handler")
+	}
+
+	ran = false
+	call := testutil.MustParseRequest(t, `{"jsonrpc":"2.0","id":1,"method":"Event"}`)
+	if got, err := h.Handle(ctx, call); err == nil {
+		t.Errorf("Handle(call): got %v, want error", got)
+	} else if c := code.FromError(err); c != code.InvalidRequest {
+		t.Errorf("Handle(call): got code %v, want %v", c, code.InvalidRequest)
+	} else if ran {
+		t.Error("Handle(call) ran the handler")
+	}
+}
+
+func TestCallOnly(t *testing.T) {
+	ctx := context.Background()
+	var ran bool
+	base := handler.New(func(context.Context) (string, error) { ran = true; return "ok", nil })
+	note := testutil.MustParseRequest(t, `{"jsonrpc":"2.0","method":"Get"}`)
+	call := testutil.MustParseRequest(t, `{"jsonrpc":"2.0","id":1,"method":"Get"}`)
+
+	var dropped []string
+	for _, h := range []jrpc2.Handler{
+		handler.CallOnly(base, nil),
+		handler.CallOnly(base, func(req *jrpc2.Request) { dropped = append(dropped, req.Method()) }),
+	} {
+		ran = false
+		if got, err := h.Handle(ctx, call); err != nil {
+			t.Errorf("Handle(call): unexpected error: %v", err)
+		} else if got != "ok" || !ran {
+			t.Errorf("Handle(call): got %v, ran=%v; want ok, ran=true", got, ran)
+		}
+
+		ran = false
+		if got, err := h.Handle(ctx, note); err != nil || got != nil {
+			t.Errorf("Handle(notification): got (%v, %v), want (nil, nil)", got, err)
+		} else if ran {
+			t.Error("Handle(notification) ran the handler")
+		}
+	}
+	if diff := cmp.Diff([]string{"Get"}, dropped); diff != "" {
+		t.Errorf("Dropped notifications (-want, +got):\n%s", diff)
+	}
+}
+
+func TestWithDefaultParams(t *testing.T) {
+	ctx := context.Background()
+	type args struct {
+		N int    `json:"n"`
+		S string `json:"s"`
+	}
+	h := handler.WithDefaultParams(handler.New(func(_ context.Context, a args) (string, error) {
+		return fmt.Sprintf("%d/%s", a.N, a.S), nil
+	}), json.RawMessage(`{"n":10,"s":"default"}`))
+
+	tests := []struct {
+		input, want string
+	}{
+		{`{"jsonrpc":"2.0","id":1,"method":"M"}`, "10/default"},
+		{`{"jsonrpc":"2.0","id":2,"method":"M","params":{"n":3}}`, "3/"},
+		{`{"jsonrpc":"2.0","id":3,"method":"M","params":{}}`, "0/"},
+		{`{"jsonrpc":"2.0","method":"M"}`, "10/default"},
+	}
+	for _, test := range tests {
+		req := testutil.MustParseRequest(t, test.input)
+		got, err := h.Handle(ctx, req)
+		if err != nil {
+			t.Errorf("Handle %s: unexpected error: %v", test.input, err)
+		} else if got != test.want {
+			t.Errorf("Handle %s: got %v, want %q", test.input, got, test.want)
+		}
+	}
+
+	for _, bad := range []string{``, `"x"`, `{"n":`} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("WithDefaultParams(%#q): did not panic", bad)
+				}
+			}()
+			handler.WithDefaultParams(h, json.RawMessage(bad))
+		}()
+	}
+}
+
+// Verify that a Mutable reflects registration changes.
+func TestMutable(t *testing.T) {
+	ctx := context.Background()
+	var m handler.Mutable
+	if h := m.Assign(ctx, "X"); h != nil {
+		t.Errorf("Assign(X) on empty: got %v, want nil", h)
+	}
+	if names := m.Names(); len(names) != 0 {
+		t.Errorf("Names on empty: got %q, want none", names)
+	}
+
+	m.Register("X", handler.New(y1))
+	m.Register("Y", handler.New(y2))
+	if m.Assign(ctx, "X") == nil || m.Assign(ctx, "Y") == nil {
+		t.Error("Assign after Register: got nil, want handler")
+	}
+	if diff := cmp.Diff([]string{"X", "Y"}, m.Names()); diff != "" {
+		t.Errorf("Wrong method names: (-want, +got)\n%s", diff)
+	}
+
+	m.Unregister("X")
+	m.Register("Y", nil)
+	if h := m.Assign(ctx, "X"); h != nil {
+		t.Errorf("Assign(X) after Unregister: got %v, want nil", h)
+	}
+	if names := m.Names(); len(names) != 0 {
+		t.Errorf("Names after Unregister: got %q, want none", names)
+	}
+}
+
+// Verify that ServiceMap.Validate reports ambiguous names.
+func TestServiceMap_Validate(t *testing.T) {
+	y := handler.New(y1)
+	tests := []struct {
+		m  handler.ServiceMap
+		ok bool
+	}{
+		{handler.ServiceMap{}, true},
+		{handler.ServiceMap{"A": handler.Map{"X": y}, "B": handler.Map{"X": y}}, true},
+		{handler.ServiceMap{"A": handler.ServiceMap{"B": handler.Map{"X": y}}}, true},
+
+		{handler.ServiceMap{"": handler.Map{"X": y}}, false},
+		{handler.ServiceMap{"A.B": handler.Map{"X": y}}, false},
+		{handler.ServiceMap{"A": handler.ServiceMap{"B.C": handler.Map{"X": y}}}, false},
+		{handler.ServiceMap{"A": dupNamer{}}, false},
+	}
+	for _, test := range tests {
+		err := test.m.Validate()
+		if test.ok && err != nil {
+			t.Errorf("Validate %v: unexpected error: %v", test.m.Names(), err)
+		} else if !test.ok && err == nil {
+			t.Errorf("Validate %v: got nil, want error", test.m.Names())
+		}
+	}
+}
+
+// dupNamer is an assigner that reports the same method name twice.
+type dupNamer struct{}
+
+func (dupNamer) Assign(context.Context, string) jrpc2.Handler { return nil }
+func (dupNamer) Names() []string                              { return []string{"X", "X"} }
+
 // Verify that argument decoding works.
 func TestArgs(t *testing.T) {
 	type stuff struct {
@@ -507,6 +782,199 @@ func TestObjUnmarshal(t *testing.T) {
 	}
 }
 
+func TestOneOf(t *testing.T) {
+	type point struct{ X, Y int }
+
+	tests := []struct {
+		input string
+		want  int   // index of the matching variant, or -1 for error
+		pt    point // the resulting point, if want >= 0
+	}{
+		{`{"X":1, "Y":2}`, 0, point{1, 2}},
+		{`[3, 4]`, 1, point{3, 4}},
+		{`{"X":1, "Z":2}`, -1, point{}}, // unknown field
+		{`[1, 2, 3]`, -1, point{}},      // wrong number of args
+		{`{"X":"one"}`, -1, point{}},    // wrong field type
+	}
+	for _, test := range tests {
+		var obj point
+		var x, y int
+		ch := handler.OneOf(&obj, &handler.Args{&x, &y})
+
+		req := testutil.MustParseRequest(t, fmt.Sprintf(
+			`{"jsonrpc":"2.0", "id":1, "method":"X", "params":%s}`, test.input))
+		err := req.UnmarshalParams(ch)
+		if got := ch.Matched(); got != test.want {
+			t.Errorf("UnmarshalParams(%s): matched %d, want %d (err=%v)", test.input, got, test.want, err)
+			continue
+		}
+		if test.want < 0 {
+			if err == nil {
+				t.Errorf("UnmarshalParams(%s): got nil, wanted error", test.input)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("UnmarshalParams(%s): unexpected error: %v", test.input, err)
+			continue
+		}
+		if ch.Matched() == 1 {
+			obj = point{x, y}
+		}
+		if obj != test.pt {
+			t.Errorf("UnmarshalParams(%s): got %+v, want %+v", test.input, obj, test.pt)
+		}
+	}
+}
+
+func TestBytes(t *testing.T) {
+	type params struct {
+		Data handler.Bytes `json:"data"`
+	}
+	// "\xfb\xff" has different encodings in the standard and URL alphabets.
+	tests := []struct {
+		input string
+		want  []byte
+		ok    bool
+	}{
+		{`{"data":null}`, nil, true},
+		{`{"data":""}`, []byte{}, true},
+		{`{"data":"aGVsbG8="}`, []byte("hello"), true}, // standard, padded
+		{`{"data":"aGVsbG8"}`, []byte("hello"), true},  // standard, unpadded
+		{`{"data":"+/8="}`, []byte("\xfb\xff"), true},  // standard alphabet
+		{`{"data":"-_8"}`, []byte("\xfb\xff"), true},   // URL alphabet, unpadded
+		{`{"data":"-_8="}`, []byte("\xfb\xff"), true},  // URL alphabet, padded
+
+		{`{"data":"not base64!"}`, nil, false},
+		{`{"data":[1,2,3]}`, nil, false},
+		{`{"data":17}`, nil, false},
+	}
+	for _, test := range tests {
+		var got params
+		err := json.Unmarshal([]byte(test.input), &got)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("Unmarshal %#q: got %q, want error", test.input, got.Data)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("Unmarshal %#q: unexpected error: %v", test.input, err)
+			continue
+		}
+		if diff := cmp.Diff(test.want, []byte(got.Data)); diff != "" {
+			t.Errorf("Unmarshal %#q: (-want, +got)\n%s", test.input, diff)
+		}
+	}
+
+	for _, test := range []struct {
+		input handler.Bytes
+		want  string
+	}{
+		{nil, `{"data":null}`},
+		{handler.Bytes{}, `{"data":""}`},
+		{handler.Bytes("\xfb\xff"), `{"data":"+/8="}`},
+	} {
+		bits, err := json.Marshal(params{Data: test.input})
+		if err != nil {
+			t.Errorf("Marshal %q: unexpected error: %v", test.input, err)
+		} else if got := string(bits); got != test.want {
+			t.Errorf("Marshal %q: got %#q, want %#q", test.input, got, test.want)
+		}
+	}
+}
+
+func TestUnmarshalWithDefaults(t *testing.T) {
+	type params struct {
+		Name  string  `jrpc2:"default=anon"`
+		Limit int     `jrpc2:"default=10"`
+		Mask  uint8   `jrpc2:"default=0xff"`
+		Rate  float64 `jrpc2:"default=0.5"`
+		Debug bool    `jrpc2:"default=true"`
+		Note  string  // no default
+	}
+	tests := []struct {
+		input string
+		want  params
+	}{
+		{`{}`, params{"anon", 10, 255, 0.5, true, ""}},
+		{`null`, params{"anon", 10, 255, 0.5, true, ""}},
+		{`{"Name":"bob","Limit":3,"Note":"hi"}`, params{"bob", 3, 255, 0.5, true, "hi"}},
+		{`{"Mask":7,"Rate":2.25}`, params{"anon", 10, 7, 2.25, true, ""}},
+	}
+	for _, test := range tests {
+		req := testutil.MustParseRequest(t, fmt.Sprintf(
+			`{"jsonrpc":"2.0", "id":1, "method":"X", "params":%s}`, test.input))
+		var got params
+		if err := handler.UnmarshalWithDefaults(req, &got); err != nil {
+			t.Errorf("UnmarshalWithDefaults(%s): unexpected error: %v", test.input, err)
+		} else if got != test.want {
+			t.Errorf("UnmarshalWithDefaults(%s): got %+v, want %+v", test.input, got, test.want)
+		}
+	}
+
+	req := testutil.MustParseRequest(t, `{"jsonrpc":"2.0", "id":1, "method":"X", "params":{}}`)
+	t.Run("BadDefault", func(t *testing.T) {
+		var v struct {
+			N int `jrpc2:"default=many"`
+		}
+		if err := handler.UnmarshalWithDefaults(req, &v); err == nil {
+			t.Errorf("UnmarshalWithDefaults: got %+v, want error", v)
+		}
+	})
+	t.Run("BadTarget", func(t *testing.T) {
+		var v int
+		if err := handler.UnmarshalWithDefaults(req, &v); err == nil {
+			t.Errorf("UnmarshalWithDefaults: got %v, want error", v)
+		}
+	})
+}
+
+func TestUnmarshalPositional(t *testing.T) {
+	type params struct {
+		Name  string
+		skip  int // unexported
+		Count int
+		Cache bool `jrpc2:"-"`
+		Tags  []string
+	}
+	tests := []struct {
+		input string
+		want  params
+		ok    bool
+	}{
+		{`["a", 2, ["x", "y"]]`, params{Name: "a", Count: 2, Tags: []string{"x", "y"}}, true},
+		{`["b", 0, null]`, params{Name: "b"}, true},
+		{`["a", 2]`, params{}, false},               // too few
+		{`["a", 2, [], true]`, params{}, false},     // too many
+		{`["a", "two", []]`, params{}, false},       // wrong type
+		{`{"Name":"a","Count":2}`, params{}, false}, // not an array
+	}
+	for _, test := range tests {
+		req := testutil.MustParseRequest(t, fmt.Sprintf(
+			`{"jsonrpc":"2.0", "id":1, "method":"X", "params":%s}`, test.input))
+		var got params
+		err := handler.UnmarshalPositional(req, &got)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("UnmarshalPositional(%s): got %+v, want error", test.input, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("UnmarshalPositional(%s): unexpected error: %v", test.input, err)
+		} else if diff := cmp.Diff(test.want, got, cmp.AllowUnexported(params{})); diff != "" {
+			t.Errorf("UnmarshalPositional(%s) (-want, +got):\n%s", test.input, diff)
+		}
+	}
+
+	t.Run("BadTarget", func(t *testing.T) {
+		req := testutil.MustParseRequest(t, `{"jsonrpc":"2.0", "id":1, "method":"X", "params":[]}`)
+		var v []int
+		if err := handler.UnmarshalPositional(req, &v); err == nil {
+			t.Errorf("UnmarshalPositional: got %v, want error", v)
+		}
+	})
+}
+
 // stringByte is a byte with a custom JSON encoding. It expects a string of
 // decimal digits 1 and 0, e.g., "10011000" == 0x98.
 type stringByte byte
@@ -4,8 +4,15 @@ package handler
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/creachadair/jrpc2"
 )
 
 // Args is a wrapper that decodes an array of positional parameters into
@@ -85,6 +92,231 @@ func (o Obj) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// OneOf returns a Choice that decodes a JSON value into the first of the
+// given targets that accepts it. Each target must be a valid argument to
+// json.Unmarshal, typically a pointer. This is useful for methods whose
+// parameters may take several forms, such as an object or an equivalent
+// array of positional values.
+//
+// Usage example:
+//
+//	var obj struct{ X, Y int }
+//	var x, y int
+//	ch := handler.OneOf(&obj, &handler.Args{&x, &y})
+//	if err := req.UnmarshalParams(ch); err != nil {
+//	   return nil, err
+//	}
+//	if ch.Matched() == 1 {
+//	   obj.X, obj.Y = x, y
+//	}
+func OneOf(targets ...interface{}) *Choice {
+	return &Choice{targets: targets, matched: -1}
+}
+
+// A Choice is a set of candidate decoding targets constructed by OneOf.
+//
+// Unmarshaling a JSON value into a Choice tries each target in order, and
+// succeeds with the first target that decodes the value without error.
+// Targets are decoded strictly: An object that has fields not defined by a
+// struct target does not match that target. A target that fails to match may
+// have been partially modified.
+type Choice struct {
+	targets []interface{}
+	matched int
+}
+
+// Matched reports the index of the target that decoded the most recent value
+// unmarshaled into c, or -1 if no value has been successfully unmarshaled.
+func (c *Choice) Matched() int { return c.matched }
+
+// UnmarshalJSON supports JSON unmarshaling into c.
+func (c *Choice) UnmarshalJSON(data []byte) error {
+	c.matched = -1
+	var errs []string
+	for i, target := range c.targets {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(target); err != nil {
+			errs = append(errs, fmt.Sprintf("variant %d: %v", i, err))
+			continue
+		}
+		c.matched = i
+		return nil
+	}
+	if len(errs) == 0 {
+		return errors.New("no variants to decode into")
+	}
+	return fmt.Errorf("no matching variant (%s)", strings.Join(errs, "; "))
+}
+
+// Bytes is a byte slice that is encoded in JSON as a base64 string. It can be
+// used as a field of a parameter or result type for a method that carries
+// binary data.
+//
+// Marshaling a Bytes value produces a string in standard padded base64, or
+// null for a nil slice. Unmarshaling accepts a string in either the standard
+// or the URL-safe base64 alphabet, with or without padding, and maps null to
+// a nil slice.
+type Bytes []byte
+
+// MarshalJSON supports JSON marshaling for b.
+func (b Bytes) MarshalJSON() ([]byte, error) {
+	if b == nil {
+		return []byte("null"), nil
+	}
+	return json.Marshal(base64.StdEncoding.EncodeToString(b))
+}
+
+// UnmarshalJSON supports JSON unmarshaling for b.
+func (b *Bytes) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*b = nil
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return filterJSONError("bytes", "string", err)
+	}
+	enc := base64.StdEncoding
+	if strings.ContainsAny(s, "-_") {
+		enc = base64.URLEncoding
+	}
+	if !strings.HasSuffix(s, "=") {
+		enc = enc.WithPadding(base64.NoPadding)
+	}
+	dec, err := enc.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("decoding bytes: %w", err)
+	}
+	*b = dec
+	return nil
+}
+
+// UnmarshalWithDefaults decodes the parameters of req into v as
+// req.UnmarshalParams does, where v must be a non-nil pointer to a struct.
+// Then it sets each exported field of the struct that still has its zero
+// value to the default given by a struct tag of the form:
+//
+//	jrpc2:"default=value"
+//
+// Defaults are supported for fields of string, bool, integer, and
+// floating-point kind. A field the request explicitly sets to its zero value
+// cannot be distinguished from one the request omits, so it too receives the
+// default. A default that cannot be parsed as the kind of its field is
+// reported as an error.
+//
+// Usage example:
+//
+//	var p struct {
+//	   Query string
+//	   Limit int     `jrpc2:"default=10"`
+//	   Order string  `jrpc2:"default=asc"`
+//	}
+//	if err := handler.UnmarshalWithDefaults(req, &p); err != nil {
+//	   return nil, err
+//	}
+func UnmarshalWithDefaults(req *jrpc2.Request, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("defaults: target must be a non-nil pointer to a struct, got %T", v)
+	}
+	if err := req.UnmarshalParams(v); err != nil {
+		return err
+	}
+	sv := rv.Elem()
+	for i := 0; i < sv.NumField(); i++ {
+		ft := sv.Type().Field(i)
+		def, ok := defaultTag(ft.Tag.Get("jrpc2"))
+		if !ok || ft.PkgPath != "" {
+			continue // no default, or the field is unexported
+		}
+		if fv := sv.Field(i); fv.IsZero() {
+			if err := setDefault(fv, def); err != nil {
+				return fmt.Errorf("defaults: field %s: %w", ft.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// UnmarshalPositional decodes the parameters of req, which must be an array,
+// into the exported fields of the struct v points to, in the order the fields
+// are declared. A field with the struct tag jrpc2:"-" is skipped, and the
+// array must have exactly one element for each remaining field, as for Args.
+//
+// Usage example:
+//
+//	var p struct {
+//	   Name  string
+//	   Count int
+//	   Cache bool `jrpc2:"-"` // not a parameter
+//	}
+//	// Accepts params like ["alice", 5].
+//	if err := handler.UnmarshalPositional(req, &p); err != nil {
+//	   return nil, err
+//	}
+func UnmarshalPositional(req *jrpc2.Request, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("positional: target must be a non-nil pointer to a struct, got %T", v)
+	}
+	sv := rv.Elem()
+	var args Args
+	for i := 0; i < sv.NumField(); i++ {
+		ft := sv.Type().Field(i)
+		if ft.PkgPath != "" || ft.Tag.Get("jrpc2") == "-" {
+			continue // unexported, or explicitly skipped
+		}
+		args = append(args, sv.Field(i).Addr().Interface())
+	}
+	return req.UnmarshalParams(&args)
+}
+
+// defaultTag reports the default value specified by a jrpc2 struct tag, and
+// whether the tag specifies one.
+func defaultTag(tag string) (string, bool) {
+	const prefix = "default="
+	if !strings.HasPrefix(tag, prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(tag, prefix), true
+}
+
+// setDefault parses def according to the kind of fv and assigns it to fv.
+func setDefault(fv reflect.Value, def string) error {
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(def)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(def)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		z, err := strconv.ParseInt(def, 0, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetInt(z)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		z, err := strconv.ParseUint(def, 0, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetUint(z)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(def, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(f)
+	default:
+		return fmt.Errorf("default values are not supported for %v", fv.Type())
+	}
+	return nil
+}
+
 func filterJSONError(tag, want string, err error) error {
 	if t, ok := err.(*json.UnmarshalTypeError); ok {
 		return fmt.Errorf("%s: cannot decode %s as %s", tag, t.Value, want)
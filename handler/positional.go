@@ -3,6 +3,7 @@
 package handler
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"reflect"
@@ -25,6 +26,38 @@ func NewPos(fn interface{}, names ...string) Func {
 	return fi.Wrap()
 }
 
+// PositionalFields returns a value that can be passed to UnmarshalParams to
+// decode parameters into v, which must be a pointer to a struct, accepting
+// either an object or an array of positional values. When the parameters are
+// an array, its elements are assigned in order to the fields of v with the
+// given JSON field names, and the array must have exactly len(names)
+// elements. If no names are given, the eligible fields of the struct are used
+// in order of declaration, as for Positional.
+//
+// This is useful for handlers that decode their parameters into a struct but
+// must also support callers that send them positionally:
+//
+//	var args struct {
+//	   Name string `json:"name"`
+//	   Age  int    `json:"age"`
+//	}
+//	if err := req.UnmarshalParams(handler.PositionalFields(&args, "name", "age")); err != nil {
+//	   return nil, err
+//	}
+//
+// PositionalFields will panic if v is not a pointer to a struct.
+func PositionalFields(v interface{}, names ...string) json.Unmarshaler {
+	t := reflect.TypeOf(v)
+	ok, fields := structFieldNames(t)
+	if !ok || t.Kind() != reflect.Ptr {
+		panic(fmt.Sprintf("value of type %T is not a pointer to a struct", v))
+	}
+	if len(names) == 0 {
+		names = fields
+	}
+	return &arrayStub{v: v, posNames: names}
+}
+
 // structFieldNames reports whether atype is a struct or pointer to struct, and
 // if so returns a slice of the eligible field names in order of declaration.
 // If atype == nil or is not a (pointer to) struct, it returns false, nil.
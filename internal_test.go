@@ -13,7 +13,9 @@ import (
 	"time"
 
 	"github.com/creachadair/jrpc2/channel"
+	"github.com/creachadair/jrpc2/channel/chantest"
 	"github.com/creachadair/jrpc2/code"
+	"github.com/creachadair/jrpc2/metrics"
 	"github.com/fortytw2/leaktest"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
@@ -121,7 +123,7 @@ func TestRequest_UnmarshalParams(t *testing.T) {
 	}
 	for _, test := range tests {
 		var reqs jmessages
-		if err := reqs.parseJSON([]byte(test.input)); err != nil {
+		if err := reqs.parseJSON([]byte(test.input), Version); err != nil {
 			t.Errorf("Parsing request %#q failed: %v", test.input, err)
 		} else if len(reqs) != 1 {
 			t.Fatalf("Wrong number of requests: got %d, want 1", len(reqs))
@@ -215,6 +217,113 @@ func TestClient_contextCancellation(t *testing.T) {
 	}
 }
 
+// Verify that WaitContext waits for a pending response, and that the end of
+// its context stops the wait without abandoning the request.
+func TestResponse_WaitContext(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	ch := chantest.New()
+	c := NewClient(ch, nil)
+	defer c.Close()
+
+	ctx := context.Background()
+	req, err := c.req(ctx, "Test", nil)
+	if err != nil {
+		t.Fatalf("c.req(Test) failed: %v", err)
+	}
+	rsps, err := c.send(ctx, jmessages{req})
+	if err != nil {
+		t.Fatalf("c.send(Test) failed: %v", err)
+	}
+	rsp := rsps[0]
+
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := rsp.WaitContext(tctx); err != context.DeadlineExceeded {
+		t.Errorf("WaitContext: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if ids := c.PendingIDs(); len(ids) != 1 {
+		t.Errorf("PendingIDs: got %+v, want 1 request", ids)
+	}
+
+	ch.Enqueue([]byte(`{"jsonrpc":"2.0","id":1,"result":"ok"}`))
+	for i := 0; i < 2; i++ {
+		if err := rsp.WaitContext(ctx); err != nil {
+			t.Errorf("WaitContext %d: unexpected error: %v", i+1, err)
+		}
+		if got := rsp.ResultString(); got != `"ok"` {
+			t.Errorf("WaitContext %d: got result %#q, want %#q", i+1, got, `"ok"`)
+		}
+	}
+
+	var zero Response
+	if err := zero.WaitContext(tctx); err != nil {
+		t.Errorf("WaitContext(zero): unexpected error: %v", err)
+	}
+}
+
+// Verify that a cancellation that loses the race with delivery of the response
+// is counted, and reported to the OnCancel hook only if AlwaysCancel is set,
+// and that the end of the call context after a call completes is neither.
+func TestClient_cancelTooLate(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	for _, always := range []bool{false, true} {
+		var cancelled []string
+		m := metrics.New()
+		ch := chantest.New()
+		c := NewClient(ch, &ClientOptions{
+			OnCancel:     func(_ *Client, rsp *Response) { cancelled = append(cancelled, rsp.ID()) },
+			AlwaysCancel: always,
+			Metrics:      m,
+		})
+
+		// A call that completes normally, and whose context is cancelled
+		// afterward, as by a deferred cancel.
+		ctx, cancel := context.WithCancel(context.Background())
+		req, err := c.req(ctx, "Test", nil)
+		if err != nil {
+			t.Fatalf("c.req(Test) failed: %v", err)
+		}
+		rsps, err := c.send(ctx, jmessages{req})
+		if err != nil {
+			t.Fatalf("c.send(Test) failed: %v", err)
+		}
+		rsp := rsps[0]
+		ch.Enqueue([]byte(`{"jsonrpc":"2.0","id":1,"result":"ok"}`))
+		if err := rsp.WaitContext(context.Background()); err != nil {
+			t.Fatalf("WaitContext: unexpected error: %v", err)
+		}
+		cancel()
+		c.waitComplete(ctx, ctx, rsp.id, rsp)
+
+		// A call whose context ends, but whose response is delivered before
+		// the client notices.
+		lctx, lcancel := context.WithCancel(context.Background())
+		pctx, p := newPending(lctx, "2", "Test", 0)
+		c.mu.Lock()
+		c.pending[p.id] = p
+		lcancel()
+		c.deliver(&jmessage{ID: json.RawMessage("2"), R: json.RawMessage(`"ok"`)})
+		c.mu.Unlock()
+		c.waitComplete(lctx, pctx, p.id, p)
+
+		snap := metrics.Snapshot{Counter: make(map[string]int64)}
+		m.Snapshot(snap)
+		if got := snap.Counter["rpc.cancel.tooLate"]; got != 1 {
+			t.Errorf("AlwaysCancel=%v: rpc.cancel.tooLate is %d, want 1", always, got)
+		}
+		var want []string
+		if always {
+			want = []string{"2"}
+		}
+		if diff := cmp.Diff(want, cancelled); diff != "" {
+			t.Errorf("AlwaysCancel=%v: cancelled IDs (-want, +got):\n%s", always, diff)
+		}
+		c.Close()
+	}
+}
+
 func TestServer_specialMethods(t *testing.T) {
 	defer leaktest.Check(t)()
 
@@ -329,3 +438,139 @@ func TestMarshalResponse(t *testing.T) {
 		}
 	}
 }
+
+func TestTruncateData(t *testing.T) {
+	tests := []struct {
+		data string
+		max  int
+		want string
+	}{
+		{`"abcdefghijklmnopqrstuvwxyz"`, 20, `"abcd...(truncated)"`},
+		{`"\n\n\n\n\n\n\n\n\n\n\n\n"`, 22, `"\n\n\n...(truncated)"`},
+		{`"ééééééééééé"`, 21, `"éé...(truncated)"`},
+		{`"\u0001\u0001\u0001\u0001"`, 25, `"\u0001...(truncated)"`},
+		{`"abcdefghijklmnopqrstuvwxyz"`, 10, `{"truncated":true,"size":28}`},
+		{`{"key":"a long value that does not fit"}`, 30, `{"truncated":true,"size":40}`},
+		{`[1,2,3,4,5,6,7,8,9,10]`, 5, `{"truncated":true,"size":22}`},
+	}
+	for _, test := range tests {
+		got := string(truncateData(json.RawMessage(test.data), test.max))
+		if got != test.want {
+			t.Errorf("truncateData(%#q, %d): got %#q, want %#q", test.data, test.max, got, test.want)
+		}
+		if !json.Valid([]byte(got)) {
+			t.Errorf("truncateData(%#q, %d): result %#q is not valid JSON", test.data, test.max, got)
+		}
+	}
+}
+
+func TestFlightGroup(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	g := &flightGroup{m: make(map[string]*flight)}
+	waitFor := func(key string, n int) {
+		t.Helper()
+		for {
+			g.mu.Lock()
+			f := g.m[key]
+			ok := f != nil && f.nwait == n
+			g.mu.Unlock()
+			if ok {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	t.Run("Shared", func(t *testing.T) {
+		var runs int
+		release := make(chan struct{})
+		run := func(context.Context) (json.RawMessage, map[string]json.RawMessage, error) {
+			runs++ // only one execution at a time, by construction
+			<-release
+			return json.RawMessage(`"ok"`), nil, nil
+		}
+		results := make(chan string, 3)
+		for i := 0; i < 3; i++ {
+			go func() {
+				val, _, err := g.do(context.Background(), "k", run)
+				if err != nil {
+					results <- "error: " + err.Error()
+				} else {
+					results <- string(val)
+				}
+			}()
+		}
+		waitFor("k", 3)
+		close(release)
+		for i := 0; i < 3; i++ {
+			if got := <-results; got != `"ok"` {
+				t.Errorf("Result %d: got %s, want %q", i, got, "ok")
+			}
+		}
+		if runs != 1 {
+			t.Errorf("Got %d executions, want 1", runs)
+		}
+	})
+
+	t.Run("Abandon", func(t *testing.T) {
+		stopped := make(chan error, 1)
+		run := func(ctx context.Context) (json.RawMessage, map[string]json.RawMessage, error) {
+			<-ctx.Done()
+			stopped <- ctx.Err()
+			return nil, nil, ctx.Err()
+		}
+		ctx1, cancel1 := context.WithCancel(context.Background())
+		ctx2, cancel2 := context.WithCancel(context.Background())
+		errc := make(chan error, 2)
+		go func() { _, _, err := g.do(ctx1, "q", run); errc <- err }()
+		waitFor("q", 1)
+		go func() { _, _, err := g.do(ctx2, "q", run); errc <- err }()
+		waitFor("q", 2)
+
+		// When one caller gives up, the execution continues for the other.
+		cancel1()
+		if err := <-errc; err != context.Canceled {
+			t.Errorf("First caller: got %v, want %v", err, context.Canceled)
+		}
+		select {
+		case err := <-stopped:
+			t.Fatalf("Execution stopped early: %v", err)
+		default:
+		}
+
+		// When the last caller gives up, the execution is cancelled.
+		cancel2()
+		if err := <-errc; err != context.Canceled {
+			t.Errorf("Second caller: got %v, want %v", err, context.Canceled)
+		}
+		if err := <-stopped; err != context.Canceled {
+			t.Errorf("Execution: got %v, want %v", err, context.Canceled)
+		}
+	})
+
+	t.Run("LastWaits", func(t *testing.T) {
+		release := make(chan struct{})
+		run := func(ctx context.Context) (json.RawMessage, map[string]json.RawMessage, error) {
+			<-ctx.Done()
+			<-release // keep running after cancellation
+			return nil, nil, ctx.Err()
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		errc := make(chan error, 1)
+		go func() { _, _, err := g.do(ctx, "w", run); errc <- err }()
+		waitFor("w", 1)
+
+		// The last caller to give up does not return until the execution does.
+		cancel()
+		select {
+		case err := <-errc:
+			t.Fatalf("Caller returned before the execution: %v", err)
+		case <-time.After(20 * time.Millisecond):
+		}
+		close(release)
+		if err := <-errc; err != context.Canceled {
+			t.Errorf("Caller: got %v, want %v", err, context.Canceled)
+		}
+	})
+}
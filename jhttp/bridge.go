@@ -5,12 +5,17 @@
 package jhttp
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
 
 	"github.com/creachadair/jrpc2"
+	"github.com/creachadair/jrpc2/code"
 	"github.com/creachadair/jrpc2/server"
 )
 
@@ -37,6 +42,7 @@ type Bridge struct {
 	local    server.Local
 	parseReq func(*http.Request) ([]*jrpc2.ParsedRequest, error)
 	getter   *Getter
+	typed    *typedSet // if non-nil, recognizes typed results
 }
 
 // ServeHTTP implements the required method of http.Handler.
@@ -97,6 +103,10 @@ func (b Bridge) serveInternal(w http.ResponseWriter, req *http.Request) error {
 	var inboundID []string // for calls
 	var spec []jrpc2.Spec  // requests & notifications
 	for _, req := range jreq {
+		if req.Error == nil && req.Method == "" {
+			// The client will not send a request without a method name.
+			req.Error = &jrpc2.Error{Code: code.InvalidRequest, Message: "empty method name"}
+		}
 		if req.Error != nil {
 			// Filter out statically invalid requests.
 			msg, err := marshalError(req)
@@ -118,10 +128,23 @@ func (b Bridge) serveInternal(w http.ResponseWriter, req *http.Request) error {
 	}
 
 	if len(spec) != 0 {
-		rsps, err := b.local.Client.Batch(req.Context(), spec)
+		ctx := req.Context()
+		var tc *typedCall
+		if b.typed != nil && len(jreq) == 1 && !spec[0].Notify {
+			var done func()
+			ctx, tc, done = b.typed.begin(ctx)
+			defer done()
+		}
+		rsps, err := b.local.Client.Batch(ctx, spec)
 		if err != nil {
 			return err
 		}
+		if tc != nil && len(rsps) == 1 && rsps[0].Error() == nil {
+			if tr, ok := tc.result(); ok {
+				writeTyped(w, tr)
+				return nil
+			}
+		}
 		for i, rsp := range rsps {
 			// Map the responses back to their original IDs and marshal to JSON.
 			rsp.SetID(inboundID[i])
@@ -188,18 +211,21 @@ func (b Bridge) Close() error {
 // hooks on the bridge client as usual, but the remote client will not see push
 // messages from the server.
 func NewBridge(mux jrpc2.Assigner, opts *BridgeOptions) Bridge {
+	typed := newTypedSet(opts.typedResults())
 	b := Bridge{
-		local: server.NewLocal(mux, &server.LocalOptions{
-			Client: opts.clientOptions(),
-			Server: opts.serverOptions(),
+		local: server.NewLocal(typed.wrap(mux), &server.LocalOptions{
+			Client: typed.clientOptions(opts.clientOptions()),
+			Server: typed.serverOptions(opts.serverOptions()),
 		}),
 		parseReq: opts.parseRequest(),
+		typed:    typed,
 	}
 	if pget := opts.parseGETRequest(); pget != nil {
 		g := NewGetter(mux, &GetterOptions{
 			Client:       opts.clientOptions(),
 			Server:       opts.serverOptions(),
 			ParseRequest: pget,
+			TypedResults: opts.typedResults(),
 		})
 		b.getter = &g
 	}
@@ -231,6 +257,25 @@ type BridgeOptions struct {
 	// parse function, and are not passed to a ParseRequest hook even if one is
 	// defined.
 	ParseGETRequest func(*http.Request) (string, interface{}, error)
+
+	// If true, when an HTTP request contains a single call whose handler
+	// returns a jrpc2.TypedResult (or a pointer to one), the bridge sends the
+	// body of the result as the HTTP response with its content type, rather
+	// than a JSON-RPC response. This also applies to GET requests handled by a
+	// ParseGETRequest hook. A result is recognized by the type the handler
+	// returns, not by the shape of its encoding, so a call whose result merely
+	// looks like a typed result is answered as usual, as is a result the
+	// handler did not produce for that call, such as one shared by the
+	// SingleFlight hook of the server. When this is enabled, the bridge server
+	// does not cache results (see jrpc2.ServerOptions.Cache), since a cached
+	// result could not be recognized as typed. The bridge uses request
+	// metadata to track typed results, and passes any other metadata sent by
+	// the bridge client to the DecodeMeta hook of the server as usual.
+	//
+	// Note that a JSON-RPC client, such as one using a jhttp.Channel, cannot
+	// decode such a response, so this should be enabled only for bridges
+	// whose callers expect it.
+	TypedResults bool
 }
 
 func (o *BridgeOptions) clientOptions() *jrpc2.ClientOptions {
@@ -254,6 +299,8 @@ func (o *BridgeOptions) parseRequest() func(*http.Request) ([]*jrpc2.ParsedReque
 	return o.ParseRequest
 }
 
+func (o *BridgeOptions) typedResults() bool { return o != nil && o.TypedResults }
+
 func (o *BridgeOptions) parseGETRequest() func(*http.Request) (string, interface{}, error) {
 	if o == nil {
 		return nil
@@ -261,6 +308,201 @@ func (o *BridgeOptions) parseGETRequest() func(*http.Request) (string, interface
 	return o.ParseGETRequest
 }
 
+// A typedSet lets a bridge or getter recognize the typed results of its calls
+// by their type rather than by the shape of their encoding. Each call that may
+// be answered with a typed result is given a typedCall, which the bridge client
+// identifies to the bridge server by a token in the request metadata, and
+// which the handler fills in if it returns a typed result. A nil *typedSet
+// recognizes nothing.
+type typedSet struct {
+	next  uint64   // the last token issued; updated atomically
+	calls sync.Map // :: token ⇒ *typedCall, for calls in progress
+}
+
+// typedMetaKey is the request metadata key that carries the token of a call.
+const typedMetaKey = "jhttp.typed"
+
+type typedTokenKey struct{}
+type typedCallKey struct{}
+
+// A typedCall records the typed result of a single call, if any.
+type typedCall struct {
+	mu sync.Mutex
+	tr *jrpc2.TypedResult
+}
+
+func (c *typedCall) set(tr jrpc2.TypedResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tr = &tr
+}
+
+// result reports the typed result recorded for c, if there is one.
+func (c *typedCall) result() (jrpc2.TypedResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tr == nil || c.tr.ContentType == "" {
+		return jrpc2.TypedResult{}, false
+	}
+	return *c.tr, true
+}
+
+// newTypedSet returns a new empty typedSet if enabled is true, otherwise nil.
+func newTypedSet(enabled bool) *typedSet {
+	if enabled {
+		return new(typedSet)
+	}
+	return nil
+}
+
+// begin registers a new call, and returns a context for the client request
+// that identifies it. The caller must call done when the call is complete, to
+// release the record; a handler that finishes later records nothing.
+func (t *typedSet) begin(ctx context.Context) (_ context.Context, _ *typedCall, done func()) {
+	tok := atomic.AddUint64(&t.next, 1)
+	tc := new(typedCall)
+	t.calls.Store(tok, tc)
+	return context.WithValue(ctx, typedTokenKey{}, tok), tc, func() { t.calls.Delete(tok) }
+}
+
+// wrap returns an assigner that delegates to mux, and whose handlers record a
+// typed result in the typedCall of their request. If t == nil, it returns mux
+// unmodified.
+//
+// The handlers it returns are never cacheable, since a result served from the
+// cache could not be recognized as typed.
+func (t *typedSet) wrap(mux jrpc2.Assigner) jrpc2.Assigner {
+	if t == nil {
+		return mux
+	}
+	ta := typedAssigner{mux: mux}
+	if n, ok := mux.(jrpc2.Namer); ok {
+		return typedNamer{typedAssigner: ta, namer: n}
+	}
+	return ta
+}
+
+// clientOptions returns a copy of opts whose EncodeMeta hook adds the token of
+// the call, if any, to the request metadata. If t == nil, it returns opts.
+func (t *typedSet) clientOptions(opts *jrpc2.ClientOptions) *jrpc2.ClientOptions {
+	if t == nil {
+		return opts
+	}
+	var cp jrpc2.ClientOptions
+	if opts != nil {
+		cp = *opts
+	}
+	encodeMeta := cp.EncodeMeta
+	cp.EncodeMeta = func(ctx context.Context, method string) (json.RawMessage, error) {
+		var meta json.RawMessage
+		if encodeMeta != nil {
+			var err error
+			meta, err = encodeMeta(ctx, method)
+			if err != nil {
+				return nil, err
+			}
+		}
+		tok, ok := ctx.Value(typedTokenKey{}).(uint64)
+		if !ok {
+			return meta, nil
+		}
+		obj := make(map[string]json.RawMessage)
+		if len(meta) != 0 && string(meta) != "null" {
+			if err := json.Unmarshal(meta, &obj); err != nil {
+				return nil, err
+			}
+		}
+		obj[typedMetaKey] = json.RawMessage(strconv.FormatUint(tok, 10))
+		return json.Marshal(obj)
+	}
+	return &cp
+}
+
+// serverOptions returns a copy of opts whose DecodeMeta hook attaches the
+// typedCall named by the request metadata, if any, to the request context, and
+// passes any other metadata to the DecodeMeta hook of opts. If t == nil, it
+// returns opts.
+func (t *typedSet) serverOptions(opts *jrpc2.ServerOptions) *jrpc2.ServerOptions {
+	if t == nil {
+		return opts
+	}
+	var cp jrpc2.ServerOptions
+	if opts != nil {
+		cp = *opts
+	}
+	decodeMeta := cp.DecodeMeta
+	cp.DecodeMeta = func(ctx context.Context, method string, meta json.RawMessage) (context.Context, error) {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(meta, &obj); err == nil {
+			if raw, ok := obj[typedMetaKey]; ok {
+				delete(obj, typedMetaKey)
+				var tok uint64
+				if json.Unmarshal(raw, &tok) == nil {
+					if tc, ok := t.calls.Load(tok); ok {
+						ctx = context.WithValue(ctx, typedCallKey{}, tc)
+					}
+				}
+				if len(obj) == 0 {
+					return ctx, nil
+				}
+				meta, _ = json.Marshal(obj)
+			}
+		}
+		if decodeMeta == nil {
+			return nil, jrpc2.Errorf(code.InvalidRequest, "extra fields in request").WithData([]string{"meta"})
+		}
+		return decodeMeta(ctx, method, meta)
+	}
+	return &cp
+}
+
+type typedAssigner struct{ mux jrpc2.Assigner }
+
+// Assign implements part of the jrpc2.Assigner interface.
+func (a typedAssigner) Assign(ctx context.Context, method string) jrpc2.Handler {
+	h := a.mux.Assign(ctx, method)
+	if h == nil {
+		return nil
+	}
+	return typedHandler{h: h}
+}
+
+type typedNamer struct {
+	typedAssigner
+	namer jrpc2.Namer
+}
+
+// Names implements the optional jrpc2.Namer extension interface.
+func (n typedNamer) Names() []string { return n.namer.Names() }
+
+type typedHandler struct{ h jrpc2.Handler }
+
+// Handle implements the jrpc2.Handler interface.
+func (t typedHandler) Handle(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+	v, err := t.h.Handle(ctx, req)
+	tc, ok := ctx.Value(typedCallKey{}).(*typedCall)
+	if err != nil || !ok {
+		return v, err
+	}
+	switch tr := v.(type) {
+	case jrpc2.TypedResult:
+		tc.set(tr)
+	case *jrpc2.TypedResult:
+		if tr != nil {
+			tc.set(*tr)
+		}
+	}
+	return v, err
+}
+
+// writeTyped writes the body of tr to w as a successful HTTP response.
+func writeTyped(w http.ResponseWriter, tr jrpc2.TypedResult) {
+	w.Header().Set("Content-Type", tr.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(tr.Body)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(tr.Body)
+}
+
 // marshalError encodes an error response for an invalid request.
 func marshalError(req *jrpc2.ParsedRequest) ([]byte, error) {
 	v, err := json.Marshal(req.Error)
@@ -9,6 +9,8 @@ import (
 	"io"
 	"net/http"
 	"sync"
+
+	"github.com/creachadair/jrpc2"
 )
 
 // A Channel implements a channel.Channel that dispatches requests via HTTP to
@@ -57,6 +59,18 @@ func NewChannel(url string, opts *ChannelOptions) *Channel {
 	}
 }
 
+// NewClient constructs a *jrpc2.Client that sends its requests to the HTTP
+// JSON-RPC endpoint at url, using a Channel. Each call or notification is sent
+// as a separate HTTP POST request, and a batch is sent as a single request.
+// If cli == nil, the client uses http.DefaultClient. The opts are passed to
+// the jrpc2 client.
+//
+// The Channel reads and closes each HTTP response body, so connections are
+// returned to cli for reuse.
+func NewClient(url string, cli HTTPClient, opts *jrpc2.ClientOptions) *jrpc2.Client {
+	return jrpc2.NewClient(NewChannel(url, &ChannelOptions{Client: cli}), opts)
+}
+
 // Send forwards msg to the server as the body of an HTTP POST request.
 func (c *Channel) Send(msg []byte) error {
 	cli := c.cli
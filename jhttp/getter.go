@@ -45,6 +45,7 @@ import (
 type Getter struct {
 	local    server.Local
 	parseReq func(*http.Request) (string, interface{}, error)
+	typed    *typedSet // if non-nil, recognizes typed results
 }
 
 // NewGetter constructs a new Getter that starts a server on mux and dispatches
@@ -53,12 +54,14 @@ type Getter struct {
 // Note that a getter is not able to push calls or notifications from the
 // server back to the remote client even if enabled.
 func NewGetter(mux jrpc2.Assigner, opts *GetterOptions) Getter {
+	typed := newTypedSet(opts.typedResults())
 	return Getter{
-		local: server.NewLocal(mux, &server.LocalOptions{
-			Client: opts.clientOptions(),
-			Server: opts.serverOptions(),
+		local: server.NewLocal(typed.wrap(mux), &server.LocalOptions{
+			Client: typed.clientOptions(opts.clientOptions()),
+			Server: typed.serverOptions(opts.serverOptions()),
 		}),
 		parseReq: opts.parseRequest(),
+		typed:    typed,
 	}
 }
 
@@ -74,7 +77,24 @@ func (g Getter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 
 	var result json.RawMessage
-	if err := g.local.Client.CallResult(req.Context(), method, params, &result); err != nil {
+	ctx := req.Context()
+	var tc *typedCall
+	if g.typed != nil {
+		var done func()
+		ctx, tc, done = g.typed.begin(ctx)
+		defer done()
+	}
+	rsp, err := g.local.Client.Call(ctx, method, params)
+	if err == nil {
+		if tc != nil {
+			if tr, ok := tc.result(); ok {
+				writeTyped(w, tr)
+				return
+			}
+		}
+		err = rsp.UnmarshalResult(&result)
+	}
+	if err != nil {
 		var status int
 		switch code.FromError(err) {
 		case code.MethodNotFound:
@@ -113,8 +133,17 @@ type GetterOptions struct {
 	// uses the URL path as the method name and the URL query as the method
 	// parameters.
 	ParseRequest func(*http.Request) (string, interface{}, error)
+
+	// If true, a call whose handler returns a jrpc2.TypedResult (or a pointer
+	// to one) is answered with the body of the result and its content type,
+	// rather than a JSON encoding of the result. As for a Bridge, results are
+	// recognized by their type and not by their encoding (see
+	// BridgeOptions.TypedResults).
+	TypedResults bool
 }
 
+func (o *GetterOptions) typedResults() bool { return o != nil && o.TypedResults }
+
 func (o *GetterOptions) clientOptions() *jrpc2.ClientOptions {
 	if o == nil {
 		return nil
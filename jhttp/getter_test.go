@@ -12,6 +12,8 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/creachadair/jrpc2"
+	"github.com/creachadair/jrpc2/code"
 	"github.com/creachadair/jrpc2/handler"
 	"github.com/creachadair/jrpc2/jhttp"
 	"github.com/fortytw2/leaktest"
@@ -231,3 +233,33 @@ func mustGet(t *testing.T, url string, code int) string {
 	}
 	return string(body)
 }
+
+func TestStatusForCode(t *testing.T) {
+	tests := []struct {
+		code code.Code
+		want int
+	}{
+		{code.NoError, http.StatusOK},
+		{code.ParseError, http.StatusBadRequest},
+		{code.InvalidRequest, http.StatusBadRequest},
+		{code.InvalidParams, http.StatusBadRequest},
+		{code.MethodNotFound, http.StatusNotFound},
+		{code.Cancelled, http.StatusRequestTimeout},
+		{code.DeadlineExceeded, http.StatusGatewayTimeout},
+		{code.ServerUnavailable, http.StatusServiceUnavailable},
+		{code.InternalError, http.StatusInternalServerError},
+		{code.SystemError, http.StatusInternalServerError},
+		{code.Code(12345), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		if got := jhttp.StatusForCode(test.code); got != test.want {
+			t.Errorf("StatusForCode(%v): got %d, want %d", test.code, got, test.want)
+		}
+	}
+	if got := jhttp.StatusForError(nil); got != http.StatusOK {
+		t.Errorf("StatusForError(nil): got %d, want %d", got, http.StatusOK)
+	}
+	if got := jhttp.StatusForError(jrpc2.Errorf(code.InvalidParams, "bad")); got != http.StatusBadRequest {
+		t.Errorf("StatusForError(InvalidParams): got %d, want %d", got, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright (C) 2026 Michael J. Fromberger. All Rights Reserved.
+
+package jhttp
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/creachadair/jrpc2"
+	"github.com/creachadair/jrpc2/channel"
+)
+
+// NewHandler returns an http.Handler that serves each HTTP request with its
+// own server on mux. The server is started when the request arrives, given the
+// (complete) request body as its only input message, and shut down as soon as
+// it has delivered its reply. The options for the server are taken from opts.
+//
+// Unlike a Bridge, the handler does not share a client among HTTP callers, so
+// request IDs are passed through to the server without remapping, and the
+// server validates the request message exactly as it would on any other
+// channel. The response body is the message sent by the server, which is a
+// single response or an array for a batch.
+//
+// Like a Bridge, the handler accepts only HTTP POST requests whose
+// Content-Type is application/json, and otherwise reports 405 (Method Not
+// Allowed) or 415 (Unsupported Media Type). If the server replies, the HTTP
+// response is 200 (OK); if the request contained only notifications, the
+// response is 204 (No Content) with an empty body.
+//
+// Because the server exits once the request is complete, it cannot push
+// messages back to the caller, and the AllowPush server option is ignored.
+// The handler does not support typed results (see BridgeOptions.TypedResults):
+// A jrpc2.TypedResult is sent as an ordinary JSON-RPC result.
+//
+// The contexts of each server carry its HTTP request, which the Authenticate
+// hook of the server options and the handlers of mux may retrieve with
+// HTTPRequest, for example to check its headers.
+func NewHandler(mux jrpc2.Assigner, opts *HandlerOptions) http.Handler {
+	var sopts jrpc2.ServerOptions
+	if s := opts.serverOptions(); s != nil {
+		sopts = *s
+	}
+	sopts.AllowPush = false
+	return serverHandler{mux: mux, opts: &sopts}
+}
+
+// HandlerOptions are optional settings for a handler constructed by
+// NewHandler. A nil pointer is ready for use and provides default values.
+type HandlerOptions struct {
+	// Options for the server constructed for each request (default nil).
+	Server *jrpc2.ServerOptions
+}
+
+func (o *HandlerOptions) serverOptions() *jrpc2.ServerOptions {
+	if o == nil {
+		return nil
+	}
+	return o.Server
+}
+
+type serverHandler struct {
+	mux  jrpc2.Assigner
+	opts *jrpc2.ServerOptions
+}
+
+// ServeHTTP implements the required method of http.Handler.
+func (h serverHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Accept-Post", "application/json")
+	if req.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	} else if req.Header.Get("Content-Type") != "application/json" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	opts := *h.opts
+	newContext := opts.NewContext
+	opts.NewContext = func() context.Context {
+		ctx := context.Background()
+		if newContext != nil {
+			ctx = newContext()
+		}
+		return context.WithValue(ctx, httpRequestKey{}, req)
+	}
+
+	ch := newOneShot(body)
+	srv := jrpc2.NewServer(h.mux, &opts).Start(ch)
+
+	// Once the server has read the request, begin a graceful shutdown so that
+	// the server exits after its reply (if any) is delivered.
+	select {
+	case <-ch.read:
+		srv.Shutdown(req.Context())
+	case <-ch.done:
+		// The server stopped before reading the request, for example because
+		// authentication failed.
+	case <-req.Context().Done():
+		srv.Stop()
+	}
+	srv.Wait()
+
+	reply := ch.reply()
+	if reply == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(reply)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(reply)
+}
+
+type httpRequestKey struct{}
+
+// HTTPRequest returns the HTTP request attached to ctx by a handler created by
+// NewHandler, or nil if ctx does not carry a request.
+func HTTPRequest(ctx context.Context) *http.Request {
+	req, _ := ctx.Value(httpRequestKey{}).(*http.Request)
+	return req
+}
+
+// oneShot is a channel.Channel that delivers a single message to the server
+// and records the first message the server sends in reply.
+type oneShot struct {
+	read chan struct{} // closed when the server asks for a second message
+	done chan struct{} // closed when the channel is closed
+
+	mu   sync.Mutex
+	msg  []byte // the request message, nil once it has been received
+	rsp  []byte // the first reply from the server
+	sent bool   // whether the request message has been received
+}
+
+func newOneShot(msg []byte) *oneShot {
+	return &oneShot{
+		read: make(chan struct{}),
+		done: make(chan struct{}),
+		msg:  msg,
+	}
+}
+
+// Send implements part of channel.Channel. Only the first message is kept.
+func (o *oneShot) Send(msg []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.rsp == nil {
+		o.rsp = append([]byte{}, msg...)
+	}
+	return nil
+}
+
+// Recv implements part of channel.Channel. The first call returns the
+// request message. The second call blocks until the channel is closed.
+func (o *oneShot) Recv() ([]byte, error) {
+	o.mu.Lock()
+	if !o.sent {
+		o.sent = true
+		msg := o.msg
+		o.msg = nil
+		o.mu.Unlock()
+		return msg, nil
+	}
+	o.mu.Unlock()
+
+	// The server does not ask for another message until it has queued the
+	// first one, so it is now safe to shut it down gracefully.
+	close(o.read)
+	<-o.done
+	return nil, channel.ErrClosed
+}
+
+// Close implements part of channel.Channel.
+func (o *oneShot) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	select {
+	case <-o.done:
+	default:
+		close(o.done)
+	}
+	return nil
+}
+
+func (o *oneShot) reply() []byte {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.rsp
+}
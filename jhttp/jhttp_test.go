@@ -6,10 +6,13 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/creachadair/jrpc2"
@@ -233,6 +236,312 @@ func TestBridge_parseGETRequest(t *testing.T) {
 	})
 }
 
+func TestBridge_typedResults(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	mux := handler.Map{
+		"File": handler.New(func(context.Context) jrpc2.TypedResult {
+			return jrpc2.TypedResult{ContentType: "text/plain", Body: []byte("hello")}
+		}),
+		"Ptr": handler.New(func(context.Context) *jrpc2.TypedResult {
+			return &jrpc2.TypedResult{ContentType: "text/html", Body: []byte("<p>hi</p>")}
+		}),
+		"Lookalike": handler.New(func(context.Context) interface{} {
+			return struct {
+				ContentType string `json:"contentType"`
+				Body        []byte `json:"body"`
+			}{"text/plain", []byte("hello")}
+		}),
+	}
+	const call = `{"jsonrpc":"2.0","id":1,"method":"File"}`
+	const encoded = `{"jsonrpc":"2.0","id":1,"result":{"contentType":"text/plain","body":"aGVsbG8="}}`
+
+	post := func(t *testing.T, url, body string) (string, string) {
+		t.Helper()
+		rsp, err := http.Post(url, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("POST request failed: %v", err)
+		}
+		defer rsp.Body.Close()
+		data, err := io.ReadAll(rsp.Body)
+		if err != nil {
+			t.Fatalf("Reading POST body: %v", err)
+		}
+		return rsp.Header.Get("Content-Type"), string(data)
+	}
+
+	t.Run("Default", func(t *testing.T) {
+		b := jhttp.NewBridge(mux, nil)
+		defer checkClose(t, b)
+		hsrv := httptest.NewServer(b)
+		defer hsrv.Close()
+
+		if _, got := post(t, hsrv.URL, call); got != encoded {
+			t.Errorf("POST body: got %#q, want %#q", got, encoded)
+		}
+	})
+
+	t.Run("Enabled", func(t *testing.T) {
+		b := jhttp.NewBridge(mux, &jhttp.BridgeOptions{
+			TypedResults: true,
+			ParseGETRequest: func(req *http.Request) (string, interface{}, error) {
+				return strings.Trim(req.URL.Path, "/"), nil, nil
+			},
+		})
+		defer checkClose(t, b)
+		hsrv := httptest.NewServer(b)
+		defer hsrv.Close()
+
+		ctype, got := post(t, hsrv.URL, call)
+		if got != "hello" || ctype != "text/plain" {
+			t.Errorf("POST: got %#q (%s), want hello (text/plain)", got, ctype)
+		}
+
+		// A batch is answered with JSON-RPC responses.
+		const batch = `[` + call + `,{"jsonrpc":"2.0","id":2,"method":"File"}]`
+		if _, got := post(t, hsrv.URL, batch); !strings.HasPrefix(got, `[`+encoded+`,`) {
+			t.Errorf("POST batch: got %#q, want JSON responses", got)
+		}
+
+		if got := mustGet(t, hsrv.URL+"/File", http.StatusOK); got != "hello" {
+			t.Errorf("GET: got %#q, want hello", got)
+		}
+
+		ctype, got = post(t, hsrv.URL, `{"jsonrpc":"2.0","id":1,"method":"Ptr"}`)
+		if got != "<p>hi</p>" || ctype != "text/html" {
+			t.Errorf("POST Ptr: got %#q (%s), want <p>hi</p> (text/html)", got, ctype)
+		}
+
+		// A result that only looks like a typed result is sent as JSON-RPC.
+		const lookalike = `{"jsonrpc":"2.0","id":1,"method":"Lookalike"}`
+		if _, got := post(t, hsrv.URL, lookalike); got != encoded {
+			t.Errorf("POST Lookalike: got %#q, want %#q", got, encoded)
+		}
+		if got := mustGet(t, hsrv.URL+"/Lookalike", http.StatusOK); got != `{"contentType":"text/plain","body":"aGVsbG8="}` {
+			t.Errorf("GET Lookalike: got %#q, want JSON", got)
+		}
+	})
+
+	t.Run("Meta", func(t *testing.T) {
+		type userKey struct{}
+		mmux := handler.Map{
+			"User": handler.New(func(ctx context.Context) jrpc2.TypedResult {
+				user, _ := ctx.Value(userKey{}).(string)
+				return jrpc2.TypedResult{ContentType: "text/plain", Body: []byte(user)}
+			}),
+		}
+		b := jhttp.NewBridge(mmux, &jhttp.BridgeOptions{
+			TypedResults: true,
+			Client: &jrpc2.ClientOptions{
+				EncodeMeta: func(context.Context, string) (json.RawMessage, error) {
+					return json.RawMessage(`{"user":"alice"}`), nil
+				},
+			},
+			Server: &jrpc2.ServerOptions{
+				DecodeMeta: func(ctx context.Context, _ string, meta json.RawMessage) (context.Context, error) {
+					var m struct{ User string }
+					if strings.Contains(string(meta), "jhttp.") {
+						return nil, fmt.Errorf("unexpected metadata %s", meta)
+					} else if err := json.Unmarshal(meta, &m); err != nil {
+						return nil, err
+					}
+					return context.WithValue(ctx, userKey{}, m.User), nil
+				},
+			},
+		})
+		defer checkClose(t, b)
+		hsrv := httptest.NewServer(b)
+		defer hsrv.Close()
+
+		// The bridge's own metadata is not visible to the user's hooks.
+		ctype, got := post(t, hsrv.URL, `{"jsonrpc":"2.0","id":1,"method":"User"}`)
+		if got != "alice" || ctype != "text/plain" {
+			t.Errorf("POST User: got %#q (%s), want alice (text/plain)", got, ctype)
+		}
+	})
+
+	t.Run("FailAfterHandler", func(t *testing.T) {
+		started := make(chan struct{})
+		release := make(chan struct{})
+		returned := make(chan struct{})
+		fmux := handler.Map{
+			"Slow": handler.New(func(context.Context) jrpc2.TypedResult {
+				close(started)
+				<-release
+				defer close(returned)
+				return jrpc2.TypedResult{ContentType: "text/plain", Body: []byte("slow")}
+			}),
+			"Broken":    mux["File"],
+			"Lookalike": mux["Lookalike"],
+		}
+		b := jhttp.NewBridge(fmux, &jhttp.BridgeOptions{
+			TypedResults: true,
+			Server: &jrpc2.ServerOptions{
+				TransformResult: func(_ context.Context, method string, result json.RawMessage) (json.RawMessage, error) {
+					if method == "Broken" {
+						return nil, errors.New("transform failed")
+					}
+					return result, nil
+				},
+			},
+		})
+		defer checkClose(t, b)
+
+		serve := func(ctx context.Context, body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("POST", "/", strings.NewReader(body)).WithContext(ctx)
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			b.ServeHTTP(rec, req)
+			return rec
+		}
+
+		// A typed result reported after its caller gave up is not mistaken
+		// for the result of a later call.
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			serve(ctx, `{"jsonrpc":"2.0","id":1,"method":"Slow"}`)
+		}()
+		<-started
+		cancel()
+		<-done
+		close(release)
+		<-returned
+
+		const lookalike = `{"jsonrpc":"2.0","id":1,"method":"Lookalike"}`
+		if rec := serve(context.Background(), lookalike); rec.Body.String() != encoded {
+			t.Errorf("POST Lookalike: got %#q, want %#q", rec.Body.String(), encoded)
+		}
+
+		// A typed result whose call then fails is reported as an error.
+		rec := serve(context.Background(), `{"jsonrpc":"2.0","id":1,"method":"Broken"}`)
+		if ctype := rec.Header().Get("Content-Type"); ctype != "application/json" ||
+			!strings.Contains(rec.Body.String(), `"error"`) {
+			t.Errorf("POST Broken: got %#q (%s), want a JSON-RPC error", rec.Body.String(), ctype)
+		}
+	})
+}
+
+func TestHandler(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	var mu sync.Mutex
+	var notes []string
+	mux := handler.Map{
+		"Test1": testService["Test1"],
+		"Note": handler.New(func(_ context.Context, ss []string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			notes = append(notes, ss...)
+			return nil
+		}),
+	}
+	hsrv := httptest.NewServer(jhttp.NewHandler(mux, nil))
+	defer hsrv.Close()
+
+	tests := []struct {
+		name, req string
+		code      int
+		want      string
+	}{
+		{"Call", `{"jsonrpc":"2.0","id":"xyz","method":"Test1","params":["a","b"]}`,
+			http.StatusOK, `{"jsonrpc":"2.0","id":"xyz","result":2}`},
+		{"Batch", `[{"jsonrpc":"2.0","id":3,"method":"Test1","params":["c"]},
+		  {"jsonrpc":"2.0","method":"Note","params":["d"]},
+		  {"jsonrpc":"2.0","id":7,"method":"Test1","params":[]}]`,
+			http.StatusOK, `[{"jsonrpc":"2.0","id":3,"result":1},{"jsonrpc":"2.0","id":7,"result":0}]`},
+		{"Notification", `{"jsonrpc":"2.0","method":"Note","params":["e"]}`,
+			http.StatusNoContent, ``},
+		{"NoMethod", `{"jsonrpc":"2.0","id":1,"method":"Nonesuch"}`,
+			http.StatusOK, `{"jsonrpc":"2.0","id":1,"error":{"code":-32601,"message":"method not found","data":"Nonesuch"}}`},
+		{"ParseError", `{"jsonrpc":"2.0",`,
+			http.StatusOK, `{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"invalid request value"}}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := mustPost(t, hsrv.URL, test.req, test.code)
+			if got != test.want {
+				t.Errorf("POST body: got %#q, want %#q", got, test.want)
+			}
+		})
+	}
+
+	// Notifications must complete before the reply is written.
+	mu.Lock()
+	if got := strings.Join(notes, " "); got != "d e" {
+		t.Errorf("Notifications: got %q, want %q", got, "d e")
+	}
+	mu.Unlock()
+
+	t.Run("GetFail", func(t *testing.T) {
+		rsp, err := http.Get(hsrv.URL)
+		if err != nil {
+			t.Fatalf("GET request failed: %v", err)
+		} else if got, want := rsp.StatusCode, http.StatusMethodNotAllowed; got != want {
+			t.Errorf("GET status: got %v, want %v", got, want)
+		}
+	})
+	t.Run("PostInvalidType", func(t *testing.T) {
+		rsp, err := http.Post(hsrv.URL, "text/plain", strings.NewReader(`{}`))
+		if err != nil {
+			t.Fatalf("POST request failed: %v", err)
+		} else if got, want := rsp.StatusCode, http.StatusUnsupportedMediaType; got != want {
+			t.Errorf("POST response code: got %v, want %v", got, want)
+		}
+	})
+}
+
+// Verify that the server for each request can see the HTTP request.
+func TestHandler_httpRequest(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	mux := handler.Map{
+		"Agent": handler.New(func(ctx context.Context) string {
+			return jhttp.HTTPRequest(ctx).Header.Get("User-Agent")
+		}),
+	}
+	hsrv := httptest.NewServer(jhttp.NewHandler(mux, &jhttp.HandlerOptions{
+		Server: &jrpc2.ServerOptions{
+			Authenticate: func(ctx context.Context) (context.Context, error) {
+				if req := jhttp.HTTPRequest(ctx); req == nil || req.Header.Get("User-Agent") != "ok" {
+					return nil, errors.New("denied")
+				}
+				return ctx, nil
+			},
+		},
+	}))
+	defer hsrv.Close()
+
+	post := func(agent string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest("POST", hsrv.URL, strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"Agent"}`))
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", agent)
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST request failed: %v", err)
+		}
+		return rsp
+	}
+
+	rsp := post("ok")
+	body, _ := io.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if got, want := string(body), `{"jsonrpc":"2.0","id":1,"result":"ok"}`; got != want {
+		t.Errorf("POST body: got %#q, want %#q", got, want)
+	}
+
+	rsp = post("bad")
+	rsp.Body.Close()
+	if got, want := rsp.StatusCode, http.StatusNoContent; got != want {
+		t.Errorf("POST denied: got status %v, want %v", got, want)
+	}
+}
+
 func TestChannel(t *testing.T) {
 	defer leaktest.Check(t)()
 
@@ -283,6 +592,49 @@ func TestChannel(t *testing.T) {
 	}
 }
 
+func TestNewClient(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	hsrv := httptest.NewServer(jhttp.NewHandler(testService, nil))
+	defer hsrv.Close()
+
+	var posts int32
+	cli := jhttp.NewClient(hsrv.URL, countPosts{&posts}, nil)
+	ctx := context.Background()
+
+	var got int
+	if err := cli.CallResult(ctx, "Test1", []string{"a", "b", "c"}, &got); err != nil {
+		t.Errorf("Call failed: %v", err)
+	} else if got != 3 {
+		t.Errorf("Call result: got %d, want 3", got)
+	}
+	if err := cli.Notify(ctx, "Test1", []string{"d"}); err != nil {
+		t.Errorf("Notify failed: %v", err)
+	}
+	rsps, err := cli.Batch(ctx, []jrpc2.Spec{
+		{Method: "Test1", Params: []string{"e"}},
+		{Method: "Test1", Params: []string{}, Notify: true},
+		{Method: "Test1", Params: []string{"f", "g"}},
+	})
+	if err != nil {
+		t.Errorf("Batch failed: %v", err)
+	} else if len(rsps) != 2 {
+		t.Errorf("Batch: got %d responses, want 2", len(rsps))
+	} else {
+		for i, want := range []string{"1", "2"} {
+			if got := rsps[i].ResultString(); got != want {
+				t.Errorf("Batch response %d: got %s, want %s", i, got, want)
+			}
+		}
+	}
+	cli.Close()
+
+	// One POST each for the call, the notification, and the batch.
+	if got := atomic.LoadInt32(&posts); got != 3 {
+		t.Errorf("HTTP requests: got %d, want 3", got)
+	}
+}
+
 // counter implements the HTTPClient interface via a real HTTP client.  As a
 // side effect it counts the number of invocations of its signature method.
 type counter struct {
@@ -295,6 +647,15 @@ func (c counter) Do(req *http.Request) (*http.Response, error) {
 	return c.c.Do(req)
 }
 
+// countPosts implements the HTTPClient interface via http.DefaultClient, and
+// counts the requests it sends. It is safe for concurrent use.
+type countPosts struct{ z *int32 }
+
+func (c countPosts) Do(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(c.z, 1)
+	return http.DefaultClient.Do(req)
+}
+
 func checkClose(t *testing.T, c io.Closer) {
 	t.Helper()
 	if err := c.Close(); err != nil {
@@ -0,0 +1,45 @@
+// Copyright (C) 2026 Michael J. Fromberger. All Rights Reserved.
+
+package jhttp
+
+import (
+	"net/http"
+
+	"github.com/creachadair/jrpc2/code"
+)
+
+// StatusForCode returns an HTTP status code suitable for reporting a JSON-RPC
+// error with code c to an HTTP client. It is intended for gateways that front
+// a JSON-RPC service with plain HTTP:
+//
+//	JSON-RPC code                              HTTP Status
+//	------------------------------------------ -------------------------
+//	NoError                                    200 (OK)
+//	ParseError, InvalidRequest, InvalidParams  400 (Bad request)
+//	MethodNotFound                             404 (Not found)
+//	Cancelled                                  408 (Request timeout)
+//	ServerUnavailable                          503 (Service unavailable)
+//	DeadlineExceeded                           504 (Gateway timeout)
+//	(other codes)                              500 (Internal server error)
+func StatusForCode(c code.Code) int {
+	switch c {
+	case code.NoError:
+		return http.StatusOK
+	case code.ParseError, code.InvalidRequest, code.InvalidParams:
+		return http.StatusBadRequest
+	case code.MethodNotFound:
+		return http.StatusNotFound
+	case code.Cancelled:
+		return http.StatusRequestTimeout
+	case code.ServerUnavailable:
+		return http.StatusServiceUnavailable
+	case code.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+// StatusForError returns the HTTP status code corresponding to the JSON-RPC
+// error code of err, as determined by StatusForCode. If err == nil, it
+// returns 200 (OK).
+func StatusForError(err error) int { return StatusForCode(code.FromError(err)) }
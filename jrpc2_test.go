@@ -7,7 +7,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -15,8 +18,10 @@ import (
 
 	"github.com/creachadair/jrpc2"
 	"github.com/creachadair/jrpc2/channel"
+	"github.com/creachadair/jrpc2/channel/chantest"
 	"github.com/creachadair/jrpc2/code"
 	"github.com/creachadair/jrpc2/handler"
+	"github.com/creachadair/jrpc2/metrics"
 	"github.com/creachadair/jrpc2/server"
 	"github.com/fortytw2/leaktest"
 	"github.com/google/go-cmp/cmp"
@@ -248,6 +253,9 @@ func TestClient_Batch(t *testing.T) {
 		t.Errorf("Wrong number of responses: got %d, want %d", len(batch), len(callTests))
 	}
 	for i, rsp := range batch {
+		if got, want := rsp.Method(), callTests[i].method; got != want {
+			t.Errorf("Response %d method: got %q, want %q", i+1, got, want)
+		}
 		if err := rsp.Error(); err != nil {
 			t.Errorf("Response %d failed: %v", i+1, err)
 			continue
@@ -263,6 +271,66 @@ func TestClient_Batch(t *testing.T) {
 	}
 }
 
+// Verify that a batch spec that cannot be encoded is identified in the error.
+func TestClient_NewBatch(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	loc := server.NewLocal(handler.Map{
+		"Echo": handler.New(func(_ context.Context, ss []string) (string, error) {
+			return strings.Join(ss, " "), nil
+		}),
+	}, nil)
+	defer loc.Close()
+
+	rsps, err := loc.Client.NewBatch().
+		Add("Echo", []string{"a"}).
+		Notify("Echo", []string{"b"}).
+		Add("Echo", []string{"c", "d"}).
+		Do(context.Background())
+	if err != nil {
+		t.Fatalf("Do: unexpected error: %v", err)
+	}
+	want := []string{`"a"`, "", `"c d"`}
+	if len(rsps) != len(want) {
+		t.Fatalf("Do: got %d responses, want %d", len(rsps), len(want))
+	}
+	for i, rsp := range rsps {
+		if want[i] == "" {
+			if rsp != nil {
+				t.Errorf("Response %d: got %v, want nil for a notification", i, rsp)
+			}
+		} else if rsp == nil {
+			t.Errorf("Response %d: got nil, want %s", i, want[i])
+		} else if got := rsp.ResultString(); got != want[i] {
+			t.Errorf("Response %d: got %s, want %s", i, got, want[i])
+		}
+	}
+}
+
+func TestClient_BatchEncodingError(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	loc := server.NewLocal(handler.Map{
+		"Test": handler.New(func(context.Context) error { return nil }),
+	}, nil)
+	defer loc.Close()
+
+	rsps, err := loc.Client.Batch(context.Background(), []jrpc2.Spec{
+		{Method: "Test"},
+		{Method: "Test", Params: []interface{}{make(chan int)}},
+	})
+	if err == nil {
+		t.Fatalf("Batch: got %+v, wanted error", rsps)
+	}
+	if got, want := err.Error(), `spec 1 ("Test"): `; !strings.HasPrefix(got, want) {
+		t.Errorf("Batch error: got %q, want prefix %q", got, want)
+	}
+	var jerr *json.UnsupportedTypeError
+	if !errors.As(err, &jerr) {
+		t.Errorf("Batch error: got %v, want it to wrap %T", err, jerr)
+	}
+}
+
 // Verify that notifications respect order of arrival.
 func TestServer_notificationOrder(t *testing.T) {
 	defer leaktest.Check(t)()
@@ -411,6 +479,155 @@ func TestServer_stopCancelsHandlers(t *testing.T) {
 	}
 }
 
+// Test that Shutdown waits for in-flight requests to finish before stopping.
+func TestServer_Shutdown(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	loc := server.NewLocal(handler.Map{
+		"Block": handler.New(func(ctx context.Context) (string, error) {
+			started <- struct{}{}
+			<-release
+			return "done", nil
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{Concurrency: 2},
+	})
+	defer loc.Close()
+	s, c := loc.Server, loc.Client
+
+	// Issue a batch whose handlers will block until released.
+	type result struct {
+		rsps []*jrpc2.Response
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		rsps, err := c.Batch(context.Background(), []jrpc2.Spec{
+			{Method: "Block"},
+			{Method: "Block"},
+		})
+		done <- result{rsps, err}
+	}()
+	<-started
+	<-started
+
+	sdone := make(chan error, 1)
+	go func() { sdone <- s.Shutdown(context.Background()) }()
+
+	select {
+	case err := <-sdone:
+		t.Fatalf("Shutdown returned early: %v", err)
+	case <-time.After(50 * time.Millisecond):
+		// OK, the handlers are still running
+	}
+	close(release)
+
+	if err := <-sdone; err != nil {
+		t.Errorf("Shutdown: unexpected error: %v", err)
+	}
+	res := <-done
+	if res.err != nil {
+		t.Fatalf("Batch failed: %v", res.err)
+	}
+	for i, rsp := range res.rsps {
+		var got string
+		if err := rsp.UnmarshalResult(&got); err != nil {
+			t.Errorf("Response %d: unexpected error: %v", i, err)
+		} else if got != "done" {
+			t.Errorf("Response %d: got %q, want done", i, got)
+		}
+	}
+	if err := s.Wait(); err != nil {
+		t.Errorf("Wait: unexpected error: %v", err)
+	}
+}
+
+// Test that Shutdown stops the server when its context ends.
+func TestServer_ShutdownTimeout(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	started := make(chan struct{})
+	loc := server.NewLocal(handler.Map{
+		"Hang": handler.New(func(ctx context.Context) error {
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		}),
+	}, nil)
+	defer loc.Close()
+	s, c := loc.Server, loc.Client
+
+	stopped := make(chan error, 1)
+	go func() {
+		_, err := c.Call(context.Background(), "Hang", nil)
+		stopped <- err
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := <-stopped; code.FromError(err) != code.Cancelled {
+		t.Errorf("Call: got %v, wanted code %v", err, code.Cancelled)
+	}
+}
+
+// Test that a server replies to calls received during shutdown with a code
+// that tells the client it may retry elsewhere.
+func TestServer_ShutdownUnavailable(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	loc := server.NewLocal(handler.Map{
+		"Block": handler.New(func(context.Context) error {
+			close(started)
+			<-release
+			return nil
+		}),
+		"Quick": handler.New(func(context.Context) error { return nil }),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{Concurrency: 2},
+	})
+	defer loc.Close()
+	s, c := loc.Server, loc.Client
+	ctx := context.Background()
+
+	bdone := make(chan error, 1)
+	go func() { _, err := c.Call(ctx, "Block", nil); bdone <- err }()
+	<-started
+
+	sdone := make(chan error, 1)
+	go func() { sdone <- s.Shutdown(ctx) }()
+
+	// Calls succeed until the shutdown begins, and are rejected after.
+	for {
+		_, err := c.Call(ctx, "Quick", nil)
+		if err == nil {
+			time.Sleep(time.Millisecond)
+			continue
+		} else if got := code.FromError(err); got != code.ServerUnavailable {
+			t.Fatalf("Call: got %v, want code %v", err, code.ServerUnavailable)
+		}
+		break
+	}
+	if err := c.Notify(ctx, "Quick", nil); err != nil {
+		t.Errorf("Notify: unexpected error: %v", err)
+	}
+
+	close(release)
+	if err := <-bdone; err != nil {
+		t.Errorf("Call(Block): unexpected error: %v", err)
+	}
+	if err := <-sdone; err != nil {
+		t.Errorf("Shutdown: unexpected error: %v", err)
+	}
+}
+
 // Test that a handler can cancel an in-flight request.
 func TestServer_CancelRequest(t *testing.T) {
 	defer leaktest.Check(t)()
@@ -463,158 +680,1247 @@ func TestServer_CancelRequest(t *testing.T) {
 	}
 }
 
-// Test that an error with data attached to it is correctly propagated back
-// from the server to the client, in a value of concrete type *Error.
-func TestError_withData(t *testing.T) {
+// Test that a long-poll handler blocked waiting for data unblocks when the
+// client asks the server to cancel its request.
+func TestServer_longPollCancel(t *testing.T) {
 	defer leaktest.Check(t)()
 
-	const errCode = -32000
-	const errData = `{"caroline":452}`
-	const errMessage = "error thingy"
+	data := make(chan string) // never ready
+	polling := make(chan struct{})
 	loc := server.NewLocal(handler.Map{
-		"Err": handler.New(func(_ context.Context) (int, error) {
-			return 17, jrpc2.Errorf(errCode, errMessage).WithData(json.RawMessage(errData))
-		}),
-		"Push": handler.New(func(ctx context.Context) (bool, error) {
-			return false, jrpc2.ServerFromContext(ctx).Notify(ctx, "PushBack", nil)
+		"Poll": handler.New(func(ctx context.Context) (string, error) {
+			close(polling)
+			select {
+			case s := <-data:
+				return s, nil
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
 		}),
-		"Code": handler.New(func(ctx context.Context) error {
-			return code.Code(12345).Err()
+		"Cancel": handler.New(func(ctx context.Context, ids []string) error {
+			for _, id := range ids {
+				jrpc2.ServerFromContext(ctx).CancelRequest(id)
+			}
+			return nil
 		}),
 	}, &server.LocalOptions{
-		Client: &jrpc2.ClientOptions{
-			OnNotify: func(req *jrpc2.Request) {
-				t.Errorf("Client received unexpected push: %#v", req)
-			},
-		},
+		// The cancellation must be able to run while the poll is blocked.
+		Server: &jrpc2.ServerOptions{Concurrency: 2},
 	})
 	defer loc.Close()
-	c := loc.Client
+	ctx := context.Background()
 
-	if got, err := c.Call(context.Background(), "Err", nil); err == nil {
-		t.Errorf("Call(Push): got %#v, wanted error", got)
-	} else if e, ok := err.(*jrpc2.Error); ok {
-		if e.Code != errCode {
-			t.Errorf("Error code: got %d, want %d", e.Code, errCode)
-		}
-		if e.Message != errMessage {
-			t.Errorf("Error message: got %q, want %q", e.Message, errMessage)
-		}
-		if s := string(e.Data); s != errData {
-			t.Errorf("Error data: got %q, want %q", s, errData)
-		}
-	} else {
-		t.Fatalf("Call(Err): unexpected error: %v", err)
-	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := loc.Client.CallID(ctx, json.RawMessage(`100`), "Poll", nil)
+		errc <- err
+	}()
+	<-polling
 
-	if got, err := c.Call(context.Background(), "Push", nil); err == nil {
-		t.Errorf("Call(Push): got %#v, wanted error", got)
+	if _, err := loc.Client.Call(ctx, "Cancel", []string{"100"}); err != nil {
+		t.Fatalf("Cancel call failed: %v", err)
 	}
 
-	if got, err := c.Call(context.Background(), "Code", nil); err == nil {
-		t.Errorf("Call(Code): got %#v, wanted error", got)
-	} else if s, exp := err.Error(), "[12345] error code 12345"; s != exp {
-		t.Errorf("Call(Code): got error %q, want %q", s, exp)
+	if err := <-errc; code.FromError(err) != code.Cancelled {
+		t.Errorf("Poll: got %v, want code %v", err, code.Cancelled)
 	}
 }
 
-// Test that a client correctly reports bad parameters.
-func TestClient_badCallParams(t *testing.T) {
+// Test that a handler can see how much time remains for it to run.
+func TestTimeRemaining(t *testing.T) {
 	defer leaktest.Check(t)()
 
+	if d, ok := jrpc2.TimeRemaining(context.Background()); ok {
+		t.Errorf("TimeRemaining(no deadline): got %v, true; want false", d)
+	}
+
 	loc := server.NewLocal(handler.Map{
-		"Test": handler.New(func(_ context.Context, v interface{}) error {
-			return jrpc2.Errorf(129, "this should not be reached")
+		"Left": handler.New(func(ctx context.Context) (bool, error) {
+			d, ok := jrpc2.TimeRemaining(ctx)
+			return ok && d > 0 && d <= time.Minute, nil
 		}),
-	}, nil)
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{HandlerTimeout: time.Minute},
+	})
 	defer loc.Close()
 
-	rsp, err := loc.Client.Call(context.Background(), "Test", "bogus")
-	if err == nil {
-		t.Errorf("Call(Test): got %+v, wanted error", rsp)
-	} else if got, want := code.FromError(err), code.InvalidRequest; got != want {
-		t.Errorf("Call(Test): got code %v, want %v", got, want)
+	var ok bool
+	if err := loc.Client.CallResult(context.Background(), "Left", nil, &ok); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	} else if !ok {
+		t.Error("Handler did not see the remaining time of its deadline")
 	}
 }
 
-// Verify that metrics are correctly propagated to server info.
-func TestServer_serverInfoMetrics(t *testing.T) {
+// Test that a handler can invoke a sibling method via LocalAssigner.
+func TestLocalAssigner(t *testing.T) {
 	defer leaktest.Check(t)()
 
+	if a := jrpc2.LocalAssigner(context.Background()); a != nil {
+		t.Errorf("LocalAssigner(non-handler context): got %v, want nil", a)
+	}
+
 	loc := server.NewLocal(handler.Map{
-		"Metricize": handler.New(func(ctx context.Context) (bool, error) {
-			m := jrpc2.ServerFromContext(ctx).Metrics()
-			if m == nil {
-				t.Error("Request context does not contain a metrics writer")
-				return false, nil
+		"Sum": handler.New(func(_ context.Context, vs []int) int {
+			var sum int
+			for _, v := range vs {
+				sum += v
 			}
-			m.Count("counters-written", 1)
-			m.Count("counters-written", 2)
-
-			// Max value trackers are not accumulative.
-			m.SetMaxValue("max-metric-value", 1)
-			m.SetMaxValue("max-metric-value", 5)
-			m.SetMaxValue("max-metric-value", 3)
-			m.SetMaxValue("max-metric-value", -30337)
-
-			// Counters are accumulative, and negative deltas subtract.
-			m.Count("zero-sum", 0)
-			m.Count("zero-sum", 15)
-			m.Count("zero-sum", -16)
-			m.Count("zero-sum", 1)
-			return true, nil
+			return sum
 		}),
-	}, nil)
-	s, c := loc.Server, loc.Client
+		"Twice": handler.New(func(ctx context.Context, req *jrpc2.Request) (int, error) {
+			h := jrpc2.LocalAssigner(ctx).Assign(ctx, "Sum")
+			if h == nil {
+				return 0, errors.New("no Sum method")
+			}
+			v, err := h.Handle(ctx, req)
+			if err != nil {
+				return 0, err
+			}
+			return 2 * v.(int), nil
+		}),
+	}, &server.LocalOptions{
+		// Direct invocation does not need a second concurrency slot.
+		Server: &jrpc2.ServerOptions{Concurrency: 1},
+	})
+	defer loc.Close()
 
-	ctx := context.Background()
-	if _, err := c.Call(ctx, "Metricize", nil); err != nil {
-		t.Fatalf("Call(Metricize) failed: %v", err)
-	}
-	if got := s.ServerInfo().Counter["rpc.serversActive"]; got != 1 {
-		t.Errorf("Metric rpc.serversActive: got %d, want 1", got)
+	var got int
+	if err := loc.Client.CallResult(context.Background(), "Twice", []int{1, 2, 3}, &got); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	} else if got != 12 {
+		t.Errorf("Twice result: got %d, want 12", got)
 	}
-	loc.Close()
+}
 
-	info := s.ServerInfo()
-	tests := []struct {
-		input map[string]int64
-		name  string
-		want  int64 // use < 0 to test for existence only
-	}{
-		{info.Counter, "rpc.requests", 1},
-		{info.Counter, "counters-written", 3},
-		{info.Counter, "zero-sum", 0},
-		{info.Counter, "rpc.bytesRead", -1},
-		{info.Counter, "rpc.bytesWritten", -1},
-		{info.Counter, "rpc.serversActive", 0},
-		{info.MaxValue, "max-metric-value", 5},
-		{info.MaxValue, "rpc.bytesRead", -1},
-		{info.MaxValue, "rpc.bytesWritten", -1},
-	}
-	for _, test := range tests {
-		got, ok := test.input[test.name]
-		if !ok {
-			t.Errorf("Metric %q is not defined, but was expected", test.name)
-			continue
+// Verify that requests constructed by NewRequest can be handled directly.
+func TestNewRequest(t *testing.T) {
+	ctx := context.Background()
+	add := handler.New(func(_ context.Context, vs []int) int { return vs[0] + vs[1] })
+
+	params := json.RawMessage(`[1, 2]`)
+	for _, req := range []*jrpc2.Request{
+		jrpc2.NewRequest("Add", params),
+		jrpc2.NewRequestWithID(`"x"`, "Add", params),
+	} {
+		got, err := add.Handle(ctx, req)
+		if err != nil {
+			t.Errorf("Handle %q: unexpected error: %v", req.ID(), err)
+		} else if got != 3 {
+			t.Errorf("Handle %q: got %v, want 3", req.ID(), got)
 		}
-		if test.want >= 0 && got != test.want {
-			t.Errorf("Wrong value for metric %q: got %d, want %d", test.name, got, test.want)
+		if req.Method() != "Add" || req.ParamString() != string(params) {
+			t.Errorf("Request: got method %q params %#q, want Add %#q", req.Method(), req.ParamString(), params)
 		}
 	}
+
+	if req := jrpc2.NewRequest("Note", nil); !req.IsNotification() || req.HasParams() {
+		t.Errorf("NewRequest(Note): got notification=%v params=%v, want true, false", req.IsNotification(), req.HasParams())
+	}
+	if req := jrpc2.NewRequestWithID("1", "Call", nil); req.IsNotification() || req.ID() != "1" {
+		t.Errorf("NewRequestWithID(1): got notification=%v id=%q, want false, 1", req.IsNotification(), req.ID())
+	}
 }
 
-// Ensure that a correct request not sent via the *Client type will still
-// elicit a correct response from the server. Here we simulate a "different"
-// client by writing requests directly into the channel.
-func TestServer_nonLibraryClient(t *testing.T) {
+// Verify that Logf writes to the server log with the request prefixed.
+func TestLogf(t *testing.T) {
 	defer leaktest.Check(t)()
 
-	srv, cli := channel.Direct()
-	s := jrpc2.NewServer(handler.Map{
-		"X": testOK,
-		"Y": handler.New(func(context.Context) (interface{}, error) {
-			return nil, nil
+	jrpc2.Logf(context.Background(), "not a handler") // should not panic
+
+	var mu sync.Mutex
+	var lines []string
+	loc := server.NewLocal(handler.Map{
+		"Sum": handler.New(func(ctx context.Context, vs []int) error {
+			jrpc2.Logf(ctx, "adding %d values", len(vs))
+			return nil
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{
+			Logger: func(text string) {
+				mu.Lock()
+				defer mu.Unlock()
+				lines = append(lines, text)
+			},
+		},
+	})
+	ctx := context.Background()
+	if _, err := loc.Client.Call(ctx, "Sum", []int{1, 2, 3}); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	if err := loc.Client.Notify(ctx, "Sum", []int{4}); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	loc.Close()
+
+	want := map[string]bool{"[Sum id=1] adding 3 values": true, "[Sum] adding 1 values": true}
+	for _, line := range lines {
+		delete(want, line)
+	}
+	if len(want) != 0 {
+		t.Errorf("Missing log lines: %v\nGot: %q", want, lines)
+	}
+}
+
+// Test that request metadata sent by the client as a top-level meta member is
+// decoded by the server into the handler context, leaving params unchanged.
+func TestServer_meta(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	type traceKey struct{}
+	loc := server.NewLocal(handler.Map{
+		"Test": handler.New(func(ctx context.Context, req *jrpc2.Request) (string, error) {
+			trace, _ := ctx.Value(traceKey{}).(string)
+			return trace + " " + req.ParamString(), nil
+		}),
+	}, &server.LocalOptions{
+		Client: &jrpc2.ClientOptions{
+			EncodeMeta: func(ctx context.Context, method string) (json.RawMessage, error) {
+				if method == "Bad" {
+					return json.RawMessage(`[1]`), nil
+				} else if method == "Broken" {
+					return json.RawMessage(`{"a":`), nil
+				}
+				trace, _ := ctx.Value(traceKey{}).(string)
+				if trace == "" {
+					return nil, nil
+				}
+				return json.Marshal(map[string]string{"trace": trace})
+			},
+		},
+		Server: &jrpc2.ServerOptions{
+			DecodeMeta: func(ctx context.Context, method string, meta json.RawMessage) (context.Context, error) {
+				var m struct {
+					Trace string `json:"trace"`
+				}
+				if err := json.Unmarshal(meta, &m); err != nil {
+					return nil, err
+				} else if m.Trace == "reject" {
+					return nil, jrpc2.Errorf(code.Code(-1999), "rejected trace")
+				}
+				return context.WithValue(ctx, traceKey{}, m.Trace), nil
+			},
+		},
+	})
+	defer loc.Close()
+
+	tctx := func(trace string) context.Context {
+		return context.WithValue(context.Background(), traceKey{}, trace)
+	}
+	tests := []struct {
+		ctx  context.Context
+		want string
+	}{
+		{context.Background(), ` ["a"]`},
+		{tctx("t1"), `t1 ["a"]`},
+	}
+	for _, test := range tests {
+		var got string
+		if err := loc.Client.CallResult(test.ctx, "Test", []string{"a"}, &got); err != nil {
+			t.Errorf("Call failed: %v", err)
+		} else if got != test.want {
+			t.Errorf("Call result: got %#q, want %#q", got, test.want)
+		}
+	}
+
+	// An error from the decoder is reported to the caller.
+	if _, err := loc.Client.Call(tctx("reject"), "Test", nil); code.FromError(err) != -1999 {
+		t.Errorf("Call with rejected meta: got %v, want code -1999", err)
+	}
+
+	// The client requires the metadata to be a valid JSON object.
+	for _, method := range []string{"Bad", "Broken"} {
+		if _, err := loc.Client.Call(context.Background(), method, nil); code.FromError(err) != code.InvalidRequest {
+			t.Errorf("Call %q with invalid meta: got %v, want %v", method, err, code.InvalidRequest)
+		}
+	}
+}
+
+// Test that the server reports an access log entry for each request.
+func TestServer_accessLog(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	var mu sync.Mutex
+	entries := make(map[string]jrpc2.AccessLogEntry)
+	loc := server.NewLocal(handler.Map{
+		"Test": handler.New(func(context.Context) string { return "OK" }),
+		"Fail": handler.New(func(context.Context) error { return jrpc2.Errorf(-32050, "failed") }),
+		"Note": handler.New(func(context.Context) error { return nil }),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{
+			AccessLog: func(e jrpc2.AccessLogEntry) {
+				mu.Lock()
+				defer mu.Unlock()
+				entries[e.Method] = e
+			},
+		},
+	})
+	ctx := context.Background()
+	loc.Client.Call(ctx, "Test", nil)
+	loc.Client.Call(ctx, "Fail", nil)
+	loc.Client.Call(ctx, "NoSuch", nil)
+	loc.Client.Notify(ctx, "Note", nil)
+	loc.Close() // wait for the server to finish
+
+	tests := []struct {
+		method    string
+		note      bool
+		req, rsp  int
+		code      code.Code
+		wantDelay bool
+	}{
+		{"Test", false, 40, 38, 0, true},
+		{"Fail", false, 40, 67, -32050, true},
+		{"NoSuch", false, 42, 93, code.MethodNotFound, false},
+		{"Note", true, 33, 0, 0, true},
+	}
+	for _, test := range tests {
+		e, ok := entries[test.method]
+		if !ok {
+			t.Errorf("Missing access log entry for %q", test.method)
+			continue
+		}
+		if e.Notification != test.note {
+			t.Errorf("%s: got notification %v, want %v", test.method, e.Notification, test.note)
+		}
+		if e.RequestBytes != test.req || e.ResponseBytes != test.rsp {
+			t.Errorf("%s: got sizes (%d, %d), want (%d, %d)",
+				test.method, e.RequestBytes, e.ResponseBytes, test.req, test.rsp)
+		}
+		if e.Code != test.code {
+			t.Errorf("%s: got code %v, want %v", test.method, e.Code, test.code)
+		}
+		if ran := e.Duration > 0; ran != test.wantDelay {
+			t.Errorf("%s: got duration %v, want handler run %v", test.method, e.Duration, test.wantDelay)
+		}
+	}
+}
+
+// Test that the server indents its messages when requested, and that they
+// survive framings that do not depend on line breaks.
+func TestServer_indent(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	mux := handler.Map{
+		"Test": handler.New(func(context.Context) []string { return []string{"a", "b"} }),
+	}
+	opts := &jrpc2.ServerOptions{Indent: "  "}
+
+	t.Run("Output", func(t *testing.T) {
+		ch := chantest.New()
+		srv := jrpc2.NewServer(mux, opts).Start(ch)
+		ch.Enqueue([]byte(`{"jsonrpc":"2.0","id":1,"method":"Test"}`))
+		got := string(ch.WaitSent(1)[0])
+		ch.EnqueueEOF()
+		srv.Wait()
+
+		const want = `{
+  "jsonrpc": "2.0",
+  "id": 1,
+  "result": [
+    "a",
+    "b"
+  ]
+}`
+		if got != want {
+			t.Errorf("Server output: got:\n%s\nwant:\n%s", got, want)
+		}
+	})
+
+	for _, test := range []struct {
+		name    string
+		framing channel.Framing
+	}{
+		{"Header", channel.Header("")},
+		{"RawJSON", channel.RawJSON},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cr, sw := io.Pipe()
+			sr, cw := io.Pipe()
+			srv := jrpc2.NewServer(mux, opts).Start(test.framing(sr, sw))
+			cli := jrpc2.NewClient(test.framing(cr, cw), nil)
+
+			var got []string
+			if err := cli.CallResult(context.Background(), "Test", nil, &got); err != nil {
+				t.Errorf("Call failed: %v", err)
+			} else if len(got) != 2 || got[0] != "a" || got[1] != "b" {
+				t.Errorf("Call result: got %q, want [a b]", got)
+			}
+			cli.Close()
+			srv.Wait()
+		})
+	}
+}
+
+// streamCounter wraps a channel that supports streamed sends, and counts the
+// number of streamed records sent.
+type streamCounter struct {
+	channel.Channel
+	n *int32
+}
+
+func (c streamCounter) SendStream(r io.Reader) (int64, error) {
+	atomic.AddInt32(c.n, 1)
+	return c.Channel.(channel.StreamSender).SendStream(r)
+}
+
+// closeReader is an io.ReadCloser that records whether it was closed.
+type closeReader struct {
+	io.Reader
+	closed *int32
+}
+
+func (c closeReader) Close() error { atomic.AddInt32(c.closed, 1); return nil }
+
+// Verify that stream results are streamed when the channel supports it, and
+// buffered otherwise.
+func TestServer_streamResult(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	var closed int32
+	mux := handler.Map{
+		"Stream": handler.New(func(_ context.Context, ss []string) jrpc2.StreamResult {
+			return jrpc2.StreamResult{Reader: closeReader{strings.NewReader(ss[0]), &closed}}
+		}),
+	}
+	ctx := context.Background()
+
+	t.Run("Streamed", func(t *testing.T) {
+		closed = 0
+		var streamed int32
+		cr, sw := io.Pipe()
+		sr, cw := io.Pipe()
+		srv := jrpc2.NewServer(mux, nil).Start(streamCounter{channel.RawJSON(sr, sw), &streamed})
+		cli := jrpc2.NewClient(channel.RawJSON(cr, cw), nil)
+		defer func() { cli.Close(); srv.Wait() }()
+
+		var got []string
+		if err := cli.CallResult(ctx, "Stream", []string{`["a","b"]`}, &got); err != nil {
+			t.Fatalf("Call failed: %v", err)
+		} else if len(got) != 2 || got[0] != "a" || got[1] != "b" {
+			t.Errorf("Call result: got %q, want [a b]", got)
+		}
+		if n := atomic.LoadInt32(&streamed); n != 1 {
+			t.Errorf("Streamed sends: got %d, want 1", n)
+		}
+
+		// The elements of a batch are not streamed.
+		rsps, err := cli.Batch(ctx, []jrpc2.Spec{
+			{Method: "Stream", Params: []string{`17`}},
+			{Method: "Stream", Params: []string{`25`}},
+		})
+		if err != nil {
+			t.Fatalf("Batch failed: %v", err)
+		}
+		for i, want := range []string{"17", "25"} {
+			if got := rsps[i].ResultString(); got != want {
+				t.Errorf("Batch result %d: got %s, want %s", i, got, want)
+			}
+		}
+		if n := atomic.LoadInt32(&streamed); n != 1 {
+			t.Errorf("Streamed sends after batch: got %d, want 1", n)
+		}
+		if n := atomic.LoadInt32(&closed); n != 3 {
+			t.Errorf("Readers closed: got %d, want 3", n)
+		}
+	})
+
+	t.Run("Buffered", func(t *testing.T) {
+		closed = 0
+		loc := server.NewLocal(mux, nil)
+		defer loc.Close()
+
+		rsp, err := loc.Client.Call(ctx, "Stream", []string{`{"ok":true}`})
+		if err != nil {
+			t.Fatalf("Call failed: %v", err)
+		} else if got, want := rsp.ResultString(), `{"ok":true}`; got != want {
+			t.Errorf("Call result: got %s, want %s", got, want)
+		}
+
+		// A buffered result must be valid JSON.
+		if rsp, err := loc.Client.Call(ctx, "Stream", []string{`{"ok":`}); err == nil {
+			t.Errorf("Call: got %v, want error", rsp)
+		} else if got := code.FromError(err); got != code.InternalError {
+			t.Errorf("Call: got code %v, want %v", got, code.InternalError)
+		}
+		if n := atomic.LoadInt32(&closed); n != 2 {
+			t.Errorf("Readers closed: got %d, want 2", n)
+		}
+	})
+}
+
+// chanWriter wraps the writer of a channel so that a test can recognize it.
+type chanWriter struct{ io.WriteCloser }
+
+// jsonWriter is an io.WriterTo that records whether it was asked to write
+// directly to a chanWriter.
+type jsonWriter struct {
+	text   string
+	direct *int32
+}
+
+func (j jsonWriter) WriteTo(w io.Writer) (int64, error) {
+	if _, ok := w.(chanWriter); ok {
+		atomic.AddInt32(j.direct, 1)
+	}
+	n, err := io.WriteString(w, j.text)
+	return int64(n), err
+}
+
+// Verify that a handler result of type io.WriterTo is written directly to a
+// streaming channel, and buffered otherwise.
+func TestServer_writerToResult(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	var direct int32
+	mux := handler.Map{
+		"Write": handler.New(func(_ context.Context, ss []string) io.WriterTo {
+			return jsonWriter{text: ss[0], direct: &direct}
+		}),
+	}
+	ctx := context.Background()
+
+	t.Run("Streamed", func(t *testing.T) {
+		direct = 0
+		cr, sw := io.Pipe()
+		sr, cw := io.Pipe()
+		srv := jrpc2.NewServer(mux, nil).Start(channel.RawJSON(sr, chanWriter{sw}))
+		cli := jrpc2.NewClient(channel.RawJSON(cr, cw), nil)
+		defer func() { cli.Close(); srv.Wait() }()
+
+		rsp, err := cli.Call(ctx, "Write", []string{`[1,2,3]`})
+		if err != nil {
+			t.Fatalf("Call failed: %v", err)
+		} else if got, want := rsp.ResultString(), `[1,2,3]`; got != want {
+			t.Errorf("Call result: got %s, want %s", got, want)
+		}
+		if n := atomic.LoadInt32(&direct); n != 1 {
+			t.Errorf("Direct writes: got %d, want 1", n)
+		}
+	})
+
+	t.Run("Buffered", func(t *testing.T) {
+		direct = 0
+		loc := server.NewLocal(mux, nil)
+		defer loc.Close()
+
+		rsp, err := loc.Client.Call(ctx, "Write", []string{`{"ok":true}`})
+		if err != nil {
+			t.Fatalf("Call failed: %v", err)
+		} else if got, want := rsp.ResultString(), `{"ok":true}`; got != want {
+			t.Errorf("Call result: got %s, want %s", got, want)
+		}
+		if _, err := loc.Client.Call(ctx, "Write", []string{`{"ok":`}); code.FromError(err) != code.InternalError {
+			t.Errorf("Call: got error %v, want %v", err, code.InternalError)
+		}
+		if n := atomic.LoadInt32(&direct); n != 0 {
+			t.Errorf("Direct writes: got %d, want 0", n)
+		}
+	})
+}
+
+// Test that the server consults the SingleFlight hook for calls but not
+// notifications, and that coalesced calls get their results.
+func TestServer_singleFlight(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	var mu sync.Mutex
+	var keys []string
+	loc := server.NewLocal(handler.Map{
+		"Echo": handler.New(func(_ context.Context, vs []int) []int { return vs }),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{
+			SingleFlight: func(method string, params json.RawMessage) (string, bool) {
+				mu.Lock()
+				defer mu.Unlock()
+				key := method + string(params)
+				keys = append(keys, key)
+				return key, true
+			},
+		},
+	})
+	ctx := context.Background()
+	rsps, err := loc.Client.Batch(ctx, []jrpc2.Spec{
+		{Method: "Echo", Params: []int{1}},
+		{Method: "Echo", Params: []int{1}},
+		{Method: "Echo", Params: []int{2}, Notify: true},
+	})
+	if err != nil {
+		t.Fatalf("Batch failed: %v", err)
+	}
+	for i, rsp := range rsps {
+		if got := rsp.ResultString(); got != "[1]" {
+			t.Errorf("Response %d: got %#q, want [1]", i, got)
+		}
+	}
+	loc.Close()
+
+	sort.Strings(keys)
+	if diff := cmp.Diff([]string{"Echo[1]", "Echo[1]"}, keys); diff != "" {
+		t.Errorf("SingleFlight keys (-want, +got):\n%s", diff)
+	}
+}
+
+// Test that nil slice and map results are sent as empty values when the
+// EmptySliceAsArray option is set, and as null otherwise.
+func TestServer_emptySliceAsArray(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	mux := handler.Map{
+		"Slice": handler.New(func(context.Context) ([]int, error) { return nil, nil }),
+		"Map":   handler.New(func(context.Context) (map[string]int, error) { return nil, nil }),
+		"Bytes": handler.New(func(context.Context) ([]byte, error) { return nil, nil }),
+		"Raw":   handler.New(func(context.Context) (json.RawMessage, error) { return nil, nil }),
+		"Ptr":   handler.New(func(context.Context) (*int, error) { return nil, nil }),
+		"Full":  handler.New(func(context.Context) ([]int, error) { return []int{1}, nil }),
+	}
+	tests := []struct {
+		method      string
+		unset, want string
+	}{
+		{"Slice", "null", "[]"},
+		{"Map", "null", "{}"},
+		{"Bytes", "null", "null"},
+		{"Raw", "null", "null"},
+		{"Ptr", "null", "null"},
+		{"Full", "[1]", "[1]"},
+	}
+	for _, empty := range []bool{false, true} {
+		loc := server.NewLocal(mux, &server.LocalOptions{
+			Server: &jrpc2.ServerOptions{EmptySliceAsArray: empty},
+		})
+		for _, test := range tests {
+			want := test.unset
+			if empty {
+				want = test.want
+			}
+			rsp, err := loc.Client.Call(context.Background(), test.method, nil)
+			if err != nil {
+				t.Errorf("Call %q failed: %v", test.method, err)
+			} else if got := rsp.ResultString(); got != want {
+				t.Errorf("Call %q (empty=%v): got %s, want %s", test.method, empty, got, want)
+			}
+		}
+		loc.Close()
+	}
+}
+
+// Test that the server limits the size of error data it sends.
+func TestServer_maxErrorData(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	bigErr := jrpc2.Errorf(-32001, "big").WithData(strings.Repeat("x", 100))
+	loc := server.NewLocal(handler.Map{
+		"Big": handler.New(func(context.Context) error { return bigErr }),
+		"Small": handler.New(func(context.Context) error {
+			return jrpc2.Errorf(-32002, "small").WithData("ok")
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{MaxErrorDataBytes: 30},
+	})
+	defer loc.Close()
+	ctx := context.Background()
+
+	tests := []struct {
+		method   string
+		wantCode code.Code
+		wantData string
+	}{
+		{"Big", -32001, `"xxxxxxxxxxxxxx...(truncated)"`},
+		{"Small", -32002, `"ok"`},
+	}
+	for _, test := range tests {
+		_, err := loc.Client.Call(ctx, test.method, nil)
+		var e *jrpc2.Error
+		if !errors.As(err, &e) {
+			t.Errorf("Call %q: got %v, want *jrpc2.Error", test.method, err)
+			continue
+		}
+		if e.Code != test.wantCode {
+			t.Errorf("Call %q: got code %v, want %v", test.method, e.Code, test.wantCode)
+		}
+		if got := string(e.Data); got != test.wantData {
+			t.Errorf("Call %q: got data %#q, want %#q", test.method, got, test.wantData)
+		}
+	}
+
+	// The handler's own error value is not modified.
+	if n := len(bigErr.Data); n != 102 {
+		t.Errorf("Handler error data was modified: got length %d, want 102", n)
+	}
+}
+
+// Test that an error with data attached to it is correctly propagated back
+// from the server to the client, in a value of concrete type *Error.
+func TestError_withData(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	const errCode = -32000
+	const errData = `{"caroline":452}`
+	const errMessage = "error thingy"
+	loc := server.NewLocal(handler.Map{
+		"Err": handler.New(func(_ context.Context) (int, error) {
+			return 17, jrpc2.Errorf(errCode, errMessage).WithData(json.RawMessage(errData))
+		}),
+		"Push": handler.New(func(ctx context.Context) (bool, error) {
+			return false, jrpc2.ServerFromContext(ctx).Notify(ctx, "PushBack", nil)
+		}),
+		"Code": handler.New(func(ctx context.Context) error {
+			return code.Code(12345).Err()
+		}),
+	}, &server.LocalOptions{
+		Client: &jrpc2.ClientOptions{
+			OnNotify: func(req *jrpc2.Request) {
+				t.Errorf("Client received unexpected push: %#v", req)
+			},
+		},
+	})
+	defer loc.Close()
+	c := loc.Client
+
+	if got, err := c.Call(context.Background(), "Err", nil); err == nil {
+		t.Errorf("Call(Push): got %#v, wanted error", got)
+	} else if e, ok := err.(*jrpc2.Error); ok {
+		if e.Code != errCode {
+			t.Errorf("Error code: got %d, want %d", e.Code, errCode)
+		}
+		if e.Message != errMessage {
+			t.Errorf("Error message: got %q, want %q", e.Message, errMessage)
+		}
+		if s := string(e.Data); s != errData {
+			t.Errorf("Error data: got %q, want %q", s, errData)
+		}
+	} else {
+		t.Fatalf("Call(Err): unexpected error: %v", err)
+	}
+
+	if got, err := c.Call(context.Background(), "Push", nil); err == nil {
+		t.Errorf("Call(Push): got %#v, wanted error", got)
+	}
+
+	if got, err := c.Call(context.Background(), "Code", nil); err == nil {
+		t.Errorf("Call(Code): got %#v, wanted error", got)
+	} else if s, exp := err.Error(), "[12345] error code 12345"; s != exp {
+		t.Errorf("Call(Code): got error %q, want %q", s, exp)
+	}
+}
+
+// Test that a client correctly reports bad parameters.
+func TestClient_badCallParams(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	loc := server.NewLocal(handler.Map{
+		"Test": handler.New(func(_ context.Context, v interface{}) error {
+			return jrpc2.Errorf(129, "this should not be reached")
+		}),
+	}, nil)
+	defer loc.Close()
+
+	rsp, err := loc.Client.Call(context.Background(), "Test", "bogus")
+	if err == nil {
+		t.Errorf("Call(Test): got %+v, wanted error", rsp)
+	} else if got, want := code.FromError(err), code.InvalidRequest; got != want {
+		t.Errorf("Call(Test): got code %v, want %v", got, want)
+	}
+}
+
+// Verify that metrics are correctly propagated to server info.
+func TestServer_serverInfoMetrics(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	loc := server.NewLocal(handler.Map{
+		"Metricize": handler.New(func(ctx context.Context) (bool, error) {
+			m := jrpc2.ServerFromContext(ctx).Metrics()
+			if m == nil {
+				t.Error("Request context does not contain a metrics writer")
+				return false, nil
+			}
+			m.Count("counters-written", 1)
+			m.Count("counters-written", 2)
+
+			// Max value trackers are not accumulative.
+			m.SetMaxValue("max-metric-value", 1)
+			m.SetMaxValue("max-metric-value", 5)
+			m.SetMaxValue("max-metric-value", 3)
+			m.SetMaxValue("max-metric-value", -30337)
+
+			// Counters are accumulative, and negative deltas subtract.
+			m.Count("zero-sum", 0)
+			m.Count("zero-sum", 15)
+			m.Count("zero-sum", -16)
+			m.Count("zero-sum", 1)
+			return true, nil
+		}),
+	}, nil)
+	s, c := loc.Server, loc.Client
+
+	ctx := context.Background()
+	if _, err := c.Call(ctx, "Metricize", nil); err != nil {
+		t.Fatalf("Call(Metricize) failed: %v", err)
+	}
+	if got := s.ServerInfo().Counter["rpc.serversActive"]; got != 1 {
+		t.Errorf("Metric rpc.serversActive: got %d, want 1", got)
+	}
+	loc.Close()
+
+	info := s.ServerInfo()
+	tests := []struct {
+		input map[string]int64
+		name  string
+		want  int64 // use < 0 to test for existence only
+	}{
+		{info.Counter, "rpc.requests", 1},
+		{info.Counter, "counters-written", 3},
+		{info.Counter, "zero-sum", 0},
+		{info.Counter, "rpc.bytesRead", -1},
+		{info.Counter, "rpc.bytesWritten", -1},
+		{info.Counter, "rpc.serversActive", 0},
+		{info.MaxValue, "max-metric-value", 5},
+		{info.MaxValue, "rpc.bytesRead", -1},
+		{info.MaxValue, "rpc.bytesWritten", -1},
+		{info.Counter, "rpc.response.bytes", int64(len("true"))},
+		{info.MaxValue, "rpc.response.bytes.max", int64(len("true"))},
+	}
+	for _, test := range tests {
+		got, ok := test.input[test.name]
+		if !ok {
+			t.Errorf("Metric %q is not defined, but was expected", test.name)
+			continue
+		}
+		if test.want >= 0 && got != test.want {
+			t.Errorf("Wrong value for metric %q: got %d, want %d", test.name, got, test.want)
+		}
+	}
+
+	snap := metrics.Snapshot{LabeledCounter: make(map[string]map[string]int64)}
+	s.Metrics().Snapshot(snap)
+	if got := snap.LabeledCounter["rpc.response.bytes"]["method=Metricize"]; got != int64(len("true")) {
+		t.Errorf("Labeled metric rpc.response.bytes for Metricize: got %d, want %d", got, len("true"))
+	}
+}
+
+// Verify that the server distinguishes requests that ran at once from those
+// that waited for a concurrency slot.
+func TestServer_queuedMetrics(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	loc := server.NewLocal(handler.Map{
+		"Block": handler.New(func(context.Context) error {
+			started <- struct{}{}
+			<-release
+			return nil
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{Concurrency: 1},
+	})
+	defer loc.Close()
+	counter := func(name string) int64 { return loc.Server.ServerInfo().Counter[name] }
+
+	ctx := context.Background()
+	errc := make(chan error, 2)
+	call := func() { _, err := loc.Client.Call(ctx, "Block", nil); errc <- err }
+
+	go call()
+	<-started // the first call holds the only slot
+	go call()
+
+	// Wait for the second call to report that it is waiting.
+	for counter("rpc.requests.queued") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != nil {
+			t.Errorf("Call failed: %v", err)
+		}
+	}
+	if got := counter("rpc.requests.immediate"); got != 1 {
+		t.Errorf("rpc.requests.immediate: got %d, want 1", got)
+	}
+	if got := counter("rpc.requests.queued"); got != 1 {
+		t.Errorf("rpc.requests.queued: got %d, want 1", got)
+	}
+}
+
+// Verify that the server reports its concurrency limit and the peak number
+// of handlers running at once.
+func TestServer_concurrencyMetrics(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	loc := server.NewLocal(handler.Map{
+		"Block": handler.New(func(context.Context) error {
+			started <- struct{}{}
+			<-release
+			return nil
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{Concurrency: 3},
+	})
+	defer loc.Close()
+
+	ctx := context.Background()
+	errc := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { _, err := loc.Client.Call(ctx, "Block", nil); errc <- err }()
+	}
+	<-started
+	<-started
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != nil {
+			t.Errorf("Call failed: %v", err)
+		}
+	}
+
+	info := loc.Server.ServerInfo()
+	if got := info.Label["rpc.concurrency.limit"]; got != int64(3) {
+		t.Errorf("rpc.concurrency.limit: got %v, want 3", got)
+	}
+	if got := info.MaxValue["rpc.concurrency.inUse.max"]; got != 2 {
+		t.Errorf("rpc.concurrency.inUse.max: got %d, want 2", got)
+	}
+}
+
+// Ensure that a correct request not sent via the *Client type will still
+// elicit a correct response from the server. Here we simulate a "different"
+// client by writing requests directly into the channel.
+func TestServer_nonLibraryClient(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	srv, cli := channel.Direct()
+	s := jrpc2.NewServer(handler.Map{
+		"X": testOK,
+		"Y": handler.New(func(context.Context) (interface{}, error) {
+			return nil, nil
+		}),
+	}, nil).Start(srv)
+	defer func() {
+		cli.Close()
+		if err := s.Wait(); err != nil {
+			t.Errorf("Server wait: unexpected error %v", err)
+		}
+	}()
+
+	const invalidIDMessage = `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"invalid request ID"}}`
+	tests := []struct {
+		input, want string
+	}{
+		// Missing version marker (and therefore wrong).
+		{`{"id":0}`,
+			`{"jsonrpc":"2.0","id":0,"error":{"code":-32600,"message":"invalid version marker"}}`},
+
+		// Version marker is present, but wrong.
+		{`{"jsonrpc":"1.5","id":1}`,
+			`{"jsonrpc":"2.0","id":1,"error":{"code":-32600,"message":"invalid version marker"}}`},
+
+		// No method was specified.
+		{`{"jsonrpc":"2.0","id":2}`,
+			`{"jsonrpc":"2.0","id":2,"error":{"code":-32600,"message":"empty method name"}}`},
+
+		// The method specified doesn't exist.
+		{`{"jsonrpc":"2.0", "id": 3, "method": "NoneSuch"}`,
+			`{"jsonrpc":"2.0","id":3,"error":{"code":-32601,"message":"method not found","data":"NoneSuch"}}`},
+
+		// The parameters are of the wrong form.
+		{`{"jsonrpc":"2.0", "id": 4, "method": "X", "params": "bogus"}`,
+			`{"jsonrpc":"2.0","id":4,"error":{"code":-32600,"message":"parameters must be array or object"}}`},
+
+		// The parameters are absent, but as null.
+		{`{"jsonrpc": "2.0", "id": 6, "method": "X", "params": null}`,
+			`{"jsonrpc":"2.0","id":6,"result":"OK"}`},
+
+		// Correct requests.
+		{`{"jsonrpc":"2.0","id": 5, "method": "X"}`, `{"jsonrpc":"2.0","id":5,"result":"OK"}`},
+		{`{"jsonrpc":"2.0","id":21,"method":"Y"}`, `{"jsonrpc":"2.0","id":21,"result":null}`},
+		{`{"jsonrpc":"2.0","id":0,"method":"X"}`, `{"jsonrpc":"2.0","id":0,"result":"OK"}`},
+		{`{"jsonrpc":"2.0","id":-0,"method":"X"}`, `{"jsonrpc":"2.0","id":-0,"result":"OK"}`},
+		{`{"jsonrpc":"2.0","id":-1,"method":"X"}`, `{"jsonrpc":"2.0","id":-1,"result":"OK"}`},
+		{`{"jsonrpc":"2.0","id":-600,"method":"Y"}`, `{"jsonrpc":"2.0","id":-600,"result":null}`},
+
+		// A batch of correct requests.
+		{`[{"jsonrpc":"2.0", "id":"a1", "method":"X"}, {"jsonrpc":"2.0", "id":"a2", "method": "X"}]`,
+			`[{"jsonrpc":"2.0","id":"a1","result":"OK"},{"jsonrpc":"2.0","id":"a2","result":"OK"}]`},
+		{`{"jsonrpc":"2.0", "id":-25, "method":"X"}`, `{"jsonrpc":"2.0","id":-25,"result":"OK"}`},
+
+		// Extra fields on an otherwise-correct request.
+		{`{"jsonrpc":"2.0","id": 7, "method": "Z", "params":[], "bogus":true}`,
+			`{"jsonrpc":"2.0","id":7,"error":{"code":-32600,"message":"extra fields in request","data":["bogus"]}}`},
+
+		// Request metadata is rejected unless the server enables it.
+		{`{"jsonrpc":"2.0","id": 9, "method": "X", "meta":{"trace":"x"}}`,
+			`{"jsonrpc":"2.0","id":9,"error":{"code":-32600,"message":"extra fields in request","data":["meta"]}}`},
+
+		// An empty batch request should report a single error object.
+		{`[]`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"empty request batch"}}`},
+
+		// An invalid batch request should report a single error object.
+		{`[1]`, `[{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"request is not a JSON object"}}]`},
+
+		// A batch of invalid requests returns a batch of errors.
+		{`[{"jsonrpc": "2.0", "id": 6, "method":"bogus"}]`,
+			`[{"jsonrpc":"2.0","id":6,"error":{"code":-32601,"message":"method not found","data":"bogus"}}]`},
+
+		// Batch requests return batch responses, even for a singleton.
+		{`[{"jsonrpc": "2.0", "id": 7, "method": "X"}]`, `[{"jsonrpc":"2.0","id":7,"result":"OK"}]`},
+
+		// Notifications are not reflected in a batch response.
+		{`[{"jsonrpc": "2.0", "method": "note"}, {"jsonrpc": "2.0", "id": 8, "method": "X"}]`,
+			`[{"jsonrpc":"2.0","id":8,"result":"OK"}]`},
+
+		// Invalid structure for a version is reported, with and without ID.
+		{`{"jsonrpc": false}`,
+			`{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"invalid version key"}}`},
+		{`{"jsonrpc": false, "id": 747}`,
+			`{"jsonrpc":"2.0","id":747,"error":{"code":-32700,"message":"invalid version key"}}`},
+
+		// Invalid structure for a method name is reported, with and without ID.
+		{`{"jsonrpc":"2.0", "method": [false]}`,
+			`{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"invalid method name"}}`},
+		{`{"jsonrpc":"2.0", "method": [false], "id": 252}`,
+			`{"jsonrpc":"2.0","id":252,"error":{"code":-32700,"message":"invalid method name"}}`},
+
+		// A broken batch request should report a single top-level error.
+		{`[{"jsonrpc":"2.0", "method":"A", "id": 1}, {"jsonrpc":"2.0"]`, // N.B. syntax error
+			`{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"invalid request value"}}`},
+
+		// A broken single request should report a top-level error.
+		{`{"bogus"][++`,
+			`{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"invalid request value"}}`},
+
+		// Various invalid ID checks.
+		{`{"jsonrpc":"2.0", "id":[], "method":"X"}`, invalidIDMessage},    // invalid ID: array
+		{`{"jsonrpc":"2.0", "id":["q"], "method":"X"}`, invalidIDMessage}, // "
+		{`{"jsonrpc":"2.0", "id":{}, "method":"X"}`, invalidIDMessage},    // invalid ID: object
+		{`{"jsonrpc":"2.0", "id":true, "method":"X"}`, invalidIDMessage},  // invalid ID: Boolean
+		{`{"jsonrpc":"2.0", "id":false, "method":"X"}`, invalidIDMessage}, // "
+	}
+	for _, test := range tests {
+		if err := cli.Send([]byte(test.input)); err != nil {
+			t.Fatalf("Send %#q failed: %v", test.input, err)
+		}
+		raw, err := cli.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if got := string(raw); got != test.want {
+			t.Errorf("Simulated call %#q: got %#q, want %#q", test.input, got, test.want)
+		}
+	}
+}
+
+// Verify that a server with batches disabled rejects them.
+func TestServer_disableBatch(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	srv, cli := channel.Direct()
+	s := jrpc2.NewServer(handler.Map{"X": testOK}, &jrpc2.ServerOptions{
+		DisableBatch: true,
+	}).Start(srv)
+	defer func() {
+		cli.Close()
+		if err := s.Wait(); err != nil {
+			t.Errorf("Server wait: unexpected error %v", err)
+		}
+	}()
+
+	const rejected = `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"batch requests are not supported"}}`
+	tests := []struct {
+		input, want string
+	}{
+		{`{"jsonrpc":"2.0", "id": 1, "method": "X"}`, `{"jsonrpc":"2.0","id":1,"result":"OK"}`},
+		{`[{"jsonrpc":"2.0", "id": 2, "method": "X"}]`, rejected},
+		{`[{"jsonrpc":"2.0", "id": 3, "method": "X"}, {"jsonrpc":"2.0", "method": "X"}]`, rejected},
+		{`{"jsonrpc":"2.0", "id": 4, "method": "X"}`, `{"jsonrpc":"2.0","id":4,"result":"OK"}`},
+	}
+	for _, test := range tests {
+		if err := cli.Send([]byte(test.input)); err != nil {
+			t.Fatalf("Send %#q failed: %v", test.input, err)
+		}
+		raw, err := cli.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if got := string(raw); got != test.want {
+			t.Errorf("Simulated call %#q: got %#q, want %#q", test.input, got, test.want)
+		}
+	}
+}
+
+// Verify that a server enforces and reports its request limits, and that a
+// client that knows them splits its batches to fit.
+func TestServer_capabilities(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	opts := &jrpc2.ServerOptions{
+		MaxBatchSize:       2,
+		MaxRequestBytes:    200,
+		EnableCapabilities: true,
+	}
+
+	t.Run("Limits", func(t *testing.T) {
+		srv, cli := channel.Direct()
+		s := jrpc2.NewServer(handler.Map{"X": testOK}, opts).Start(srv)
+		defer func() {
+			cli.Close()
+			if err := s.Wait(); err != nil {
+				t.Errorf("Server wait: unexpected error %v", err)
+			}
+		}()
+
+		const call = `{"jsonrpc":"2.0","id":%d,"method":"X"}`
+		tests := []struct {
+			input, want string
+		}{
+			{fmt.Sprintf("[%s,%s]", fmt.Sprintf(call, 1), fmt.Sprintf(call, 2)),
+				`[{"jsonrpc":"2.0","id":1,"result":"OK"},{"jsonrpc":"2.0","id":2,"result":"OK"}]`},
+			{fmt.Sprintf("[%s,%s,%s]", fmt.Sprintf(call, 3), fmt.Sprintf(call, 4), fmt.Sprintf(call, 5)),
+				`{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"request batch is too large"}}`},
+			{`{"jsonrpc":"2.0","id":6,"method":"X","params":["` + strings.Repeat("x", 200) + `"]}`,
+				`{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"request message is too large"}}`},
+			{`{"jsonrpc":"2.0","id":7,"method":"rpc.capabilities"}`,
+				`{"jsonrpc":"2.0","id":7,"result":{"maxBatchSize":2,"maxRequestBytes":200}}`},
+		}
+		for _, test := range tests {
+			if err := cli.Send([]byte(test.input)); err != nil {
+				t.Fatalf("Send %#q failed: %v", test.input, err)
+			}
+			raw, err := cli.Recv()
+			if err != nil {
+				t.Fatalf("Recv failed: %v", err)
+			}
+			if got := string(raw); got != test.want {
+				t.Errorf("Simulated call %#q: got %#q, want %#q", test.input, got, test.want)
+			}
+		}
+	})
+
+	t.Run("Client", func(t *testing.T) {
+		loc := server.NewLocal(handler.Map{"X": testOK}, &server.LocalOptions{Server: opts})
+		defer loc.Close()
+		ctx := context.Background()
+
+		caps, err := loc.Client.Capabilities(ctx)
+		if err != nil {
+			t.Fatalf("Capabilities: unexpected error: %v", err)
+		}
+		want := jrpc2.Capabilities{MaxBatchSize: 2, MaxRequestBytes: 200}
+		if *caps != want {
+			t.Errorf("Capabilities: got %+v, want %+v", *caps, want)
+		}
+
+		specs := make([]jrpc2.Spec, 5)
+		for i := range specs {
+			specs[i] = jrpc2.Spec{Method: "X", Notify: i == 2}
+		}
+		rsps, err := loc.Client.Batch(ctx, specs)
+		if err != nil {
+			t.Fatalf("Batch: unexpected error: %v", err)
+		}
+		if len(rsps) != 4 {
+			t.Errorf("Batch: got %d responses, want 4", len(rsps))
+		}
+		for i, rsp := range rsps {
+			if got := rsp.ResultString(); got != `"OK"` {
+				t.Errorf("Response %d: got %s, want %q", i, got, "OK")
+			}
+		}
+	})
+}
+
+// Verify that the server authenticates a connection once, and that handlers
+// can see the principal.
+func TestServer_authenticate(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	whoami := handler.Map{
+		"WhoAmI": handler.New(func(ctx context.Context) (interface{}, error) {
+			return jrpc2.Principal(ctx), nil
+		}),
+	}
+
+	t.Run("OK", func(t *testing.T) {
+		var calls int32
+		loc := server.NewLocal(whoami, &server.LocalOptions{
+			Server: &jrpc2.ServerOptions{
+				Authenticate: func(ctx context.Context) (context.Context, error) {
+					atomic.AddInt32(&calls, 1)
+					return jrpc2.WithPrincipal(ctx, "alice"), nil
+				},
+			},
+		})
+		defer loc.Close()
+
+		for i := 0; i < 3; i++ {
+			var got string
+			if err := loc.Client.CallResult(context.Background(), "WhoAmI", nil, &got); err != nil {
+				t.Fatalf("Call WhoAmI: unexpected error: %v", err)
+			} else if got != "alice" {
+				t.Errorf("Call WhoAmI: got %q, want alice", got)
+			}
+		}
+		if n := atomic.LoadInt32(&calls); n != 1 {
+			t.Errorf("Authenticate called %d times, want 1", n)
+		}
+	})
+
+	t.Run("Refused", func(t *testing.T) {
+		errDenied := errors.New("access denied")
+		cch, sch := channel.Direct()
+		s := jrpc2.NewServer(whoami, &jrpc2.ServerOptions{
+			Authenticate: func(context.Context) (context.Context, error) { return nil, errDenied },
+		}).Start(sch)
+		c := jrpc2.NewClient(cch, nil)
+		defer c.Close()
+
+		if err := s.Wait(); err != errDenied {
+			t.Errorf("Server wait: got %v, want %v", err, errDenied)
+		}
+		if rsp, err := c.Call(context.Background(), "WhoAmI", nil); err == nil {
+			t.Errorf("Call WhoAmI: got %v, want error", rsp)
+		}
+	})
+}
+
+// Verify that a server whose options request it validates its assigner, and
+// refuses to serve if the assigner is invalid.
+func TestServer_validateAssigner(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	bad := handler.ServiceMap{
+		"a.b": handler.Map{"X": handler.New(func(context.Context) error { return nil })},
+	}
+	for _, check := range []bool{false, true} {
+		cch, sch := channel.Direct()
+		s := jrpc2.NewServer(bad, &jrpc2.ServerOptions{ValidateAssigner: check}).Start(sch)
+		c := jrpc2.NewClient(cch, nil)
+		_, cerr := c.Call(context.Background(), "a.b.X", nil)
+		c.Close()
+		err := s.Wait()
+		if check {
+			if err == nil || !strings.Contains(err.Error(), "invalid assigner") {
+				t.Errorf("ValidateAssigner: server wait: got %v, want invalid assigner", err)
+			}
+			if cerr == nil {
+				t.Error("ValidateAssigner: call succeeded, want error")
+			}
+		} else if err != nil {
+			t.Errorf("No validation: server wait: unexpected error: %v", err)
+		}
+	}
+}
+
+// Verify that a handler can return a raw response with extension fields.
+func TestServer_rawResponse(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	srv, cli := channel.Direct()
+	s := jrpc2.NewServer(handler.Map{
+		"Raw": handler.New(func(_ context.Context, ss []string) (interface{}, error) {
+			return jrpc2.RawResponse(ss[0]), nil
 		}),
 	}, nil).Start(srv)
 	defer func() {
@@ -622,756 +1928,2915 @@ func TestServer_nonLibraryClient(t *testing.T) {
 		if err := s.Wait(); err != nil {
 			t.Errorf("Server wait: unexpected error %v", err)
 		}
-	}()
+	}()
+
+	const req = `{"jsonrpc":"2.0","id":%d,"method":"Raw","params":[%q]}`
+	tests := []struct {
+		input, want string
+	}{
+		// Extension fields are included, and the ID and version are fixed.
+		{`{"result":true,"meta":{"a":1},"id":99,"jsonrpc":"1.0"}`,
+			`{"jsonrpc":"2.0","id":1,"result":true,"meta":{"a":1}}`},
+		{`{"error":{"code":-32000,"message":"bad"},"zz":2,"aa":1}`,
+			`{"jsonrpc":"2.0","id":2,"error":{"code":-32000,"message":"bad"},"aa":1,"zz":2}`},
+
+		// Invalid raw responses are reported as internal errors.
+		{`{"meta":1}`,
+			`{"jsonrpc":"2.0","id":3,"error":{"code":-32603,"message":"invalid raw response: want one of result or error"}}`},
+	}
+	for i, test := range tests {
+		input := fmt.Sprintf(req, i+1, test.input)
+		if err := cli.Send([]byte(input)); err != nil {
+			t.Fatalf("Send %#q failed: %v", input, err)
+		}
+		raw, err := cli.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if got := string(raw); got != test.want {
+			t.Errorf("Raw response %#q: got %#q, want %#q", test.input, got, test.want)
+		}
+	}
+}
+
+// Verify that server-side push notifications work.
+func TestServer_Notify(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	// Set up a server and client with server-side notification support.  Here
+	// we're just capturing the name of the notification method, as a sign we
+	// got the right thing.
+	var notes []string
+	loc := server.NewLocal(handler.Map{
+		"NoteMe": handler.New(func(ctx context.Context) (bool, error) {
+			// When this method is called, it posts a notification back to the
+			// client before returning.
+			if err := jrpc2.ServerFromContext(ctx).Notify(ctx, "method", nil); err != nil {
+				t.Errorf("Push Notify unexpectedly failed: %v", err)
+				return false, err
+			}
+			return true, nil
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{
+			AllowPush: true,
+		},
+		Client: &jrpc2.ClientOptions{
+			OnNotify: func(req *jrpc2.Request) {
+				notes = append(notes, req.Method())
+				t.Logf("OnNotify handler saw method %q", req.Method())
+			},
+		},
+	})
+	s, c := loc.Server, loc.Client
+	ctx := context.Background()
+
+	// Post an explicit notification.
+	if err := s.Notify(ctx, "explicit", nil); err != nil {
+		t.Errorf("Notify explicit: unexpected error: %v", err)
+	}
+
+	// Call the method that posts a notification.
+	if _, err := c.Call(ctx, "NoteMe", nil); err != nil {
+		t.Errorf("Call NoteMe: unexpected error: %v", err)
+	}
+
+	// Shut everything down to be sure the callbacks have settled.
+	// Sort the results since the order of arrival may vary.
+	loc.Close()
+	sort.Strings(notes)
+
+	want := []string{"explicit", "method"}
+	if diff := cmp.Diff(want, notes); diff != "" {
+		t.Errorf("Server notifications: (-want, +got)\n%s", diff)
+	}
+}
+
+// Verify that notifications are routed by method to the client's handlers.
+func TestClient_NotifyHandlers(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	var notes []string
+	record := func(tag string) func(*jrpc2.Request) {
+		return func(req *jrpc2.Request) { notes = append(notes, tag+":"+req.Method()) }
+	}
+	loc := server.NewLocal(handler.Map{}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{AllowPush: true},
+		Client: &jrpc2.ClientOptions{
+			OnNotify: record("default"),
+			NotifyHandlers: map[string]func(*jrpc2.Request){
+				"alpha": record("A"),
+				"bravo": record("B"),
+			},
+		},
+	})
+	ctx := context.Background()
+	for _, method := range []string{"alpha", "other", "bravo", "alpha"} {
+		if err := loc.Server.Notify(ctx, method, nil); err != nil {
+			t.Errorf("Notify %q: unexpected error: %v", method, err)
+		}
+	}
+
+	// Notifications are delivered in order, but close to be sure they settle.
+	loc.Close()
+	want := []string{"A:alpha", "default:other", "B:bravo", "A:alpha"}
+	if diff := cmp.Diff(want, notes); diff != "" {
+		t.Errorf("Server notifications: (-want, +got)\n%s", diff)
+	}
+}
+
+// Verify that the server can push a batch of notifications in one message.
+func TestServer_PushBatch(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	specs := []jrpc2.Spec{
+		{Method: "alpha", Params: []int{1, 2}},
+		{Method: "bravo", Params: map[string]bool{"ok": true}},
+	}
+	t.Run("Disabled", func(t *testing.T) {
+		loc := server.NewLocal(make(handler.Map), nil)
+		defer loc.Close()
+		if err := loc.Server.PushBatch(context.Background(), specs); err != jrpc2.ErrPushUnsupported {
+			t.Errorf("PushBatch: got %v, want %v", err, jrpc2.ErrPushUnsupported)
+		}
+	})
+
+	t.Run("Enabled", func(t *testing.T) {
+		cpipe, spipe := channel.Direct()
+		s := jrpc2.NewServer(make(handler.Map), &jrpc2.ServerOptions{
+			AllowPush: true,
+		}).Start(spipe)
+
+		errc := make(chan error, 1)
+		go func() { errc <- s.PushBatch(context.Background(), specs) }()
+
+		got, err := cpipe.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if err := <-errc; err != nil {
+			t.Errorf("PushBatch: unexpected error: %v", err)
+		}
+		const want = `[{"jsonrpc":"2.0","method":"alpha","params":[1,2]},` +
+			`{"jsonrpc":"2.0","method":"bravo","params":{"ok":true}}]`
+		if string(got) != want {
+			t.Errorf("PushBatch message:\n got: %s\nwant: %s", got, want)
+		}
+
+		cpipe.Close()
+		s.Wait()
+		if err := s.PushBatch(context.Background(), specs); err != jrpc2.ErrConnClosed {
+			t.Errorf("PushBatch after close: got %v, want %v", err, jrpc2.ErrConnClosed)
+		}
+	})
+}
+
+// Verify that server-side callbacks can time out.
+func TestServer_callbackTimeout(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	loc := server.NewLocal(handler.Map{
+		"Test": handler.New(func(ctx context.Context) error {
+			tctx, cancel := context.WithTimeout(ctx, 5*time.Millisecond)
+			defer cancel()
+			rsp, err := jrpc2.ServerFromContext(ctx).Callback(tctx, "hey", nil)
+			if err == context.DeadlineExceeded {
+				t.Logf("Callback correctly failed: %v", err)
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("unexpected error: %v", err)
+			}
+			return fmt.Errorf("got rsp=%+v, want error", rsp)
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{AllowPush: true},
+
+		// N.B. Client does not have a callback handler, so calls will be ignored
+		// and no response will be generated.
+	})
+	defer loc.Close()
+	ctx := context.Background()
+
+	if _, err := loc.Client.Call(ctx, "Test", nil); err != nil {
+		t.Errorf("Call failed: %v", err)
+	}
+}
+
+// Verify that server-side callbacks work.
+func TestServer_Callback(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	loc := server.NewLocal(handler.Map{
+		"CallMeMaybe": handler.New(func(ctx context.Context) error {
+			if _, err := jrpc2.ServerFromContext(ctx).Callback(ctx, "succeed", nil); err != nil {
+				t.Errorf("Callback failed: %v", err)
+			}
+
+			if rsp, err := jrpc2.ServerFromContext(ctx).Callback(ctx, "fail", nil); err == nil {
+				t.Errorf("Callback did not fail: got %v, want error", rsp)
+			}
+			return nil
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{AllowPush: true},
+		Client: &jrpc2.ClientOptions{
+			OnCallback: func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+				t.Logf("OnCallback invoked for method %q", req.Method())
+				switch req.Method() {
+				case "succeed":
+					return true, nil
+				case "fail":
+					return false, errors.New("here is your requested error")
+				}
+				panic("broken test: you should not see this")
+			},
+		},
+	})
+	defer loc.Close()
+	ctx := context.Background()
+
+	// Call the method that posts a callback.
+	if _, err := loc.Client.Call(ctx, "CallMeMaybe", nil); err != nil {
+		t.Fatalf("Call CallMeMaybe: unexpected error: %v", err)
+	}
+
+	// Post an explicit callback.
+	if _, err := loc.Server.Callback(ctx, "succeed", nil); err != nil {
+		t.Errorf("Callback explicit: unexpected error: %v", err)
+	}
+}
+
+// Verify that a server push after the client closes does not trigger a panic.
+func TestServer_pushAfterClose(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	loc := server.NewLocal(make(handler.Map), &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{AllowPush: true},
+	})
+	loc.Client.Close()
+	ctx := context.Background()
+	if err := loc.Server.Notify(ctx, "whatever", nil); err != jrpc2.ErrConnClosed {
+		t.Errorf("Notify(whatever): got %v, want %v", err, jrpc2.ErrConnClosed)
+	}
+	if rsp, err := loc.Server.Callback(ctx, "whatever", nil); err != jrpc2.ErrConnClosed {
+		t.Errorf("Callback(whatever): got %v, %v; want %v", rsp, err, jrpc2.ErrConnClosed)
+	}
+}
+
+// Verify that an OnCancel hook is called when expected.
+func TestClient_onCancelHook(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	hooked := make(chan struct{}) // closed when hook notification is finished
+
+	loc := server.NewLocal(handler.Map{
+		// Block until explicitly cancelled or a long timeout expires.
+		"Stall": handler.New(func(ctx context.Context) error {
+			select {
+			case <-ctx.Done():
+				t.Logf("Method unblocked; returning err=%v", ctx.Err())
+				return ctx.Err()
+			case <-time.After(10 * time.Second): // shouldn't happen
+				t.Error("Timeout waiting for server cancellation")
+			}
+			return nil
+		}),
+
+		// Cancel the specified request (notification only).
+		"computerSaysNo": handler.New(func(ctx context.Context, ids []string) error {
+			defer close(hooked)
+			if req := jrpc2.InboundRequest(ctx); !req.IsNotification() {
+				return jrpc2.Errorf(code.MethodNotFound, "no such method %q", req.Method())
+			}
+			srv := jrpc2.ServerFromContext(ctx)
+			for _, id := range ids {
+				srv.CancelRequest(id)
+				t.Logf("In cancellation handler, cancelled request id=%v", id)
+			}
+			return nil
+		}),
+	}, &server.LocalOptions{
+		Client: &jrpc2.ClientOptions{
+			OnCancel: func(cli *jrpc2.Client, rsp *jrpc2.Response) {
+				t.Logf("OnCancel hook called with id=%q, err=%v", rsp.ID(), rsp.Error())
+				cli.Notify(context.Background(), "computerSaysNo", []string{rsp.ID()})
+			},
+		},
+	})
+
+	// Call a method on the server that will stall until its context terminates.
+	// On the client side, set a deadline to expire the caller's context.
+	// The cancellation hook will notify the server to unblock the method.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	got, err := loc.Client.Call(ctx, "Stall", nil)
+	if err == nil {
+		t.Errorf("Stall: got %+v, wanted error", got)
+	} else if err != context.DeadlineExceeded {
+		t.Errorf("Stall: got error %v, want %v", err, context.Canceled)
+	}
+	<-hooked
+	loc.Client.Close()
+	if err := loc.Server.Wait(); err != nil {
+		t.Errorf("Server exit status: %v", err)
+	}
+}
+
+// Verify that client callback handlers are cancelled when the client stops.
+func TestClient_closeEndsCallbacks(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	ready := make(chan struct{})
+	loc := server.NewLocal(handler.Map{
+		"Test": handler.New(func(ctx context.Context) error {
+			// Call back to the client and block indefinitely until it returns.
+			srv := jrpc2.ServerFromContext(ctx)
+			_, err := srv.Callback(ctx, "whatever", nil)
+			return err
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{AllowPush: true},
+		Client: &jrpc2.ClientOptions{
+			OnCallback: handler.New(func(ctx context.Context) error {
+				// Signal the test that the callback handler is running.  When the
+				// client is closed, it should terminate ctx and allow this to
+				// return. If that doesn't happen, time out and fail.
+				close(ready)
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(10 * time.Second):
+					return errors.New("context not cancelled before timeout")
+				}
+			}),
+		},
+	})
+	go func() {
+		rsp, err := loc.Client.Call(context.Background(), "Test", nil)
+		if err == nil {
+			t.Errorf("Client call: got %+v, wanted error", rsp)
+		}
+	}()
+	<-ready
+	loc.Client.Close()
+	loc.Server.Wait()
+}
+
+// Verify that it is possible for multiple callback handlers to execute
+// concurrently.
+func TestClient_concurrentCallbacks(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	ready1 := make(chan struct{})
+	ready2 := make(chan struct{})
+	release := make(chan struct{})
+
+	loc := server.NewLocal(handler.Map{
+		"Test": handler.New(func(ctx context.Context) []string {
+			srv := jrpc2.ServerFromContext(ctx)
+
+			// Call two callbacks concurrently, wait until they are both running,
+			// then ungate them and wait for them both to reply. Return their
+			// responses back to the test for validation.
+			ss := make([]string, 2)
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				rsp, err := srv.Callback(ctx, "C1", nil)
+				if err != nil {
+					t.Errorf("Callback C1 failed: %v", err)
+				} else {
+					rsp.UnmarshalResult(&ss[0])
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				rsp, err := srv.Callback(ctx, "C2", nil)
+				if err != nil {
+					t.Errorf("Callback C2 failed: %v", err)
+				} else {
+					rsp.UnmarshalResult(&ss[1])
+				}
+			}()
+			<-ready1       // C1 is ready
+			<-ready2       // C2 is ready
+			close(release) // allow all callbacks to proceed
+			wg.Wait()      // wait for all callbacks to be done
+			return ss
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{AllowPush: true},
+		Client: &jrpc2.ClientOptions{
+			OnCallback: handler.Func(func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+				// A trivial callback that reports its method name.
+				// The name is used to select which invocation we are serving.
+				switch req.Method() {
+				case "C1":
+					close(ready1)
+				case "C2":
+					close(ready2)
+				default:
+					return nil, fmt.Errorf("unexpected method %q", req.Method())
+				}
+				<-release
+				return req.Method(), nil
+			}),
+		},
+	})
+	defer loc.Close()
+
+	var got []string
+	if err := loc.Client.CallResult(context.Background(), "Test", nil, &got); err != nil {
+		t.Errorf("Call Test failed: %v", err)
+	}
+	want := []string{"C1", "C2"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Wrong callback results: (-want, +got)\n%s", diff)
+	}
+}
+
+// Verify that a callback can successfully call "up" into the server.
+func TestClient_callbackUpCall(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	const pingMessage = "kittens!"
+
+	var probe string
+	loc := server.NewLocal(handler.Map{
+		"Test": handler.New(func(ctx context.Context) error {
+			// Call back to the client, and propagate its response.
+			srv := jrpc2.ServerFromContext(ctx)
+			_, err := srv.Callback(ctx, "whatever", nil)
+			return err
+		}),
+		"Ping": handler.New(func(context.Context) string {
+			// This method is called by the client-side callback.
+			return pingMessage
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{AllowPush: true},
+		Client: &jrpc2.ClientOptions{
+			OnCallback: handler.New(func(ctx context.Context) error {
+				// Call back up into the server.
+				cli := jrpc2.ClientFromContext(ctx)
+				return cli.CallResult(ctx, "Ping", nil, &probe)
+			}),
+		},
+	})
+
+	if _, err := loc.Client.Call(context.Background(), "Test", nil); err != nil {
+		t.Errorf("Call Test failed: %v", err)
+	}
+	loc.Close()
+	if probe != pingMessage {
+		t.Errorf("Probe response: got %q, want %q", probe, pingMessage)
+	}
+}
+
+// Verify that calling a wrapped method which takes no parameters, but in which
+// the caller provided parameters, will correctly report an error.
+func TestHandler_noParams(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	loc := server.NewLocal(handler.Map{"Test": testOK}, nil)
+	defer loc.Close()
+
+	var rsp string
+	if err := loc.Client.CallResult(context.Background(), "Test", []int{1, 2, 3}, &rsp); err == nil {
+		t.Errorf("Call(Test): got %q, wanted error", rsp)
+	} else if ec := code.FromError(err); ec != code.InvalidParams {
+		t.Errorf("Call(Test): got code %v, wanted %v", ec, code.InvalidParams)
+	}
+}
+
+// Verify that the rpc.serverInfo handler and client wrapper work together.
+func TestRPCServerInfo(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	loc := server.NewLocal(handler.Map{"Test": testOK}, nil)
+	defer loc.Close()
+
+	si, err := jrpc2.RPCServerInfo(context.Background(), loc.Client)
+	if err != nil {
+		t.Errorf("RPCServerInfo failed: %v", err)
+	}
+	{
+		got, want := si.Methods, []string{"Test"}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Wrong method names: (-want, +got)\n%s", diff)
+		}
+	}
+
+	// The client method reports the same, with a plausible uptime.
+	si, err = loc.Client.RPCServerInfo(context.Background())
+	if err != nil {
+		t.Fatalf("Client.RPCServerInfo failed: %v", err)
+	}
+	if diff := cmp.Diff([]string{"Test"}, si.Methods); diff != "" {
+		t.Errorf("Wrong method names: (-want, +got)\n%s", diff)
+	}
+	if up := si.Uptime(); up <= 0 {
+		t.Errorf("Uptime: got %v, want > 0", up)
+	}
+	if si.Version != jrpc2.Version {
+		t.Errorf("Version: got %q, want %q", si.Version, jrpc2.Version)
+	}
+
+	// A server with a custom version marker reports it.
+	vloc := server.NewLocal(handler.Map{"Test": testOK}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{Version: "x1"},
+		Client: &jrpc2.ClientOptions{Version: "x1"},
+	})
+	defer vloc.Close()
+	if si, err := vloc.Client.RPCServerInfo(context.Background()); err != nil {
+		t.Errorf("RPCServerInfo with custom version failed: %v", err)
+	} else if si.Version != "x1" {
+		t.Errorf("Version: got %q, want x1", si.Version)
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	tests := []struct {
+		input, want string
+	}{
+		{"", "unix"},
+		{":", "unix"},
+
+		{"nothing", "unix"},        // no colon
+		{"like/a/file", "unix"},    // no colon
+		{"no-port:", "unix"},       // empty port
+		{"file/with:port", "unix"}, // slashes in host
+		{"path/with:404", "unix"},  // slashes in host
+		{"mangled:@3", "unix"},     // non-alphanumerics in port
+
+		{":80", "tcp"},            // numeric port
+		{":dumb-crud", "tcp"},     // service name
+		{"localhost:80", "tcp"},   // host and numeric port
+		{"localhost:http", "tcp"}, // host and service name
+	}
+	for _, test := range tests {
+		got, addr := jrpc2.Network(test.input)
+		if got != test.want {
+			t.Errorf("Network(%q) type: got %q, want %q", test.input, got, test.want)
+		}
+		if addr != test.input {
+			t.Errorf("Network(%q) addr: got %q, want %q", test.input, addr, test.input)
+		}
+	}
+}
+
+// Verify that the context passed to an assigner has the correct structure.
+func TestHandler_assignContext(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	loc := server.NewLocal(assignFunc(func(ctx context.Context, method string) jrpc2.Handler {
+		req := jrpc2.InboundRequest(ctx)
+		if req == nil {
+			t.Errorf("No inbound request for assignment of %q", method)
+		} else if req.Method() != method {
+			t.Errorf("Assign inbound: got %q, want %q", req.Method(), method)
+		} else {
+			t.Logf("Inbound request id=%v method=%q OK", req.ID(), req.Method())
+		}
+		return testOK
+	}), nil)
+	defer loc.Close()
+
+	ctx := context.Background()
+	var got string
+	if err := loc.Client.CallResult(ctx, "NerbleFleeger", nil, &got); err != nil {
+		t.Errorf("CallResult unexpectedly failed: %v", err)
+	} else if got != "OK" {
+		t.Errorf("CallResult: got %q, want %q", got, "OK")
+	}
+}
+
+type assignFunc func(context.Context, string) jrpc2.Handler
+
+func (a assignFunc) Assign(ctx context.Context, m string) jrpc2.Handler { return a(ctx, m) }
+
+func TestServer_WaitStatus(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	check := func(t *testing.T, stat jrpc2.ServerStatus, closed, stopped bool, wantErr error) {
+		t.Helper()
+		if got, want := stat.Success(), wantErr == nil; got != want {
+			t.Errorf("Status success: got %v, want %v", got, want)
+		}
+		if got := stat.Closed; got != closed {
+			t.Errorf("Status closed: got %v, want %v", got, closed)
+		}
+		if got := stat.Stopped; got != stopped {
+			t.Errorf("Status stopped: got %v, want %v", got, stopped)
+		}
+		if stat.Err != wantErr {
+			t.Errorf("Status error: got %v, want %v", stat.Err, wantErr)
+		}
+	}
+	t.Run("ChannelClosed", func(t *testing.T) {
+		loc := server.NewLocal(handler.Map{"OK": testOK}, nil)
+		loc.Client.Close()
+		check(t, loc.Server.WaitStatus(), true, false, nil)
+	})
+
+	t.Run("ServerStopped", func(t *testing.T) {
+		loc := server.NewLocal(handler.Map{"OK": testOK}, nil)
+		loc.Server.Stop()
+		check(t, loc.Server.WaitStatus(), false, true, nil)
+	})
+
+	t.Run("ChannelFailed", func(t *testing.T) {
+		wantErr := errors.New("failed")
+		ch := buggyChannel{data: "bogus", err: wantErr}
+		srv := jrpc2.NewServer(handler.Map{"OK": testOK}, nil).Start(ch)
+		check(t, srv.WaitStatus(), false, false, wantErr)
+	})
+}
+
+type buggyChannel struct {
+	data string
+	err  error
+}
+
+func (buggyChannel) Send([]byte) error       { panic("should not be called") }
+func (b buggyChannel) Recv() ([]byte, error) { return []byte(b.data), b.err }
+func (buggyChannel) Close() error            { return nil }
+
+func TestRequest_strictFields(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	type other struct {
+		C bool `json:"charlie"`
+	}
+	type params struct {
+		A string `json:"alpha"`
+		B int    `json:"bravo"`
+		other
+	}
+	loc := server.NewLocal(handler.Map{
+		"Strict": handler.New(func(ctx context.Context, req *jrpc2.Request) (string, error) {
+			var ps params
+			if err := req.UnmarshalParams(jrpc2.StrictFields(&ps)); err != nil {
+				return "", err
+			}
+			return ps.A, nil
+		}),
+		"Normal": handler.New(func(ctx context.Context, req *jrpc2.Request) (string, error) {
+			var ps params
+			if err := req.UnmarshalParams(&ps); err != nil {
+				return "", err
+			}
+			return ps.A, nil
+		}),
+	}, nil)
+	defer loc.Close()
+	ctx := context.Background()
+
+	tests := []struct {
+		method string
+		params interface{}
+		code   code.Code
+		want   string
+	}{
+		{"Strict", handler.Obj{"alpha": "aiuto"}, code.NoError, "aiuto"},
+		{"Strict", handler.Obj{"alpha": "selva me", "charlie": true}, code.NoError, "selva me"},
+		{"Strict", handler.Obj{"alpha": "OK", "nonesuch": true}, code.InvalidParams, ""},
+		{"Normal", handler.Obj{"alpha": "OK", "nonesuch": true}, code.NoError, "OK"},
+	}
+	for _, test := range tests {
+		name := test.method + "/"
+		if test.code == code.NoError {
+			name += "OK"
+		} else {
+			name += test.code.String()
+		}
+		t.Run(name, func(t *testing.T) {
+			var res string
+			err := loc.Client.CallResult(ctx, test.method, test.params, &res)
+			if err == nil && test.code != code.NoError {
+				t.Errorf("CallResult: got %+v, want error code %v", res, test.code)
+			} else if err != nil {
+				if c := code.FromError(err); c != test.code {
+					t.Errorf("CallResult: got error %v, wanted code %v", err, test.code)
+				}
+			} else if res != test.want {
+				t.Errorf("CallResult: got %#q, want %#q", res, test.want)
+			}
+		})
+	}
+}
+
+func TestResponse_strictFields(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	type result struct {
+		A string `json:"alpha"`
+	}
+	loc := server.NewLocal(handler.Map{
+		"Test": handler.New(func(ctx context.Context, req *jrpc2.Request) handler.Obj {
+			return handler.Obj{"alpha": "OK", "bravo": "not OK"}
+		}),
+	}, nil)
+	defer loc.Close()
+	ctx := context.Background()
+
+	res, err := loc.Client.Call(ctx, "Test", nil)
+	if err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+
+	t.Run("Normal", func(t *testing.T) {
+		var got result
+		if err := res.UnmarshalResult(&got); err != nil {
+			t.Errorf("UnmarshalResult failed: %v", err)
+		} else if got.A != "OK" {
+			t.Errorf("Result: got %#q, want OK", got.A)
+		}
+	})
+	t.Run("Strict", func(t *testing.T) {
+		var got result
+		if err := res.UnmarshalResult(jrpc2.StrictFields(&got)); err == nil {
+			t.Errorf("UnmarshalResult: got %#v, wanted error", got)
+		}
+	})
+}
+
+func TestServerFromContext(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	var got *jrpc2.Server
+	loc := server.NewLocal(handler.Map{
+		"Test": handler.New(func(ctx context.Context) error {
+			got = jrpc2.ServerFromContext(ctx)
+			return nil
+		}),
+	}, nil)
+	if _, err := loc.Client.Call(context.Background(), "Test", nil); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	if err := loc.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if got != loc.Server {
+		t.Errorf("ServerFromContext: got %p, want %p", got, loc.Server)
+	}
+}
+
+func TestServer_newContext(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	// Prepare a context with a test value attached to it, that the handler can
+	// extract to verify that the base context was plumbed in correctly.
+	type ctxKey string
+	ctx := context.WithValue(context.Background(), ctxKey("test"), 42)
+
+	loc := server.NewLocal(handler.Map{
+		"Test": handler.New(func(ctx context.Context) error {
+			val := ctx.Value(ctxKey("test"))
+			if val == nil {
+				t.Error("Test value is not present in context")
+			} else if v, ok := val.(int); !ok || v != 42 {
+				t.Errorf("Wrong test value: got %+v, want %v", val, 42)
+			}
+			return nil
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{
+			// Use the test context constructed above as the base request context.
+			NewContext: func() context.Context { return ctx },
+		},
+	})
+	defer loc.Close()
+	if _, err := loc.Client.Call(context.Background(), "Test", nil); err != nil {
+		t.Errorf("Call failed: %v", err)
+	}
+}
+
+func TestServer_transformResult(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	loc := server.NewLocal(handler.Map{
+		"Secret": handler.New(func(context.Context) (map[string]string, error) {
+			return map[string]string{"user": "alice", "password": "hunter2"}, nil
+		}),
+		"Fail": handler.New(func(context.Context) (string, error) {
+			return "ok", nil
+		}),
+		"Garble": handler.New(func(context.Context) (string, error) {
+			return "ok", nil
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{
+			TransformResult: func(_ context.Context, method string, result json.RawMessage) (json.RawMessage, error) {
+				if method == "Fail" {
+					return nil, jrpc2.Errorf(code.InternalError, "transform failed")
+				} else if method == "Garble" {
+					return json.RawMessage(`{"oops`), nil
+				}
+				var m map[string]string
+				if err := json.Unmarshal(result, &m); err != nil {
+					return nil, err
+				}
+				delete(m, "password")
+				return json.Marshal(m)
+			},
+		},
+	})
+	defer loc.Close()
+	ctx := context.Background()
+
+	var got map[string]string
+	if err := loc.Client.CallResult(ctx, "Secret", nil, &got); err != nil {
+		t.Fatalf("Call Secret: unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(map[string]string{"user": "alice"}, got); diff != "" {
+		t.Errorf("Wrong result (-want, +got):\n%s", diff)
+	}
+
+	rsp, err := loc.Client.Call(ctx, "Fail", nil)
+	if code.FromError(err) != code.InternalError {
+		t.Errorf("Call Fail: got %+v, %v; want code %v", rsp, err, code.InternalError)
+	}
+
+	// A transformer that produces invalid JSON fails the call, rather than
+	// corrupting the response.
+	rsp, err = loc.Client.Call(ctx, "Garble", nil)
+	if code.FromError(err) != code.InternalError {
+		t.Errorf("Call Garble: got %+v, %v; want code %v", rsp, err, code.InternalError)
+	}
+}
+
+func TestClient_onCallDone(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	type done struct {
+		method string
+		code   code.Code
+	}
+	var mu sync.Mutex
+	var got []done
+	loc := server.NewLocal(handler.Map{
+		"Sleep": handler.New(func(context.Context) error {
+			time.Sleep(5 * time.Millisecond)
+			return nil
+		}),
+		"Fail": handler.New(func(context.Context) error {
+			return jrpc2.Errorf(code.InvalidParams, "no")
+		}),
+	}, &server.LocalOptions{
+		Client: &jrpc2.ClientOptions{
+			OnCallDone: func(method string, elapsed time.Duration, err error) {
+				if method == "Sleep" && elapsed < 5*time.Millisecond {
+					t.Errorf("OnCallDone(%q): elapsed %v is too short", method, elapsed)
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				got = append(got, done{method, code.FromError(err)})
+			},
+		},
+	})
+	defer loc.Close()
+	ctx := context.Background()
+
+	if _, err := loc.Client.Call(ctx, "Sleep", nil); err != nil {
+		t.Fatalf("Call Sleep: unexpected error: %v", err)
+	}
+	if _, err := loc.Client.Batch(ctx, []jrpc2.Spec{
+		{Method: "Fail"},
+		{Method: "Sleep", Notify: true},
+		{Method: "Sleep"},
+	}); err != nil {
+		t.Fatalf("Batch: unexpected error: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []done{
+		{"Sleep", code.NoError},
+		{"Fail", code.InvalidParams},
+		{"Sleep", code.NoError},
+	}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(done{})); diff != "" {
+		t.Errorf("OnCallDone reports (-want, +got):\n%s", diff)
+	}
+}
+
+func TestClient_onSend(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	type sent struct {
+		method string
+		notify bool
+		id     string
+	}
+	var got []sent
+	loc := server.NewLocal(handler.Map{
+		"Test": handler.New(func(context.Context) error { return nil }),
+	}, &server.LocalOptions{
+		Client: &jrpc2.ClientOptions{
+			OnSend: func(method string, isNotify bool, id string) {
+				got = append(got, sent{method, isNotify, id})
+			},
+		},
+	})
+	ctx := context.Background()
+
+	// Each of these returns only after the hook has been called, so the test
+	// does not need to synchronize with it.
+	if _, err := loc.Client.Call(ctx, "Test", nil); err != nil {
+		t.Fatalf("Call: unexpected error: %v", err)
+	}
+	if err := loc.Client.Notify(ctx, "Test", nil); err != nil {
+		t.Fatalf("Notify: unexpected error: %v", err)
+	}
+	if _, err := loc.Client.Batch(ctx, []jrpc2.Spec{
+		{Method: "Test", Notify: true},
+		{Method: "Test"},
+	}); err != nil {
+		t.Fatalf("Batch: unexpected error: %v", err)
+	}
+	loc.Close()
+
+	// A message that could not be sent is not reported.
+	if err := loc.Client.Notify(ctx, "Test", nil); err == nil {
+		t.Error("Notify after close: got nil, want error")
+	}
+
+	want := []sent{
+		{"Test", false, "1"},
+		{"Test", true, ""},
+		{"Test", true, ""},
+		{"Test", false, "2"},
+	}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(sent{})); diff != "" {
+		t.Errorf("OnSend reports (-want, +got):\n%s", diff)
+	}
+}
+
+func TestClient_keepAlive(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	t.Run("Alive", func(t *testing.T) {
+		m := metrics.New()
+		loc := server.NewLocal(handler.Map{
+			"Test": handler.New(func(context.Context) error { return nil }),
+		}, &server.LocalOptions{
+			Client: &jrpc2.ClientOptions{KeepAlive: 5 * time.Millisecond},
+			Server: &jrpc2.ServerOptions{Metrics: m},
+		})
+		time.Sleep(50 * time.Millisecond)
+		if _, err := loc.Client.Call(context.Background(), "Test", nil); err != nil {
+			t.Errorf("Call failed: %v", err)
+		}
+		if err := loc.Close(); err != nil {
+			t.Errorf("Close: unexpected error: %v", err)
+		}
+
+		// The server should have received at least one ping besides the call.
+		var snap metrics.Snapshot
+		snap.Counter = make(map[string]int64)
+		m.Snapshot(snap)
+		if n := snap.Counter["rpc.requests"]; n < 2 {
+			t.Errorf("Server received %d requests, wanted pings as well", n)
+		}
+	})
+
+	t.Run("Limits", func(t *testing.T) {
+		// A call that occupies the only pending slot for several intervals must
+		// not delay the pings, and the pings must not reach the user hooks.
+		var mu sync.Mutex
+		var hooked []string
+		record := func(method string) {
+			mu.Lock()
+			defer mu.Unlock()
+			hooked = append(hooked, method)
+		}
+		release := make(chan struct{})
+		loc := server.NewLocal(handler.Map{
+			"Wait": handler.New(func(context.Context) error { <-release; return nil }),
+		}, &server.LocalOptions{
+			Client: &jrpc2.ClientOptions{
+				KeepAlive:  5 * time.Millisecond,
+				MaxPending: 1,
+				OnSend:     func(method string, _ bool, _ string) { record(method) },
+				OnCallDone: func(method string, _ time.Duration, _ error) { record(method) },
+			},
+			Server: &jrpc2.ServerOptions{Concurrency: 2},
+		})
+		errc := make(chan error, 1)
+		go func() {
+			_, err := loc.Client.Call(context.Background(), "Wait", nil)
+			errc <- err
+		}()
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+		if err := <-errc; err != nil {
+			t.Errorf("Call failed: %v", err)
+		}
+		if err := loc.Close(); err != nil {
+			t.Errorf("Close: unexpected error: %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if diff := cmp.Diff([]string{"Wait", "Wait"}, hooked); diff != "" {
+			t.Errorf("Hooked methods (-want, +got):\n%s", diff)
+		}
+	})
+
+	t.Run("Manual", func(t *testing.T) {
+		// A manual-accept client that is not accepting must not time out its
+		// pings, so it does not send any.
+		m := metrics.New()
+		loc := server.NewLocal(handler.Map{
+			"Test": handler.New(func(context.Context) error { return nil }),
+		}, &server.LocalOptions{
+			Client: &jrpc2.ClientOptions{KeepAlive: 5 * time.Millisecond, ManualAccept: true},
+			Server: &jrpc2.ServerOptions{Metrics: m},
+		})
+		defer loc.Close()
+		time.Sleep(50 * time.Millisecond)
+
+		done := make(chan error, 1)
+		go func() { _, err := loc.Client.Call(context.Background(), "Test", nil); done <- err }()
+		if err := loc.Client.Accept(); err != nil {
+			t.Fatalf("Accept: unexpected error: %v", err)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("Call failed: %v", err)
+		}
+		if err := loc.Client.LastError(); err != nil {
+			t.Errorf("LastError: got %v, want nil", err)
+		}
+
+		var snap metrics.Snapshot
+		snap.Counter = make(map[string]int64)
+		m.Snapshot(snap)
+		if n := snap.Counter["rpc.requests"]; n != 1 {
+			t.Errorf("Server received %d requests, want 1", n)
+		}
+	})
+
+	t.Run("Dead", func(t *testing.T) {
+		// A server that reads requests but never replies.
+		cch, sch := channel.Direct()
+		go func() {
+			for {
+				if _, err := sch.Recv(); err != nil {
+					return
+				}
+			}
+		}()
+
+		c := jrpc2.NewClient(cch, &jrpc2.ClientOptions{KeepAlive: 5 * time.Millisecond})
+		_, err := c.Call(context.Background(), "Test", nil)
+		if err == nil {
+			t.Error("Call: got nil, wanted error")
+		}
+		sch.Close() // unblock the client reader
+		if err := c.Close(); err == nil || !strings.Contains(err.Error(), "keepalive") {
+			t.Errorf("Close: got %v, wanted keepalive error", err)
+		}
+	})
+}
+
+func TestServer_handlerTimeout(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	unstick := make(chan struct{})
+	loc := server.NewLocal(handler.Map{
+		"Fast": handler.New(func(context.Context) (string, error) { return "ok", nil }),
+		"Wait": handler.New(func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}),
+		"Ignore": handler.New(func(context.Context) (string, error) {
+			time.Sleep(50 * time.Millisecond)
+			return "late", nil
+		}),
+		"Fail": handler.New(func(context.Context) error {
+			time.Sleep(50 * time.Millisecond)
+			return errors.New("late failure")
+		}),
+		"Stuck": handler.New(func(context.Context) (string, error) {
+			<-unstick // ignores its context
+			return "unstuck", nil
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{HandlerTimeout: 10 * time.Millisecond},
+	})
+	defer loc.Close()
+	ctx := context.Background()
+
+	var got string
+	if err := loc.Client.CallResult(ctx, "Fast", nil, &got); err != nil {
+		t.Errorf("Call Fast: unexpected error: %v", err)
+	} else if got != "ok" {
+		t.Errorf("Call Fast: got %q, want ok", got)
+	}
+	for _, method := range []string{"Wait", "Fail", "Ignore"} {
+		rsp, err := loc.Client.Call(ctx, method, nil)
+		if got := code.FromError(err); got != code.DeadlineExceeded {
+			t.Errorf("Call %s: got %v, %v; want code %v", method, rsp, err, code.DeadlineExceeded)
+		}
+	}
+
+	// A handler that ignores its context does not delay the reply, but is
+	// still running after the client receives it.
+	start := time.Now()
+	if rsp, err := loc.Client.Call(ctx, "Stuck", nil); code.FromError(err) != code.DeadlineExceeded {
+		t.Errorf("Call Stuck: got %v, %v; want code %v", rsp, err, code.DeadlineExceeded)
+	} else if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Call Stuck took %v, want about 10ms", elapsed)
+	}
+	var stuck bool
+	for _, info := range loc.Server.InFlight() {
+		stuck = stuck || info.Method == "Stuck"
+	}
+	if !stuck {
+		t.Errorf("InFlight: got %+v, want Stuck still running", loc.Server.InFlight())
+	}
+	close(unstick)
+
+	// A request whose own context ends first does not report the timeout.
+	pctx, cancel := context.WithTimeout(ctx, 5*time.Millisecond)
+	defer cancel()
+	short := server.NewLocal(handler.Map{
+		"Wait": handler.New(func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{
+			HandlerTimeout: time.Minute,
+			NewContext:     func() context.Context { return pctx },
+		},
+	})
+	defer short.Close()
+	if _, err := short.Client.Call(ctx, "Wait", nil); err == nil || strings.Contains(err.Error(), "handler timed out") {
+		t.Errorf("Call Wait with expired parent: got %v, want the parent error", err)
+	}
+}
+
+func TestServer_workerPool(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	loc := server.NewLocal(handler.Map{
+		"Add": handler.New(func(_ context.Context, vs []int) (int, error) {
+			sum := 0
+			for _, v := range vs {
+				sum += v
+			}
+			return sum, nil
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{Concurrency: 3, UseWorkerPool: true},
+	})
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var got int
+			if err := loc.Client.CallResult(ctx, "Add", []int{i, i}, &got); err != nil {
+				t.Errorf("Call %d: unexpected error: %v", i, err)
+			} else if got != 2*i {
+				t.Errorf("Call %d: got %d, want %d", i, got, 2*i)
+			}
+		}()
+	}
+	wg.Wait()
+
+	rsps, err := loc.Client.Batch(ctx, []jrpc2.Spec{
+		{Method: "Add", Params: []int{1, 2}},
+		{Method: "Add", Params: []int{3, 4}},
+	})
+	if err != nil {
+		t.Fatalf("Batch failed: %v", err)
+	}
+	for i, want := range []int{3, 7} {
+		var got int
+		if err := rsps[i].UnmarshalResult(&got); err != nil || got != want {
+			t.Errorf("Batch response %d: got %d, %v; want %d", i, got, err, want)
+		}
+	}
+	if err := loc.Close(); err != nil {
+		t.Errorf("Server exit: unexpected error: %v", err)
+	}
+}
+
+func TestClient_Subscribe(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	unsub := make(chan string, 1)
+	var other []string
+	loc := server.NewLocal(handler.Map{
+		"subscribe": handler.New(func(context.Context, []string) (string, error) {
+			return "s1", nil
+		}),
+		"unsubscribe": handler.New(func(_ context.Context, ids []string) error {
+			unsub <- strings.Join(ids, ",")
+			return nil
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{AllowPush: true, Concurrency: 2},
+		Client: &jrpc2.ClientOptions{
+			OnNotify: func(req *jrpc2.Request) { other = append(other, req.Method()) },
+		},
+	})
+	s, c := loc.Server, loc.Client
+	ctx := context.Background()
+
+	sub, err := c.Subscribe(ctx, "subscribe", []string{"events"})
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	if got := sub.ID(); got != "s1" {
+		t.Errorf("Subscription ID: got %q, want s1", got)
+	}
+
+	type event struct {
+		Sub string `json:"subscription"`
+		N   int    `json:"result"`
+	}
+	for i := 1; i <= 3; i++ {
+		if err := s.Notify(ctx, "event", event{"s1", i}); err != nil {
+			t.Fatalf("Notify %d failed: %v", i, err)
+		}
+	}
+	if err := s.Notify(ctx, "event", event{"s2", 0}); err != nil {
+		t.Fatalf("Notify other failed: %v", err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		req := <-sub.C
+		var got event
+		if err := req.UnmarshalParams(&got); err != nil {
+			t.Fatalf("Notification %d: invalid params: %v", i, err)
+		} else if got.N != i {
+			t.Errorf("Notification %d: got result %d, want %d", i, got.N, i)
+		}
+	}
+
+	if err := sub.Close(); err != nil {
+		t.Errorf("Subscription close: unexpected error: %v", err)
+	}
+	if got := <-unsub; got != "s1" {
+		t.Errorf("Unsubscribe: got %q, want s1", got)
+	}
+	if req, ok := <-sub.C; ok {
+		t.Errorf("Subscription channel was not closed: got %v", req)
+	}
+
+	loc.Close()
+	if diff := cmp.Diff([]string{"event"}, other); diff != "" {
+		t.Errorf("Other notifications (-want, +got):\n%s", diff)
+	}
+}
+
+func TestClient_LastError(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	t.Run("Decode", func(t *testing.T) {
+		cch, sch := channel.Direct()
+		c := jrpc2.NewClient(cch, nil)
+		if err := c.LastError(); err != nil {
+			t.Errorf("LastError before failure: got %v, want nil", err)
+		}
+		if err := sch.Send([]byte("}{")); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		sch.Close()
+
+		err := waitLastError(t, c)
+		c.Close()
+		if got := code.FromError(err); got != code.ParseError {
+			t.Errorf("LastError: got %v (code %v), want code %v", err, got, code.ParseError)
+		}
+		if err == nil || !strings.Contains(err.Error(), "decoding 2-byte message") {
+			t.Errorf("LastError: got %v, want message size", err)
+		}
+		var jerr *jrpc2.Error
+		if !errors.As(err, &jerr) || jerr.Message != "invalid request value" {
+			t.Errorf("LastError: got %v, want message %q", err, "invalid request value")
+		}
+	})
+
+	t.Run("EOF", func(t *testing.T) {
+		cch, sch := channel.Direct()
+		c := jrpc2.NewClient(cch, nil)
+		sch.Close()
+		err := waitLastError(t, c)
+		c.Close()
+		if err != io.EOF {
+			t.Errorf("LastError: got %v, want %v", err, io.EOF)
+		}
+	})
+}
+
+// waitLastError waits for c to stop on its own, and returns its last error.
+func waitLastError(t *testing.T, c *jrpc2.Client) error {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(time.Millisecond) {
+		if err := c.LastError(); err != nil {
+			return err
+		}
+	}
+	t.Fatal("Timed out waiting for the client to stop")
+	return nil
+}
+
+func TestInboundBatch(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	loc := server.NewLocal(handler.Map{
+		"Peers": handler.New(func(ctx context.Context) ([]string, error) {
+			var ids []string
+			for _, req := range jrpc2.InboundBatch(ctx) {
+				ids = append(ids, req.ID())
+			}
+			return ids, nil
+		}),
+		"Note": handler.New(func(context.Context) error { return nil }),
+	}, nil)
+	defer loc.Close()
+	ctx := context.Background()
+
+	var single []string
+	if err := loc.Client.CallResult(ctx, "Peers", nil, &single); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	} else if single != nil {
+		t.Errorf("Single request: got batch %q, want nil", single)
+	}
+
+	rsps, err := loc.Client.Batch(ctx, []jrpc2.Spec{
+		{Method: "Peers"},
+		{Method: "Note", Notify: true},
+		{Method: "Peers"},
+	})
+	if err != nil {
+		t.Fatalf("Batch failed: %v", err)
+	}
+	want := []string{rsps[0].ID(), "", rsps[1].ID()}
+	for i, rsp := range rsps {
+		var got []string
+		if err := rsp.UnmarshalResult(&got); err != nil {
+			t.Errorf("Response %d: unexpected error: %v", i, err)
+		} else if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Response %d batch IDs (-want, +got):\n%s", i, diff)
+		}
+	}
+}
+
+// flakyChannel is a channel whose first few sends fail.
+type flakyChannel struct {
+	channel.Channel
+	fails int32 // remaining sends to fail
+}
+
+func (f *flakyChannel) Send(msg []byte) error {
+	if atomic.AddInt32(&f.fails, -1) >= 0 {
+		return errors.New("transient send failure")
+	}
+	return f.Channel.Send(msg)
+}
+
+func TestClient_Retry(t *testing.T) {
+	defer leaktest.Check(t)()
 
-	const invalidIDMessage = `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"invalid request ID"}}`
 	tests := []struct {
-		input, want string
+		fails int32
+		retry jrpc2.RetryPolicy
+		ok    bool
 	}{
-		// Missing version marker (and therefore wrong).
-		{`{"id":0}`,
-			`{"jsonrpc":"2.0","id":0,"error":{"code":-32600,"message":"invalid version marker"}}`},
+		{0, jrpc2.RetryPolicy{}, true},
+		{1, jrpc2.RetryPolicy{}, false},
+		{2, jrpc2.RetryPolicy{Max: 2}, true},
+		{3, jrpc2.RetryPolicy{Max: 2}, false},
+		{2, jrpc2.RetryPolicy{
+			Max:     5,
+			Backoff: func(n int) time.Duration { return time.Duration(n) * time.Millisecond },
+		}, true},
+		{1, jrpc2.RetryPolicy{
+			Max:       5,
+			Retryable: func(error) bool { return false },
+		}, false},
+	}
+	for _, test := range tests {
+		cch, sch := channel.Direct()
+		s := jrpc2.NewServer(handler.Map{"X": testOK}, nil).Start(sch)
+		c := jrpc2.NewClient(&flakyChannel{Channel: cch, fails: test.fails}, &jrpc2.ClientOptions{
+			Retry: test.retry,
+		})
 
-		// Version marker is present, but wrong.
-		{`{"jsonrpc":"1.5","id":1}`,
-			`{"jsonrpc":"2.0","id":1,"error":{"code":-32600,"message":"invalid version marker"}}`},
+		rsp, err := c.Call(context.Background(), "X", nil)
+		if test.ok && err != nil {
+			t.Errorf("Call (fails=%d, max=%d): unexpected error: %v", test.fails, test.retry.Max, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("Call (fails=%d, max=%d): got %v, wanted error", test.fails, test.retry.Max, rsp.ResultString())
+		}
+		c.Close()
+		s.Wait()
+	}
 
-		// No method was specified.
-		{`{"jsonrpc":"2.0","id":2}`,
-			`{"jsonrpc":"2.0","id":2,"error":{"code":-32600,"message":"empty method name"}}`},
+	t.Run("Context", func(t *testing.T) {
+		cch, sch := channel.Direct()
+		s := jrpc2.NewServer(handler.Map{"X": testOK}, nil).Start(sch)
+		defer s.Wait()
+		c := jrpc2.NewClient(&flakyChannel{Channel: cch, fails: 100}, &jrpc2.ClientOptions{
+			Retry: jrpc2.RetryPolicy{
+				Max:     100,
+				Backoff: func(int) time.Duration { return time.Hour },
+			},
+		})
+		defer c.Close()
 
-		// The method specified doesn't exist.
-		{`{"jsonrpc":"2.0", "id": 3, "method": "NoneSuch"}`,
-			`{"jsonrpc":"2.0","id":3,"error":{"code":-32601,"message":"method not found","data":"NoneSuch"}}`},
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if _, err := c.Call(ctx, "X", nil); err != context.DeadlineExceeded {
+			t.Errorf("Call: got %v, want %v", err, context.DeadlineExceeded)
+		}
+	})
+}
 
-		// The parameters are of the wrong form.
-		{`{"jsonrpc":"2.0", "id": 4, "method": "X", "params": "bogus"}`,
-			`{"jsonrpc":"2.0","id":4,"error":{"code":-32600,"message":"parameters must be array or object"}}`},
+// Verify that NotifyReliable retries notifications the channel fails to send,
+// and sends each at most once after the channel accepts it.
+func TestClient_NotifyReliable(t *testing.T) {
+	defer leaktest.Check(t)()
+	ctx := context.Background()
 
-		// The parameters are absent, but as null.
-		{`{"jsonrpc": "2.0", "id": 6, "method": "X", "params": null}`,
-			`{"jsonrpc":"2.0","id":6,"result":"OK"}`},
+	tests := []struct {
+		fails int32
+		retry jrpc2.RetryPolicy
+		ok    bool
+	}{
+		{0, jrpc2.RetryPolicy{}, true},
+		{1, jrpc2.RetryPolicy{}, false},
+		{2, jrpc2.RetryPolicy{Max: 2}, true},
+		{3, jrpc2.RetryPolicy{Max: 2}, false},
+		{1, jrpc2.RetryPolicy{
+			Max:       5,
+			Retryable: func(error) bool { return false },
+		}, false},
+	}
+	for _, test := range tests {
+		ch := chantest.New()
+		c := jrpc2.NewClient(&flakyChannel{Channel: ch, fails: test.fails}, &jrpc2.ClientOptions{
+			Retry: test.retry,
+		})
 
-		// Correct requests.
-		{`{"jsonrpc":"2.0","id": 5, "method": "X"}`, `{"jsonrpc":"2.0","id":5,"result":"OK"}`},
-		{`{"jsonrpc":"2.0","id":21,"method":"Y"}`, `{"jsonrpc":"2.0","id":21,"result":null}`},
-		{`{"jsonrpc":"2.0","id":0,"method":"X"}`, `{"jsonrpc":"2.0","id":0,"result":"OK"}`},
-		{`{"jsonrpc":"2.0","id":-0,"method":"X"}`, `{"jsonrpc":"2.0","id":-0,"result":"OK"}`},
-		{`{"jsonrpc":"2.0","id":-1,"method":"X"}`, `{"jsonrpc":"2.0","id":-1,"result":"OK"}`},
-		{`{"jsonrpc":"2.0","id":-600,"method":"Y"}`, `{"jsonrpc":"2.0","id":-600,"result":null}`},
+		err := c.NotifyReliable(ctx, "Event", nil)
+		if test.ok && err != nil {
+			t.Errorf("NotifyReliable (fails=%d, max=%d): unexpected error: %v", test.fails, test.retry.Max, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("NotifyReliable (fails=%d, max=%d): got nil, wanted error", test.fails, test.retry.Max)
+		}
+		want := 0
+		if test.ok {
+			want = 1
+		}
+		if n := len(ch.Sent()); n != want {
+			t.Errorf("NotifyReliable (fails=%d, max=%d): sent %d messages, want %d",
+				test.fails, test.retry.Max, n, want)
+		}
+		c.Close()
+	}
 
-		// A batch of correct requests.
-		{`[{"jsonrpc":"2.0", "id":"a1", "method":"X"}, {"jsonrpc":"2.0", "id":"a2", "method": "X"}]`,
-			`[{"jsonrpc":"2.0","id":"a1","result":"OK"},{"jsonrpc":"2.0","id":"a2","result":"OK"}]`},
-		{`{"jsonrpc":"2.0", "id":-25, "method":"X"}`, `{"jsonrpc":"2.0","id":-25,"result":"OK"}`},
+	t.Run("BadParams", func(t *testing.T) {
+		ch := chantest.New()
+		c := jrpc2.NewClient(ch, &jrpc2.ClientOptions{Retry: jrpc2.RetryPolicy{Max: 5}})
+		defer c.Close()
+		if err := c.NotifyReliable(ctx, "Event", func() {}); err == nil {
+			t.Error("NotifyReliable: got nil, wanted error")
+		}
+		if n := len(ch.Sent()); n != 0 {
+			t.Errorf("NotifyReliable: sent %d messages, want 0", n)
+		}
+	})
+}
 
-		// Extra fields on an otherwise-correct request.
-		{`{"jsonrpc":"2.0","id": 7, "method": "Z", "params":[], "bogus":true}`,
-			`{"jsonrpc":"2.0","id":7,"error":{"code":-32600,"message":"extra fields in request","data":["bogus"]}}`},
+func TestClient_CallID(t *testing.T) {
+	defer leaktest.Check(t)()
 
-		// An empty batch request should report a single error object.
-		{`[]`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"empty request batch"}}`},
+	started := make(chan struct{})
+	release := make(chan struct{})
+	loc := server.NewLocal(handler.Map{
+		"Echo": handler.New(func(ctx context.Context) (string, error) {
+			return jrpc2.InboundRequest(ctx).ID(), nil
+		}),
+		"Wait": handler.New(func(ctx context.Context) error {
+			close(started)
+			<-release
+			return nil
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{Concurrency: 2},
+	})
+	defer loc.Close()
+	c := loc.Client
+	ctx := context.Background()
 
-		// An invalid batch request should report a single error object.
-		{`[1]`, `[{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"request is not a JSON object"}}]`},
+	// The caller's ID is sent to the server.
+	rsp, err := c.CallID(ctx, json.RawMessage(` "req-1" `), "Echo", nil)
+	if err != nil {
+		t.Fatalf("CallID failed: %v", err)
+	}
+	var got string
+	if err := rsp.UnmarshalResult(&got); err != nil {
+		t.Fatalf("Invalid result: %v", err)
+	} else if got != `"req-1"` {
+		t.Errorf("Server saw ID %s, want %q", got, `"req-1"`)
+	}
 
-		// A batch of invalid requests returns a batch of errors.
-		{`[{"jsonrpc": "2.0", "id": 6, "method":"bogus"}]`,
-			`[{"jsonrpc":"2.0","id":6,"error":{"code":-32601,"message":"method not found","data":"bogus"}}]`},
+	// Invalid IDs are rejected without sending.
+	for _, id := range []string{"", "null", "true", `{}`, `[1]`} {
+		if _, err := c.CallID(ctx, json.RawMessage(id), "Echo", nil); code.FromError(err) != code.InvalidRequest {
+			t.Errorf("CallID(%#q): got %v, want code %v", id, err, code.InvalidRequest)
+		}
+	}
 
-		// Batch requests return batch responses, even for a singleton.
-		{`[{"jsonrpc": "2.0", "id": 7, "method": "X"}]`, `[{"jsonrpc":"2.0","id":7,"result":"OK"}]`},
+	// An ID that is already pending is rejected. Use the first ID the client
+	// would assign, to check that it skips it.
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.CallID(ctx, json.RawMessage("1"), "Wait", nil)
+		done <- err
+	}()
+	<-started
+	if _, err := c.CallID(ctx, json.RawMessage("1"), "Echo", nil); code.FromError(err) != code.InvalidRequest {
+		t.Errorf("CallID duplicate: got %v, want code %v", err, code.InvalidRequest)
+	}
+	if err := c.CallResult(ctx, "Echo", nil, &got); err != nil {
+		t.Errorf("Call failed: %v", err)
+	} else if got == "1" {
+		t.Errorf("Call used pending ID %s", got)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("CallID Wait: unexpected error: %v", err)
+	}
+}
 
-		// Notifications are not reflected in a batch response.
-		{`[{"jsonrpc": "2.0", "method": "note"}, {"jsonrpc": "2.0", "id": 8, "method": "X"}]`,
-			`[{"jsonrpc":"2.0","id":8,"result":"OK"}]`},
+// Verify that UnmarshalResultNumber preserves large integers in generic values.
+func TestResponse_UnmarshalResultNumber(t *testing.T) {
+	defer leaktest.Check(t)()
 
-		// Invalid structure for a version is reported, with and without ID.
-		{`{"jsonrpc": false}`,
-			`{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"invalid version key"}}`},
-		{`{"jsonrpc": false, "id": 747}`,
-			`{"jsonrpc":"2.0","id":747,"error":{"code":-32700,"message":"invalid version key"}}`},
+	const big = int64(1<<62 + 1) // not exactly representable as float64
+	loc := server.NewLocal(handler.Map{
+		"Big": handler.New(func(context.Context) (map[string]int64, error) {
+			return map[string]int64{"id": big}, nil
+		}),
+	}, nil)
+	defer loc.Close()
+
+	rsp, err := loc.Client.Call(context.Background(), "Big", nil)
+	if err != nil {
+		t.Fatalf("Call Big: unexpected error: %v", err)
+	}
+	var got map[string]interface{}
+	if err := rsp.UnmarshalResultNumber(&got); err != nil {
+		t.Fatalf("UnmarshalResultNumber: unexpected error: %v", err)
+	}
+	num, ok := got["id"].(json.Number)
+	if !ok {
+		t.Fatalf("Result id: got %T, want json.Number", got["id"])
+	}
+	if v, err := num.Int64(); err != nil || v != big {
+		t.Errorf("Result id: got %v, %v; want %d", v, err, big)
+	}
+}
+
+// Test that calls with an acknowledgement timeout fail if no response arrives
+// in time, and that they are retried if the client has a retry policy.
+func TestClient_ackTimeout(t *testing.T) {
+	defer leaktest.Check(t)()
+	ctx := context.Background()
+	const ack = 20 * time.Millisecond
+
+	t.Run("Fail", func(t *testing.T) {
+		ch := chantest.New()
+		cli := jrpc2.NewClient(ch, nil)
+		defer cli.Close()
+
+		if rsp, err := cli.CallAck(ctx, ack, "Lost", nil); err != jrpc2.ErrAckTimeout {
+			t.Errorf("CallAck: got %v, %v; want %v", rsp, err, jrpc2.ErrAckTimeout)
+		}
+
+		rsps, err := cli.Batch(ctx, []jrpc2.Spec{{Method: "Lost", AckTimeout: ack}})
+		if err != nil {
+			t.Fatalf("Batch failed: %v", err)
+		}
+		if got := code.FromError(rsps[0].Error()); got != code.DeadlineExceeded {
+			t.Errorf("Batch response: got %v, want %v", rsps[0].Error(), code.DeadlineExceeded)
+		}
+	})
+
+	t.Run("Retry", func(t *testing.T) {
+		ch := chantest.New()
+		cli := jrpc2.NewClient(ch, &jrpc2.ClientOptions{
+			Retry: jrpc2.RetryPolicy{Max: 1},
+		})
+		defer cli.Close()
+
+		// Lose the first request, and answer the retry.
+		go func() {
+			ch.WaitSent(2)
+			ch.Enqueue([]byte(`{"jsonrpc":"2.0","id":1,"result":"late"}`))
+			ch.Enqueue([]byte(`{"jsonrpc":"2.0","id":2,"result":"ok"}`))
+		}()
+		rsp, err := cli.CallAck(ctx, ack, "Lossy", nil)
+		if err != nil {
+			t.Fatalf("CallAck failed: %v", err)
+		}
+		if got := rsp.ResultString(); got != `"ok"` {
+			t.Errorf("CallAck result: got %#q, want %#q", got, `"ok"`)
+		}
+	})
+}
+
+// Verify that CallTrace reports the message the client sent, whether or not
+// the call succeeded.
+func TestClient_CallTrace(t *testing.T) {
+	defer leaktest.Check(t)()
+	ctx := context.Background()
+
+	ch := chantest.New()
+	cli := jrpc2.NewClient(ch, nil)
+	defer cli.Close()
+
+	go func() {
+		ch.WaitSent(1)
+		ch.Enqueue([]byte(`{"jsonrpc":"2.0","id":1,"result":"ok"}`))
+		ch.WaitSent(2)
+		ch.Enqueue([]byte(`{"jsonrpc":"2.0","id":2,"error":{"code":-32601,"message":"no"}}`))
+	}()
+
+	rsp, msg, err := cli.CallTrace(ctx, "Test", []int{1, 2})
+	if err != nil {
+		t.Fatalf("CallTrace failed: %v", err)
+	} else if got := rsp.ResultString(); got != `"ok"` {
+		t.Errorf("CallTrace result: got %#q, want %#q", got, `"ok"`)
+	}
+	const want1 = `{"jsonrpc":"2.0","id":1,"method":"Test","params":[1,2]}`
+	if got := string(msg); got != want1 {
+		t.Errorf("CallTrace message: got %#q, want %#q", got, want1)
+	}
+
+	_, msg, err = cli.CallTrace(ctx, "Fail", nil)
+	if got := code.FromError(err); got != code.MethodNotFound {
+		t.Errorf("CallTrace: got error %v, want %v", err, code.MethodNotFound)
+	}
+	const want2 = `{"jsonrpc":"2.0","id":2,"method":"Fail"}`
+	if got := string(msg); got != want2 {
+		t.Errorf("CallTrace message: got %#q, want %#q", got, want2)
+	}
+	if sent := ch.Sent(); len(sent) != 2 || string(sent[1]) != want2 {
+		t.Errorf("Channel messages: got %q, want [%s %s]", sent, want1, want2)
+	}
+}
+
+// Verify that BatchStream delivers responses in order of completion.
+func TestClient_BatchStream(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	ch := chantest.New()
+	cli := jrpc2.NewClient(ch, nil)
+	defer cli.Close()
+
+	rsps, err := cli.BatchStream(context.Background(), []jrpc2.Spec{
+		{Method: "A"},
+		{Method: "B"},
+		{Method: "Note", Notify: true},
+		{Method: "C"},
+	})
+	if err != nil {
+		t.Fatalf("BatchStream failed: %v", err)
+	}
+	for _, want := range []struct{ id, method string }{{"3", "C"}, {"1", "A"}, {"2", "B"}} {
+		ch.Enqueue([]byte(fmt.Sprintf(`{"jsonrpc":"2.0","id":%s,"result":%q}`, want.id, want.method)))
+		rsp, ok := <-rsps
+		if !ok {
+			t.Fatalf("Response channel closed early, want id %s", want.id)
+		}
+		if rsp.ID() != want.id || rsp.Method() != want.method {
+			t.Errorf("Response: got id %s method %q, want id %s method %q", rsp.ID(), rsp.Method(), want.id, want.method)
+		}
+		if got, want := rsp.ResultString(), fmt.Sprintf("%q", want.method); got != want {
+			t.Errorf("Response %s result: got %#q, want %#q", rsp.ID(), got, want)
+		}
+	}
+	if rsp, ok := <-rsps; ok {
+		t.Errorf("Extra response: %v", rsp)
+	}
+}
+
+// Verify that in PartialBatch mode, calls that cannot be encoded fail
+// individually without failing the batch.
+func TestClient_PartialBatch(t *testing.T) {
+	defer leaktest.Check(t)()
+	ctx := context.Background()
+
+	ch := chantest.New()
+	cli := jrpc2.NewClient(ch, &jrpc2.ClientOptions{PartialBatch: true})
+	defer cli.Close()
+
+	go func() {
+		ch.WaitSent(1)
+		ch.Enqueue([]byte(`[{"jsonrpc":"2.0","id":1,"result":"A"},{"jsonrpc":"2.0","id":2,"result":"D"}]`))
+	}()
+	rsps, err := cli.Batch(ctx, []jrpc2.Spec{
+		{Method: "A"},
+		{Method: "B", Params: []interface{}{make(chan int)}}, // cannot be marshaled
+		{Method: "C", Params: "not an array"},
+		{Method: "D"},
+	})
+	if err != nil {
+		t.Fatalf("Batch failed: %v", err)
+	}
+	const want = `[{"jsonrpc":"2.0","id":1,"method":"A"},{"jsonrpc":"2.0","id":2,"method":"D"}]`
+	if sent := ch.Sent(); len(sent) != 1 || string(sent[0]) != want {
+		t.Errorf("Channel messages: got %q, want [%s]", sent, want)
+	}
+	tests := []struct {
+		method string
+		code   code.Code
+		result string
+	}{
+		{"A", code.NoError, `"A"`},
+		{"B", code.InvalidParams, ""},
+		{"C", code.InvalidRequest, ""},
+		{"D", code.NoError, `"D"`},
+	}
+	if len(rsps) != len(tests) {
+		t.Fatalf("Batch: got %d responses, want %d", len(rsps), len(tests))
+	}
+	for i, test := range tests {
+		rsp := rsps[i]
+		if rsp.Method() != test.method {
+			t.Errorf("Response %d: got method %q, want %q", i, rsp.Method(), test.method)
+		}
+		var got code.Code = code.NoError
+		if err := rsp.Error(); err != nil {
+			got = err.Code
+		}
+		if got != test.code {
+			t.Errorf("Response %d: got code %v, want %v", i, got, test.code)
+		} else if s := rsp.ResultString(); s != test.result {
+			t.Errorf("Response %d: got result %#q, want %#q", i, s, test.result)
+		}
+	}
+
+	// If no call can be sent, nothing is.
+	rsps, err = cli.Batch(ctx, []jrpc2.Spec{{Method: "E", Params: "bad"}})
+	if err != nil {
+		t.Fatalf("Batch failed: %v", err)
+	} else if len(rsps) != 1 || rsps[0].Error() == nil {
+		t.Errorf("Batch: got %+v, want one failed response", rsps)
+	}
+	if n := len(ch.Sent()); n != 1 {
+		t.Errorf("Channel messages: got %d, want 1", n)
+	}
+
+	// A notification that cannot be encoded fails the batch.
+	if _, err := cli.Batch(ctx, []jrpc2.Spec{{Method: "F", Params: "bad", Notify: true}}); err == nil {
+		t.Error("Batch with invalid notification: got nil error, want failure")
+	}
+}
+
+// Verify that BatchTimeout returns the responses that arrived before its
+// deadline, and reports the rest as expired.
+func TestClient_BatchTimeout(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	ch := chantest.New()
+	cli := jrpc2.NewClient(ch, nil)
+	defer cli.Close()
+
+	go func() {
+		ch.WaitSent(1)
+		ch.Enqueue([]byte(`{"jsonrpc":"2.0","id":1,"result":"ok"}`))
+	}()
+	start := time.Now()
+	rsps, err := cli.BatchTimeout(context.Background(), []jrpc2.Spec{
+		{Method: "Fast"},
+		{Method: "Note", Notify: true},
+		{Method: "Slow"},
+	}, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("BatchTimeout failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("BatchTimeout returned after %v, before its deadline", elapsed)
+	}
+	if len(rsps) != 2 {
+		t.Fatalf("BatchTimeout: got %d responses, want 2", len(rsps))
+	}
+	if got := rsps[0].ResultString(); got != `"ok"` {
+		t.Errorf("Response 0: got %#q, want %#q", got, `"ok"`)
+	}
+	if got := code.FromError(rsps[1].Error()); got != code.DeadlineExceeded {
+		t.Errorf("Response 1: got error %v, want %v", rsps[1].Error(), code.DeadlineExceeded)
+	}
+	if ids := cli.PendingIDs(); len(ids) != 0 {
+		t.Errorf("PendingIDs after BatchTimeout: got %+v, want none", ids)
+	}
+}
 
-		// Invalid structure for a method name is reported, with and without ID.
-		{`{"jsonrpc":"2.0", "method": [false]}`,
-			`{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"invalid method name"}}`},
-		{`{"jsonrpc":"2.0", "method": [false], "id": 252}`,
-			`{"jsonrpc":"2.0","id":252,"error":{"code":-32700,"message":"invalid method name"}}`},
+type paramsFunc func() (json.RawMessage, error)
 
-		// A broken batch request should report a single top-level error.
-		{`[{"jsonrpc":"2.0", "method":"A", "id": 1}, {"jsonrpc":"2.0"]`, // N.B. syntax error
-			`{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"invalid request value"}}`},
+func (f paramsFunc) MarshalParams() (json.RawMessage, error) { return f() }
 
-		// A broken single request should report a top-level error.
-		{`{"bogus"][++`,
-			`{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"invalid request value"}}`},
+// Verify that the client uses the encoding provided by a ParamsMarshaler.
+func TestClient_ParamsMarshaler(t *testing.T) {
+	defer leaktest.Check(t)()
+	ctx := context.Background()
 
-		// Various invalid ID checks.
-		{`{"jsonrpc":"2.0", "id":[], "method":"X"}`, invalidIDMessage},    // invalid ID: array
-		{`{"jsonrpc":"2.0", "id":["q"], "method":"X"}`, invalidIDMessage}, // "
-		{`{"jsonrpc":"2.0", "id":{}, "method":"X"}`, invalidIDMessage},    // invalid ID: object
-		{`{"jsonrpc":"2.0", "id":true, "method":"X"}`, invalidIDMessage},  // invalid ID: Boolean
-		{`{"jsonrpc":"2.0", "id":false, "method":"X"}`, invalidIDMessage}, // "
+	ch := chantest.New()
+	cli := jrpc2.NewClient(ch, nil)
+	defer cli.Close()
+
+	custom := paramsFunc(func() (json.RawMessage, error) {
+		return json.RawMessage(`{"canonical":true}`), nil
+	})
+	if err := cli.Notify(ctx, "Test", custom); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	const want = `{"jsonrpc":"2.0","method":"Test","params":{"canonical":true}}`
+	if sent := ch.Sent(); len(sent) != 1 || string(sent[0]) != want {
+		t.Errorf("Channel messages: got %q, want [%s]", sent, want)
+	}
+
+	tests := []struct {
+		name string
+		f    paramsFunc
+		want string // error substring
+	}{
+		{"Error", func() (json.RawMessage, error) { return nil, errors.New("bad params") }, "bad params"},
+		{"NotArray", func() (json.RawMessage, error) { return json.RawMessage(`"x"`), nil }, "array or object required"},
+		{"Invalid", func() (json.RawMessage, error) { return json.RawMessage(`{"x":`), nil }, "not valid JSON"},
 	}
 	for _, test := range tests {
-		if err := cli.Send([]byte(test.input)); err != nil {
-			t.Fatalf("Send %#q failed: %v", test.input, err)
-		}
-		raw, err := cli.Recv()
-		if err != nil {
-			t.Fatalf("Recv failed: %v", err)
-		}
-		if got := string(raw); got != test.want {
-			t.Errorf("Simulated call %#q: got %#q, want %#q", test.input, got, test.want)
+		t.Run(test.name, func(t *testing.T) {
+			err := cli.Notify(ctx, "Test", test.f)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("Notify: got error %v, want %q", err, test.want)
+			}
+		})
+	}
+	if n := len(ch.Sent()); n != 1 {
+		t.Errorf("Channel messages: got %d, want 1", n)
+	}
+}
+
+// Verify that Positional encodes its arguments as a JSON array.
+func TestPositional(t *testing.T) {
+	defer leaktest.Check(t)()
+	ctx := context.Background()
+
+	ch := chantest.New()
+	cli := jrpc2.NewClient(ch, nil)
+	defer cli.Close()
+
+	for _, p := range []jrpc2.ParamsMarshaler{
+		jrpc2.Positional(),
+		jrpc2.Positional(1, "two", []int{3}, nil),
+	} {
+		if err := cli.Notify(ctx, "Test", p); err != nil {
+			t.Fatalf("Notify failed: %v", err)
 		}
 	}
+	var sent []string
+	for _, msg := range ch.Sent() {
+		sent = append(sent, string(msg))
+	}
+	if diff := cmp.Diff([]string{
+		`{"jsonrpc":"2.0","method":"Test","params":[]}`,
+		`{"jsonrpc":"2.0","method":"Test","params":[1,"two",[3],null]}`,
+	}, sent); diff != "" {
+		t.Errorf("Channel messages (-want, +got):\n%s", diff)
+	}
+
+	err := cli.Notify(ctx, "Test", jrpc2.Positional(1, func() {}))
+	if err == nil || !strings.Contains(err.Error(), "argument 2") {
+		t.Errorf("Notify with a bad argument: got error %v, want argument 2", err)
+	}
 }
 
-// Verify that server-side push notifications work.
-func TestServer_Notify(t *testing.T) {
+// Verify that the OnFrame hooks observe the messages sent and received by the
+// client and the server.
+func TestOnFrame(t *testing.T) {
 	defer leaktest.Check(t)()
 
-	// Set up a server and client with server-side notification support.  Here
-	// we're just capturing the name of the notification method, as a sign we
-	// got the right thing.
-	var notes []string
+	type frame struct {
+		Dir jrpc2.Direction
+		Msg string
+	}
+	var mu sync.Mutex
+	var cframes, sframes []frame
+	record := func(fs *[]frame) func(jrpc2.Direction, []byte) {
+		return func(dir jrpc2.Direction, msg []byte) {
+			mu.Lock()
+			defer mu.Unlock()
+			*fs = append(*fs, frame{dir, string(msg)})
+		}
+	}
 	loc := server.NewLocal(handler.Map{
-		"NoteMe": handler.New(func(ctx context.Context) (bool, error) {
-			// When this method is called, it posts a notification back to the
-			// client before returning.
-			if err := jrpc2.ServerFromContext(ctx).Notify(ctx, "method", nil); err != nil {
-				t.Errorf("Push Notify unexpectedly failed: %v", err)
-				return false, err
-			}
-			return true, nil
-		}),
+		"Test": handler.New(func(context.Context) (string, error) { return "ok", nil }),
 	}, &server.LocalOptions{
-		Server: &jrpc2.ServerOptions{
-			AllowPush: true,
-		},
-		Client: &jrpc2.ClientOptions{
-			OnNotify: func(req *jrpc2.Request) {
-				notes = append(notes, req.Method())
-				t.Logf("OnNotify handler saw method %q", req.Method())
-			},
-		},
+		Client: &jrpc2.ClientOptions{OnFrame: record(&cframes)},
+		Server: &jrpc2.ServerOptions{OnFrame: record(&sframes)},
 	})
-	s, c := loc.Server, loc.Client
-	ctx := context.Background()
+	if _, err := loc.Client.Call(context.Background(), "Test", nil); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	loc.Close()
 
-	// Post an explicit notification.
-	if err := s.Notify(ctx, "explicit", nil); err != nil {
-		t.Errorf("Notify explicit: unexpected error: %v", err)
+	const req = `{"jsonrpc":"2.0","id":1,"method":"Test"}`
+	const rsp = `{"jsonrpc":"2.0","id":1,"result":"ok"}`
+	if diff := cmp.Diff([]frame{{jrpc2.Outbound, req}, {jrpc2.Inbound, rsp}}, cframes); diff != "" {
+		t.Errorf("Client frames (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]frame{{jrpc2.Inbound, req}, {jrpc2.Outbound, rsp}}, sframes); diff != "" {
+		t.Errorf("Server frames (-want, +got):\n%s", diff)
 	}
+}
 
-	// Call the method that posts a notification.
-	if _, err := c.Call(ctx, "NoteMe", nil); err != nil {
-		t.Errorf("Call NoteMe: unexpected error: %v", err)
+// Verify that the server enforces the NotifyOnly and CallOnly markers in both
+// directions of misuse.
+func TestServer_callOrNotifyOnly(t *testing.T) {
+	defer leaktest.Check(t)()
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	var ran, dropped []string
+	record := func(name string) {
+		mu.Lock()
+		defer mu.Unlock()
+		ran = append(ran, name)
 	}
+	loc := server.NewLocal(handler.Map{
+		"Event": handler.NotifyOnly(handler.New(func(context.Context) error { record("Event"); return nil })),
+		"Get": handler.CallOnly(handler.New(func(context.Context) string {
+			record("Get")
+			return "ok"
+		}), func(req *jrpc2.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			dropped = append(dropped, req.Method())
+		}),
+	}, nil)
+	defer loc.Close()
 
-	// Shut everything down to be sure the callbacks have settled.
-	// Sort the results since the order of arrival may vary.
-	loc.Close()
-	sort.Strings(notes)
+	if _, err := loc.Client.Call(ctx, "Event", nil); code.FromError(err) != code.InvalidRequest {
+		t.Errorf("Call Event: got %v, want %v", err, code.InvalidRequest)
+	}
+	if err := loc.Client.Notify(ctx, "Get", nil); err != nil {
+		t.Errorf("Notify Get failed: %v", err)
+	}
+	if err := loc.Client.Notify(ctx, "Event", nil); err != nil {
+		t.Errorf("Notify Event failed: %v", err)
+	}
+	if _, err := loc.Client.Call(ctx, "Get", nil); err != nil {
+		t.Errorf("Call Get failed: %v", err)
+	}
+	loc.Client.Close()
+	loc.Server.Wait()
 
-	want := []string{"explicit", "method"}
-	if diff := cmp.Diff(want, notes); diff != "" {
-		t.Errorf("Server notifications: (-want, +got)\n%s", diff)
+	mu.Lock()
+	defer mu.Unlock()
+	sort.Strings(ran)
+	if diff := cmp.Diff([]string{"Event", "Get"}, ran); diff != "" {
+		t.Errorf("Handlers run (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"Get"}, dropped); diff != "" {
+		t.Errorf("Dropped notifications (-want, +got):\n%s", diff)
 	}
 }
 
-// Verify that server-side callbacks can time out.
-func TestServer_callbackTimeout(t *testing.T) {
+// Verify that the server normalizes method names before assigning them.
+func TestServer_normalizeMethod(t *testing.T) {
 	defer leaktest.Check(t)()
+	ctx := context.Background()
 
 	loc := server.NewLocal(handler.Map{
-		"Test": handler.New(func(ctx context.Context) error {
-			tctx, cancel := context.WithTimeout(ctx, 5*time.Millisecond)
-			defer cancel()
-			rsp, err := jrpc2.ServerFromContext(ctx).Callback(tctx, "hey", nil)
-			if err == context.DeadlineExceeded {
-				t.Logf("Callback correctly failed: %v", err)
-				return nil
-			} else if err != nil {
-				return fmt.Errorf("unexpected error: %v", err)
-			}
-			return fmt.Errorf("got rsp=%+v, want error", rsp)
+		"echo": handler.New(func(ctx context.Context) string {
+			return jrpc2.InboundRequest(ctx).Method()
 		}),
 	}, &server.LocalOptions{
-		Server: &jrpc2.ServerOptions{AllowPush: true},
-
-		// N.B. Client does not have a callback handler, so calls will be ignored
-		// and no response will be generated.
+		Server: &jrpc2.ServerOptions{NormalizeMethod: strings.ToLower},
 	})
 	defer loc.Close()
-	ctx := context.Background()
 
-	if _, err := loc.Client.Call(ctx, "Test", nil); err != nil {
-		t.Errorf("Call failed: %v", err)
+	for _, method := range []string{"echo", "Echo", "ECHO"} {
+		var got string
+		if err := loc.Client.CallResult(ctx, method, nil, &got); err != nil {
+			t.Errorf("Call %q failed: %v", method, err)
+		} else if got != "echo" {
+			t.Errorf("Call %q: handler saw method %q, want echo", method, got)
+		}
+	}
+	if _, err := loc.Client.Call(ctx, "Other", nil); code.FromError(err) != code.MethodNotFound {
+		t.Errorf("Call Other: got %v, want %v", err, code.MethodNotFound)
 	}
 }
 
-// Verify that server-side callbacks work.
-func TestServer_Callback(t *testing.T) {
+// Verify that the server applies its parameter validator to each request
+// before running the handler.
+func TestServer_validateParams(t *testing.T) {
 	defer leaktest.Check(t)()
 
+	var mu sync.Mutex
+	var checked []string
+	var ran int
 	loc := server.NewLocal(handler.Map{
-		"CallMeMaybe": handler.New(func(ctx context.Context) error {
-			if _, err := jrpc2.ServerFromContext(ctx).Callback(ctx, "succeed", nil); err != nil {
-				t.Errorf("Callback failed: %v", err)
-			}
-
-			if rsp, err := jrpc2.ServerFromContext(ctx).Callback(ctx, "fail", nil); err == nil {
-				t.Errorf("Callback did not fail: got %v, want error", rsp)
-			}
+		"Test": handler.New(func(context.Context, []int) error {
+			mu.Lock()
+			defer mu.Unlock()
+			ran++
 			return nil
 		}),
 	}, &server.LocalOptions{
-		Server: &jrpc2.ServerOptions{AllowPush: true},
-		Client: &jrpc2.ClientOptions{
-			OnCallback: func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
-				t.Logf("OnCallback invoked for method %q", req.Method())
-				switch req.Method() {
-				case "succeed":
-					return true, nil
-				case "fail":
-					return false, errors.New("here is your requested error")
+		Server: &jrpc2.ServerOptions{
+			ValidateParams: func(method string, params json.RawMessage) error {
+				mu.Lock()
+				defer mu.Unlock()
+				checked = append(checked, string(params))
+				switch string(params) {
+				case "[1]":
+					return nil
+				case "[2]":
+					return &jrpc2.Error{Code: code.Code(-1999), Message: "custom"}
 				}
-				panic("broken test: you should not see this")
+				return errors.New("field 0: value out of range")
 			},
 		},
 	})
 	defer loc.Close()
-	ctx := context.Background()
 
-	// Call the method that posts a callback.
-	if _, err := loc.Client.Call(ctx, "CallMeMaybe", nil); err != nil {
-		t.Fatalf("Call CallMeMaybe: unexpected error: %v", err)
+	rsps, err := loc.Client.Batch(context.Background(), []jrpc2.Spec{
+		{Method: "Test", Params: []int{1}},
+		{Method: "Test", Params: []int{2}},
+		{Method: "Test", Params: []int{3}},
+		{Method: "Test", Params: []int{4}, Notify: true},
+	})
+	if err != nil {
+		t.Fatalf("Batch failed: %v", err)
 	}
-
-	// Post an explicit callback.
-	if _, err := loc.Server.Callback(ctx, "succeed", nil); err != nil {
-		t.Errorf("Callback explicit: unexpected error: %v", err)
+	if err := rsps[0].Error(); err != nil {
+		t.Errorf("Response 0: unexpected error: %v", err)
+	}
+	if err := rsps[1].Error(); err == nil || err.Code != -1999 {
+		t.Errorf("Response 1: got error %v, want code -1999", err)
+	}
+	if err := rsps[2].Error(); err == nil || err.Code != code.InvalidParams {
+		t.Errorf("Response 2: got error %v, want %v", err, code.InvalidParams)
+	} else if got, want := string(err.Data), `"field 0: value out of range"`; got != want {
+		t.Errorf("Response 2 data: got %#q, want %#q", got, want)
 	}
-}
-
-// Verify that a server push after the client closes does not trigger a panic.
-func TestServer_pushAfterClose(t *testing.T) {
-	defer leaktest.Check(t)()
 
-	loc := server.NewLocal(make(handler.Map), &server.LocalOptions{
-		Server: &jrpc2.ServerOptions{AllowPush: true},
-	})
-	loc.Client.Close()
-	ctx := context.Background()
-	if err := loc.Server.Notify(ctx, "whatever", nil); err != jrpc2.ErrConnClosed {
-		t.Errorf("Notify(whatever): got %v, want %v", err, jrpc2.ErrConnClosed)
+	mu.Lock()
+	defer mu.Unlock()
+	sort.Strings(checked)
+	if diff := cmp.Diff([]string{"[1]", "[2]", "[3]", "[4]"}, checked); diff != "" {
+		t.Errorf("Validated params (-want, +got):\n%s", diff)
 	}
-	if rsp, err := loc.Server.Callback(ctx, "whatever", nil); err != jrpc2.ErrConnClosed {
-		t.Errorf("Callback(whatever): got %v, %v; want %v", rsp, err, jrpc2.ErrConnClosed)
+	if ran != 1 {
+		t.Errorf("Handler ran %d times, want 1", ran)
 	}
 }
 
-// Verify that an OnCancel hook is called when expected.
-func TestClient_onCancelHook(t *testing.T) {
+// Verify that the server reports its processing time in responses when
+// IncludeTiming is set, and that the client can read it.
+func TestServer_includeTiming(t *testing.T) {
 	defer leaktest.Check(t)()
+	ctx := context.Background()
 
-	hooked := make(chan struct{}) // closed when hook notification is finished
-
-	loc := server.NewLocal(handler.Map{
-		// Block until explicitly cancelled or a long timeout expires.
-		"Stall": handler.New(func(ctx context.Context) error {
-			select {
-			case <-ctx.Done():
-				t.Logf("Method unblocked; returning err=%v", ctx.Err())
-				return ctx.Err()
-			case <-time.After(10 * time.Second): // shouldn't happen
-				t.Error("Timeout waiting for server cancellation")
-			}
-			return nil
+	const delay = 5 * time.Millisecond
+	mux := handler.Map{
+		"Slow": handler.New(func(context.Context) string {
+			time.Sleep(delay)
+			return "ok"
 		}),
+	}
+	for _, timing := range []bool{false, true} {
+		loc := server.NewLocal(mux, &server.LocalOptions{
+			Server: &jrpc2.ServerOptions{IncludeTiming: timing},
+		})
+		rsp, err := loc.Client.Call(ctx, "Slow", nil)
+		if err != nil {
+			t.Fatalf("IncludeTiming=%v: Call failed: %v", timing, err)
+		}
+		d, ok := rsp.ProcessTime()
+		if ok != timing {
+			t.Errorf("IncludeTiming=%v: ProcessTime reported ok=%v", timing, ok)
+		} else if ok && d < delay {
+			t.Errorf("IncludeTiming=%v: ProcessTime is %v, want at least %v", timing, d, delay)
+		}
+		var got string
+		if err := rsp.UnmarshalResult(&got); err != nil || got != "ok" {
+			t.Errorf("IncludeTiming=%v: result is %q, %v; want ok", timing, got, err)
+		}
+		loc.Close()
+	}
 
-		// Cancel the specified request (notification only).
-		"computerSaysNo": handler.New(func(ctx context.Context, ids []string) error {
-			defer close(hooked)
-			if req := jrpc2.InboundRequest(ctx); !req.IsNotification() {
-				return jrpc2.Errorf(code.MethodNotFound, "no such method %q", req.Method())
-			}
-			srv := jrpc2.ServerFromContext(ctx)
-			for _, id := range ids {
-				srv.CancelRequest(id)
-				t.Logf("In cancellation handler, cancelled request id=%v", id)
-			}
-			return nil
-		}),
-	}, &server.LocalOptions{
-		Client: &jrpc2.ClientOptions{
-			OnCancel: func(cli *jrpc2.Client, rsp *jrpc2.Response) {
-				t.Logf("OnCancel hook called with id=%q, err=%v", rsp.ID(), rsp.Error())
-				cli.Notify(context.Background(), "computerSaysNo", []string{rsp.ID()})
+	// The timing is merged into the metadata of a raw response.
+	t.Run("RawResponse", func(t *testing.T) {
+		var mu sync.Mutex
+		var frames []string
+		loc := server.NewLocal(handler.Map{
+			"Raw": handler.New(func(context.Context) jrpc2.RawResponse {
+				return jrpc2.RawResponse(`{"result":1,"meta":{"x":1}}`)
+			}),
+		}, &server.LocalOptions{
+			Server: &jrpc2.ServerOptions{IncludeTiming: true},
+			Client: &jrpc2.ClientOptions{
+				OnFrame: func(dir jrpc2.Direction, msg []byte) {
+					if dir == jrpc2.Inbound {
+						mu.Lock()
+						defer mu.Unlock()
+						frames = append(frames, string(msg))
+					}
+				},
 			},
-		},
-	})
-
-	// Call a method on the server that will stall until its context terminates.
-	// On the client side, set a deadline to expire the caller's context.
-	// The cancellation hook will notify the server to unblock the method.
-	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
-	defer cancel()
+		})
+		defer loc.Close()
 
-	got, err := loc.Client.Call(ctx, "Stall", nil)
-	if err == nil {
-		t.Errorf("Stall: got %+v, wanted error", got)
-	} else if err != context.DeadlineExceeded {
-		t.Errorf("Stall: got error %v, want %v", err, context.Canceled)
-	}
-	<-hooked
-	loc.Client.Close()
-	if err := loc.Server.Wait(); err != nil {
-		t.Errorf("Server exit status: %v", err)
-	}
+		rsp, err := loc.Client.Call(ctx, "Raw", nil)
+		if err != nil {
+			t.Fatalf("Call failed: %v", err)
+		}
+		if _, ok := rsp.ProcessTime(); !ok {
+			t.Error("ProcessTime: got ok=false, want true")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if len(frames) != 1 {
+			t.Fatalf("Got %d inbound frames, want 1", len(frames))
+		}
+		if n := strings.Count(frames[0], `"meta"`); n != 1 {
+			t.Errorf("Frame %#q has %d meta fields, want 1", frames[0], n)
+		}
+		if !strings.Contains(frames[0], `"x":1`) || !strings.Contains(frames[0], `"processNanos":`) {
+			t.Errorf("Frame %#q does not have the merged metadata", frames[0])
+		}
+	})
 }
-
-// Verify that client callback handlers are cancelled when the client stops.
-func TestClient_closeEndsCallbacks(t *testing.T) {
+
+// Verify that the server reports the requests whose handlers are running.
+func TestServer_InFlight(t *testing.T) {
 	defer leaktest.Check(t)()
+	ctx := context.Background()
 
-	ready := make(chan struct{})
+	started := make(chan struct{})
+	release := make(chan struct{})
 	loc := server.NewLocal(handler.Map{
-		"Test": handler.New(func(ctx context.Context) error {
-			// Call back to the client and block indefinitely until it returns.
-			srv := jrpc2.ServerFromContext(ctx)
-			_, err := srv.Callback(ctx, "whatever", nil)
-			return err
+		"Block": handler.New(func(context.Context) error {
+			started <- struct{}{}
+			<-release
+			return nil
 		}),
 	}, &server.LocalOptions{
-		Server: &jrpc2.ServerOptions{AllowPush: true},
-		Client: &jrpc2.ClientOptions{
-			OnCallback: handler.New(func(ctx context.Context) error {
-				// Signal the test that the callback handler is running.  When the
-				// client is closed, it should terminate ctx and allow this to
-				// return. If that doesn't happen, time out and fail.
-				close(ready)
-				select {
-				case <-ctx.Done():
-					return ctx.Err()
-				case <-time.After(10 * time.Second):
-					return errors.New("context not cancelled before timeout")
-				}
-			}),
-		},
+		Server: &jrpc2.ServerOptions{Concurrency: 2},
 	})
-	go func() {
-		rsp, err := loc.Client.Call(context.Background(), "Test", nil)
-		if err == nil {
-			t.Errorf("Client call: got %+v, wanted error", rsp)
+	defer loc.Close()
+
+	before := time.Now()
+	errc := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := loc.Client.Call(ctx, "Block", nil)
+			errc <- err
+		}()
+	}
+	<-started
+	<-started
+
+	got := loc.Server.InFlight()
+	var ids []string
+	for _, info := range got {
+		ids = append(ids, info.ID)
+		if info.Method != "Block" {
+			t.Errorf("InFlight method: got %q, want Block", info.Method)
 		}
-	}()
-	<-ready
-	loc.Client.Close()
-	loc.Server.Wait()
+		if info.Started.Before(before) {
+			t.Errorf("InFlight start time %v is before the calls were made", info.Started)
+		}
+	}
+	sort.Strings(ids)
+	if diff := cmp.Diff([]string{"1", "2"}, ids); diff != "" {
+		t.Errorf("InFlight IDs (-want, +got):\n%s", diff)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != nil {
+			t.Errorf("Call failed: %v", err)
+		}
+	}
+	if got := loc.Server.InFlight(); len(got) != 0 {
+		t.Errorf("InFlight after completion: got %+v, want empty", got)
+	}
 }
 
-// Verify that it is possible for multiple callback handlers to execute
-// concurrently.
-func TestClient_concurrentCallbacks(t *testing.T) {
+// Verify that a client and server can use a custom version marker, and that
+// peers with different markers do not interoperate.
+func TestVersion(t *testing.T) {
 	defer leaktest.Check(t)()
+	ctx := context.Background()
 
-	ready1 := make(chan struct{})
-	ready2 := make(chan struct{})
-	release := make(chan struct{})
-
+	var mu sync.Mutex
+	var frames []string
 	loc := server.NewLocal(handler.Map{
-		"Test": handler.New(func(ctx context.Context) []string {
-			srv := jrpc2.ServerFromContext(ctx)
-
-			// Call two callbacks concurrently, wait until they are both running,
-			// then ungate them and wait for them both to reply. Return their
-			// responses back to the test for validation.
-			ss := make([]string, 2)
-			var wg sync.WaitGroup
-			wg.Add(2)
-			go func() {
-				defer wg.Done()
-				rsp, err := srv.Callback(ctx, "C1", nil)
-				if err != nil {
-					t.Errorf("Callback C1 failed: %v", err)
-				} else {
-					rsp.UnmarshalResult(&ss[0])
-				}
-			}()
-			go func() {
-				defer wg.Done()
-				rsp, err := srv.Callback(ctx, "C2", nil)
-				if err != nil {
-					t.Errorf("Callback C2 failed: %v", err)
-				} else {
-					rsp.UnmarshalResult(&ss[1])
-				}
-			}()
-			<-ready1       // C1 is ready
-			<-ready2       // C2 is ready
-			close(release) // allow all callbacks to proceed
-			wg.Wait()      // wait for all callbacks to be done
-			return ss
-		}),
+		"Test": handler.New(func(context.Context) string { return "ok" }),
 	}, &server.LocalOptions{
-		Server: &jrpc2.ServerOptions{AllowPush: true},
+		Server: &jrpc2.ServerOptions{Version: "x1"},
 		Client: &jrpc2.ClientOptions{
-			OnCallback: handler.Func(func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
-				// A trivial callback that reports its method name.
-				// The name is used to select which invocation we are serving.
-				switch req.Method() {
-				case "C1":
-					close(ready1)
-				case "C2":
-					close(ready2)
-				default:
-					return nil, fmt.Errorf("unexpected method %q", req.Method())
-				}
-				<-release
-				return req.Method(), nil
-			}),
+			Version: "x1",
+			OnFrame: func(_ jrpc2.Direction, msg []byte) {
+				mu.Lock()
+				defer mu.Unlock()
+				frames = append(frames, string(msg))
+			},
 		},
 	})
 	defer loc.Close()
 
-	var got []string
-	if err := loc.Client.CallResult(context.Background(), "Test", nil, &got); err != nil {
-		t.Errorf("Call Test failed: %v", err)
+	var got string
+	if err := loc.Client.CallResult(ctx, "Test", nil, &got); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	} else if got != "ok" {
+		t.Errorf("Call: got %q, want ok", got)
 	}
-	want := []string{"C1", "C2"}
-	if diff := cmp.Diff(want, got); diff != "" {
-		t.Errorf("Wrong callback results: (-want, +got)\n%s", diff)
+	if _, err := loc.Client.CallID(ctx, json.RawMessage(`"custom"`), "Test", nil); err != nil {
+		t.Errorf("CallID failed: %v", err)
+	}
+	mu.Lock()
+	if len(frames) != 4 {
+		t.Errorf("Got %d frames, want 4", len(frames))
+	}
+	for _, frame := range frames {
+		if !strings.Contains(frame, `"jsonrpc":"x1"`) {
+			t.Errorf("Frame %#q does not have the custom version", frame)
+		}
+	}
+	mu.Unlock()
+
+	bad := server.NewLocal(handler.Map{
+		"Test": handler.New(func(context.Context) string { return "ok" }),
+	}, &server.LocalOptions{
+		Client: &jrpc2.ClientOptions{Version: "x1"},
+	})
+	defer bad.Close()
+	if rsp, err := bad.Client.Call(ctx, "Test", nil); err == nil {
+		t.Errorf("Call with mismatched version: got %v, want error", rsp)
 	}
 }
 
-// Verify that a callback can successfully call "up" into the server.
-func TestClient_callbackUpCall(t *testing.T) {
-	defer leaktest.Check(t)()
+// mapCache is a trivial implementation of jrpc2.Cache for testing, which
+// ignores TTLs.
+type mapCache struct {
+	mu sync.Mutex
+	m  map[string]json.RawMessage
+}
 
-	const pingMessage = "kittens!"
+func (c *mapCache) Get(key string) (json.RawMessage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.m[key]
+	return v, ok
+}
 
-	var probe string
+func (c *mapCache) Set(key string, val json.RawMessage, _ time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m[key] = val
+}
+
+// Verify that the server caches the successful results of cacheable methods,
+// and nothing else.
+func TestServer_cache(t *testing.T) {
+	defer leaktest.Check(t)()
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	runs := make(map[string]int)
+	count := func(name string) {
+		mu.Lock()
+		defer mu.Unlock()
+		runs[name]++
+	}
+	cache := &mapCache{m: make(map[string]json.RawMessage)}
 	loc := server.NewLocal(handler.Map{
-		"Test": handler.New(func(ctx context.Context) error {
-			// Call back to the client, and propagate its response.
-			srv := jrpc2.ServerFromContext(ctx)
-			_, err := srv.Callback(ctx, "whatever", nil)
-			return err
-		}),
-		"Ping": handler.New(func(context.Context) string {
-			// This method is called by the client-side callback.
-			return pingMessage
+		"Cached": handler.Cacheable(handler.New(func(_ context.Context, ss []string) (string, error) {
+			count("Cached")
+			if len(ss) == 0 {
+				return "", errors.New("no arguments")
+			}
+			return strings.Join(ss, "+"), nil
+		}), time.Minute),
+		"Plain": handler.New(func(context.Context) string {
+			count("Plain")
+			return "ok"
 		}),
 	}, &server.LocalOptions{
-		Server: &jrpc2.ServerOptions{AllowPush: true},
-		Client: &jrpc2.ClientOptions{
-			OnCallback: handler.New(func(ctx context.Context) error {
-				// Call back up into the server.
-				cli := jrpc2.ClientFromContext(ctx)
-				return cli.CallResult(ctx, "Ping", nil, &probe)
-			}),
-		},
+		Server: &jrpc2.ServerOptions{Cache: cache},
 	})
+	defer loc.Close()
 
-	if _, err := loc.Client.Call(context.Background(), "Test", nil); err != nil {
-		t.Errorf("Call Test failed: %v", err)
+	for i := 0; i < 3; i++ {
+		var got string
+		if err := loc.Client.CallResult(ctx, "Cached", []string{"a", "b"}, &got); err != nil {
+			t.Fatalf("Call Cached failed: %v", err)
+		} else if got != "a+b" {
+			t.Errorf("Call Cached: got %q, want a+b", got)
+		}
+		if _, err := loc.Client.Call(ctx, "Cached", []string{}); err == nil {
+			t.Error("Call Cached with no arguments: got nil error")
+		}
+		if err := loc.Client.Notify(ctx, "Cached", []string{"c"}); err != nil {
+			t.Errorf("Notify Cached failed: %v", err)
+		}
+		if _, err := loc.Client.Call(ctx, "Plain", nil); err != nil {
+			t.Errorf("Call Plain failed: %v", err)
+		}
 	}
-	loc.Close()
-	if probe != pingMessage {
-		t.Errorf("Probe response: got %q, want %q", probe, pingMessage)
+	loc.Client.Close()
+	loc.Server.Wait()
+
+	// One successful call, three failures, and three notifications.
+	mu.Lock()
+	defer mu.Unlock()
+	if diff := cmp.Diff(map[string]int{"Cached": 7, "Plain": 3}, runs); diff != "" {
+		t.Errorf("Handler runs (-want, +got):\n%s", diff)
+	}
+	if len(cache.m) != 1 {
+		t.Errorf("Cache has %d entries, want 1: %v", len(cache.m), cache.m)
+	}
+	for key := range cache.m {
+		if !strings.HasPrefix(key, "Cached/") {
+			t.Errorf("Cache key %q does not have the method prefix", key)
+		}
 	}
 }
 
-// Verify that calling a wrapped method which takes no parameters, but in which
-// the caller provided parameters, will correctly report an error.
-func TestHandler_noParams(t *testing.T) {
+// Verify that cache keys are scoped to the principal of the connection, that
+// a CacheKey hook replaces the default key, and that calls served from the
+// cache are still validated.
+func TestServer_cacheScope(t *testing.T) {
 	defer leaktest.Check(t)()
+	ctx := context.Background()
 
-	loc := server.NewLocal(handler.Map{"Test": testOK}, nil)
-	defer loc.Close()
+	var runs int32
+	mux := handler.Map{
+		"Who": handler.Cacheable(handler.New(func(ctx context.Context) string {
+			atomic.AddInt32(&runs, 1)
+			return jrpc2.Principal(ctx).(string)
+		}), time.Minute),
+	}
+	newLocal := func(cache jrpc2.Cache, who string, opts *jrpc2.ServerOptions) server.Local {
+		o := *opts
+		o.Cache = cache
+		o.Authenticate = func(ctx context.Context) (context.Context, error) {
+			return jrpc2.WithPrincipal(ctx, who), nil
+		}
+		return server.NewLocal(mux, &server.LocalOptions{Server: &o})
+	}
+	call := func(t *testing.T, loc server.Local, want string) {
+		t.Helper()
+		var got string
+		if err := loc.Client.CallResult(ctx, "Who", nil, &got); err != nil {
+			t.Errorf("Call Who failed: %v", err)
+		} else if got != want {
+			t.Errorf("Call Who: got %q, want %q", got, want)
+		}
+	}
 
-	var rsp string
-	if err := loc.Client.CallResult(context.Background(), "Test", []int{1, 2, 3}, &rsp); err == nil {
-		t.Errorf("Call(Test): got %q, wanted error", rsp)
-	} else if ec := code.FromError(err); ec != code.InvalidParams {
-		t.Errorf("Call(Test): got code %v, wanted %v", ec, code.InvalidParams)
+	t.Run("Principal", func(t *testing.T) {
+		atomic.StoreInt32(&runs, 0)
+		cache := &mapCache{m: make(map[string]json.RawMessage)}
+		alice := newLocal(cache, "alice", &jrpc2.ServerOptions{})
+		defer alice.Close()
+		bob := newLocal(cache, "bob", &jrpc2.ServerOptions{})
+		defer bob.Close()
+
+		call(t, alice, "alice")
+		call(t, bob, "bob")
+		call(t, alice, "alice")
+		call(t, bob, "bob")
+		if n := atomic.LoadInt32(&runs); n != 2 {
+			t.Errorf("Handler ran %d times, want 2", n)
+		}
+	})
+
+	t.Run("CacheKey", func(t *testing.T) {
+		atomic.StoreInt32(&runs, 0)
+		cache := &mapCache{m: make(map[string]json.RawMessage)}
+		opts := &jrpc2.ServerOptions{
+			CacheKey: func(_ context.Context, req *jrpc2.Request) (string, bool) {
+				return "shared:" + req.Method(), true
+			},
+		}
+		alice := newLocal(cache, "alice", opts)
+		defer alice.Close()
+		bob := newLocal(cache, "bob", opts)
+		defer bob.Close()
+
+		call(t, alice, "alice")
+		call(t, bob, "alice") // shared by the hook
+		if n := atomic.LoadInt32(&runs); n != 1 {
+			t.Errorf("Handler ran %d times, want 1", n)
+		}
+		if _, ok := cache.m["shared:Who"]; !ok {
+			t.Errorf("Cache keys: got %v, want shared:Who", cache.m)
+		}
+	})
+
+	t.Run("Validate", func(t *testing.T) {
+		cache := &mapCache{m: make(map[string]json.RawMessage)}
+		var deny int32
+		opts := &jrpc2.ServerOptions{
+			ValidateParams: func(string, json.RawMessage) error {
+				if atomic.LoadInt32(&deny) != 0 {
+					return errors.New("denied")
+				}
+				return nil
+			},
+		}
+		loc := newLocal(cache, "alice", opts)
+		defer loc.Close()
+
+		call(t, loc, "alice")
+		atomic.StoreInt32(&deny, 1)
+		_, err := loc.Client.Call(ctx, "Who", nil)
+		if got := code.FromError(err); got != code.InvalidParams {
+			t.Errorf("Call Who from cache: got %v, want InvalidParams", err)
+		}
+	})
+}
+
+// Verify that the client rejects empty and invalid method names without
+// sending anything to the server.
+func TestClient_ValidMethod(t *testing.T) {
+	defer leaktest.Check(t)()
+	ctx := context.Background()
+
+	ch := chantest.New()
+	cli := jrpc2.NewClient(ch, &jrpc2.ClientOptions{
+		ValidMethod: func(method string) bool { return !strings.ContainsAny(method, " \t") },
+	})
+	defer cli.Close()
+
+	for _, method := range []string{"", "Bad Name"} {
+		checks := []struct {
+			name string
+			err  error
+		}{
+			{"Call", func() error { _, err := cli.Call(ctx, method, nil); return err }()},
+			{"CallID", func() error { _, err := cli.CallID(ctx, json.RawMessage(`"x"`), method, nil); return err }()},
+			{"Notify", cli.Notify(ctx, method, nil)},
+			{"Batch", func() error { _, err := cli.Batch(ctx, []jrpc2.Spec{{Method: method}}); return err }()},
+		}
+		for _, c := range checks {
+			if got := code.FromError(c.err); got != code.InvalidRequest {
+				t.Errorf("%s(%q): got error %v, want %v", c.name, method, c.err, code.InvalidRequest)
+			}
+		}
+	}
+	if sent := ch.Sent(); len(sent) != 0 {
+		t.Errorf("Channel messages: got %q, want none", sent)
 	}
 }
 
-// Verify that the rpc.serverInfo handler and client wrapper work together.
-func TestRPCServerInfo(t *testing.T) {
+// Verify that the client waits for room before sending a request that would
+// exceed its MaxPending limit.
+func TestClient_maxPending(t *testing.T) {
 	defer leaktest.Check(t)()
+	ctx := context.Background()
 
-	loc := server.NewLocal(handler.Map{"Test": testOK}, nil)
-	defer loc.Close()
+	ch := chantest.New()
+	cli := jrpc2.NewClient(ch, &jrpc2.ClientOptions{MaxPending: 1})
+	defer cli.Close()
 
-	si, err := jrpc2.RPCServerInfo(context.Background(), loc.Client)
-	if err != nil {
-		t.Errorf("RPCServerInfo failed: %v", err)
+	errc := make(chan error, 2)
+	go func() { _, err := cli.Call(ctx, "A", nil); errc <- err }()
+	ch.WaitSent(1)
+
+	// A call whose context ends while it waits is never sent.
+	tctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := cli.Call(tctx, "B", nil); err != context.DeadlineExceeded {
+		t.Errorf("Call(B): got error %v, want %v", err, context.DeadlineExceeded)
 	}
-	{
-		got, want := si.Methods, []string{"Test"}
-		if diff := cmp.Diff(want, got); diff != "" {
-			t.Errorf("Wrong method names: (-want, +got)\n%s", diff)
+
+	// Notifications do not wait.
+	if err := cli.Notify(ctx, "Note", nil); err != nil {
+		t.Errorf("Notify: unexpected error: %v", err)
+	}
+	go func() { _, err := cli.Call(ctx, "C", nil); errc <- err }()
+	time.Sleep(10 * time.Millisecond) // give C a chance to misbehave
+	if n := len(ch.Sent()); n != 2 {
+		t.Errorf("Messages sent while A is pending: got %d, want 2", n)
+	}
+
+	ch.Enqueue([]byte(`{"jsonrpc":"2.0","id":1,"result":"A"}`))
+	sent := ch.WaitSent(3)
+	if got, want := string(sent[2]), `{"jsonrpc":"2.0","id":3,"method":"C"}`; got != want {
+		t.Errorf("Third message: got %#q, want %#q", got, want)
+	}
+	ch.Enqueue([]byte(`{"jsonrpc":"2.0","id":3,"result":"C"}`))
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != nil {
+			t.Errorf("Call failed: %v", err)
 		}
 	}
 }
 
-func TestNetwork(t *testing.T) {
-	tests := []struct {
-		input, want string
-	}{
-		{"", "unix"},
-		{":", "unix"},
+// Test that the client reports the requests awaiting responses.
+func TestClient_PendingIDs(t *testing.T) {
+	defer leaktest.Check(t)()
 
-		{"nothing", "unix"},        // no colon
-		{"like/a/file", "unix"},    // no colon
-		{"no-port:", "unix"},       // empty port
-		{"file/with:port", "unix"}, // slashes in host
-		{"path/with:404", "unix"},  // slashes in host
-		{"mangled:@3", "unix"},     // non-alphanumerics in port
+	ch := chantest.New()
+	cli := jrpc2.NewClient(ch, nil)
+	defer cli.Close()
+	ctx := context.Background()
 
-		{":80", "tcp"},            // numeric port
-		{":dumb-crud", "tcp"},     // service name
-		{"localhost:80", "tcp"},   // host and numeric port
-		{"localhost:http", "tcp"}, // host and service name
+	if got := cli.PendingIDs(); len(got) != 0 {
+		t.Errorf("PendingIDs: got %+v, want none", got)
 	}
-	for _, test := range tests {
-		got, addr := jrpc2.Network(test.input)
-		if got != test.want {
-			t.Errorf("Network(%q) type: got %q, want %q", test.input, got, test.want)
+
+	start := time.Now()
+	errc := make(chan error, 2)
+	for i, method := range []string{"Alpha", "Bravo"} {
+		go func(method string) {
+			_, err := cli.Call(ctx, method, nil)
+			errc <- err
+		}(method)
+		ch.WaitSent(i + 1)
+	}
+
+	check := func(want ...string) {
+		t.Helper()
+		var got []string
+		for _, p := range cli.PendingIDs() {
+			if p.Sent.Before(start) {
+				t.Errorf("Request %s sent at %v, before the test started", p.ID, p.Sent)
+			}
+			got = append(got, p.ID+" "+p.Method)
 		}
-		if addr != test.input {
-			t.Errorf("Network(%q) addr: got %q, want %q", test.input, addr, test.input)
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("PendingIDs (-want, +got):\n%s", diff)
 		}
 	}
+	check("1 Alpha", "2 Bravo")
+
+	ch.Enqueue([]byte(`{"jsonrpc":"2.0","id":1,"result":null}`))
+	if err := <-errc; err != nil {
+		t.Errorf("Call Alpha failed: %v", err)
+	}
+	check("2 Bravo")
+
+	ch.Enqueue([]byte(`{"jsonrpc":"2.0","id":2,"result":null}`))
+	if err := <-errc; err != nil {
+		t.Errorf("Call Bravo failed: %v", err)
+	}
+	check()
 }
 
-// Verify that the context passed to an assigner has the correct structure.
-func TestHandler_assignContext(t *testing.T) {
+// Verify that a client with ReuseIDs set reuses the IDs of completed calls,
+// but not those of calls still pending.
+func TestClient_reuseIDs(t *testing.T) {
 	defer leaktest.Check(t)()
 
-	loc := server.NewLocal(assignFunc(func(ctx context.Context, method string) jrpc2.Handler {
-		req := jrpc2.InboundRequest(ctx)
-		if req == nil {
-			t.Errorf("No inbound request for assignment of %q", method)
-		} else if req.Method() != method {
-			t.Errorf("Assign inbound: got %q, want %q", req.Method(), method)
-		} else {
-			t.Logf("Inbound request id=%v method=%q OK", req.ID(), req.Method())
-		}
-		return testOK
-	}), nil)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var ids []string
+	loc := server.NewLocal(handler.Map{
+		"Test":  handler.New(func(context.Context) error { return nil }),
+		"Block": handler.New(func(context.Context) error { <-release; return nil }),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{Concurrency: 2},
+		Client: &jrpc2.ClientOptions{
+			ReuseIDs: true,
+			OnSend: func(_ string, _ bool, id string) {
+				mu.Lock()
+				defer mu.Unlock()
+				ids = append(ids, id)
+			},
+		},
+	})
 	defer loc.Close()
-
 	ctx := context.Background()
-	var got string
-	if err := loc.Client.CallResult(ctx, "NerbleFleeger", nil, &got); err != nil {
-		t.Errorf("CallResult unexpectedly failed: %v", err)
-	} else if got != "OK" {
-		t.Errorf("CallResult: got %q, want %q", got, "OK")
+
+	call := func(method string) {
+		if _, err := loc.Client.Call(ctx, method, nil); err != nil {
+			t.Errorf("Call %q failed: %v", method, err)
+		}
+	}
+	call("Test")
+	call("Test")
+
+	// While a call is pending, its ID is not reused.
+	done := make(chan struct{})
+	go func() { defer close(done); call("Block") }()
+	for {
+		mu.Lock()
+		n := len(ids)
+		mu.Unlock()
+		if n == 3 {
+			break // the blocking call was sent
+		}
+		time.Sleep(time.Millisecond)
+	}
+	call("Test")
+	close(release)
+	<-done
+	call("Test")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if diff := cmp.Diff([]string{"1", "1", "1", "2", "1"}, ids); diff != "" {
+		t.Errorf("Request IDs (-want, +got):\n%s", diff)
 	}
 }
 
-type assignFunc func(context.Context, string) jrpc2.Handler
-
-func (a assignFunc) Assign(ctx context.Context, m string) jrpc2.Handler { return a(ctx, m) }
-
-func TestServer_WaitStatus(t *testing.T) {
+// Verify that the OnClose hook reports how the client stopped.
+func TestClient_OnClose(t *testing.T) {
 	defer leaktest.Check(t)()
 
-	check := func(t *testing.T, stat jrpc2.ServerStatus, closed, stopped bool, wantErr error) {
-		t.Helper()
-		if got, want := stat.Success(), wantErr == nil; got != want {
-			t.Errorf("Status success: got %v, want %v", got, want)
-		}
-		if got := stat.Closed; got != closed {
-			t.Errorf("Status closed: got %v, want %v", got, closed)
+	newClient := func() (*chantest.Channel, *jrpc2.Client, chan error) {
+		ch := chantest.New()
+		errc := make(chan error, 2)
+		cli := jrpc2.NewClient(ch, &jrpc2.ClientOptions{
+			OnClose: func(err error) { errc <- err },
+		})
+		return ch, cli, errc
+	}
+
+	t.Run("Close", func(t *testing.T) {
+		_, cli, errc := newClient()
+		cli.Close()
+		if err := <-errc; err != nil {
+			t.Errorf("OnClose: got %v, want nil", err)
 		}
-		if got := stat.Stopped; got != stopped {
-			t.Errorf("Status stopped: got %v, want %v", got, stopped)
+	})
+	t.Run("EOF", func(t *testing.T) {
+		ch, cli, errc := newClient()
+		ch.EnqueueEOF()
+		if err := <-errc; err != io.EOF {
+			t.Errorf("OnClose: got %v, want %v", err, io.EOF)
 		}
-		if stat.Err != wantErr {
-			t.Errorf("Status error: got %v, want %v", stat.Err, wantErr)
+		cli.Close()
+		select {
+		case err := <-errc:
+			t.Errorf("OnClose called again: %v", err)
+		default:
 		}
-	}
-	t.Run("ChannelClosed", func(t *testing.T) {
-		loc := server.NewLocal(handler.Map{"OK": testOK}, nil)
-		loc.Client.Close()
-		check(t, loc.Server.WaitStatus(), true, false, nil)
-	})
-
-	t.Run("ServerStopped", func(t *testing.T) {
-		loc := server.NewLocal(handler.Map{"OK": testOK}, nil)
-		loc.Server.Stop()
-		check(t, loc.Server.WaitStatus(), false, true, nil)
 	})
-
-	t.Run("ChannelFailed", func(t *testing.T) {
-		wantErr := errors.New("failed")
-		ch := buggyChannel{data: "bogus", err: wantErr}
-		srv := jrpc2.NewServer(handler.Map{"OK": testOK}, nil).Start(ch)
-		check(t, srv.WaitStatus(), false, false, wantErr)
+	t.Run("CloseFromHook", func(t *testing.T) {
+		ch := chantest.New()
+		done := make(chan struct{})
+		var cli *jrpc2.Client
+		cli = jrpc2.NewClient(ch, &jrpc2.ClientOptions{
+			OnClose: func(error) { cli.Close(); close(done) },
+		})
+		ch.EnqueueEOF()
+		<-done
 	})
 }
 
-type buggyChannel struct {
-	data string
-	err  error
-}
+// Verify that closing the client interrupts a send that is blocked because
+// the peer has stopped reading.
+func TestClient_CloseBlockedSend(t *testing.T) {
+	defer leaktest.Check(t)()
 
-func (buggyChannel) Send([]byte) error       { panic("should not be called") }
-func (b buggyChannel) Recv() ([]byte, error) { return []byte(b.data), b.err }
-func (buggyChannel) Close() error            { return nil }
+	cconn, sconn := net.Pipe() // sconn is never read
+	defer sconn.Close()
 
-func TestRequest_strictFields(t *testing.T) {
-	defer leaktest.Check(t)()
+	sending := make(chan struct{})
+	cli := jrpc2.NewClient(channel.Line(cconn, cconn), &jrpc2.ClientOptions{
+		OnFrame: func(dir jrpc2.Direction, _ []byte) {
+			if dir == jrpc2.Outbound {
+				close(sending)
+			}
+		},
+	})
 
-	type other struct {
-		C bool `json:"charlie"`
+	errc := make(chan error, 1)
+	go func() { errc <- cli.Notify(context.Background(), "Stuck", nil) }()
+	<-sending
+
+	closed := make(chan struct{})
+	go func() { defer close(closed); cli.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return while a send was blocked")
 	}
-	type params struct {
-		A string `json:"alpha"`
-		B int    `json:"bravo"`
-		other
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("Notify: got nil error, want failure")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Notify did not return after Close")
 	}
+}
+
+// Test that CancelAll fails pending calls without stopping the client.
+func TestClient_CancelAll(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	var numCancel int32
 	loc := server.NewLocal(handler.Map{
-		"Strict": handler.New(func(ctx context.Context, req *jrpc2.Request) (string, error) {
-			var ps params
-			if err := req.UnmarshalParams(jrpc2.StrictFields(&ps)); err != nil {
-				return "", err
-			}
-			return ps.A, nil
-		}),
-		"Normal": handler.New(func(ctx context.Context, req *jrpc2.Request) (string, error) {
-			var ps params
-			if err := req.UnmarshalParams(&ps); err != nil {
-				return "", err
-			}
-			return ps.A, nil
+		"Stall": handler.New(func(context.Context) error {
+			started <- struct{}{}
+			<-release
+			return nil
 		}),
-	}, nil)
+		"Test": handler.New(func(context.Context) string { return "OK" }),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{Concurrency: 3},
+		Client: &jrpc2.ClientOptions{
+			OnCancel: func(*jrpc2.Client, *jrpc2.Response) { atomic.AddInt32(&numCancel, 1) },
+		},
+	})
 	defer loc.Close()
 	ctx := context.Background()
 
-	tests := []struct {
-		method string
-		params interface{}
-		code   code.Code
-		want   string
-	}{
-		{"Strict", handler.Obj{"alpha": "aiuto"}, code.NoError, "aiuto"},
-		{"Strict", handler.Obj{"alpha": "selva me", "charlie": true}, code.NoError, "selva me"},
-		{"Strict", handler.Obj{"alpha": "OK", "nonesuch": true}, code.InvalidParams, ""},
-		{"Normal", handler.Obj{"alpha": "OK", "nonesuch": true}, code.NoError, "OK"},
+	errc := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := loc.Client.Call(ctx, "Stall", nil)
+			errc <- err
+		}()
 	}
-	for _, test := range tests {
-		name := test.method + "/"
-		if test.code == code.NoError {
-			name += "OK"
-		} else {
-			name += test.code.String()
+	<-started
+	<-started
+
+	loc.Client.CancelAll(jrpc2.Errorf(-32050, "reset"))
+	for i := 0; i < 2; i++ {
+		if err := <-errc; code.FromError(err) != -32050 {
+			t.Errorf("Stall call: got %v, want code -32050", err)
 		}
-		t.Run(name, func(t *testing.T) {
-			var res string
-			err := loc.Client.CallResult(ctx, test.method, test.params, &res)
-			if err == nil && test.code != code.NoError {
-				t.Errorf("CallResult: got %+v, want error code %v", res, test.code)
-			} else if err != nil {
-				if c := code.FromError(err); c != test.code {
-					t.Errorf("CallResult: got error %v, wanted code %v", err, test.code)
-				}
-			} else if res != test.want {
-				t.Errorf("CallResult: got %#q, want %#q", res, test.want)
-			}
-		})
+	}
+	if n := atomic.LoadInt32(&numCancel); n != 2 {
+		t.Errorf("OnCancel called %d times, want 2", n)
+	}
+	close(release) // the late replies are discarded
+
+	var got string
+	if err := loc.Client.CallResult(ctx, "Test", nil, &got); err != nil {
+		t.Errorf("Call after CancelAll: unexpected error: %v", err)
+	} else if got != "OK" {
+		t.Errorf("Call after CancelAll: got %q, want OK", got)
 	}
 }
 
-func TestResponse_strictFields(t *testing.T) {
+func TestClient_manualAccept(t *testing.T) {
 	defer leaktest.Check(t)()
 
-	type result struct {
-		A string `json:"alpha"`
-	}
 	loc := server.NewLocal(handler.Map{
-		"Test": handler.New(func(ctx context.Context, req *jrpc2.Request) handler.Obj {
-			return handler.Obj{"alpha": "OK", "bravo": "not OK"}
-		}),
-	}, nil)
+		"Test": handler.New(func(context.Context) (string, error) { return "ok", nil }),
+	}, &server.LocalOptions{
+		Client: &jrpc2.ClientOptions{ManualAccept: true},
+	})
 	defer loc.Close()
 	ctx := context.Background()
 
-	res, err := loc.Client.Call(ctx, "Test", nil)
-	if err != nil {
-		t.Fatalf("Call failed: %v", err)
+	done := make(chan error, 1)
+	var got string
+	go func() { done <- loc.Client.CallResult(ctx, "Test", nil, &got) }()
+
+	// The call cannot complete until we accept its response.
+	if err := loc.Client.Accept(); err != nil {
+		t.Fatalf("Accept: unexpected error: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Call: unexpected error: %v", err)
+	} else if got != "ok" {
+		t.Errorf("Call: got %q, want ok", got)
 	}
 
-	t.Run("Normal", func(t *testing.T) {
-		var got result
-		if err := res.UnmarshalResult(&got); err != nil {
-			t.Errorf("UnmarshalResult failed: %v", err)
-		} else if got.A != "OK" {
-			t.Errorf("Result: got %#q, want OK", got.A)
-		}
-	})
-	t.Run("Strict", func(t *testing.T) {
-		var got result
-		if err := res.UnmarshalResult(jrpc2.StrictFields(&got)); err == nil {
-			t.Errorf("UnmarshalResult: got %#v, wanted error", got)
-		}
-	})
+	loc.Client.Close()
+	if err := loc.Client.Accept(); err == nil {
+		t.Error("Accept after close: got nil, want error")
+	}
+
+	// A client that reads automatically does not permit manual accepts.
+	auto := server.NewLocal(handler.Map{}, nil)
+	defer auto.Close()
+	if err := auto.Client.Accept(); err == nil {
+		t.Error("Accept on automatic client: got nil, want error")
+	}
 }
 
-func TestServerFromContext(t *testing.T) {
+// Verify that an unknown method in a batch fails only its own element, and
+// the other elements are executed and reported in the same reply.
+func TestServer_batchUnknownMethod(t *testing.T) {
 	defer leaktest.Check(t)()
 
-	var got *jrpc2.Server
+	var ran int32
 	loc := server.NewLocal(handler.Map{
-		"Test": handler.New(func(ctx context.Context) error {
-			got = jrpc2.ServerFromContext(ctx)
-			return nil
+		"Known": handler.New(func(context.Context) (string, error) {
+			atomic.AddInt32(&ran, 1)
+			return "ok", nil
 		}),
 	}, nil)
-	if _, err := loc.Client.Call(context.Background(), "Test", nil); err != nil {
-		t.Fatalf("Call failed: %v", err)
+	defer loc.Close()
+
+	rsps, err := loc.Client.Batch(context.Background(), []jrpc2.Spec{
+		{Method: "Known"},
+		{Method: "Unknown"},
+		{Method: "Known"},
+	})
+	if err != nil {
+		t.Fatalf("Batch: unexpected error: %v", err)
 	}
-	if err := loc.Close(); err != nil {
-		t.Errorf("Close failed: %v", err)
+	want := []code.Code{code.NoError, code.MethodNotFound, code.NoError}
+	if len(rsps) != len(want) {
+		t.Fatalf("Batch: got %d responses, want %d", len(rsps), len(want))
 	}
-	if got != loc.Server {
-		t.Errorf("ServerFromContext: got %p, want %p", got, loc.Server)
+	for i, rsp := range rsps {
+		var err error
+		if e := rsp.Error(); e != nil {
+			err = e
+		}
+		if got := code.FromError(err); got != want[i] {
+			t.Errorf("Response %d: got code %v, want %v", i, got, want[i])
+		} else if got == code.NoError && rsp.ResultString() != `"ok"` {
+			t.Errorf("Response %d: got result %s, want %q", i, rsp.ResultString(), "ok")
+		}
+	}
+	if got := atomic.LoadInt32(&ran); got != 2 {
+		t.Errorf("Known handler ran %d times, want 2", got)
 	}
 }
 
-func TestServer_newContext(t *testing.T) {
+// Verify that the context of a call bounds the time spent sending it.
+func TestClient_sendHonorsContext(t *testing.T) {
 	defer leaktest.Check(t)()
 
-	// Prepare a context with a test value attached to it, that the handler can
-	// extract to verify that the base context was plumbed in correctly.
-	type ctxKey string
-	ctx := context.WithValue(context.Background(), ctxKey("test"), 42)
+	// Nothing reads from the server side, so sends by the client block.
+	cch, sch := channel.Direct()
+	c := jrpc2.NewClient(cch, nil)
 
-	loc := server.NewLocal(handler.Map{
-		"Test": handler.New(func(ctx context.Context) error {
-			val := ctx.Value(ctxKey("test"))
-			if val == nil {
-				t.Error("Test value is not present in context")
-			} else if v, ok := val.(int); !ok || v != 42 {
-				t.Errorf("Wrong test value: got %+v, want %v", val, 42)
-			}
-			return nil
-		}),
-	}, &server.LocalOptions{
-		Server: &jrpc2.ServerOptions{
-			// Use the test context constructed above as the base request context.
-			NewContext: func() context.Context { return ctx },
-		},
-	})
-	defer loc.Close()
-	if _, err := loc.Client.Call(context.Background(), "Test", nil); err != nil {
-		t.Errorf("Call failed: %v", err)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.Call(ctx, "X", nil); err != context.DeadlineExceeded {
+		t.Errorf("Call: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Call took %v, longer than its deadline", elapsed)
+	}
+
+	// Closing the client unblocks the abandoned send.
+	sch.Close()
+	c.Close()
+}
+
+// joinedError aggregates errors in the manner of errors.Join.
+type joinedError []error
+
+func (j joinedError) Error() string   { return fmt.Sprint([]error(j)) }
+func (j joinedError) Unwrap() []error { return j }
+
+// Verify that an aggregate error from a handler reports its most severe code.
+func TestServer_joinedErrors(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	appErr := jrpc2.Errorf(code.Code(1234), "app")
+	tests := []struct {
+		err  joinedError
+		code code.Code
+		msg  string
+	}{
+		{joinedError{errors.New("a"), errors.New("b")}, code.InternalError, "a; b"},
+		{joinedError{appErr, jrpc2.Errorf(code.InvalidParams, "bad")}, code.InvalidParams, "app; bad"},
+		{joinedError{jrpc2.Errorf(code.MethodNotFound, "x"), jrpc2.Errorf(code.InvalidParams, "y")},
+			code.MethodNotFound, "x; y"},
+		{joinedError{appErr, fmt.Errorf("wrapped: %w", jrpc2.Errorf(code.SystemError, "sys")), nil},
+			code.SystemError, "app; wrapped: [-32098] sys"},
+		{joinedError{errors.New("plain"), appErr}, code.Code(1234), "plain; app"},
+	}
+	for _, test := range tests {
+		loc := server.NewLocal(handler.Map{
+			"Fail": handler.New(func(context.Context) error { return test.err }),
+		}, nil)
+		_, err := loc.Client.Call(context.Background(), "Fail", nil)
+		var jerr *jrpc2.Error
+		if !errors.As(err, &jerr) {
+			t.Errorf("Call with %v: got %v, want *jrpc2.Error", test.err, err)
+		} else if jerr.Code != test.code || jerr.Message != test.msg {
+			t.Errorf("Call with %v: got (%v, %q), want (%v, %q)",
+				test.err, jerr.Code, jerr.Message, test.code, test.msg)
+		}
+		loc.Close()
 	}
 }
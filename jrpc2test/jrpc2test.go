@@ -0,0 +1,28 @@
+// Copyright (C) 2026 Michael J. Fromberger. All Rights Reserved.
+
+// Package jrpc2test provides support code for testing JSON-RPC handlers
+// end to end, using a client and server connected in memory.
+package jrpc2test
+
+import (
+	"github.com/creachadair/jrpc2"
+	"github.com/creachadair/jrpc2/server"
+)
+
+// NewLocal starts a server that dispatches requests using assigner, and
+// returns it along with a client connected to it by an in-memory channel.
+// The options sopts and copts configure the server and client respectively,
+// and either may be nil.
+//
+// The returned function closes the client and waits for the server to exit.
+// A test should call it, typically via defer, when it is done with the pair:
+//
+//	cli, srv, cleanup := jrpc2test.NewLocal(handler.Map{...}, nil, nil)
+//	defer cleanup()
+func NewLocal(assigner jrpc2.Assigner, sopts *jrpc2.ServerOptions, copts *jrpc2.ClientOptions) (*jrpc2.Client, *jrpc2.Server, func()) {
+	loc := server.NewLocal(assigner, &server.LocalOptions{
+		Server: sopts,
+		Client: copts,
+	})
+	return loc.Client, loc.Server, func() { loc.Close() }
+}
@@ -0,0 +1,35 @@
+// Copyright (C) 2026 Michael J. Fromberger. All Rights Reserved.
+
+package jrpc2test_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/creachadair/jrpc2"
+	"github.com/creachadair/jrpc2/handler"
+	"github.com/creachadair/jrpc2/jrpc2test"
+	"github.com/fortytw2/leaktest"
+)
+
+func TestNewLocal(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	cli, srv, cleanup := jrpc2test.NewLocal(handler.Map{
+		"Hello": handler.New(func(context.Context) (string, error) {
+			return "world", nil
+		}),
+	}, &jrpc2.ServerOptions{Concurrency: 2}, nil)
+
+	var got string
+	if err := cli.CallResult(context.Background(), "Hello", nil, &got); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	} else if got != "world" {
+		t.Errorf("Call result: got %q, want world", got)
+	}
+
+	cleanup()
+	if err := srv.Wait(); err != nil {
+		t.Errorf("Server wait: unexpected error: %v", err)
+	}
+}
@@ -5,6 +5,10 @@ package jrpc2
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
 
 	"github.com/creachadair/jrpc2/code"
 )
@@ -14,7 +18,7 @@ import (
 // must check the individual results for their validity.
 func ParseRequests(msg []byte) ([]*ParsedRequest, error) {
 	var reqs jmessages
-	if err := reqs.parseJSON(msg); err != nil {
+	if err := reqs.parseJSON(msg, Version); err != nil {
 		return nil, err
 	}
 	var err error
@@ -82,8 +86,9 @@ func (j jmessages) toJSON() ([]byte, error) {
 }
 
 // N.B. Not UnmarshalJSON, because json.Unmarshal checks for validity early and
-// here we want to control the error that is returned.
-func (j *jmessages) parseJSON(data []byte) error {
+// here we want to control the error that is returned. Each message must have
+// the given version marker.
+func (j *jmessages) parseJSON(data []byte, version string) error {
 	*j = (*j)[:0] // reset state
 
 	// When parsing requests, validation checks are deferred: The only immediate
@@ -106,8 +111,9 @@ func (j *jmessages) parseJSON(data []byte) error {
 	// know that the messages are intact, but validity is checked at usage.
 	for _, raw := range msgs {
 		req := new(jmessage)
-		req.parseJSON(raw)
+		req.parseJSON(raw, version)
 		req.batch = batch
+		req.size = len(raw)
 		*j = append(*j, req)
 	}
 	return nil
@@ -115,7 +121,7 @@ func (j *jmessages) parseJSON(data []byte) error {
 
 // jmessage is the transmission format of a protocol message.
 type jmessage struct {
-	V  string          // must be Version
+	V  string          // the version marker; if empty, Version
 	ID json.RawMessage // may be nil
 
 	// Fields belonging to request or notification objects
@@ -130,8 +136,22 @@ type jmessage struct {
 	// and R. Specifically, if M != "" then E and R must both be unset. This is
 	// checked during parsing.
 
+	// Non-standard top-level fields of a response (see RawResponse).
+	ext map[string]json.RawMessage
+
+	// Non-standard request metadata (see ServerOptions.DecodeMeta), or
+	// response metadata (see ServerOptions.IncludeTiming).
+	meta json.RawMessage
+
 	batch bool   // this message was part of a batch
+	size  int    // the length in bytes of the encoded message, if parsed
 	err   *Error // if not nil, this message is invalid and err is why
+
+	ack time.Duration // if positive, the acknowledgement timeout (client only)
+
+	internal bool // sent by the client on its own behalf (client only)
+
+	stream StreamResult // if stream.Reader != nil, the streamed result (server only)
 }
 
 // isValidID reports whether v is a valid JSON encoding of a request ID.
@@ -148,8 +168,13 @@ func isValidID(v json.RawMessage) bool {
 	return false // anything else is garbage
 }
 
-// isValidVersion reports whether v is a valid JSON-RPC version string.
-func isValidVersion(v string) bool { return v == Version }
+// version returns the version marker of j, or Version if it has none.
+func (j *jmessage) version() string {
+	if j.V == "" {
+		return Version
+	}
+	return j.V
+}
 
 func (j *jmessage) fail(code code.Code, msg string) {
 	if j.err == nil {
@@ -159,7 +184,16 @@ func (j *jmessage) fail(code code.Code, msg string) {
 
 func (j *jmessage) toJSON() ([]byte, error) {
 	var sb bytes.Buffer
-	sb.WriteString(`{"jsonrpc":"2.0"`)
+	if v := j.version(); v == Version {
+		sb.WriteString(`{"jsonrpc":"2.0"`)
+	} else {
+		bits, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		sb.WriteString(`{"jsonrpc":`)
+		sb.Write(bits)
+	}
 	if len(j.ID) != 0 {
 		sb.WriteString(`,"id":`)
 		sb.Write(j.ID)
@@ -189,12 +223,34 @@ func (j *jmessage) toJSON() ([]byte, error) {
 		sb.WriteString(`,"error":`)
 		sb.Write(e)
 	}
+	if len(j.meta) != 0 {
+		sb.WriteString(`,"meta":`)
+		sb.Write(j.meta)
+	}
+
+	if len(j.ext) != 0 {
+		keys := make([]string, 0, len(j.ext))
+		for key := range j.ext {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			k, err := json.Marshal(key)
+			if err != nil {
+				return nil, err
+			}
+			sb.WriteByte(',')
+			sb.Write(k)
+			sb.WriteByte(':')
+			sb.Write(j.ext[key])
+		}
+	}
 
 	sb.WriteByte('}')
 	return sb.Bytes(), nil
 }
 
-func (j *jmessage) parseJSON(data []byte) error {
+func (j *jmessage) parseJSON(data []byte, version string) error {
 	// Unmarshal into a map so we can check for extra keys.  The json.Decoder
 	// has DisallowUnknownFields, but fails decoding eagerly for fields that do
 	// not map to known tags. We want to fully parse the object so we can
@@ -240,13 +296,21 @@ func (j *jmessage) parseJSON(data []byte) error {
 			}
 		case "result":
 			j.R = val
+		case "meta":
+			// Whether this is allowed is up to the server; see checkAndAssign.
+			if !isNull(val) {
+				j.meta = val
+			}
+			if fb := firstByte(j.meta); fb != 0 && fb != '{' {
+				j.fail(code.InvalidRequest, "request metadata must be an object")
+			}
 		default:
 			extra = append(extra, key)
 		}
 	}
 
 	// Report an error for an invalid version marker
-	if !isValidVersion(j.V) {
+	if j.V != version {
 		j.fail(code.InvalidRequest, "invalid version marker")
 	}
 
@@ -268,11 +332,11 @@ func (j *jmessage) isRequestOrNotification() bool { return j.M != "" && j.E == n
 // isNotification reports whether j is a notification
 func (j *jmessage) isNotification() bool { return j.isRequestOrNotification() && fixID(j.ID) == nil }
 
-// fixID filters id, treating "null" as a synonym for an unset ID.  Some
+// fixID filters id, treating "null" or empty as a synonym for an unset ID. Some
 // implementations (possibly a vestige of v1) emit "null" as an ID for
 // notifications.
 func fixID(id json.RawMessage) json.RawMessage {
-	if !isNull(id) {
+	if len(id) != 0 && !isNull(id) {
 		return id
 	}
 	return nil
@@ -284,12 +348,20 @@ type sender interface{ Send([]byte) error }
 // receiver is the subset of channel.Channel needed to receive messages.
 type receiver interface{ Recv() ([]byte, error) }
 
-// encode marshals rsps as JSON and forwards it to the channel.
-func encode(ch sender, rsps jmessages) (int, error) {
+// encode marshals rsps as JSON and forwards it to the channel. If indent is
+// not empty, the JSON is indented as by json.MarshalIndent with that indent.
+func encode(ch sender, rsps jmessages, indent string) (int, error) {
 	bits, err := rsps.toJSON()
 	if err != nil {
 		return 0, err
 	}
+	if indent != "" {
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, bits, "", indent); err != nil {
+			return 0, err
+		}
+		bits = buf.Bytes()
+	}
 	return len(bits), ch.Send(bits)
 }
 
@@ -307,6 +379,209 @@ func firstByte(data []byte) byte {
 	return clean[0]
 }
 
+// jsonKind returns a short description of the top-level kind of JSON value
+// encoded by data, without validating the whole of it. This is intended for
+// diagnostics where logging the complete value would be too verbose.
+func jsonKind(data []byte) string {
+	switch b := firstByte(data); {
+	case b == 0:
+		return "empty"
+	case b == '{':
+		return "object"
+	case b == '[':
+		return "array"
+	case b == '"':
+		return "string"
+	case b == 't' || b == 'f':
+		return "boolean"
+	case b == 'n':
+		return "null"
+	case b == '-' || (b >= '0' && b <= '9'):
+		return "number"
+	}
+	return "invalid"
+}
+
+// A RawResponse is a complete encoded JSON-RPC response object, which a
+// handler may return in place of a result to send fields that are not defined
+// by the specification alongside the result. It must be a JSON object having
+// exactly one of the keys "result" or "error". The server replaces the
+// "jsonrpc" and "id" keys with the correct values, and sends the other keys of
+// the object verbatim.
+//
+// Note that a response with extension fields is not valid JSON-RPC 2.0, and
+// will be rejected by a client that enforces the specification, including
+// *jrpc2.Client.
+type RawResponse json.RawMessage
+
+// parse decodes the result or error from r, along with its extension fields.
+// It reports an error with code InternalError if r is not valid.
+func (r RawResponse) parse() (json.RawMessage, map[string]json.RawMessage, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(r, &obj); err != nil {
+		return nil, nil, Errorf(code.InternalError, "invalid raw response: %v", err)
+	}
+	res, hasResult := obj["result"]
+	ejs, hasError := obj["error"]
+	if hasResult == hasError {
+		return nil, nil, Errorf(code.InternalError, "invalid raw response: want one of result or error")
+	}
+	for _, key := range []string{"jsonrpc", "id", "result", "error"} {
+		delete(obj, key)
+	}
+	if hasError {
+		var e *Error
+		if err := json.Unmarshal(ejs, &e); err != nil || e == nil {
+			return nil, nil, Errorf(code.InternalError, "invalid raw response error: %v", err)
+		}
+		return nil, obj, e
+	}
+	return res, obj, nil
+}
+
+// A StreamResult is a result whose JSON encoding is read from the embedded
+// io.Reader, which a handler may return in place of a result that is too
+// large to hold in memory. The reader must produce exactly one JSON value.
+// If the reader also implements io.Closer, the server closes it once it has
+// finished with the result. The server reads the result after the handler
+// has returned, so the reader must not depend on the handler's context.
+//
+// The server copies the result directly to the client, without buffering it,
+// if the request was not part of a batch, the channel implements the
+// channel.StreamSender interface, and the server has no TransformResult or
+// SingleFlight hook and no Indent setting. A streamed result is not checked
+// for validity, and the server sends no other messages until it is finished.
+// Otherwise, the server reads the whole result into memory and sends it in
+// the usual way, reporting an error if it is not valid JSON.
+type StreamResult struct{ io.Reader }
+
+// readAll reads and validates the complete result from r.
+func (r StreamResult) readAll() (json.RawMessage, error) {
+	if r.Reader == nil {
+		return json.RawMessage("null"), nil
+	}
+	defer r.close()
+	bits, err := io.ReadAll(r.Reader)
+	if err != nil {
+		return nil, Errorf(code.InternalError, "reading result stream: %v", err)
+	} else if !json.Valid(bits) {
+		return nil, Errorf(code.InternalError, "result stream is not valid JSON")
+	}
+	return bits, nil
+}
+
+// close closes the underlying reader of r, if it is an io.Closer.
+func (r StreamResult) close() {
+	if c, ok := r.Reader.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// WriterStream returns a StreamResult whose JSON encoding is produced by the
+// WriteTo method of w, for a result producer that writes its output rather
+// than providing a reader. It is subject to the same rules as any other
+// StreamResult, and w must write exactly one JSON value. If w also implements
+// io.Closer, the server closes it once it has finished with the result.
+//
+// When the result is streamed, the reader passed to the SendStream method of
+// the channel implements io.WriterTo, so a channel that copies it with
+// io.Copy, as channel.RawJSON does, lets w write directly to its output
+// without an intermediate buffer. Otherwise, the output of w is read through
+// a pipe, and WriteTo runs in a separate goroutine.
+func WriterStream(w io.WriterTo) StreamResult { return StreamResult{Reader: &writerStream{w: w}} }
+
+// writerStream adapts an io.WriterTo to an io.Reader. If WriteTo is called
+// before any Read, the output of w is written directly; otherwise it is read
+// through a pipe whose writer is fed by w in another goroutine.
+type writerStream struct {
+	w  io.WriterTo
+	pr *io.PipeReader // set on the first Read
+}
+
+func (ws *writerStream) Read(data []byte) (int, error) {
+	if ws.pr == nil {
+		pr, pw := io.Pipe()
+		ws.pr = pr
+		go func() { _, err := ws.w.WriteTo(pw); pw.CloseWithError(err) }()
+	}
+	return ws.pr.Read(data)
+}
+
+func (ws *writerStream) WriteTo(w io.Writer) (int64, error) {
+	if ws.pr != nil {
+		return io.Copy(w, ws.pr)
+	}
+	return ws.w.WriteTo(w)
+}
+
+func (ws *writerStream) Close() error {
+	if ws.pr != nil {
+		ws.pr.Close() // unblock the writer goroutine, if it is still running
+	}
+	if c, ok := ws.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// A TypedResult is a result that carries content of a particular media type,
+// such as a rendered file, rather than a JSON value. Over a JSON-RPC channel it
+// is sent as an object with the content type and the base64-encoded body:
+//
+//	{"contentType": "text/plain", "body": "aGVsbG8="}
+//
+// An HTTP bridge from package jhttp can be configured to send the body of a
+// typed result as the HTTP response, with the given Content-Type, instead of
+// a JSON-RPC response (see jhttp.BridgeOptions).
+type TypedResult struct {
+	ContentType string `json:"contentType"`
+	Body        []byte `json:"body"`
+}
+
+// ParamsMarshaler is an optional interface that can be implemented by the
+// params value of a client call to control how the parameters are encoded in
+// the request. If params implements this interface, the client uses the result
+// of MarshalParams instead of calling json.Marshal. The result must still be
+// a JSON array or object, or empty to send the request without parameters.
+type ParamsMarshaler interface {
+	MarshalParams() (json.RawMessage, error)
+}
+
+// Positional returns a params value that encodes args as a JSON array, so the
+// request passes them as positional parameters in the order given. Unlike a
+// plain slice, which may encode as null, the result is an array even when
+// there are no arguments. If an argument cannot be encoded, the call fails
+// with an error that reports its position, numbered from 1.
+//
+// Usage example:
+//
+//	rsp, err := cli.Call(ctx, "Add", jrpc2.Positional(1, 2, 3))
+func Positional(args ...interface{}) ParamsMarshaler { return positional(args) }
+
+type positional []interface{}
+
+// MarshalParams implements the ParamsMarshaler interface.
+func (p positional) MarshalParams() (json.RawMessage, error) { return p.MarshalJSON() }
+
+// MarshalJSON encodes p as a JSON array, so p can also be used where params
+// are encoded with json.Marshal, such as a Spec for Server.PushBatch.
+func (p positional) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i, arg := range p {
+		bits, err := json.Marshal(arg)
+		if err != nil {
+			return nil, fmt.Errorf("argument %d: %w", i+1, err)
+		}
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(bits)
+	}
+	buf.WriteByte(']')
+	return buf.Bytes(), nil
+}
+
 // strictFielder is an optional interface that can be implemented by a type to
 // reject unknown fields when unmarshaling from JSON.  If a type does not
 // implement this interface, unknown fields are ignored.
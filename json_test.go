@@ -56,3 +56,26 @@ func BenchmarkEncodeMessage(b *testing.B) {
 		}
 	})
 }
+
+func TestJSONKind(t *testing.T) {
+	tests := []struct {
+		input, want string
+	}{
+		{"", "empty"},
+		{"  \n", "empty"},
+		{`{"a":1}`, "object"},
+		{` [1, 2]`, "array"},
+		{`"xyz"`, "string"},
+		{"true", "boolean"},
+		{"false", "boolean"},
+		{"null", "null"},
+		{"-25", "number"},
+		{"3.5", "number"},
+		{"@", "invalid"},
+	}
+	for _, test := range tests {
+		if got := jsonKind([]byte(test.input)); got != test.want {
+			t.Errorf("jsonKind(%#q): got %q, want %q", test.input, got, test.want)
+		}
+	}
+}
@@ -7,45 +7,178 @@
 // by the collector except to locate its stored value.
 package metrics
 
-import "sync"
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
 
 // An M collects counters and maximum value trackers.  A nil *M is valid, and
 // discards all metrics. The methods of an *M are safe for concurrent use by
 // multiple goroutines.
 type M struct {
+	// Counters and max values are partitioned by name among several shards,
+	// so that updates to different names do not contend for a single lock.
+	shards [numShards]shard
+
+	mu    sync.Mutex
+	label map[string]interface{}
+
+	labeled map[string]map[string]int64 // :: name ⇒ label set ⇒ count
+	maxSets int                         // max distinct label sets per name
+}
+
+// numShards is the number of shards for counters and max values.
+const numShards = 16
+
+// A shard holds the counters and max values for a subset of names.
+type shard struct {
 	mu      sync.Mutex
 	counter map[string]int64
 	maxVal  map[string]int64
-	label   map[string]interface{}
 }
 
+// shard returns the shard responsible for values with the given name.
+func (m *M) shard(name string) *shard {
+	// FNV-1a, computed inline to avoid converting name to a slice.
+	h := uint32(2166136261)
+	for i := 0; i < len(name); i++ {
+		h ^= uint32(name[i])
+		h *= 16777619
+	}
+	return &m.shards[h%numShards]
+}
+
+// DefaultMaxLabelSets is the default limit on the number of distinct label
+// sets tracked for each name by CountLabeled.
+const DefaultMaxLabelSets = 100
+
+// OtherLabelSet is the label set under which CountLabeled records counts for
+// label sets in excess of the limit for a name.
+const OtherLabelSet = "__other__"
+
 // New creates a new, empty metrics collector.
 func New() *M {
-	return &M{
-		counter: make(map[string]int64),
-		maxVal:  make(map[string]int64),
+	m := &M{
 		label:   make(map[string]interface{}),
+		labeled: make(map[string]map[string]int64),
+		maxSets: DefaultMaxLabelSets,
+	}
+	for i := range m.shards {
+		m.shards[i].counter = make(map[string]int64)
+		m.shards[i].maxVal = make(map[string]int64)
 	}
+	return m
 }
 
 // Count adds n to the current value of the counter named, defining the counter
 // if it does not already exist.
 func (m *M) Count(name string, n int64) {
 	if m != nil {
+		s := m.shard(name)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.counter[name] += n
+	}
+}
+
+// CountLabeled adds n to the current value of the counter named, for the
+// given set of labels, defining the counter if it does not already exist.
+// Labeled counters are reported separately from those updated by Count.
+//
+// Each distinct set of labels is recorded under a key of the form
+//
+//	key1=value1,key2=value2
+//
+// with the keys in lexicographic order. A key or value that is empty, or that
+// contains "=", ",", a double quote, or a non-printing character, is written as
+// a quoted Go string literal, so that distinct label sets have distinct keys.
+// To bound memory use, at most a fixed
+// number of distinct label sets are tracked for each name (see
+// SetMaxLabelSets); once that limit is reached, counts for any new label set
+// are added to the OtherLabelSet bucket instead.
+func (m *M) CountLabeled(name string, labels map[string]string, n int64) {
+	if m != nil {
+		key := labelSetKey(labels)
 		m.mu.Lock()
 		defer m.mu.Unlock()
-		m.counter[name] += n
+		sets, ok := m.labeled[name]
+		if !ok {
+			sets = make(map[string]int64)
+			m.labeled[name] = sets
+		}
+		if _, ok := sets[key]; !ok {
+			used := len(sets)
+			if _, ok := sets[OtherLabelSet]; ok {
+				used-- // the overflow bucket does not count toward the limit
+			}
+			if used >= m.maxSets {
+				key = OtherLabelSet
+			}
+		}
+		sets[key] += n
+	}
+}
+
+// SetMaxLabelSets sets the maximum number of distinct label sets tracked for
+// each name by CountLabeled. Label sets already recorded are not affected.
+// If n < 1, the limit is reset to DefaultMaxLabelSets.
+func (m *M) SetMaxLabelSets(n int) {
+	if m != nil {
+		if n < 1 {
+			n = DefaultMaxLabelSets
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.maxSets = n
+	}
+}
+
+// labelSetKey returns the canonical key for the given labels.
+func labelSetKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	for i, k := range keys {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(quoteLabel(k))
+		sb.WriteByte('=')
+		sb.WriteString(quoteLabel(labels[k]))
+	}
+	return sb.String()
+}
+
+// quoteLabel returns s quoted as a Go string literal if it is empty or
+// contains characters that would make a label set key ambiguous, or otherwise
+// returns s unchanged.
+func quoteLabel(s string) string {
+	if s == "" || strings.ContainsAny(s, `=,"`) {
+		return strconv.Quote(s)
 	}
+	for _, r := range s {
+		if !strconv.IsPrint(r) {
+			return strconv.Quote(s)
+		}
+	}
+	return s
 }
 
 // SetMaxValue sets the maximum value metric named to the greater of n and its
 // current value, defining the value if it does not already exist.
 func (m *M) SetMaxValue(name string, n int64) {
 	if m != nil {
-		m.mu.Lock()
-		defer m.mu.Unlock()
-		if old, ok := m.maxVal[name]; !ok || n > old {
-			m.maxVal[name] = n
+		s := m.shard(name)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if old, ok := s.maxVal[name]; !ok || n > old {
+			s.maxVal[name] = n
 		}
 	}
 }
@@ -54,12 +187,13 @@ func (m *M) SetMaxValue(name string, n int64) {
 // updates a max value tracker with the same name in a single step.
 func (m *M) CountAndSetMax(name string, n int64) {
 	if m != nil {
-		m.mu.Lock()
-		defer m.mu.Unlock()
-		if old, ok := m.maxVal[name]; !ok || n > old {
-			m.maxVal[name] = n
+		s := m.shard(name)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if old, ok := s.maxVal[name]; !ok || n > old {
+			s.maxVal[name] = n
 		}
-		m.counter[name] += n
+		s.counter[name] += n
 	}
 }
 
@@ -105,16 +239,34 @@ func (m *M) EditLabel(name string, edit func(interface{}) interface{}) {
 // nil are snapshotted.
 func (m *M) Snapshot(snap Snapshot) {
 	if m != nil {
+		// Hold all the shard locks (always in the same order) so that the
+		// snapshot is consistent across shards.
+		for i := range m.shards {
+			m.shards[i].mu.Lock()
+			defer m.shards[i].mu.Unlock()
+		}
 		m.mu.Lock()
 		defer m.mu.Unlock()
-		if c := snap.Counter; c != nil {
-			for name, val := range m.counter {
-				c[name] = val
+		for i := range m.shards {
+			s := &m.shards[i]
+			if c := snap.Counter; c != nil {
+				for name, val := range s.counter {
+					c[name] = val
+				}
+			}
+			if v := snap.MaxValue; v != nil {
+				for name, val := range s.maxVal {
+					v[name] = val
+				}
 			}
 		}
-		if v := snap.MaxValue; v != nil {
-			for name, val := range m.maxVal {
-				v[name] = val
+		if v := snap.LabeledCounter; v != nil {
+			for name, sets := range m.labeled {
+				cp := make(map[string]int64, len(sets))
+				for key, val := range sets {
+					cp[key] = val
+				}
+				v[name] = cp
 			}
 		}
 		if v := snap.Label; v != nil {
@@ -135,4 +287,79 @@ type Snapshot struct {
 	Counter  map[string]int64
 	MaxValue map[string]int64
 	Label    map[string]interface{}
+
+	// Labeled counters, by name and then by label set (see CountLabeled).
+	LabeledCounter map[string]map[string]int64
+}
+
+// Sub returns a new snapshot whose counters and labeled counters are the
+// differences between those of s and prev, treating counters missing from
+// prev as zero. The max values and labels of the result are copied from s.
+// Fields that are nil in s are nil in the result.
+//
+// Sub is useful to compute the change in a collector between two snapshots
+// taken at different times.
+func (s Snapshot) Sub(prev Snapshot) Snapshot {
+	var out Snapshot
+	if s.Counter != nil {
+		out.Counter = subCounters(s.Counter, prev.Counter)
+	}
+	if s.LabeledCounter != nil {
+		out.LabeledCounter = make(map[string]map[string]int64, len(s.LabeledCounter))
+		for name, sets := range s.LabeledCounter {
+			out.LabeledCounter[name] = subCounters(sets, prev.LabeledCounter[name])
+		}
+	}
+	if s.MaxValue != nil {
+		out.MaxValue = make(map[string]int64, len(s.MaxValue))
+		for name, val := range s.MaxValue {
+			out.MaxValue[name] = val
+		}
+	}
+	if s.Label != nil {
+		out.Label = make(map[string]interface{}, len(s.Label))
+		for name, val := range s.Label {
+			out.Label[name] = val
+		}
+	}
+	return out
+}
+
+// MarshalJSON encodes s as a JSON object with the following structure:
+//
+//	{
+//	  "counters":        {"name": value, ...},
+//	  "maxValues":       {"name": value, ...},
+//	  "labels":          {"name": value, ...},
+//	  "labeledCounters": {"name": {"key=value,...": value, ...}, ...}
+//	}
+//
+// Fields of s that are empty are omitted. The keys of each object are sorted,
+// and a label whose value has type func() interface{} is encoded as the value
+// it returns, so that the encoding of a snapshot is reproducible.
+func (s Snapshot) MarshalJSON() ([]byte, error) {
+	var labels map[string]interface{}
+	if s.Label != nil {
+		labels = make(map[string]interface{}, len(s.Label))
+		for name, val := range s.Label {
+			if fn, ok := val.(func() interface{}); ok {
+				val = fn()
+			}
+			labels[name] = val
+		}
+	}
+	return json.Marshal(struct {
+		C map[string]int64            `json:"counters,omitempty"`
+		M map[string]int64            `json:"maxValues,omitempty"`
+		L map[string]interface{}      `json:"labels,omitempty"`
+		K map[string]map[string]int64 `json:"labeledCounters,omitempty"`
+	}{C: s.Counter, M: s.MaxValue, L: labels, K: s.LabeledCounter})
+}
+
+func subCounters(cur, prev map[string]int64) map[string]int64 {
+	out := make(map[string]int64, len(cur))
+	for name, val := range cur {
+		out[name] = val - prev[name]
+	}
+	return out
 }
@@ -3,9 +3,14 @@
 package metrics_test
 
 import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/creachadair/jrpc2/metrics"
+	"github.com/google/go-cmp/cmp"
 )
 
 func getCount(m *metrics.M, name string) int64 {
@@ -106,3 +111,210 @@ func TestMetrics(t *testing.T) {
 	})
 	wantLabel("quux", "x2")
 }
+
+func TestCountLabeled(t *testing.T) {
+	m := metrics.New()
+	m.SetMaxLabelSets(2)
+
+	m.CountLabeled("rpc", map[string]string{"code": "ok", "method": "A"}, 1)
+	m.CountLabeled("rpc", map[string]string{"method": "A", "code": "ok"}, 2) // same set
+	m.CountLabeled("rpc", map[string]string{"code": "err"}, 1)
+	m.CountLabeled("rpc", map[string]string{"code": "other"}, 5) // over the limit
+	m.CountLabeled("rpc", map[string]string{"code": "more"}, 1)  // over the limit
+	m.CountLabeled("rpc", map[string]string{"code": "err"}, 1)   // existing set
+	m.CountLabeled("misc", nil, 3)
+
+	got := make(map[string]map[string]int64)
+	m.Snapshot(metrics.Snapshot{LabeledCounter: got})
+	want := map[string]map[string]int64{
+		"rpc": {
+			"code=ok,method=A":    3,
+			"code=err":            2,
+			metrics.OtherLabelSet: 6,
+		},
+		"misc": {"": 3},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Labeled counters (-want, +got):\n%s", diff)
+	}
+	if n := getCount(m, "rpc"); n != 0 {
+		t.Errorf("Unlabeled counter rpc: got %d, want 0", n)
+	}
+
+	// Label components that could be confused with the separators are quoted,
+	// so that distinct label sets do not share a key.
+	q := metrics.New()
+	q.CountLabeled("q", map[string]string{"a": "1,b=2"}, 1)
+	q.CountLabeled("q", map[string]string{"a": "1", "b": "2"}, 2)
+	q.CountLabeled("q", map[string]string{"x=y": "", "z": "\n"}, 4)
+	gotq := make(map[string]map[string]int64)
+	q.Snapshot(metrics.Snapshot{LabeledCounter: gotq})
+	wantq := map[string]map[string]int64{
+		"q": {
+			`a="1,b=2"`:       1,
+			`a=1,b=2`:         2,
+			`"x=y"="",z="\n"`: 4,
+		},
+	}
+	if diff := cmp.Diff(wantq, gotq); diff != "" {
+		t.Errorf("Quoted label sets (-want, +got):\n%s", diff)
+	}
+
+	// Snapshots must not alias the collector's state.
+	got["rpc"]["code=err"] = 100
+	again := make(map[string]map[string]int64)
+	m.Snapshot(metrics.Snapshot{LabeledCounter: again})
+	if n := again["rpc"]["code=err"]; n != 2 {
+		t.Errorf("Counter after edit of snapshot: got %d, want 2", n)
+	}
+
+	// A nil collector discards labeled counts.
+	var nm *metrics.M
+	nm.CountLabeled("x", map[string]string{"a": "b"}, 1)
+	nm.SetMaxLabelSets(1)
+}
+
+func TestSnapshotSub(t *testing.T) {
+	m := metrics.New()
+	take := func() metrics.Snapshot {
+		snap := metrics.Snapshot{
+			Counter:        make(map[string]int64),
+			MaxValue:       make(map[string]int64),
+			Label:          make(map[string]interface{}),
+			LabeledCounter: make(map[string]map[string]int64),
+		}
+		m.Snapshot(snap)
+		return snap
+	}
+
+	m.Count("a", 5)
+	m.SetMaxValue("max", 10)
+	m.CountLabeled("rpc", map[string]string{"code": "ok"}, 2)
+	prev := take()
+
+	m.Count("a", 3)
+	m.Count("b", 4) // not in prev
+	m.SetMaxValue("max", 20)
+	m.SetLabel("label", "x")
+	m.CountLabeled("rpc", map[string]string{"code": "ok"}, 1)
+	m.CountLabeled("rpc", map[string]string{"code": "err"}, 7)
+	got := take().Sub(prev)
+
+	want := metrics.Snapshot{
+		Counter:  map[string]int64{"a": 3, "b": 4},
+		MaxValue: map[string]int64{"max": 20},
+		Label:    map[string]interface{}{"label": "x"},
+		LabeledCounter: map[string]map[string]int64{
+			"rpc": {"code=ok": 1, "code=err": 7},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Snapshot difference (-want, +got):\n%s", diff)
+	}
+
+	// Fields not populated in the current snapshot are omitted.
+	if got := (metrics.Snapshot{}).Sub(prev); got.Counter != nil || got.MaxValue != nil {
+		t.Errorf("Sub of empty snapshot: got %+v, want empty", got)
+	}
+}
+
+func TestSnapshotMarshalJSON(t *testing.T) {
+	snap := metrics.Snapshot{
+		Counter:  map[string]int64{"zeta": 1, "alpha": 2},
+		MaxValue: map[string]int64{"max": 10},
+		Label: map[string]interface{}{
+			"name": "test",
+			"func": func() interface{} { return []int{1, 2} },
+		},
+		LabeledCounter: map[string]map[string]int64{
+			"rpc": {"code=ok": 3, "code=err": 4},
+		},
+	}
+	const want = `{"counters":{"alpha":2,"zeta":1},"maxValues":{"max":10},` +
+		`"labels":{"func":[1,2],"name":"test"},` +
+		`"labeledCounters":{"rpc":{"code=err":4,"code=ok":3}}}`
+	for i := 0; i < 3; i++ {
+		bits, err := json.Marshal(snap)
+		if err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+		if got := string(bits); got != want {
+			t.Errorf("Marshal snapshot:\ngot  %s\nwant %s", got, want)
+		}
+	}
+
+	// Empty fields are omitted.
+	bits, err := json.Marshal(metrics.Snapshot{MaxValue: map[string]int64{}})
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	} else if got := string(bits); got != "{}" {
+		t.Errorf("Marshal empty snapshot: got %s, want {}", got)
+	}
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	m := metrics.New()
+	const numWorkers, numUpdates = 8, 1000
+
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		name := "worker-" + strconv.Itoa(i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 1; j <= numUpdates; j++ {
+				m.Count("shared", 1)
+				m.CountAndSetMax(name, 1)
+				m.SetMaxValue("shared-max", int64(j))
+			}
+		}()
+	}
+	wg.Wait()
+
+	snap := metrics.Snapshot{Counter: make(map[string]int64), MaxValue: make(map[string]int64)}
+	m.Snapshot(snap)
+	if got, want := snap.Counter["shared"], int64(numWorkers*numUpdates); got != want {
+		t.Errorf("Counter shared: got %d, want %d", got, want)
+	}
+	if got := snap.MaxValue["shared-max"]; got != numUpdates {
+		t.Errorf("MaxValue shared-max: got %d, want %d", got, numUpdates)
+	}
+	for i := 0; i < numWorkers; i++ {
+		name := "worker-" + strconv.Itoa(i)
+		if got := snap.Counter[name]; got != numUpdates {
+			t.Errorf("Counter %s: got %d, want %d", name, got, numUpdates)
+		}
+		if got := snap.MaxValue[name]; got != 1 {
+			t.Errorf("MaxValue %s: got %d, want 1", name, got)
+		}
+	}
+}
+
+// Compare the cost of concurrent updates to a single name, which all contend
+// for one shard, with updates spread across many names.
+func BenchmarkCount(b *testing.B) {
+	names := make([]string, 64)
+	for i := range names {
+		names[i] = "metric-" + strconv.Itoa(i)
+	}
+
+	b.Run("SameName", func(b *testing.B) {
+		m := metrics.New()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				m.Count("metric", 1)
+			}
+		})
+	})
+	b.Run("ManyNames", func(b *testing.B) {
+		m := metrics.New()
+		var next int32
+		b.RunParallel(func(pb *testing.PB) {
+			i := int(atomic.AddInt32(&next, 1))
+			for pb.Next() {
+				m.Count(names[i%len(names)], 1)
+				i++
+			}
+		})
+	})
+}
@@ -5,6 +5,7 @@ package jrpc2
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"runtime"
@@ -25,6 +26,12 @@ type ServerOptions struct {
 	// received and each response or error returned.
 	RPCLog RPCLogger
 
+	// If set, this function is called once for each request and notification
+	// the server has finished with, including those that failed validation
+	// and were never handled, with a structured summary of the request. It is
+	// called before the response is sent to the client.
+	AccessLog func(AccessLogEntry)
+
 	// Instructs the server to allow server callbacks and notifications, a
 	// non-standard extension to the JSON-RPC protocol. If AllowPush is false,
 	// the Notify and Callback methods of the server report errors if called.
@@ -37,24 +44,263 @@ type ServerOptions struct {
 	// along to the given assigner.
 	DisableBuiltin bool
 
+	// Instructs the server to reject batch requests. When this option is true,
+	// a request message that is a JSON array, even one having a single element,
+	// is not processed; the server instead replies with a single error having
+	// code InvalidRequest and a null ID. Responses from the client to server
+	// callbacks are not affected.
+	DisableBatch bool
+
+	// Instructs the server to reject a batch in which two or more requests
+	// have the same ID. When this option is true, no request of such a batch
+	// is processed; the server instead replies with a single error having code
+	// InvalidRequest and a null ID, whose data is the duplicated ID. By
+	// default, only the requests sharing an ID fail, and the others in the
+	// batch are processed normally.
+	RejectDuplicateBatch bool
+
+	// The version marker the server sends in the "jsonrpc" field of its
+	// messages, and requires in the messages it receives. If empty, Version
+	// is used. This is meant for protocols derived from JSON-RPC that use a
+	// different marker; a message whose marker differs is rejected as an
+	// invalid request, so the client must be configured to match.
+	Version string
+
+	// If positive, the server rejects a batch request having more than this
+	// many elements. As with DisableBatch, the server replies with a single
+	// error having code InvalidRequest and a null ID.
+	MaxBatchSize int
+
+	// If positive, the server rejects a request message longer than this many
+	// bytes without decoding it, and replies with a single error having code
+	// InvalidRequest and a null ID.
+	MaxRequestBytes int
+
+	// If true, the server exports the built-in rpc.capabilities method, which
+	// reports the MaxBatchSize and MaxRequestBytes limits of the server to the
+	// client (see Client.Capabilities). This has no effect if DisableBuiltin
+	// is true.
+	EnableCapabilities bool
+
+	// If positive, the server limits the encoded Data of each error it sends
+	// to this many bytes. Data longer than the limit is replaced before it is
+	// sent, keeping the code and message of the error: A JSON string is cut
+	// short and marked with a "...(truncated)" suffix; any other value is
+	// replaced by an object {"truncated":true,"size":n} giving its original
+	// size in bytes. The result is always valid JSON, but it may still exceed
+	// a very small limit.
+	MaxErrorDataBytes int
+
+	// If not empty, the server indents the JSON of each message it sends, as
+	// json.MarshalIndent does with this indent, to make the messages easier
+	// for humans to read. By default, messages are sent in compact form.
+	//
+	// Indented messages span multiple lines, so they cannot be sent over a
+	// channel whose framing forbids newlines in a message, such as
+	// channel.Line. Framings that delimit messages by length or by the JSON
+	// syntax, such as channel.Header and channel.RawJSON, are not affected.
+	Indent string
+
+	// If true, a handler result that is a nil slice or a nil map is sent to
+	// the client as an empty array ([]) or object ({}) respectively, rather
+	// than as null. This applies only to the top-level result value, not to
+	// slices or maps nested within it. A nil result of interface type, a nil
+	// pointer, a nil byte slice, and a nil value of a type that implements
+	// json.Marshaler (such as json.RawMessage) are still sent as null.
+	EmptySliceAsArray bool
+
+	// If set, this function is called with a copy of each message the server
+	// sends to or receives from the channel, tagged by its direction. Outbound
+	// messages are reported before they are sent, even if sending fails.
+	// This is intended for wire-level debugging and for recording a session
+	// to replay later. Streamed results (see StreamResult) are buffered and
+	// sent as a single message when this function is set.
+	OnFrame func(dir Direction, msg []byte)
+
 	// Allows up to the specified number of goroutines to execute in parallel in
 	// request handlers. A value less than 1 uses runtime.NumCPU().  Note that
 	// this setting does not constrain order of issue.
+	//
+	// The server counts handlers that started at once in the metric
+	// "rpc.requests.immediate", and those that had to wait for another
+	// handler to finish in "rpc.requests.queued". It reports the limit in
+	// the label "rpc.concurrency.limit", and the largest number of handlers
+	// it has seen running at once in "rpc.concurrency.inUse.max".
 	Concurrency int
 
+	// If true, the server dispatches requests to a fixed pool of Concurrency
+	// worker goroutines fed by a bounded queue, rather than starting a new
+	// goroutine for each request. This reduces scheduling overhead when the
+	// server is under heavy load. The elements of a batch containing more than
+	// one request are still started concurrently.
+	UseWorkerPool bool
+
+	// If positive, bounds how long each handler may run. The context passed
+	// to the handler is cancelled when its timeout expires, and if the handler
+	// has not returned by then, the client receives an error with code
+	// DeadlineExceeded without waiting for it; any result it reports later is
+	// discarded. A request whose own context ends first (for example, because
+	// it was cancelled) is handled as usual.
+	//
+	// A handler that has timed out continues to occupy its concurrency slot
+	// (see Concurrency) until it returns, and the server does not stop until
+	// it does. Handlers must therefore respect cancellation of their context
+	// for the timeout to free resources.
+	HandlerTimeout time.Duration
+
 	// If set, this function is called to create a new base request context.
 	// If unset, the server uses a background context.
 	NewContext func() context.Context
 
+	// If set, this function is called once when the server starts, before it
+	// reads any requests, with a context created as by NewContext. It may
+	// authenticate the client and attach the resulting identity to the
+	// context it returns with WithPrincipal. The returned context is then the
+	// parent of the context for each request handled by the server.
+	//
+	// The server itself does not know what connection its channel uses, so
+	// information about the client must come from the context. The servers
+	// started by server.Serve and jhttp.NewHandler attach their connection to
+	// it (see server.Conn and jhttp.HTTPRequest); otherwise, use NewContext.
+	//
+	// If the function reports an error, the server refuses the connection:
+	// It closes the channel without reading any requests, and Wait reports
+	// the error.
+	Authenticate func(ctx context.Context) (context.Context, error)
+
+	// If true, and the assigner implements a method
+	//
+	//	Validate() error
+	//
+	// as handler.ServiceMap does, NewServer calls it to check the assigner.
+	// If it reports an error, the server refuses every connection it is
+	// started on: It closes the channel without reading any requests, and
+	// Wait reports the error.
+	ValidateAssigner bool
+
 	// If set, use this value to record server metrics. All servers created
 	// from the same options will share the same metrics collector.  If none is
 	// set, an empty collector will be created for each new server.
+	//
+	// Among others, the server records the size in bytes of each encoded
+	// result it sends, in total in the counter "rpc.response.bytes", as a
+	// maximum in "rpc.response.bytes.max", and per method in the labeled
+	// counter "rpc.response.bytes" with label "method".
 	Metrics *metrics.M
 
 	// If nonzero this value as the server start time; otherwise, use the
 	// current time when Start is called. All servers created from the same
 	// options will share the same start time if one is set.
 	StartTime time.Time
+
+	// If set, this function is called with the encoded result of each
+	// successful call, after its handler returns and before the response is
+	// sent to the client. The value it returns replaces the result.  If it
+	// reports an error, the client receives that error instead of a result.
+	// It is not called for notifications, or for calls that fail.
+	TransformResult func(ctx context.Context, method string, result json.RawMessage) (json.RawMessage, error)
+
+	// If true, the server includes the time it spent processing each call in
+	// its response, as a top-level "meta" member whose "processNanos" field
+	// is the duration in nanoseconds from when the request was dispatched
+	// until its result was ready, including any wait for a free handler slot
+	// (see Concurrency), as for AccessLogEntry.Duration. A client can read it with Response.ProcessTime, and
+	// compare it to the elapsed time reported to ClientOptions.OnCallDone to
+	// estimate the time spent in transit.
+	// Results streamed to the channel (see StreamResult) do not include it.
+	// If a handler returns a RawResponse with its own "meta" object, the
+	// processing time is added to that object, replacing any "processNanos"
+	// field it had; if its "meta" is not an object, the time is omitted.
+	//
+	// Like request metadata (see DecodeMeta), this is a non-standard
+	// extension to JSON-RPC: A jrpc2 client accepts it, but other clients may
+	// reject responses that have it.
+	IncludeTiming bool
+
+	// If set, the server accepts requests having a top-level "meta" member,
+	// a non-standard extension to JSON-RPC that carries request metadata
+	// alongside the parameters (see ClientOptions.EncodeMeta). The value of
+	// the member must be a JSON object. For each request that has one, this
+	// function is called with the request context, the method name, and the
+	// meta object, and the context it returns is passed to the handler.  If
+	// it reports an error, the request fails with that error.
+	//
+	// If unset, a request with a "meta" member is rejected with code
+	// InvalidRequest, as for any other unknown field.
+	DecodeMeta func(ctx context.Context, method string, meta json.RawMessage) (context.Context, error)
+
+	// If set, this function is applied to the method name of each request
+	// before the server looks it up in the assigner, for example to tolerate
+	// clients that are inconsistent about case by passing strings.ToLower.
+	// The request passed to the handler, the logs, and the parameter
+	// validator (see ValidateParams) all see the rewritten name. If the
+	// function returns "", the request fails as if its method were empty.
+	// Names beginning with "rpc." are rewritten too, before the server checks
+	// for its built-in methods. By default, method names are not changed.
+	NormalizeMethod func(method string) string
+
+	// If set, this function is called with the method name and the encoded
+	// parameters of each request, including each element of a batch and each
+	// notification, after its context is set up (see DecodeMeta) and before
+	// its handler runs. The params are empty if the request has none. If it
+	// reports an error, the handler is not run and the request fails with
+	// that error: An *Error is reported as given, and any other error is
+	// reported with code InvalidParams and its text as the error data. As
+	// with other handler errors, a failed notification is not reported.
+	ValidateParams func(method string, params json.RawMessage) error
+
+	// If set, the server caches the results of successful calls to methods
+	// whose handler opts in by implementing a method
+	//
+	//	CacheTTL() time.Duration
+	//
+	// that reports a positive lifetime for cached results (see the
+	// handler.Cacheable wrapper). For such a call, if the cache has a result
+	// for the method and parameters, the server sends it without running the
+	// handler; otherwise it runs the handler and, if the call succeeds, stores
+	// the encoded result with that lifetime. Errors and notifications are
+	// never cached, and the result of a cacheable method is not streamed.
+	//
+	// The cache key is the method name, a slash, and the hex-encoded SHA-256
+	// digest of the principal of the connection (see Authenticate), if any,
+	// and the compacted JSON parameters, so parameters that differ only in
+	// whitespace share a key. The key does not otherwise depend on the
+	// connection: A cache shared by several servers, as with server.Serve or
+	// jhttp.NewHandler, serves the result of one client's call to another
+	// client whose call has the same method, parameters, and principal. Use
+	// CacheKey to scope the key differently.
+	//
+	// A call served from the cache is validated (see ValidateParams) and
+	// logged (see RPCLog) as usual, and is reported by InFlight while the
+	// cache is consulted, but its handler does not run. The server may call
+	// the methods of the cache concurrently from multiple goroutines. It does
+	// not coalesce concurrent misses for the same key (see SingleFlight for
+	// that).
+	Cache Cache
+
+	// If set, this function is called to compute the cache key for each
+	// cacheable call (see Cache) in place of the default key. The context is
+	// that of the request, and carries the principal of its connection if
+	// any. If it returns ok == false, the call is not cached.
+	CacheKey func(ctx context.Context, req *Request) (key string, ok bool)
+
+	// If set, this function is called with the method name and parameters of
+	// each request (but never a notification) before it is executed. If it
+	// returns ok == true, the server coalesces the request with any other
+	// request having the same key whose handler is already running, instead
+	// of running the handler again: All the requests share the result or
+	// error reported by the one execution. Keys are scoped to the server, so
+	// requests from different connections are not coalesced.
+	//
+	// The shared execution sees the request and context values of the request
+	// that started it. Its context is not bound to the context of any one
+	// request: Each request stops waiting and fails when its own context ends,
+	// and the context of the execution is cancelled only when no request
+	// remains waiting for it. The last request to give up does not complete
+	// until the execution returns, so the execution does not outlive Stop or
+	// Wait. Use this only for methods whose results depend only on the key,
+	// such as idempotent reads.
+	SingleFlight func(method string, params json.RawMessage) (key string, ok bool)
 }
 
 func (s *ServerOptions) logFunc() func(string, ...interface{}) {
@@ -64,8 +310,64 @@ func (s *ServerOptions) logFunc() func(string, ...interface{}) {
 	return s.Logger.Printf
 }
 
+func (s *ServerOptions) accessLog() func(AccessLogEntry) {
+	if s == nil {
+		return nil
+	}
+	return s.AccessLog
+}
+
 func (s *ServerOptions) allowPush() bool    { return s != nil && s.AllowPush }
 func (s *ServerOptions) allowBuiltin() bool { return s == nil || !s.DisableBuiltin }
+func (s *ServerOptions) allowBatch() bool   { return s == nil || !s.DisableBatch }
+
+func (s *ServerOptions) rejectDuplicateBatch() bool { return s != nil && s.RejectDuplicateBatch }
+
+func (s *ServerOptions) version() string {
+	if s == nil || s.Version == "" {
+		return Version
+	}
+	return s.Version
+}
+
+func (s *ServerOptions) enableCaps() bool { return s != nil && s.EnableCapabilities }
+
+func (s *ServerOptions) capabilities() Capabilities {
+	if s == nil {
+		return Capabilities{}
+	}
+	caps := Capabilities{MaxBatchSize: s.MaxBatchSize, MaxRequestBytes: s.MaxRequestBytes}
+	if caps.MaxBatchSize < 0 {
+		caps.MaxBatchSize = 0
+	}
+	if caps.MaxRequestBytes < 0 {
+		caps.MaxRequestBytes = 0
+	}
+	return caps
+}
+
+func (s *ServerOptions) maxErrorData() int {
+	if s == nil || s.MaxErrorDataBytes < 0 {
+		return 0
+	}
+	return s.MaxErrorDataBytes
+}
+
+func (s *ServerOptions) emptySliceAsArray() bool { return s != nil && s.EmptySliceAsArray }
+
+func (s *ServerOptions) onFrame() func(Direction, []byte) {
+	if s == nil {
+		return nil
+	}
+	return s.OnFrame
+}
+
+func (s *ServerOptions) indent() string {
+	if s == nil {
+		return ""
+	}
+	return s.Indent
+}
 
 func (s *ServerOptions) concurrency() int64 {
 	if s == nil || s.Concurrency < 1 {
@@ -74,6 +376,20 @@ func (s *ServerOptions) concurrency() int64 {
 	return int64(s.Concurrency)
 }
 
+func (s *ServerOptions) workerPool() int {
+	if s == nil || !s.UseWorkerPool {
+		return 0
+	}
+	return int(s.concurrency())
+}
+
+func (s *ServerOptions) handlerTimeout() time.Duration {
+	if s == nil || s.HandlerTimeout < 0 {
+		return 0
+	}
+	return s.HandlerTimeout
+}
+
 func (s *ServerOptions) startTime() time.Time {
 	if s == nil {
 		return time.Time{}
@@ -88,6 +404,15 @@ func (o *ServerOptions) newContext() func() context.Context {
 	return o.NewContext
 }
 
+func (s *ServerOptions) validateAssigner() bool { return s != nil && s.ValidateAssigner }
+
+func (s *ServerOptions) authenticate() func(context.Context) (context.Context, error) {
+	if s == nil {
+		return nil
+	}
+	return s.Authenticate
+}
+
 func (s *ServerOptions) metrics() *metrics.M {
 	if s == nil || s.Metrics == nil {
 		return metrics.New()
@@ -95,6 +420,57 @@ func (s *ServerOptions) metrics() *metrics.M {
 	return s.Metrics
 }
 
+func (s *ServerOptions) transformResult() func(context.Context, string, json.RawMessage) (json.RawMessage, error) {
+	if s == nil {
+		return nil
+	}
+	return s.TransformResult
+}
+
+func (s *ServerOptions) decodeMeta() func(context.Context, string, json.RawMessage) (context.Context, error) {
+	if s == nil {
+		return nil
+	}
+	return s.DecodeMeta
+}
+
+func (s *ServerOptions) includeTiming() bool { return s != nil && s.IncludeTiming }
+
+func (s *ServerOptions) normalizeMethod() func(string) string {
+	if s == nil {
+		return nil
+	}
+	return s.NormalizeMethod
+}
+
+func (s *ServerOptions) validateParams() func(string, json.RawMessage) error {
+	if s == nil {
+		return nil
+	}
+	return s.ValidateParams
+}
+
+func (s *ServerOptions) cache() Cache {
+	if s == nil {
+		return nil
+	}
+	return s.Cache
+}
+
+func (s *ServerOptions) cacheKey() func(context.Context, *Request) (string, bool) {
+	if s == nil {
+		return nil
+	}
+	return s.CacheKey
+}
+
+func (s *ServerOptions) singleFlight() func(string, json.RawMessage) (string, bool) {
+	if s == nil {
+		return nil
+	}
+	return s.SingleFlight
+}
+
 func (s *ServerOptions) rpcLog() RPCLogger {
 	if s == nil || s.RPCLog == nil {
 		return nullRPCLogger{}
@@ -114,6 +490,13 @@ type ClientOptions struct {
 	// Server notifications are a non-standard extension of JSON-RPC.
 	OnNotify func(*Request)
 
+	// If set, notifications from the server are routed by method name to the
+	// functions in this map, and OnNotify is called only for notifications
+	// whose method is not in the map. The map is copied when the client is
+	// created, so later changes to it have no effect. As with OnNotify, at
+	// most one notification handler will be active at a time.
+	NotifyHandlers map[string]func(*Request)
+
 	// If set, this function is called if a request is received from the server.
 	// If unset, server requests are logged and discarded. Multiple invocations
 	// of the callback handler may be active concurrently.
@@ -134,7 +517,221 @@ type ClientOptions struct {
 	//
 	// Note that the hook does not receive the request context, which has
 	// already ended by the time the hook is called.
+	//
+	// By default, the hook is not called if the response was delivered before
+	// the client noticed that the context ended (see AlwaysCancel).
 	OnCancel func(cli *Client, rsp *Response)
+
+	// If true, the OnCancel hook is called when the context for a request
+	// ends even if its response had already been delivered, so that the hook
+	// can notify a server that may still be working on the request. In that
+	// case rsp holds the response that was delivered.
+	AlwaysCancel bool
+
+	// If set, the client records metrics here. It counts cancellations that
+	// arrived after the response had been delivered in "rpc.cancel.tooLate".
+	// By default, the client does not record metrics.
+	Metrics *metrics.M
+
+	// If set, this function is called when each request issued by Call or
+	// Batch completes, with the method name, the time elapsed between sending
+	// the request and the delivery of its response, and the error reported by
+	// the server (or nil). It is not called for notifications, nor for
+	// requests that could not be sent.
+	OnCallDone func(method string, elapsed time.Duration, err error)
+
+	// If set, this function is called for each request and notification after
+	// the client has successfully handed it to the channel, with the method
+	// name, whether the message is a notification, and the request ID (which
+	// is "" for a notification). For a notification, this is the only signal
+	// that it was transmitted.
+	//
+	// The function is called after the message is sent, so the reply to a
+	// request may be delivered before the function is called for it.
+	OnSend func(method string, isNotify bool, id string)
+
+	// If positive, the client calls the rpc.ping method on the server at this
+	// interval while it is running, and waits up to the same interval for a
+	// reply. If the server does not reply in time, or the ping cannot be sent,
+	// the client is stopped and the failure is reported by Close.
+	//
+	// Any reply from the server, including an error such as "method not
+	// found", counts as evidence that the connection is alive.
+	//
+	// The pings are not subject to the Retry policy or the MaxPending limit,
+	// are not passed to EncodeMeta or ValidMethod, and are not reported to
+	// the OnSend, OnCallDone, or OnCancel hooks.
+	//
+	// A client with ManualAccept set does not send pings, since their replies
+	// would not be read while the caller is not calling Accept.
+	KeepAlive time.Duration
+
+	// The name of the method the client notifies when a subscription is
+	// closed (see Client.Subscribe). If empty, "unsubscribe" is used.
+	UnsubscribeMethod string
+
+	// If set, Call retries requests that fail to reach the server, according
+	// to this policy, as does NotifyReliable for notifications. By default,
+	// calls are not retried.
+	Retry RetryPolicy
+
+	// If true, the client does not start a goroutine to read responses from
+	// the server. Instead, the caller must call the client's Accept method to
+	// receive and deliver each message. Since Call and Batch block until
+	// their responses are delivered, the caller must call Accept concurrently
+	// with them. Such a client ignores the KeepAlive option.
+	ManualAccept bool
+
+	// If true, a call in a batch whose parameters cannot be encoded does not
+	// fail the whole batch. Instead, the response for that call reports the
+	// failure without having been sent, and the other requests of the batch
+	// are sent normally, so that such errors can be told apart from errors in
+	// sending the batch. A notification that cannot be encoded still fails
+	// the batch, since it has no response to carry the error.
+	PartialBatch bool
+
+	// If set, this function is called for each request and notification the
+	// client sends, with the context and method name of the call. The JSON
+	// object it returns is sent as a top-level "meta" member of the request,
+	// leaving the parameters unchanged; if it returns an empty value, the
+	// request has no meta member. If it reports an error, the request is not
+	// sent and the call reports that error.
+	//
+	// The meta member is a non-standard extension to JSON-RPC: A jrpc2 server
+	// accepts it only if ServerOptions.DecodeMeta is set, and other servers
+	// may reject it.
+	EncodeMeta func(ctx context.Context, method string) (json.RawMessage, error)
+
+	// If set, this function is called with the method name of each request
+	// and notification before it is sent, and if it returns false the call
+	// fails with code InvalidRequest without sending anything. Method names
+	// the client sends on its own behalf, such as "rpc.ping" for KeepAlive,
+	// are not checked. Regardless of this setting, the client rejects an
+	// empty method name.
+	ValidMethod func(method string) bool
+
+	// The version marker the client sends in the "jsonrpc" field of its
+	// messages, and requires in the messages it receives. If empty, Version
+	// is used. It must match the version of the server (see
+	// ServerOptions.Version): otherwise the server rejects each request, and
+	// the client fails to decode the server's replies.
+	Version string
+
+	// If true, the client reuses the IDs of completed requests for new ones,
+	// rather than always issuing a fresh ID. This bounds the set of IDs used
+	// by a long-lived client to the number of requests pending at once. By
+	// default, each request gets a new ID from an increasing sequence.
+	//
+	// An ID is reused only after its response has been delivered, and never
+	// while another request with the same ID is pending. The IDs of requests
+	// that were cancelled or timed out are not reused, since the server may
+	// still reply to them.
+	ReuseIDs bool
+
+	// If positive, the maximum number of requests the client allows to be
+	// pending at once. A call or batch that would exceed the limit waits,
+	// before it is sent, until enough pending requests have completed, or
+	// until its context ends. A batch larger than the limit is sent once no
+	// other requests are pending. Notifications do not count toward the limit.
+	// By default, the number of pending requests is not limited.
+	MaxPending int
+
+	// If set, this function is called once when the goroutine that reads
+	// responses from the server exits, which happens when the client stops.
+	// The argument is nil if the client was stopped by a call to Close, and
+	// otherwise is the error that stopped it, as reported by LastError; for
+	// example, io.EOF if the server closed the connection. The function may
+	// call Close, but Close does not wait for the function to return.
+	//
+	// This function is not called if ManualAccept is true; in that case the
+	// Accept method reports the error instead.
+	OnClose func(err error)
+
+	// If set, this function is called with a copy of each message the client
+	// sends to or receives from the channel, tagged by its direction. Outbound
+	// messages are reported before they are sent, even if sending fails, so a
+	// reply is never reported ahead of its request. A batch is reported as a
+	// single message.
+	OnFrame func(dir Direction, msg []byte)
+}
+
+// A Cache stores encoded results for the server to reuse (see the Cache field
+// of ServerOptions). Its methods must be safe for concurrent use.
+type Cache interface {
+	// Get returns the result stored for key, and reports whether it has one
+	// that has not expired.
+	Get(key string) (json.RawMessage, bool)
+
+	// Set stores val as the result for key, to expire after ttl. The caller
+	// does not modify val after it is stored.
+	Set(key string, val json.RawMessage, ttl time.Duration)
+}
+
+// validator is the interface implemented by an assigner that can check itself
+// for errors (see ServerOptions.ValidateAssigner).
+type validator interface {
+	Validate() error
+}
+
+// cacheTTLer is the interface implemented by a handler whose results may be
+// cached by the server.
+type cacheTTLer interface {
+	CacheTTL() time.Duration
+}
+
+// A RetryPolicy controls how a client retries calls that fail because of an
+// error in transmission. Errors reported by the server, which have concrete
+// type *jrpc2.Error, are never retried, nor are calls whose context has ended.
+// Each retry is sent as a new request with a fresh request ID.
+//
+// Retries cannot recover from failures that stop the client, such as closure
+// of its channel; they are intended for transient errors from Send.
+type RetryPolicy struct {
+	// The maximum number of times to retry a failing call. If Max <= 0, calls
+	// are not retried.
+	Max int
+
+	// If set, this function returns how long to wait before the given retry
+	// attempt, numbered from 1. If nil, retries are not delayed.
+	Backoff func(attempt int) time.Duration
+
+	// If set, this function reports whether a call that failed with err should
+	// be retried. If nil, any error that is not a *jrpc2.Error or a context
+	// error is retried.
+	Retryable func(error) bool
+}
+
+// retry reports whether a call that failed with err on the given attempt,
+// numbered from 0, should be retried.
+func (r RetryPolicy) retry(attempt int, err error) bool {
+	var jerr *Error
+	if attempt >= r.Max || errors.As(err, &jerr) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	} else if r.Retryable != nil {
+		return r.Retryable(err)
+	}
+	return true
+}
+
+// wait blocks until it is time for the given retry attempt, numbered from 1,
+// or until ctx ends.
+func (r RetryPolicy) wait(ctx context.Context, attempt int) error {
+	if r.Backoff == nil {
+		return ctx.Err()
+	}
+	d := r.Backoff(attempt)
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
 }
 
 func (c *ClientOptions) logFunc() func(string, ...interface{}) {
@@ -145,11 +742,24 @@ func (c *ClientOptions) logFunc() func(string, ...interface{}) {
 }
 
 func (c *ClientOptions) handleNotification() func(*jmessage) {
-	if c == nil || c.OnNotify == nil {
+	if c == nil || (c.OnNotify == nil && len(c.NotifyHandlers) == 0) {
 		return nil
 	}
 	h := c.OnNotify
-	return func(req *jmessage) { h(&Request{method: req.M, params: req.P}) }
+	if len(c.NotifyHandlers) == 0 {
+		return func(req *jmessage) { h(&Request{method: req.M, params: req.P}) }
+	}
+	route := make(map[string]func(*Request), len(c.NotifyHandlers))
+	for method, f := range c.NotifyHandlers {
+		route[method] = f
+	}
+	return func(req *jmessage) {
+		if f, ok := route[req.M]; ok {
+			f(&Request{method: req.M, params: req.P})
+		} else if h != nil {
+			h(&Request{method: req.M, params: req.P})
+		}
+	}
 }
 
 func (c *ClientOptions) handleCancel() func(*Client, *Response) {
@@ -159,6 +769,105 @@ func (c *ClientOptions) handleCancel() func(*Client, *Response) {
 	return c.OnCancel
 }
 
+func (c *ClientOptions) onCallDone() func(string, time.Duration, error) {
+	if c == nil {
+		return nil
+	}
+	return c.OnCallDone
+}
+
+func (c *ClientOptions) onSend() func(string, bool, string) {
+	if c == nil {
+		return nil
+	}
+	return c.OnSend
+}
+
+func (c *ClientOptions) onClose() func(error) {
+	if c == nil {
+		return nil
+	}
+	return c.OnClose
+}
+
+func (c *ClientOptions) validMethod() func(string) bool {
+	if c == nil {
+		return nil
+	}
+	return c.ValidMethod
+}
+
+func (c *ClientOptions) onFrame() func(Direction, []byte) {
+	if c == nil {
+		return nil
+	}
+	return c.OnFrame
+}
+
+func (c *ClientOptions) manualAccept() bool { return c != nil && c.ManualAccept }
+
+func (c *ClientOptions) partialBatch() bool { return c != nil && c.PartialBatch }
+
+func (c *ClientOptions) version() string {
+	if c == nil || c.Version == "" {
+		return Version
+	}
+	return c.Version
+}
+
+func (c *ClientOptions) alwaysCancel() bool { return c != nil && c.AlwaysCancel }
+
+func (c *ClientOptions) metrics() *metrics.M {
+	if c == nil {
+		return nil
+	}
+	return c.Metrics
+}
+
+func (c *ClientOptions) maxPending() int {
+	if c == nil {
+		return 0
+	}
+	return c.MaxPending
+}
+
+// freeIDSet returns an empty set of reusable IDs if c enables ID reuse, or
+// nil otherwise.
+func (c *ClientOptions) freeIDSet() map[int64]bool {
+	if c == nil || !c.ReuseIDs {
+		return nil
+	}
+	return make(map[int64]bool)
+}
+
+func (c *ClientOptions) keepAlive() time.Duration {
+	if c == nil || c.KeepAlive < 0 {
+		return 0
+	}
+	return c.KeepAlive
+}
+
+func (c *ClientOptions) encodeMeta() func(context.Context, string) (json.RawMessage, error) {
+	if c == nil {
+		return nil
+	}
+	return c.EncodeMeta
+}
+
+func (c *ClientOptions) unsubscribeMethod() string {
+	if c == nil || c.UnsubscribeMethod == "" {
+		return "unsubscribe"
+	}
+	return c.UnsubscribeMethod
+}
+
+func (c *ClientOptions) retryPolicy() RetryPolicy {
+	if c == nil {
+		return RetryPolicy{}
+	}
+	return c.Retry
+}
+
 func (c *ClientOptions) handleCallback() func(context.Context, *jmessage) []byte {
 	if c == nil || c.OnCallback == nil {
 		return nil
@@ -174,7 +883,7 @@ func (c *ClientOptions) handleCallback() func(context.Context, *jmessage) []byte
 		// is difficult to debug.
 		//
 		// See https://github.com/creachadair/jrpc2/issues/41.
-		rsp := &jmessage{ID: req.ID}
+		rsp := &jmessage{V: c.version(), ID: req.ID}
 		v, err := panicToError(func() (interface{}, error) {
 			return cb(ctx, &Request{
 				id:     req.ID,
@@ -228,6 +937,24 @@ func StdLogger(logger *log.Logger) Logger {
 	return func(text string) { logger.Output(2, text) }
 }
 
+// An AccessLogEntry summarizes a request or notification completed by a
+// server, for use by ServerOptions.AccessLog.
+//
+// The Duration of an entry is how long the server spent processing the
+// request, from when it was dispatched until its result was ready. Besides
+// the time the handler ran, this includes validating the parameters, any wait
+// for a free handler slot (see ServerOptions.Concurrency), cache lookups, and
+// encoding the result. It is the same duration the server reports when
+// ServerOptions.IncludeTiming is set.
+type AccessLogEntry struct {
+	Method        string        // the method name requested
+	Notification  bool          // whether the request was a notification
+	RequestBytes  int           // the length of the encoded request
+	ResponseBytes int           // the length of the encoded response, 0 if none or streamed
+	Duration      time.Duration // time spent processing the request, 0 if it did not run
+	Code          code.Code     // the error code, or 0 if the request succeeded
+}
+
 // An RPCLogger receives callbacks from a server to record the receipt of
 // requests and the delivery of responses. These callbacks are invoked
 // synchronously with the processing of the request.
@@ -194,6 +194,50 @@ func TestCheckBatchDuplicateID(t *testing.T) {
 	}
 }
 
+func TestRejectDuplicateBatch(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	srv, cli := channel.Direct()
+	s := jrpc2.NewServer(handler.Map{
+		"Test": testOK,
+	}, &jrpc2.ServerOptions{RejectDuplicateBatch: true}).Start(srv)
+	defer func() {
+		cli.Close()
+		if err := s.Wait(); err != nil {
+			t.Errorf("Server wait: unexpected error: %v", err)
+		}
+	}()
+
+	tests := []struct {
+		input, want string
+	}{
+		// A duplicated ID rejects the whole batch.
+		{`[{"jsonrpc":"2.0","id":2,"method":"Test"},
+		   {"jsonrpc":"2.0","id":1,"method":"Test"},
+		   {"jsonrpc":"2.0","method":"Test"},
+		   {"jsonrpc":"2.0","id":1,"method":"Test"}]`,
+			`{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"duplicate request ID","data":"1"}}`},
+
+		// Notifications do not have IDs to duplicate.
+		{`[{"jsonrpc":"2.0","id":3,"method":"Test"},
+		   {"jsonrpc":"2.0","method":"Test"},
+		   {"jsonrpc":"2.0","method":"Test"}]`,
+			`[{"jsonrpc":"2.0","id":3,"result":"OK"}]`},
+	}
+	for _, test := range tests {
+		if err := cli.Send([]byte(test.input)); err != nil {
+			t.Fatalf("Send %d bytes failed: %v", len(test.input), err)
+		}
+		rsp, err := cli.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if diff := cmp.Diff(test.want, string(rsp)); diff != "" {
+			t.Errorf("Server response: (-want, +got)\n%s", diff)
+		}
+	}
+}
+
 // Verify that callbacks from notification handlers cannot deadlock on delivery
 // of their own replies. Reported in #78, test case courtesy of @radeksimko.
 func TestServer_NotificationCallbackDeadlock(t *testing.T) {
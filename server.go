@@ -3,13 +3,20 @@
 package jrpc2
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/creachadair/jrpc2/channel"
@@ -22,6 +29,10 @@ import (
 // responses on a channel.Channel provided by the caller, and dispatches
 // requests to user-defined Handlers.
 type Server struct {
+	// Number of handlers holding sem. This field is accessed atomically, and
+	// is placed first for alignment.
+	nrun int64
+
 	wg  sync.WaitGroup      // ready when workers are done at shutdown time
 	mux Assigner            // associates method names with handlers
 	sem *semaphore.Weighted // bounds concurrent execution (default 1)
@@ -34,14 +45,62 @@ type Server struct {
 	metrics *metrics.M                   // metrics collected during execution
 	start   time.Time                    // when Start was called
 	builtin bool                         // whether built-in rpc.* methods are enabled
+	nwork   int                          // if positive, the size of the worker pool
+	batchOK bool                         // whether batch requests are accepted
+	dupFail bool                         // whether duplicate IDs fail the whole batch
+	version string                       // the protocol version marker
+	htime   time.Duration                // if positive, the timeout for each handler
+	limits  Capabilities                 // limits on request size (zero for none)
+	capsOK  bool                         // whether rpc.capabilities is enabled
+	maxData int                          // if positive, the limit on error data size
+	alog    func(AccessLogEntry)         // if set, receives access log entries
+	indent  string                       // if not empty, indent outgoing messages
+	noNils  bool                         // send nil slice and map results as empty
+	timing  bool                         // report processing times in responses
+	frame   func(Direction, []byte)      // if set, observes each message on the channel
+
+	// If set, authenticates the client when the server starts.
+	auth func(context.Context) (context.Context, error)
+
+	// If set, the error reported by validating the assigner.
+	muxErr error
+
+	// If set, rewrites the encoded result of each successful call.
+	xform func(context.Context, string, json.RawMessage) (json.RawMessage, error)
+
+	// If set, decodes request metadata into the request context.
+	dmeta func(context.Context, string, json.RawMessage) (context.Context, error)
+
+	// If set, rewrites the method name of each request before assignment.
+	nmethod func(string) string
+
+	// If set, checks the parameters of each request before its handler runs.
+	vparams func(string, json.RawMessage) error
+
+	// If set, caches the results of calls to cacheable methods.
+	cache Cache
+	ckey  func(context.Context, *Request) (string, bool)
+
+	// If set, selects requests whose concurrent executions are coalesced.
+	sflight func(string, json.RawMessage) (string, bool)
+	flights *flightGroup
+
+	// Tracks the requests whose handlers are currently running.
+	running *runSet
 
 	mu *sync.Mutex // protects the fields below
 
-	nbar sync.WaitGroup  // notification barrier (see the dispatch method)
-	err  error           // error from a previous operation
-	work chan struct{}   // for signaling message availability
-	inq  *queue          // inbound requests awaiting processing
-	ch   channel.Channel // the channel to the client
+	nbar  sync.WaitGroup  // notification barrier (see the dispatch method)
+	err   error           // error from a previous operation
+	work  chan struct{}   // for signaling message availability
+	inq   *queue          // inbound requests awaiting processing
+	ch    channel.Channel // the channel to the client
+	base  context.Context // if set, the parent of request contexts
+	nbusy int             // number of batches dispatched and not yet delivered
+
+	// If the server is shutting down, drain is closed when all the requests
+	// received before the shutdown began have been delivered. Otherwise nil.
+	drain chan struct{}
 
 	// For each request ID currently in-flight, this map carries a cancel
 	// function attached to the context that was sent to the handler.
@@ -71,15 +130,44 @@ func NewServer(mux Assigner, opts *ServerOptions) *Server {
 		log:     opts.logFunc(),
 		rpcLog:  opts.rpcLog(),
 		newctx:  opts.newContext(),
+		auth:    opts.authenticate(),
 		mu:      new(sync.Mutex),
 		metrics: opts.metrics(),
 		start:   opts.startTime(),
 		builtin: opts.allowBuiltin(),
+		xform:   opts.transformResult(),
+		dmeta:   opts.decodeMeta(),
+		nmethod: opts.normalizeMethod(),
+		vparams: opts.validateParams(),
+		cache:   opts.cache(),
+		ckey:    opts.cacheKey(),
+		sflight: opts.singleFlight(),
+		flights: &flightGroup{m: make(map[string]*flight)},
+		running: &runSet{m: make(map[*Request]time.Time)},
+		nwork:   opts.workerPool(),
+		batchOK: opts.allowBatch(),
+		dupFail: opts.rejectDuplicateBatch(),
+		version: opts.version(),
+		htime:   opts.handlerTimeout(),
+		limits:  opts.capabilities(),
+		capsOK:  opts.enableCaps(),
+		maxData: opts.maxErrorData(),
+		alog:    opts.accessLog(),
+		indent:  opts.indent(),
+		noNils:  opts.emptySliceAsArray(),
+		timing:  opts.includeTiming(),
+		frame:   opts.onFrame(),
 		inq:     newQueue(),
 		used:    make(map[string]context.CancelFunc),
 		call:    make(map[string]*Response),
 		callID:  1,
 	}
+	if v, ok := mux.(validator); ok && opts.validateAssigner() {
+		if err := v.Validate(); err != nil {
+			s.muxErr = fmt.Errorf("invalid assigner: %w", err)
+		}
+	}
+	s.metrics.SetLabel("rpc.concurrency.limit", opts.concurrency())
 	return s
 }
 
@@ -94,6 +182,7 @@ func (s *Server) Start(c channel.Channel) *Server {
 	}
 
 	// Set up the queues and condition variable used by the workers.
+	c = tapFrames(c, s.frame)
 	s.ch = c
 	if s.start.IsZero() {
 		s.start = time.Now().In(time.UTC)
@@ -102,9 +191,12 @@ func (s *Server) Start(c channel.Channel) *Server {
 
 	// Reset all the I/O structures and start up the workers.
 	s.err = nil
+	s.base = nil
 
 	// Reset the signal channel.
 	s.work = make(chan struct{}, 1)
+	s.nbusy = 0
+	s.drain = nil
 
 	// s.wg waits for the maintenance goroutines for receiving input and
 	// processing the request queue. In addition, each request in flight adds a
@@ -115,14 +207,32 @@ func (s *Server) Start(c channel.Channel) *Server {
 	// Accept requests from the client and enqueue them for processing.
 	go func() { defer s.wg.Done(); s.read(c) }()
 
+	// If a worker pool is enabled, start the workers. They exit when the
+	// serve loop closes the pool at shutdown.
+	var pool chan func()
+	if s.nwork > 0 {
+		pool = make(chan func(), s.nwork)
+		s.wg.Add(s.nwork)
+		for i := 0; i < s.nwork; i++ {
+			go func() {
+				defer s.wg.Done()
+				for run := range pool {
+					run()
+				}
+			}()
+		}
+	}
+
 	// Remove requests from the queue and dispatch them to handlers.
-	go func() { defer s.wg.Done(); s.serve() }()
+	go func() { defer s.wg.Done(); s.serve(pool) }()
 
 	return s
 }
 
 // serve processes requests from the queue and dispatches them to handlers.
-// The responses are written back by the handler goroutines.
+// The responses are written back by the handler goroutines. If pool != nil,
+// each request batch is handed to a worker from the pool; otherwise a new
+// goroutine is started for each batch.
 //
 // The flow of an inbound request is:
 //
@@ -136,17 +246,32 @@ func (s *Server) Start(c channel.Channel) *Server {
 //	    | \ handler   -- handle an individual request
 //	    |   ...
 //	    * deliver     -- send responses to the client
-func (s *Server) serve() {
+func (s *Server) serve(pool chan<- func()) {
+	if pool != nil {
+		defer close(pool)
+	}
 	for {
 		next, err := s.nextRequest()
 		if err != nil {
 			s.log("Error reading from client: %v", err)
 			return
 		}
+		run := func() {
+			next()
+
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.nbusy--
+			s.checkDrained()
+		}
+		if pool != nil {
+			pool <- run
+			continue
+		}
 		s.wg.Add(1)
 		go func() {
 			defer s.wg.Done()
-			next()
+			run()
 		}()
 	}
 }
@@ -178,6 +303,7 @@ func (s *Server) nextRequest() (func() error, error) {
 	ch := s.ch // capture
 
 	next := s.inq.pop()
+	s.nbusy++
 	s.log("Dequeued request batch of length %d (qlen=%d)", len(next), s.inq.size())
 
 	// Construct a dispatcher to run the handlers outside the lock.
@@ -216,6 +342,9 @@ func (s *Server) dispatch(next jmessages, ch sender) func() error {
 	s.waitForBarrier(notes)
 
 	return func() error {
+		if len(tasks) == 1 && !tasks[0].batch && s.canStream(ch) {
+			tasks[0].streamOK = true
+		}
 		var wg sync.WaitGroup
 		for _, t := range tasks {
 			if t.err != nil {
@@ -224,26 +353,142 @@ func (s *Server) dispatch(next jmessages, ch sender) func() error {
 
 			todo--
 			if todo == 0 {
-				t.val, t.err = s.invoke(t.ctx, t.m, t.hreq)
-				if t.hreq.IsNotification() {
-					s.nbar.Done()
-				}
+				s.run(t)
 				break
 			}
 			t := t
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				t.val, t.err = s.invoke(t.ctx, t.m, t.hreq)
-				if t.hreq.IsNotification() {
-					s.nbar.Done()
-				}
+				s.run(t)
 			}()
 		}
 
 		// Wait for all the handlers to return, then deliver any responses.
 		wg.Wait()
-		return s.deliver(tasks.responses(s.rpcLog), ch, time.Since(start))
+		rsps := tasks.responses(s.rpcLog, s.maxData, s.version)
+		if s.timing {
+			tasks.addTiming()
+		}
+		s.recordSizes(tasks)
+		if s.alog != nil {
+			s.logAccess(tasks)
+		}
+		return s.deliver(rsps, ch, time.Since(start))
+	}
+}
+
+// run invokes the handler for t and records the results in t.
+func (s *Server) run(t *task) {
+	start := time.Now()
+	if key, ok := s.flightKey(t.hreq); ok {
+		t.val, t.ext, t.err = s.flights.do(t.ctx, key, func(ctx context.Context) (json.RawMessage, map[string]json.RawMessage, error) {
+			return s.invoke(ctx, t.m, t.hreq, nil)
+		})
+	} else if t.streamOK {
+		t.val, t.ext, t.err = s.invoke(t.ctx, t.m, t.hreq, &t.stream)
+	} else {
+		t.val, t.ext, t.err = s.invoke(t.ctx, t.m, t.hreq, nil)
+	}
+	t.elapsed = time.Since(start)
+	if t.hreq.IsNotification() {
+		s.nbar.Done()
+	}
+}
+
+// addTiming attaches the processing time of each task that was run to its
+// reply as response metadata. Streamed replies have no place for metadata,
+// and are skipped. If a raw response already has a "meta" field, the time is
+// merged into it, unless it is not an object.
+func (ts tasks) addTiming() {
+	for _, t := range ts {
+		if t.reply == nil || t.m == nil || t.stream.Reader != nil {
+			continue
+		}
+		nanos := strconv.FormatInt(int64(t.elapsed), 10)
+		em, ok := t.reply.ext["meta"]
+		if !ok {
+			t.reply.meta = json.RawMessage(`{"processNanos":` + nanos + `}`)
+			continue
+		}
+		var obj map[string]json.RawMessage
+		if json.Unmarshal(em, &obj) != nil || obj == nil {
+			continue // not an object; leave it alone
+		}
+		obj["processNanos"] = json.RawMessage(nanos)
+		meta, err := json.Marshal(obj)
+		if err != nil {
+			continue
+		}
+
+		// The extension map may be shared with other replies (for example by
+		// SingleFlight), so copy it rather than removing the key in place.
+		ext := make(map[string]json.RawMessage, len(t.reply.ext))
+		for key, val := range t.reply.ext {
+			if key != "meta" {
+				ext[key] = val
+			}
+		}
+		t.reply.ext = ext
+		t.reply.meta = meta
+	}
+}
+
+// canStream reports whether a result may be streamed to ch without buffering
+// (see StreamResult).
+func (s *Server) canStream(ch sender) bool {
+	_, ok := ch.(channel.StreamSender)
+	return ok && s.xform == nil && s.sflight == nil && s.indent == ""
+}
+
+// flightKey reports the single-flight key for req, and whether req should be
+// coalesced with other requests having the same key.
+func (s *Server) flightKey(req *Request) (string, bool) {
+	if s.sflight == nil || req.IsNotification() {
+		return "", false
+	}
+	return s.sflight(req.method, req.params)
+}
+
+// recordSizes updates the response size metrics for the results of the
+// completed tasks. The size is that of the encoded result, and is recorded in
+// total, as a maximum, and per method. Error replies and streamed results,
+// whose sizes are not known in advance, are not counted.
+func (s *Server) recordSizes(ts tasks) {
+	for _, t := range ts {
+		if t.reply == nil || t.reply.E != nil || t.reply.stream.Reader != nil {
+			continue
+		}
+		n := int64(len(t.reply.R))
+		s.metrics.Count("rpc.response.bytes", n)
+		s.metrics.SetMaxValue("rpc.response.bytes.max", n)
+		s.metrics.CountLabeled("rpc.response.bytes", map[string]string{"method": t.hreq.method}, n)
+	}
+}
+
+// logAccess reports an access log entry for each of the completed tasks.
+func (s *Server) logAccess(ts tasks) {
+	for _, t := range ts {
+		e := AccessLogEntry{
+			Method:       t.hreq.method,
+			Notification: t.hreq.IsNotification(),
+			RequestBytes: t.size,
+			Duration:     t.elapsed,
+		}
+		if t.reply != nil {
+			// The size of a streamed result is not known in advance.
+			if t.reply.stream.Reader == nil {
+				if bits, err := t.reply.toJSON(); err == nil {
+					e.ResponseBytes = len(bits)
+				}
+			}
+			if t.reply.E != nil {
+				e.Code = t.reply.E.Code
+			}
+		} else if t.err != nil {
+			e.Code = code.FromError(t.err)
+		}
+		s.alog(e)
 	}
 }
 
@@ -266,11 +511,57 @@ func (s *Server) deliver(rsps jmessages, ch sender, elapsed time.Duration) error
 		}
 	}
 
-	nw, err := encode(ch, rsps)
+	if len(rsps) == 1 && rsps[0].stream.Reader != nil {
+		nw, err := sendStream(ch.(channel.StreamSender), rsps[0])
+		s.metrics.CountAndSetMax("rpc.bytesWritten", nw)
+		return err
+	}
+	nw, err := encode(ch, rsps, s.indent)
 	s.metrics.CountAndSetMax("rpc.bytesWritten", int64(nw))
 	return err
 }
 
+// sendStream sends rsp, whose result is read from its stream, to ch.
+func sendStream(ch channel.StreamSender, rsp *jmessage) (int64, error) {
+	defer rsp.stream.close()
+	v, _ := json.Marshal(rsp.version())
+	head := `{"jsonrpc":` + string(v) + `,"id":` + string(rsp.ID) + `,"result":`
+	return ch.SendStream(&framedStream{head: head, body: rsp.stream.Reader, tail: "}"})
+}
+
+// framedStream is an io.Reader that produces head, then the contents of body,
+// then tail. It also implements io.WriterTo, which delegates to body if it is
+// itself an io.WriterTo, so that the body is not copied through a buffer.
+type framedStream struct {
+	head string
+	body io.Reader
+	tail string
+	r    io.Reader // set on the first Read
+}
+
+func (f *framedStream) Read(data []byte) (int, error) {
+	if f.r == nil {
+		f.r = io.MultiReader(strings.NewReader(f.head), f.body, strings.NewReader(f.tail))
+	}
+	return f.r.Read(data)
+}
+
+func (f *framedStream) WriteTo(w io.Writer) (int64, error) {
+	if f.r != nil {
+		return io.Copy(w, f.r)
+	}
+	nh, err := io.WriteString(w, f.head)
+	if err != nil {
+		return int64(nh), err
+	}
+	nb, err := io.Copy(w, f.body)
+	if err != nil {
+		return int64(nh) + nb, err
+	}
+	nt, err := io.WriteString(w, f.tail)
+	return int64(nh) + nb + int64(nt), err
+}
+
 // checkAndAssign resolves all the task handlers for the given batch, or
 // records errors for them as appropriate. The caller must hold s.mu.
 func (s *Server) checkAndAssign(next jmessages) tasks {
@@ -281,12 +572,19 @@ func (s *Server) checkAndAssign(next jmessages) tasks {
 	// Phase 1: Check for errors and duplicate request IDs.
 	for _, req := range next {
 		fid := fixID(req.ID)
+		method := req.M
+		if s.nmethod != nil && method != "" {
+			method = s.nmethod(method)
+		}
 		t := &task{
-			hreq:  &Request{id: fid, method: req.M, params: req.P},
+			hreq:  &Request{id: fid, method: method, params: req.P},
 			batch: req.batch,
+			size:  req.size,
 		}
 		if req.err != nil {
 			t.err = req.err
+		} else if req.meta != nil && s.dmeta == nil {
+			t.err = Errorf(code.InvalidRequest, "extra fields in request").WithData([]string{"meta"})
 		}
 		id := string(fid)
 		if old := dup[id]; old != nil {
@@ -304,6 +602,16 @@ func (s *Server) checkAndAssign(next jmessages) tasks {
 		ids = append(ids, id)
 	}
 
+	// If the requests arrived as a batch, make all of them visible to each
+	// handler via its context.
+	var batch []*Request
+	if len(next) != 0 && next[0].batch {
+		batch = make([]*Request, len(ts))
+		for i, t := range ts {
+			batch[i] = t.hreq
+		}
+	}
+
 	// Phase 2: Assign method handlers and set up contexts.
 	for i, t := range ts {
 		id := ids[i]
@@ -312,9 +620,13 @@ func (s *Server) checkAndAssign(next jmessages) tasks {
 		} else if t.hreq.method == "" {
 			t.err = errEmptyMethod
 		} else {
-			s.setContext(t, id)
-			t.m = s.assign(t.ctx, t.hreq.method)
-			if t.m == nil {
+			s.setContext(t, id, batch)
+			if next[i].meta != nil {
+				t.err = s.decodeMeta(t, next[i].meta)
+			}
+			if t.err != nil {
+				// failed to decode request metadata
+			} else if t.m = s.assign(t.ctx, t.hreq.method); t.m == nil {
 				t.err = errNoSuchMethod.WithData(t.hreq.method)
 			}
 		}
@@ -330,8 +642,15 @@ func (s *Server) checkAndAssign(next jmessages) tasks {
 
 // setContext constructs and attaches a request context to t, and reports
 // whether this succeeded.
-func (s *Server) setContext(t *task, id string) {
-	t.ctx = context.WithValue(s.newctx(), inboundRequestKey{}, t.hreq)
+func (s *Server) setContext(t *task, id string, batch []*Request) {
+	base := s.base
+	if base == nil {
+		base = s.newctx()
+	}
+	t.ctx = context.WithValue(base, inboundRequestKey{}, t.hreq)
+	if batch != nil {
+		t.ctx = context.WithValue(t.ctx, inboundBatchKey{}, batch)
+	}
 
 	// Store the cancellation for a request that needs a reply, so that we can
 	// respond to cancellation requests.
@@ -342,31 +661,279 @@ func (s *Server) setContext(t *task, id string) {
 	}
 }
 
+// decodeMeta decodes the request metadata for t into its context, and reports
+// an error if this fails.
+func (s *Server) decodeMeta(t *task, meta json.RawMessage) error {
+	ctx, err := s.dmeta(t.ctx, t.hreq.method, meta)
+	if err != nil {
+		var jerr *Error
+		if errors.As(err, &jerr) {
+			return jerr
+		}
+		return Errorf(code.InvalidRequest, "invalid request metadata: %v", err)
+	}
+	t.ctx = ctx
+	return nil
+}
+
+// checkParams reports the result of the parameter validator for req, if the
+// server has one, converting a plain error into an InvalidParams error.
+func (s *Server) checkParams(req *Request) error {
+	if s.vparams == nil {
+		return nil
+	}
+	err := s.vparams(req.method, req.params)
+	if err == nil {
+		return nil
+	}
+	s.log("Parameter validation failed for %q: %v", req.method, err)
+	var jerr *Error
+	if errors.As(err, &jerr) {
+		return jerr
+	}
+	return errInvalidParams.WithData(err.Error())
+}
+
 // invoke invokes the handler m for the specified request type, and marshals
-// the return value into JSON if there is one.
-func (s *Server) invoke(base context.Context, h Handler, req *Request) (json.RawMessage, error) {
+// the return value into JSON if there is one. If the handler returns a
+// RawResponse, invoke also reports its extension fields. If the handler
+// returns a StreamResult and stream != nil, invoke stores it in *stream
+// instead of reading it.
+//
+// If the server has a cache and h is cacheable, invoke serves the result from
+// the cache if possible, and otherwise caches the result of a successful call.
+func (s *Server) invoke(base context.Context, h Handler, req *Request, stream *StreamResult) (json.RawMessage, map[string]json.RawMessage, error) {
+	if err := s.checkParams(req); err != nil {
+		if req.IsNotification() {
+			s.log("Discarding invalid notification to %q: %v", req.method, err)
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	key, ttl, ok := s.cacheKey(base, h, req)
+	if !ok {
+		return s.invokeHandler(base, h, req, stream)
+	}
+	s.running.add(req)
+	bits, hit := s.cache.Get(key)
+	s.running.remove(req)
+	if hit {
+		s.metrics.Count("rpc.cache.hits", 1)
+		s.rpcLog.LogRequest(context.WithValue(base, serverKey{}, s), req)
+		return bits, nil, nil
+	}
+	s.metrics.Count("rpc.cache.misses", 1)
+
+	// A cacheable result is never streamed, since it must be kept.
+	bits, ext, err := s.invokeHandler(base, h, req, nil)
+	if err == nil && ext == nil && bits != nil {
+		s.cache.Set(key, bits, ttl)
+	}
+	return bits, ext, err
+}
+
+// cacheKey reports the cache key and TTL for req, and whether its result may
+// be cached. Only calls to handlers that opt in, when the server has a cache,
+// are cacheable. Unless the server has a CacheKey hook, the key combines the
+// method name with a SHA-256 digest of the principal of ctx, if any, and the
+// compacted parameters.
+func (s *Server) cacheKey(ctx context.Context, h Handler, req *Request) (string, time.Duration, bool) {
+	if s.cache == nil || req.IsNotification() {
+		return "", 0, false
+	}
+	c, ok := h.(cacheTTLer)
+	if !ok {
+		return "", 0, false
+	}
+	ttl := c.CacheTTL()
+	if ttl <= 0 {
+		return "", 0, false
+	}
+	if s.ckey != nil {
+		key, ok := s.ckey(ctx, req)
+		return key, ttl, ok
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, req.params); err != nil {
+		buf.Reset()
+		buf.Write(req.params)
+	}
+	hash := sha256.New()
+	if p := Principal(ctx); p != nil {
+		fmt.Fprintf(hash, "%T\x00%v\x00", p, p)
+	}
+	hash.Write(buf.Bytes())
+	return req.method + "/" + hex.EncodeToString(hash.Sum(nil)), ttl, true
+}
+
+// handleTimeout runs h for req with a context bounded by the handler timeout of
+// the server, and reports its results with ok == true if it returns in time.
+// If the timeout expires first, handleTimeout reports a DeadlineExceeded error
+// with ok == false without waiting for h: The handler keeps running in its own
+// goroutine, which discards its late results and calls release once it exits,
+// so that it continues to occupy a concurrency slot until then.
+//
+// If the request context ends before the timeout, handleTimeout waits for h to
+// return and reports its results as usual.
+func (s *Server) handleTimeout(ctx context.Context, h Handler, req *Request, release func()) (_ interface{}, ok bool, _ error) {
+	hctx, cancel := context.WithTimeout(ctx, s.htime)
+
+	var mu sync.Mutex
+	var finished, abandoned bool
+	var v interface{}
+	var err error
+	done := make(chan struct{})
+
+	s.running.add(req)
+	s.wg.Add(1) // the server does not stop until the handler exits
+	go func() {
+		defer s.wg.Done()
+		v, err = h.Handle(hctx, req)
+		s.running.remove(req)
+		cancel()
+
+		mu.Lock()
+		finished = true
+		late := abandoned
+		mu.Unlock()
+		close(done)
+		if late {
+			if sr, isStream := v.(StreamResult); isStream {
+				sr.close()
+			}
+			release()
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-hctx.Done():
+		if ctx.Err() == nil {
+			mu.Lock()
+			abandoned = !finished
+			mu.Unlock()
+			if abandoned {
+				s.log("Handler for %q timed out after %v", req.method, s.htime)
+				return nil, false, Errorf(code.DeadlineExceeded, "handler timed out after %v", s.htime)
+			}
+		}
+		<-done
+	}
+	if err != nil && hctx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		// The handler failed because its own timeout expired, rather than the
+		// request ending for some other reason, so report the timeout.
+		err = Errorf(code.DeadlineExceeded, "handler timed out after %v", s.htime)
+	}
+	return v, true, err
+}
+
+// invokeHandler implements the body of invoke, without validation or caching.
+func (s *Server) invokeHandler(base context.Context, h Handler, req *Request, stream *StreamResult) (json.RawMessage, map[string]json.RawMessage, error) {
 	ctx := context.WithValue(base, serverKey{}, s)
-	if err := s.sem.Acquire(ctx, 1); err != nil {
-		return nil, err
+	if s.sem.TryAcquire(1) {
+		s.metrics.Count("rpc.requests.immediate", 1)
+	} else {
+		s.metrics.Count("rpc.requests.queued", 1)
+		if err := s.sem.Acquire(ctx, 1); err != nil {
+			return nil, nil, err
+		}
+	}
+	s.metrics.SetMaxValue("rpc.concurrency.inUse.max", atomic.AddInt64(&s.nrun, 1))
+	release := func() {
+		atomic.AddInt64(&s.nrun, -1)
+		s.sem.Release(1)
 	}
-	defer s.sem.Release(1)
 
 	s.rpcLog.LogRequest(ctx, req)
-	v, err := h.Handle(ctx, req)
+	var v interface{}
+	var err error
+	if s.htime > 0 {
+		var ok bool
+		v, ok, err = s.handleTimeout(ctx, h, req, release)
+		if !ok {
+			// The handler timed out, and still holds its concurrency slot.
+			if req.IsNotification() {
+				return nil, nil, nil
+			}
+			return nil, nil, err
+		}
+	} else {
+		s.running.add(req)
+		v, err = h.Handle(ctx, req)
+		s.running.remove(req)
+	}
+	release()
 	if err != nil {
+		if code.FromError(err) == code.InvalidParams {
+			s.log("Invalid parameters for %q: %d bytes, JSON %s",
+				req.method, len(req.params), jsonKind(req.params))
+		}
 		if req.IsNotification() {
 			s.log("Discarding error from notification to %q: %v", req.Method(), err)
-			return nil, nil // a notification
+			return nil, nil, nil // a notification
+		}
+		return nil, nil, err // a call reporting an error
+	}
+	if raw, ok := v.(RawResponse); ok && !req.IsNotification() {
+		return raw.parse()
+	}
+	var bits json.RawMessage
+	if sr, ok := v.(StreamResult); ok {
+		if req.IsNotification() {
+			sr.close()
+			return nil, nil, nil
+		} else if stream != nil && sr.Reader != nil {
+			*stream = sr
+			return nil, nil, nil
+		}
+		bits, err = sr.readAll()
+	} else {
+		if s.noNils {
+			v = emptyForNil(v)
+		}
+		bits, err = json.Marshal(v)
+	}
+	if err != nil || s.xform == nil || req.IsNotification() {
+		return bits, nil, err
+	}
+	bits, err = s.xform(ctx, req.Method(), bits)
+	if err == nil && !json.Valid(bits) {
+		s.log("Result transformer for %q produced invalid JSON", req.Method())
+		return nil, nil, Errorf(code.InternalError, "transformed result is not valid JSON")
+	}
+	return bits, nil, err
+}
+
+// emptyForNil returns an empty value of the same type as v, if v is a nil
+// slice or map. Otherwise it returns v unchanged. Values that implement
+// json.Marshaler, such as json.RawMessage, and byte slices, which encode as
+// strings, are also returned unchanged.
+func emptyForNil(v interface{}) interface{} {
+	if _, ok := v.(json.Marshaler); ok {
+		return v
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			break // a byte slice encodes as a string
+		}
+		if rv.IsNil() {
+			return reflect.MakeSlice(rv.Type(), 0, 0).Interface()
+		}
+	case reflect.Map:
+		if rv.IsNil() {
+			return reflect.MakeMap(rv.Type()).Interface()
 		}
-		return nil, err // a call reporting an error
 	}
-	return json.Marshal(v)
+	return v
 }
 
 // ServerInfo returns an atomic snapshot of the current server info for s.
 func (s *Server) ServerInfo() *ServerInfo {
 	info := &ServerInfo{
 		Methods:   []string{"*"},
+		Version:   s.version,
 		StartTime: s.start,
 		Counter:   make(map[string]int64),
 		MaxValue:  make(map[string]int64),
@@ -383,6 +950,23 @@ func (s *Server) ServerInfo() *ServerInfo {
 	return info
 }
 
+// InFlightInfo describes a request whose handler is running (see InFlight).
+type InFlightInfo struct {
+	Method  string    // the method name of the request
+	ID      string    // the request ID, or "" for a notification
+	Started time.Time // when the handler began running
+}
+
+// InFlight returns a snapshot of the requests whose handlers are currently
+// running on s, in order of when they started. A request waiting for a free
+// handler slot (see ServerOptions.Concurrency) is not included. Comparing the
+// start times to the current time shows which handlers have been running for
+// a long while, for example when looking for handlers that do not respect
+// HandlerTimeout.
+func (s *Server) InFlight() []InFlightInfo {
+	return s.running.snapshot()
+}
+
 // ErrPushUnsupported is returned by the Notify and Call methods if server
 // pushes are not enabled.
 var ErrPushUnsupported = errors.New("server push is not enabled")
@@ -402,6 +986,45 @@ func (s *Server) Notify(ctx context.Context, method string, params interface{})
 	return err
 }
 
+// PushBatch posts a batch of server-side notifications to the client in a
+// single JSON array. Each spec is sent as a notification, regardless of the
+// value of its Notify field. If specs is empty, PushBatch does nothing.
+//
+// Like Notify, this is a non-standard extension of JSON-RPC. Unless s was
+// constructed with the AllowPush option set true, this method will always
+// report an error (ErrPushUnsupported) without sending anything. If PushBatch
+// is called after the client connection is closed, it returns ErrConnClosed.
+func (s *Server) PushBatch(ctx context.Context, specs []Spec) error {
+	if !s.allowP {
+		return ErrPushUnsupported
+	} else if len(specs) == 0 {
+		return nil
+	}
+	msgs := make(jmessages, len(specs))
+	for i, spec := range specs {
+		msg := &jmessage{V: s.version, M: spec.Method, batch: true}
+		if spec.Params != nil {
+			bits, err := json.Marshal(spec.Params)
+			if err != nil {
+				return fmt.Errorf("spec %d (%q): %w", i, spec.Method, err)
+			}
+			msg.P = bits
+		}
+		msgs[i] = msg
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ch == nil {
+		return ErrConnClosed
+	}
+
+	s.log("Posting server notification batch of length %d", len(msgs))
+	nw, err := encode(s.ch, msgs, s.indent)
+	s.metrics.CountAndSetMax("rpc.bytesWritten", int64(nw))
+	s.metrics.Count("rpc.notificationsPushed", int64(len(msgs)))
+	return err
+}
+
 // Callback posts a single server-side call to the client. It blocks until a
 // reply is received, ctx ends, or the client connection terminates.  A
 // successful callback reports a nil error and a non-nil response. Errors
@@ -485,10 +1108,11 @@ func (s *Server) pushReq(ctx context.Context, wantID bool, method string, params
 
 	s.log("Posting server %s %q %s", kind, method, string(bits))
 	nw, err := encode(s.ch, jmessages{{
+		V:  s.version,
 		ID: jid,
 		M:  method,
 		P:  bits,
-	}})
+	}}, s.indent)
 	s.metrics.CountAndSetMax("rpc.bytesWritten", int64(nw))
 	s.metrics.Count("rpc."+kind+"sPushed", 1)
 	return rsp, err
@@ -507,6 +1131,58 @@ func (s *Server) Stop() {
 	s.stop(errServerStopped)
 }
 
+// Shutdown gracefully shuts down the server. Shutdown stops accepting new
+// requests from the client, then waits until every request received before
+// the shutdown began, including all the elements of an in-flight batch, has
+// completed and its response has been delivered. Once that work is done, the
+// server stops as if Stop had been called.
+//
+// While the server is shutting down, it replies to each call it receives with
+// an error having code.ServerUnavailable, so that the client can retry the
+// call on another server. Notifications received during shutdown are dropped.
+//
+// If ctx ends before the pending work is finished, Shutdown stops the server
+// immediately and returns the error from ctx; otherwise it returns nil. It is
+// safe to call Shutdown multiple times, or concurrently with Stop.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.ch == nil {
+		s.mu.Unlock()
+		return nil // nothing is running
+	}
+	if s.drain == nil {
+		s.log("Server shutdown requested")
+		s.drain = make(chan struct{})
+		s.checkDrained()
+	}
+	drain := s.drain
+	s.mu.Unlock()
+
+	var err error
+	select {
+	case <-drain:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	s.Stop()
+	return err
+}
+
+// checkDrained closes s.drain if the server is shutting down and all the
+// requests received prior to the shutdown have been delivered. The caller
+// must hold s.mu.
+func (s *Server) checkDrained() {
+	if s.drain == nil || s.nbusy != 0 || !s.inq.isEmpty() {
+		return
+	}
+	select {
+	case <-s.drain:
+		// already closed
+	default:
+		close(s.drain)
+	}
+}
+
 // ServerStatus describes the status of a stopped server.
 //
 // A server is said to have succeeded if it stopped because the client channel
@@ -598,6 +1274,7 @@ func (s *Server) stop(err error) {
 	s.err = err
 	s.ch = nil
 	s.metrics.Count("rpc.serversActive", -1)
+	s.checkDrained()
 }
 
 // read is the main receiver loop, decoding requests from the client and adding
@@ -605,6 +1282,25 @@ func (s *Server) stop(err error) {
 // and reported back to the client directly, so that any message that survives
 // into the request queue is structurally valid.
 func (s *Server) read(ch receiver) {
+	if s.muxErr != nil {
+		s.mu.Lock()
+		s.log("Refusing connection: %v", s.muxErr)
+		s.stop(s.muxErr)
+		s.mu.Unlock()
+		return
+	}
+	if s.auth != nil {
+		ctx, err := s.auth(s.newctx())
+		s.mu.Lock()
+		if err != nil {
+			s.log("Authentication failed: %v", err)
+			s.stop(err)
+			s.mu.Unlock()
+			return
+		}
+		s.base = ctx
+		s.mu.Unlock()
+	}
 	for {
 		// If the message is not sensible, report an error; otherwise enqueue it
 		// for processing. Errors in individual requests are handled later.
@@ -614,8 +1310,12 @@ func (s *Server) read(ch receiver) {
 		s.metrics.CountAndSetMax("rpc.bytesRead", int64(len(bits)))
 		if err == nil || (err == io.EOF && len(bits) != 0) {
 			err = nil
-			derr = in.parseJSON(bits)
-			s.metrics.Count("rpc.requests", int64(len(in)))
+			if max := s.limits.MaxRequestBytes; max > 0 && len(bits) > max {
+				derr = errRequestTooLarge
+			} else {
+				derr = in.parseJSON(bits, s.version)
+				s.metrics.Count("rpc.requests", int64(len(in)))
+			}
 		}
 		s.mu.Lock()
 		if err != nil { // receive failure; shut down
@@ -630,7 +1330,16 @@ func (s *Server) read(ch receiver) {
 			// Filter out response messages. It's possible that the entire batch
 			// was responses, so re-check the length after doing this.
 			keep := s.filterBatch(in)
-			if len(keep) != 0 {
+			if len(keep) != 0 && keep[0].batch && !s.batchOK {
+				s.pushError(errBatchDisabled)
+			} else if max := s.limits.MaxBatchSize; max > 0 && len(keep) > max {
+				s.pushError(errBatchTooLarge)
+			} else if id, ok := s.duplicateID(keep); ok {
+				s.pushError(errDuplicateID.WithData(id))
+			} else if len(keep) != 0 && s.drain != nil {
+				s.log("Rejecting request batch of size %d during shutdown", len(keep))
+				s.rejectUnavailable(keep)
+			} else if len(keep) != 0 {
 				s.log("Received request batch of size %d (qlen=%d)", len(keep), s.inq.size())
 				s.inq.push(keep)
 				if s.inq.size() == 1 { // the queue was empty
@@ -677,6 +1386,10 @@ type ServerInfo struct {
 	// The list of method names exported by this server.
 	Methods []string `json:"methods,omitempty"`
 
+	// The protocol version marker used by this server (see
+	// ServerOptions.Version).
+	Version string `json:"version,omitempty"`
+
 	// Metric values defined by the evaluation of methods.
 	Counter  map[string]int64       `json:"counters,omitempty"`
 	MaxValue map[string]int64       `json:"maxValue,omitempty"`
@@ -686,6 +1399,15 @@ type ServerInfo struct {
 	StartTime time.Time `json:"startTime,omitempty"`
 }
 
+// Uptime reports how long the server has been running, according to its start
+// time and the local clock. It returns 0 if the start time is not known.
+func (si *ServerInfo) Uptime() time.Duration {
+	if si.StartTime.IsZero() {
+		return 0
+	}
+	return time.Since(si.StartTime)
+}
+
 // assign returns a Handler to handle the specified name, or nil.
 // The caller must hold s.mu.
 func (s *Server) assign(ctx context.Context, name string) Handler {
@@ -693,6 +1415,11 @@ func (s *Server) assign(ctx context.Context, name string) Handler {
 		switch name {
 		case rpcServerInfo:
 			return methodFunc(s.handleRPCServerInfo)
+		case rpcCapabilities:
+			if s.capsOK {
+				return methodFunc(s.handleRPCCapabilities)
+			}
+			return nil
 		default:
 			return nil // reserved
 		}
@@ -713,9 +1440,10 @@ func (s *Server) pushError(err error) {
 	}
 
 	nw, err := encode(s.ch, jmessages{{
+		V:  s.version,
 		ID: json.RawMessage("null"),
 		E:  jerr,
-	}})
+	}}, s.indent)
 	s.metrics.Count("rpc.errors", 1)
 	s.metrics.CountAndSetMax("rpc.bytesWritten", int64(nw))
 	if err != nil {
@@ -723,6 +1451,46 @@ func (s *Server) pushError(err error) {
 	}
 }
 
+// duplicateID reports the first request ID that is repeated in reqs, and
+// whether there is one. It reports false if the server does not reject such
+// batches (see ServerOptions.RejectDuplicateBatch).
+func (s *Server) duplicateID(reqs jmessages) (string, bool) {
+	if !s.dupFail {
+		return "", false
+	}
+	seen := make(map[string]bool, len(reqs))
+	for _, req := range reqs {
+		id := string(fixID(req.ID))
+		if id == "" {
+			continue // notification
+		} else if seen[id] {
+			return id, true
+		}
+		seen[id] = true
+	}
+	return "", false
+}
+
+// rejectUnavailable replies to each call in reqs with errServerUnavailable. The
+// notifications in reqs are discarded. The caller must hold s.mu.
+func (s *Server) rejectUnavailable(reqs jmessages) {
+	var rsps jmessages
+	for _, req := range reqs {
+		if id := fixID(req.ID); id != nil {
+			rsps = append(rsps, &jmessage{V: s.version, ID: id, E: errServerUnavailable, batch: req.batch})
+		}
+	}
+	if len(rsps) == 0 || s.ch == nil {
+		return
+	}
+	nw, err := encode(s.ch, rsps, s.indent)
+	s.metrics.Count("rpc.errors", int64(len(rsps)))
+	s.metrics.CountAndSetMax("rpc.bytesWritten", int64(nw))
+	if err != nil {
+		s.log("Writing error response: %v", err)
+	}
+}
+
 // cancel reports whether id is an active call.  If so, it also calls the
 // cancellation function associated with id and removes it from the
 // reservations. The caller must hold s.mu.
@@ -743,13 +1511,21 @@ type task struct {
 	hreq  *Request        // the request passed to the handler
 	batch bool            // whether the request was part of a batch
 
-	val json.RawMessage // the result value (when complete)
-	err error           // the error value (when complete)
+	val json.RawMessage            // the result value (when complete)
+	ext map[string]json.RawMessage // extension fields of a raw response
+	err error                      // the error value (when complete)
+
+	stream   StreamResult // the streamed result, if any (when complete)
+	streamOK bool         // whether the result may be streamed
+
+	size    int           // the length of the encoded request
+	elapsed time.Duration // how long the handler ran (when complete)
+	reply   *jmessage     // the reply to the request, if any
 }
 
 type tasks []*task
 
-func (ts tasks) responses(rpcLog RPCLogger) jmessages {
+func (ts tasks) responses(rpcLog RPCLogger, maxData int, version string) jmessages {
 	var rsps jmessages
 	for _, task := range ts {
 		if task.hreq.id == nil {
@@ -765,7 +1541,7 @@ func (ts tasks) responses(rpcLog RPCLogger) jmessages {
 				continue
 			}
 		}
-		rsp := &jmessage{ID: task.hreq.id, batch: task.batch}
+		rsp := &jmessage{V: version, ID: task.hreq.id, ext: task.ext, batch: task.batch}
 		if rsp.ID == nil {
 			rsp.ID = json.RawMessage("null")
 		}
@@ -775,18 +1551,27 @@ func (ts tasks) responses(rpcLog RPCLogger) jmessages {
 		}
 		if task.err == nil {
 			rsp.R = task.val
+			rsp.stream = task.stream
 		} else if e, ok := task.err.(*Error); ok {
 			rsp.E = e
+		} else if e, ok := fromJoinedError(task.err); ok {
+			rsp.E = e
 		} else if c := code.FromError(task.err); c != code.NoError {
 			rsp.E = &Error{Code: c, Message: task.err.Error()}
 		} else {
 			rsp.E = &Error{Code: code.InternalError, Message: task.err.Error()}
 		}
+		if rsp.E != nil && maxData > 0 && len(rsp.E.Data) > maxData {
+			e := *rsp.E // don't modify the handler's error value
+			e.Data = truncateData(e.Data, maxData)
+			rsp.E = &e
+		}
 		rpcLog.LogResponse(task.ctx, &Response{
 			id:     string(rsp.ID),
 			err:    rsp.E,
 			result: rsp.R,
 		})
+		task.reply = rsp
 		rsps = append(rsps, rsp)
 	}
 	return rsps
@@ -805,3 +1590,36 @@ func (ts tasks) numToDo() (todo, notes int) {
 	}
 	return
 }
+
+// A runSet records the start times of requests whose handlers are running.
+type runSet struct {
+	mu sync.Mutex
+	m  map[*Request]time.Time
+}
+
+func (r *runSet) add(req *Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.m[req] = time.Now()
+}
+
+func (r *runSet) remove(req *Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.m, req)
+}
+
+func (r *runSet) snapshot() []InFlightInfo {
+	r.mu.Lock()
+	out := make([]InFlightInfo, 0, len(r.m))
+	for req, start := range r.m {
+		out = append(out, InFlightInfo{
+			Method:  req.method,
+			ID:      req.ID(),
+			Started: start,
+		})
+	}
+	r.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Started.Before(out[j].Started) })
+	return out
+}
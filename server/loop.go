@@ -129,6 +129,79 @@ func Loop(ctx context.Context, lst Accepter, newService func() Service, opts *Lo
 	}
 }
 
+// Serve accepts connections from lst and starts a server for each, using the
+// assigner returned by a new call of newAssigner and the given options. Each
+// connection is framed by channel.Line. Use Loop instead for other framings,
+// or for services that need per-connection setup and cleanup.
+//
+// Serve blocks until lst reports an error, for example because it was
+// closed. It then stops the servers for all active connections, and returns
+// once they have exited. If lst was closed, Serve returns nil; otherwise it
+// returns the error from lst.
+func Serve(lst net.Listener, newAssigner func() jrpc2.Assigner, opts *jrpc2.ServerOptions) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	active := make(map[*jrpc2.Server]struct{})
+	for {
+		conn, err := lst.Accept()
+		if err != nil {
+			mu.Lock()
+			for srv := range active {
+				srv.Stop()
+			}
+			mu.Unlock()
+			wg.Wait()
+			if channel.IsErrClosing(err) {
+				return nil
+			}
+			return err
+		}
+		srv := jrpc2.NewServer(newAssigner(), withConn(opts, conn)).Start(channel.Line(conn, conn))
+		mu.Lock()
+		active[srv] = struct{}{}
+		mu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srv.Wait()
+			mu.Lock()
+			delete(active, srv)
+			mu.Unlock()
+		}()
+	}
+}
+
+type connKey struct{}
+
+// Conn returns the network connection attached to ctx by Serve, or nil if ctx
+// does not carry a connection. The contexts of a server started by Serve carry
+// its connection, so that the Authenticate hook of its options and the
+// handlers of its methods can inspect the client, for example its remote
+// address or TLS state.
+func Conn(ctx context.Context) net.Conn {
+	conn, _ := ctx.Value(connKey{}).(net.Conn)
+	return conn
+}
+
+// withConn returns a copy of opts whose NewContext attaches conn to each
+// context it creates.
+func withConn(opts *jrpc2.ServerOptions, conn net.Conn) *jrpc2.ServerOptions {
+	var cp jrpc2.ServerOptions
+	if opts != nil {
+		cp = *opts
+	}
+	newContext := cp.NewContext
+	cp.NewContext = func() context.Context {
+		ctx := context.Background()
+		if newContext != nil {
+			ctx = newContext()
+		}
+		return context.WithValue(ctx, connKey{}, conn)
+	}
+	return &cp
+}
+
 // LoopOptions control the behaviour of the Loop function.  A nil *LoopOptions
 // provides default values as described.
 type LoopOptions struct {
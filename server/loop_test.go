@@ -4,6 +4,7 @@ package server_test
 
 import (
 	"context"
+	"errors"
 	"math/rand"
 	"net"
 	"sync"
@@ -185,6 +186,72 @@ func TestLoop_cancelServers(t *testing.T) {
 	}
 }
 
+// Test that Serve handles connections, and that closing the listener stops
+// the servers for the active connections.
+func TestServe(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	ready := make(chan struct{}, 1)
+	newAssigner := func() jrpc2.Assigner {
+		return handler.Map{
+			"Test": handler.New(func(context.Context) (string, error) {
+				return "OK", nil
+			}),
+			"Addr": handler.New(func(ctx context.Context) string {
+				return jrpc2.Principal(ctx).(string)
+			}),
+			"Stall": handler.New(func(ctx context.Context) error {
+				ready <- struct{}{}
+				<-ctx.Done()
+				return ctx.Err()
+			}),
+		}
+	}
+
+	lst := mustListen(t)
+	errc := make(chan error, 1)
+	opts := &jrpc2.ServerOptions{
+		// The connection is available to authenticate the client.
+		Authenticate: func(ctx context.Context) (context.Context, error) {
+			conn := server.Conn(ctx)
+			if conn == nil {
+				return nil, errors.New("no connection")
+			}
+			return jrpc2.WithPrincipal(ctx, conn.LocalAddr().String()), nil
+		},
+	}
+	go func() { errc <- server.Serve(lst, newAssigner, opts) }()
+
+	cli := mustDial(t, lst.Addr().String())
+	defer cli.Close()
+	var rsp string
+	if err := cli.CallResult(context.Background(), "Test", nil, &rsp); err != nil {
+		t.Errorf("Test call: unexpected error: %v", err)
+	} else if rsp != "OK" {
+		t.Errorf("Test call: got %q, want OK", rsp)
+	}
+	if err := cli.CallResult(context.Background(), "Addr", nil, &rsp); err != nil {
+		t.Errorf("Addr call: unexpected error: %v", err)
+	} else if want := lst.Addr().String(); rsp != want {
+		t.Errorf("Addr call: got %q, want %q", rsp, want)
+	}
+
+	// Block a call on the server, then close the listener. Serve should stop
+	// the server for the connection rather than waiting for the call.
+	go cli.Call(context.Background(), "Stall", nil)
+	<-ready
+	lst.Close()
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("Serve result: %v", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Error("Serve did not exit in a timely manner after the listener closed")
+	}
+}
+
 // Test that concurrent clients against the same server work sanely.
 func TestLoop(t *testing.T) {
 	defer leaktest.Check(t)()
@@ -7,7 +7,8 @@ import (
 )
 
 const (
-	rpcServerInfo = "rpc.serverInfo"
+	rpcServerInfo   = "rpc.serverInfo"
+	rpcCapabilities = "rpc.capabilities"
 )
 
 // CancelRequest instructs s to cancel the pending or in-flight request with
@@ -34,7 +35,55 @@ func (s *Server) handleRPCServerInfo(context.Context, *Request) (interface{}, er
 
 // RPCServerInfo calls the built-in rpc.serverInfo method exported by servers.
 // It is a convenience wrapper for an invocation of cli.CallResult.
-func RPCServerInfo(ctx context.Context, cli *Client) (result *ServerInfo, err error) {
-	err = cli.CallResult(ctx, rpcServerInfo, nil, &result)
+func RPCServerInfo(ctx context.Context, cli *Client) (*ServerInfo, error) {
+	return cli.RPCServerInfo(ctx)
+}
+
+// RPCServerInfo calls the built-in rpc.serverInfo method exported by the
+// server, and decodes the description it returns. This fails if the server
+// has disabled its built-in methods.
+func (c *Client) RPCServerInfo(ctx context.Context) (result *ServerInfo, err error) {
+	err = c.CallResult(ctx, rpcServerInfo, nil, &result)
 	return
 }
+
+// Capabilities describes the limits a server imposes on the requests it
+// accepts, as reported by the built-in rpc.capabilities method. A zero value
+// for any limit means the server does not impose that limit.
+type Capabilities struct {
+	// The maximum number of elements in a batch request.
+	MaxBatchSize int `json:"maxBatchSize,omitempty"`
+
+	// The maximum length in bytes of a request message.
+	MaxRequestBytes int `json:"maxRequestBytes,omitempty"`
+}
+
+// Handle the special rpc.capabilities method, that reports server limits.
+func (s *Server) handleRPCCapabilities(context.Context, *Request) (interface{}, error) {
+	return s.limits, nil
+}
+
+// Capabilities calls the built-in rpc.capabilities method exported by the
+// server, and returns the limits it reports. The result is cached by the
+// client, so only the first successful call contacts the server.
+//
+// Once the capabilities of the server are known, the Batch method splits a
+// batch having more elements than the server permits into several batches
+// that are sent one after another. Other limits are not enforced by the
+// client.
+func (c *Client) Capabilities(ctx context.Context) (*Capabilities, error) {
+	c.mu.Lock()
+	caps := c.caps
+	c.mu.Unlock()
+	if caps == nil {
+		caps = new(Capabilities)
+		if err := c.CallResult(ctx, rpcCapabilities, nil, caps); err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		c.caps = caps
+		c.mu.Unlock()
+	}
+	cp := *caps
+	return &cp, nil
+}
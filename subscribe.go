@@ -0,0 +1,202 @@
+// Copyright (C) 2026 Michael J. Fromberger. All Rights Reserved.
+
+package jrpc2
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+)
+
+// Subscribe calls the specified method with the given params to establish a
+// subscription, and returns a Subscription that delivers the notifications
+// sent by the server for it.
+//
+// The server must reply to the call with a subscription ID, which may be any
+// JSON value other than null. Thereafter, each notification from the server
+// whose parameters are an object with a "subscription" field equal to that ID
+// is delivered to the C channel of the subscription, rather than to the
+// OnNotify hook of the client. For example:
+//
+//	{"jsonrpc":"2.0", "method":"event", "params":{"subscription":"s1", "result":...}}
+//
+// Server notifications are a non-standard extension of JSON-RPC, so the server
+// must support them for subscriptions to work.
+func (c *Client) Subscribe(ctx context.Context, method string, params interface{}) (*Subscription, error) {
+	req, err := c.req(ctx, method, params)
+	if err != nil {
+		return nil, err
+	}
+
+	// Record the pending subscription before sending, so that it is started
+	// as soon as the reply is delivered, before any notification for it can
+	// be handled.
+	sub := newSubscription(c)
+	id := string(req.ID)
+	c.mu.Lock()
+	c.pendSub[id] = sub
+	c.mu.Unlock()
+	cleanup := func() {
+		c.mu.Lock()
+		delete(c.pendSub, id)
+		c.mu.Unlock()
+	}
+
+	rsp, err := c.send(ctx, jmessages{req})
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	rsp[0].wait()
+	if err := rsp[0].Error(); err != nil {
+		cleanup()
+		return nil, filterError(err)
+	} else if sub.key == "" {
+		return nil, errors.New("invalid subscription ID")
+	}
+	return sub, nil
+}
+
+// startSubscription activates sub with the subscription ID given by result,
+// a reply from the server. The caller must hold c.mu.
+func (c *Client) startSubscription(sub *Subscription, result json.RawMessage) {
+	key := compactJSON(result)
+	if key == "" || key == "null" {
+		c.log("Invalid subscription ID %q", string(result))
+		return
+	}
+	sub.key = key
+	c.subs[key] = sub
+	c.done.Add(1)
+	go func() {
+		defer c.done.Done()
+		sub.pump()
+	}()
+}
+
+// matchSubscription returns the active subscription to which the notification
+// msg belongs, or nil. The caller must hold c.mu.
+func (c *Client) matchSubscription(msg *jmessage) *Subscription {
+	if len(c.subs) == 0 {
+		return nil
+	}
+	var env struct {
+		S json.RawMessage `json:"subscription"`
+	}
+	if err := json.Unmarshal(msg.P, &env); err != nil || env.S == nil {
+		return nil
+	}
+	return c.subs[compactJSON(env.S)]
+}
+
+// A Subscription delivers the notifications sent by the server for a single
+// subscription established by Client.Subscribe.
+type Subscription struct {
+	// C receives the notifications for the subscription in order of arrival.
+	// It is closed when the subscription or its client is closed.
+	C <-chan *Request
+
+	c   *Client
+	key string // the compacted JSON subscription ID
+	out chan *Request
+
+	mu    sync.Mutex
+	queue []*Request    // notifications not yet delivered to out
+	ready chan struct{} // signals that queue is non-empty
+	done  chan struct{} // closed when the subscription ends
+	once  sync.Once
+}
+
+func newSubscription(c *Client) *Subscription {
+	out := make(chan *Request)
+	return &Subscription{
+		C:     out,
+		c:     c,
+		out:   out,
+		ready: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+}
+
+// ID returns the subscription ID reported by the server. If the ID is a JSON
+// string, the result is its unquoted value; otherwise it is the JSON text.
+func (s *Subscription) ID() string {
+	if u, err := strconv.Unquote(s.key); err == nil {
+		return u
+	}
+	return s.key
+}
+
+// Close ends the subscription, closes its channel, and notifies the server
+// that the subscription is no longer wanted, passing the subscription ID as
+// the sole element of an array of parameters. If the client has already been
+// closed, Close just closes the channel.
+func (s *Subscription) Close() error {
+	s.c.mu.Lock()
+	active := s.c.subs[s.key] == s
+	if active {
+		delete(s.c.subs, s.key)
+	}
+	s.c.mu.Unlock()
+	s.shutdown()
+
+	if !active {
+		return nil
+	}
+	return s.c.Notify(context.Background(), s.c.unsub, []json.RawMessage{json.RawMessage(s.key)})
+}
+
+// push adds req to the queue of notifications for s.
+func (s *Subscription) push(req *Request) {
+	s.mu.Lock()
+	s.queue = append(s.queue, req)
+	s.mu.Unlock()
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pump delivers queued notifications to the output channel until s ends.
+// Queueing means the client reader never blocks on a slow subscriber.
+func (s *Subscription) pump() {
+	defer close(s.out)
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			select {
+			case <-s.ready:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		next := s.queue[0]
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		select {
+		case s.out <- next:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// shutdown terminates delivery for s. It is safe to call more than once.
+func (s *Subscription) shutdown() { s.once.Do(func() { close(s.done) }) }
+
+// compactJSON returns the compacted form of the JSON text in data, or "" if
+// data is not valid JSON.
+func compactJSON(data []byte) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		return ""
+	}
+	return buf.String()
+}